@@ -3,8 +3,7 @@ package common
 // 客户端连接封装
 
 import (
-	"bufio"
-	"bytes"
+	"context"
 	"encoding/binary"
 	"encoding/hex"
 	"errors"
@@ -17,29 +16,59 @@ import (
 	"github.com/4ra1n/go-impacket/pkg/encoder"
 )
 
+// DCE/RPC分片头部中的字段偏移与标识
+const (
+	pduHeaderSize    = 16
+	pduFlagsOffset   = 3
+	pduDataRepOffset = 4
+	pduFragLenOffset = 8
+	pduLastFrag      = 0x02
+	pduLittleEndian  = 0x10
+)
+
 // 会话结构
 type Client struct {
-	IsSigningRequired bool
-	IsAuthenticated   bool
-	debug             bool
-	securityMode      uint16
-	messageId         uint64
-	sessionId         uint64
-	conn              net.Conn
-	dialect           uint16
-	options           *ClientOptions
-	trees             map[string]uint32
+	IsSigningRequired    bool
+	IsEncryptionRequired bool // 会话要求加密所有请求
+	IsAuthenticated      bool
+	debug                bool
+	securityMode         uint16
+	sessionId            uint64
+	conn                 net.Conn
+	dialect              uint16
+	options              *ClientOptions
+	mux                  *multiplexer // 连接上共享的收发状态
+	sessionKey           []byte       // 认证得到的会话密钥
+	signingKey           []byte       // 由会话密钥派生的签名密钥
+	signingAlgorithm     uint16       // 协商得到的签名算法
+	preauthHash          []byte       // smb3.1.1预认证完整性哈希
+	cipherId             uint16       // 协商得到的加密算法
+	encryptionKey        []byte       // 客户端到服务端的加密密钥
+	decryptionKey        []byte       // 服务端到客户端的解密密钥
+	maxTransactSize      uint32       // 服务端允许的查询、设置信息缓冲区大小
+	maxReadSize          uint32       // 服务端允许的单次读取大小
+	maxWriteSize         uint32       // 服务端允许的单次写入大小
 }
 
 // 连接参数
 type ClientOptions struct {
-	Host        string
-	Port        int
-	Workstation string
-	Domain      string
-	User        string
-	Password    string
-	Hash        string
+	Host         string
+	Port         int
+	Workstation  string
+	Domain       string
+	User         string
+	Password     string
+	Hash         string
+	Dialects     []uint16      // 协商的SMB2协议版本列表，为空时使用默认列表
+	Kerberos     bool          // 使用Kerberos认证，凭据依次取CCache、Keytab、AESKey、Hash、Password
+	AESKey       string        // Kerberos AES128/AES256密钥，十六进制
+	KDCHost      string        // KDC地址，为空时使用Domain
+	CCache       string        // 凭据缓存路径，未提供其他凭据时读取KRB5CCNAME
+	Keytab       string        // keytab路径，从中取出User的长期密钥
+	DialTimeout  time.Duration // 建立连接的超时，0为不限制
+	ReadTimeout  time.Duration // 等待单个响应的超时，0为不限制
+	WriteTimeout time.Duration // 单次写入的超时，0为不限制
+	Dialer       Dialer        // 自定义拨号器，如proxy包中的SOCKS5、HTTP CONNECT代理，为空时直接连接
 }
 
 func (c *Client) Debug(msg string, err error) {
@@ -52,110 +81,110 @@ func (c *Client) Debug(msg string, err error) {
 }
 
 func (c *Client) SMBSend(req interface{}) (res []byte, err error) {
-	body, err := encoder.Marshal(req)
-	if err != nil {
-		c.Debug("", err)
-		return nil, err
-	}
-	var buf []byte
-	temp := make([]byte, 4)
-	binary.BigEndian.PutUint32(temp, uint32(len(body)))
-	buf = append(temp)
-	buf = append(buf, body...)
-
-	c.Debug("raw:\n"+hex.Dump(buf), nil)
-	n, err := c.conn.Write(buf)
+	return c.SMBSendContext(context.Background(), req)
+}
 
+// ctx取消或超过ReadTimeout时发送取消请求并返回
+func (c *Client) SMBSendContext(ctx context.Context, req interface{}) (res []byte, err error) {
+	resps, err := c.SMBSendCompoundContext(ctx, req)
 	if err != nil {
 		return nil, err
 	}
-	if n != len(buf) {
-		return nil, errors.New("send smb error")
-	}
+	return resps[0], nil
+}
 
-	respBuf := make([]byte, 1024*10)
-	n, err = c.conn.Read(respBuf)
+// 发送复合请求，返回按顺序拆分后的响应
+// 相关操作需由调用方在请求中设置SMB2_FLAGS_RELATED_OPERATIONS
+func (c *Client) SMBSendCompound(reqs ...interface{}) (res [][]byte, err error) {
+	return c.SMBSendCompoundContext(context.Background(), reqs...)
+}
 
+func (c *Client) SMBSendCompoundContext(ctx context.Context, reqs ...interface{}) (res [][]byte, err error) {
+	pending, err := c.SMBSendAsyncContext(ctx, reqs...)
 	if err != nil {
 		return nil, err
 	}
-	data := respBuf[:n]
-	c.messageId++
-	return data, nil
-}
-
-//func (c *Client) TCPSend(req interface{}) (res []byte, err error) {
-//	buf, err := encoder.Marshal(req)
-//	if err != nil {
-//		c.Debug("", err)
-//		return nil, err
-//	}
-//	c.Debug("Raw:\n"+hex.Dump(buf), nil)
-//	rw := bufio.NewReadWriter(bufio.NewReader(c.conn), bufio.NewWriter(c.conn))
-//	if _, err = rw.Write(buf); err != nil {
-//		c.Debug("", err)
-//		return
-//	}
-//	rw.Flush()
-//	data := make([]byte, 4096)
-//	c.conn.Read(data)
-//	c.messageId++
-//	return data, nil
-//}
+	return pending.WaitContext(ctx)
+}
 
 func (c *Client) TCPSend(req interface{}) (res []byte, err error) {
+	return c.TCPSendContext(context.Background(), req)
+}
+
+// 发送DCE/RPC请求并读取响应，直到收到带PFC_LAST_FRAG标识的分片
+func (c *Client) TCPSendContext(ctx context.Context, req interface{}) (res []byte, err error) {
 	buf, err := encoder.Marshal(req)
 	if err != nil {
 		c.Debug("", err)
 		return nil, err
 	}
-	c.Debug("Raw:\n"+hex.Dump(buf), nil)
-	rw := bufio.NewReadWriter(bufio.NewReader(c.conn), bufio.NewWriter(c.conn))
-	if _, err = rw.Write(buf); err != nil {
-		c.Debug("", err)
+	if err = c.WritePDUContext(ctx, buf); err != nil {
 		return nil, err
 	}
-	if err = rw.Flush(); err != nil {
-		c.Debug("", err)
-		return nil, err
-	}
-
-	var responseData bytes.Buffer
-	responseBuffer := make([]byte, 4096)
-
 	for {
-		c.conn.SetReadDeadline(time.Now().Add(time.Second * 5)) // 设置读取操作的超时时间为5秒
-
-		n, err := c.conn.Read(responseBuffer)
+		pdu, err := c.ReadPDUContext(ctx)
 		if err != nil {
-			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
-				// 超时，认为没有更多响应
-				break
-			} else if err == io.EOF {
-				// 服务器关闭连接，认为没有更多响应
-				break
-			}
-			c.Debug("", err)
 			return nil, err
 		}
+		res = append(res, pdu...)
+		if pdu[pduFlagsOffset]&pduLastFrag != 0 {
+			return res, nil
+		}
+	}
+}
 
-		responseData.Write(responseBuffer[:n])
-
-		// 根据结束条件判断是否继续接收响应
-		// if shouldStop(responseData.Bytes()) {
-		//     break
-		// }
+// 在tcp连接上发送一个DCE/RPC分片
+func (c *Client) WritePDUContext(ctx context.Context, pdu []byte) error {
+	if c.conn == nil {
+		return ErrNotConnected
+	}
+	c.Debug("Raw:\n"+hex.Dump(pdu), nil)
+	stop := watchContext(ctx, c.conn.SetWriteDeadline)
+	defer stop()
+	c.conn.SetWriteDeadline(deadline(ctx, c.writeTimeout()))
+	if _, err := c.conn.Write(pdu); err != nil {
+		c.Debug("", err)
+		return contextError(ctx, err)
+	}
+	return nil
+}
 
-		// 动态调整缓冲区大小，扩展为当前大小的两倍
-		if responseData.Len() >= len(responseBuffer) {
-			newBuffer := make([]byte, responseData.Len()*2)
-			copy(newBuffer, responseData.Bytes())
-			responseBuffer = newBuffer
-		}
+// 从tcp连接读取一个DCE/RPC分片
+func (c *Client) ReadPDUContext(ctx context.Context) ([]byte, error) {
+	if c.conn == nil {
+		return nil, ErrNotConnected
 	}
+	stop := watchContext(ctx, c.conn.SetReadDeadline)
+	defer stop()
+	c.conn.SetReadDeadline(deadline(ctx, c.readTimeout()))
+	pdu, err := readPDU(c.conn)
+	if err != nil {
+		c.Debug("", err)
+		return nil, contextError(ctx, err)
+	}
+	return pdu, nil
+}
 
-	c.messageId++
-	return responseData.Bytes(), nil
+// 按frag_length读取一个DCE/RPC分片
+func readPDU(r io.Reader) ([]byte, error) {
+	pdu := make([]byte, pduHeaderSize)
+	if _, err := io.ReadFull(r, pdu); err != nil {
+		return nil, err
+	}
+	var fragLen uint16
+	if pdu[pduDataRepOffset]&pduLittleEndian != 0 {
+		fragLen = binary.LittleEndian.Uint16(pdu[pduFragLenOffset:])
+	} else {
+		fragLen = binary.BigEndian.Uint16(pdu[pduFragLenOffset:])
+	}
+	if fragLen < pduHeaderSize {
+		return nil, errors.New("Invalid DCE/RPC fragment length")
+	}
+	pdu = append(pdu, make([]byte, fragLen-pduHeaderSize)...)
+	if _, err := io.ReadFull(r, pdu[pduHeaderSize:]); err != nil {
+		return nil, err
+	}
+	return pdu, nil
 }
 
 func (c *Client) WithDebug(debug bool) *Client {
@@ -172,8 +201,12 @@ func (c *Client) GetSecurityMode() uint16 {
 	return c.securityMode
 }
 
+// 下一个可用的MessageId，实际发送时由多路复用器重新分配
 func (c *Client) GetMessageId() uint64 {
-	return c.messageId
+	m := c.shared()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.messageId
 }
 
 func (c *Client) WithSessionId(sessionId uint64) *Client {
@@ -189,8 +222,10 @@ func (c *Client) GetConn() net.Conn {
 	return c.conn
 }
 
+// 设置连接，同时重置MessageId、信用值以及树连接状态
 func (c *Client) WithConn(conn net.Conn) *Client {
 	c.conn = conn
+	c.mux = newMultiplexer()
 	return c
 }
 
@@ -199,6 +234,109 @@ func (c *Client) WithDialect(dialect uint16) *Client {
 	return c
 }
 
+func (c *Client) GetDialect() uint16 {
+	return c.dialect
+}
+
+func (c *Client) WithSessionKey(sessionKey []byte) *Client {
+	c.sessionKey = sessionKey
+	return c
+}
+
+func (c *Client) GetSessionKey() []byte {
+	return c.sessionKey
+}
+
+func (c *Client) WithSigningKey(signingKey []byte) *Client {
+	c.signingKey = signingKey
+	return c
+}
+
+func (c *Client) GetSigningKey() []byte {
+	return c.signingKey
+}
+
+func (c *Client) WithSigningAlgorithm(algorithm uint16) *Client {
+	c.signingAlgorithm = algorithm
+	return c
+}
+
+func (c *Client) GetSigningAlgorithm() uint16 {
+	return c.signingAlgorithm
+}
+
+func (c *Client) WithPreauthHash(preauthHash []byte) *Client {
+	c.preauthHash = preauthHash
+	return c
+}
+
+func (c *Client) GetPreauthHash() []byte {
+	return c.preauthHash
+}
+
+func (c *Client) WithCipherId(cipherId uint16) *Client {
+	c.cipherId = cipherId
+	return c
+}
+
+func (c *Client) GetCipherId() uint16 {
+	return c.cipherId
+}
+
+func (c *Client) WithEncryptionKeys(encryptionKey, decryptionKey []byte) *Client {
+	c.encryptionKey = encryptionKey
+	c.decryptionKey = decryptionKey
+	return c
+}
+
+func (c *Client) GetEncryptionKey() []byte {
+	return c.encryptionKey
+}
+
+func (c *Client) GetDecryptionKey() []byte {
+	return c.decryptionKey
+}
+
+func (c *Client) WithMaxTransactSize(size uint32) *Client {
+	c.maxTransactSize = size
+	return c
+}
+
+func (c *Client) GetMaxTransactSize() uint32 {
+	return c.maxTransactSize
+}
+
+func (c *Client) WithMaxReadSize(size uint32) *Client {
+	c.maxReadSize = size
+	return c
+}
+
+func (c *Client) GetMaxReadSize() uint32 {
+	return c.maxReadSize
+}
+
+func (c *Client) WithMaxWriteSize(size uint32) *Client {
+	c.maxWriteSize = size
+	return c
+}
+
+func (c *Client) GetMaxWriteSize() uint32 {
+	return c.maxWriteSize
+}
+
+// 标记树连接是否要求加密
+func (c *Client) WithTreeEncryption(treeId uint32, encrypt bool) *Client {
+	m := c.shared()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if encrypt {
+		m.encryptedTrees[treeId] = true
+	} else {
+		delete(m.encryptedTrees, treeId)
+	}
+	return c
+}
+
 func (c *Client) WithOptions(clientOptions *ClientOptions) *Client {
 	c.options = clientOptions
 	return c
@@ -209,12 +347,48 @@ func (c *Client) GetOptions() *ClientOptions {
 }
 
 func (c *Client) WithTrees(trees map[string]uint32) *Client {
-	c.trees = trees
+	m := c.shared()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.trees = make(map[string]uint32, len(trees))
+	for k, v := range trees {
+		m.trees[k] = v
+	}
 	return c
 }
 
+// 返回树连接的副本
 func (c *Client) GetTrees() map[string]uint32 {
-	return c.trees
+	m := c.shared()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	trees := make(map[string]uint32, len(m.trees))
+	for k, v := range m.trees {
+		trees[k] = v
+	}
+	return trees
+}
+
+func (c *Client) AddTree(name string, treeId uint32) {
+	m := c.shared()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.trees[name] = treeId
+}
+
+func (c *Client) RemoveTree(name string) {
+	m := c.shared()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.trees, name)
+}
+
+func (c *Client) GetTreeId(name string) (uint32, bool) {
+	m := c.shared()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	treeId, ok := m.trees[name]
+	return treeId, ok
 }
 
 func (c *Client) Close() error {
@@ -0,0 +1,102 @@
+package common
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"net"
+	"strings"
+
+	"github.com/4ra1n/go-impacket/pkg/krb5"
+)
+
+// 此文件根据连接参数获取Kerberos服务票据，供SMB会话建立与rpc认证绑定共用
+
+// KDC地址，未指定KDCHost时使用域名
+func (opt *ClientOptions) kdcAddress(realm string) string {
+	kdc := opt.KDCHost
+	if kdc == "" {
+		kdc = realm
+	}
+	if _, _, err := net.SplitHostPort(kdc); err != nil {
+		kdc = net.JoinHostPort(kdc, "88")
+	}
+	return kdc
+}
+
+// 根据连接参数构造Kerberos客户端
+func (opt *ClientOptions) newKerberosClient() (*krb5.Client, error) {
+	kdc := opt.kdcAddress(opt.Domain)
+	switch {
+	case opt.Keytab != "":
+		kt, err := krb5.LoadKeytab(opt.Keytab)
+		if err != nil {
+			return nil, err
+		}
+		key, _, err := kt.GetKey(opt.User, opt.Domain, 0)
+		if err != nil {
+			return nil, err
+		}
+		return krb5.NewClientWithKey(opt.User, opt.Domain, kdc, key), nil
+	case opt.AESKey != "":
+		key, err := hex.DecodeString(opt.AESKey)
+		if err != nil {
+			return nil, err
+		}
+		etype := int32(krb5.ETYPE_AES256_CTS_HMAC_SHA1_96)
+		if len(key) == 16 {
+			etype = krb5.ETYPE_AES128_CTS_HMAC_SHA1_96
+		} else if len(key) != 32 {
+			return nil, errors.New("Invalid AES key length")
+		}
+		return krb5.NewClientWithKey(opt.User, opt.Domain, kdc, krb5.EncryptionKey{KeyType: etype, KeyValue: key}), nil
+	case opt.Hash != "":
+		key, err := hex.DecodeString(opt.Hash)
+		if err != nil {
+			return nil, err
+		}
+		return krb5.NewClientWithKey(opt.User, opt.Domain, kdc, krb5.EncryptionKey{KeyType: krb5.ETYPE_RC4_HMAC, KeyValue: key}), nil
+	default:
+		return krb5.NewClientWithPassword(opt.User, opt.Domain, kdc, opt.Password), nil
+	}
+}
+
+// 加载凭据缓存，指定CCache时必须成功，未提供任何凭据时尝试KRB5CCNAME
+func (opt *ClientOptions) loadCCache() (*krb5.CCache, error) {
+	if opt.CCache != "" {
+		return krb5.LoadCCache(opt.CCache)
+	}
+	if opt.Keytab != "" || opt.AESKey != "" || opt.Hash != "" || opt.Password != "" {
+		return nil, nil
+	}
+	cc, err := krb5.LoadDefaultCCache()
+	if err != nil {
+		return nil, nil
+	}
+	return cc, nil
+}
+
+// 获取spn的服务票据，优先使用缓存中已有的票据，与KDC的连接沿用拨号方式及读取超时
+func (opt *ClientOptions) ServiceTicketContext(ctx context.Context, spn string) (*krb5.Credential, error) {
+	cc, err := opt.loadCCache()
+	if err != nil {
+		return nil, err
+	}
+	var kc *krb5.Client
+	if cc != nil {
+		if opt.User != "" && !strings.EqualFold(cc.DefaultPrincipal.String(), opt.User) {
+			return nil, errors.New("Credential cache principal does not match user " + opt.User)
+		}
+		if cred := cc.GetCredential(spn, ""); cred != nil {
+			return cred, nil
+		}
+		if kc, err = krb5.NewClientWithCCache(cc, opt.kdcAddress(cc.DefaultRealm)); err != nil {
+			return nil, err
+		}
+	} else if kc, err = opt.newKerberosClient(); err != nil {
+		return nil, err
+	}
+	kc.DialContext = opt.DialContext
+	kc.Timeout = opt.ReadTimeout
+	return kc.GetServiceTicketContext(ctx, spn)
+}
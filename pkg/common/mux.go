@@ -0,0 +1,499 @@
+package common
+
+// 此文件实现SMB2请求的多路复用
+// 后台协程读取响应并按MessageId分发，发送前按CreditCharge扣减服务端授予的信用值
+// https://docs.microsoft.com/en-us/openspecs/windows_protocols/ms-smb2/dc52ea4a-8b2c-4a0f-ae70-2ee57af1e5a0
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/4ra1n/go-impacket/pkg/encoder"
+	"github.com/4ra1n/go-impacket/pkg/ms"
+	"github.com/4ra1n/go-impacket/pkg/smb"
+)
+
+const creditTarget = 128 // 信用值低于该值时在请求中额外申请
+
+var cancelTimeout = 5 * time.Second // 取消后等待服务端完成原请求的时间
+
+var (
+	ErrNotConnected       = errors.New("SMB connection is not established")
+	ErrInsufficientCredit = errors.New("Insufficient SMB2 credits for request")
+	ErrCancelTimeout      = errors.New("SMB2 request was not completed after cancel")
+)
+
+// 等待响应的单个请求
+type call struct {
+	done    chan struct{}
+	buf     []byte
+	err     error
+	asyncId uint64 // 收到STATUS_PENDING中间响应后记录，用于取消
+	treeId  uint32
+	encrypt bool
+	charge  uint16
+}
+
+// 连接上共享的收发状态，Client被复制后仍指向同一份状态
+type multiplexer struct {
+	sendMu         sync.Mutex    // 保证MessageId按分配顺序写入连接
+	mu             sync.Mutex    // 保护以下字段以及Client中的密钥状态
+	wake           chan struct{} // 信用值增加或连接出错时关闭并替换，用于唤醒等待信用值的请求
+	messageId      uint64
+	credits        uint32
+	reserved       uint32 // 已扣减但尚未分配MessageId的信用值
+	pending        map[uint64]*call
+	reading        bool
+	err            error
+	trees          map[string]uint32
+	encryptedTrees map[uint32]bool // 要求加密的树连接
+}
+
+func newMultiplexer() *multiplexer {
+	return &multiplexer{
+		wake:           make(chan struct{}),
+		credits:        1,
+		pending:        make(map[uint64]*call),
+		trees:          make(map[string]uint32),
+		encryptedTrees: make(map[uint32]bool),
+	}
+}
+
+// 唤醒所有等待信用值的请求，需持有mu
+func (m *multiplexer) broadcast() {
+	close(m.wake)
+	m.wake = make(chan struct{})
+}
+
+func (c *Client) shared() *multiplexer {
+	if c.mux == nil {
+		c.mux = newMultiplexer()
+	}
+	return c.mux
+}
+
+// 已发送的请求，可等待响应或取消
+type PendingRequest struct {
+	c     *Client
+	ids   []uint64
+	calls []*call
+}
+
+// 发送请求但不等待响应，多个请求组成复合请求
+// MessageId、CreditCharge以及CreditRequest由此处统一分配
+func (c *Client) SMBSendAsync(reqs ...interface{}) (*PendingRequest, error) {
+	return c.SMBSendAsyncContext(context.Background(), reqs...)
+}
+
+// ctx影响等待信用值与写入，等待响应使用WaitContext
+func (c *Client) SMBSendAsyncContext(ctx context.Context, reqs ...interface{}) (*PendingRequest, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if len(reqs) == 0 {
+		return nil, errors.New("No request to send")
+	}
+	m := c.mux
+	if m == nil || c.conn == nil {
+		return nil, ErrNotConnected
+	}
+	pkts := make([][]byte, len(reqs))
+	for i, req := range reqs {
+		var err error
+		if pkts[i], err = encoder.Marshal(req); err != nil {
+			c.Debug("", err)
+			return nil, err
+		}
+	}
+	// 在发送锁之外等待信用值，等待期间其他请求与取消请求仍可发送
+	charges, total := creditCharges(c, pkts)
+	if err := m.acquire(ctx, total); err != nil {
+		return nil, err
+	}
+	m.sendMu.Lock()
+	defer m.sendMu.Unlock()
+	if err := ctx.Err(); err != nil {
+		m.unreserve(total)
+		return nil, err
+	}
+	m.mu.Lock()
+	r := &PendingRequest{c: c}
+	if err := m.assign(c, pkts, charges, total, r); err != nil {
+		m.mu.Unlock()
+		return nil, err
+	}
+	if !m.reading {
+		m.reading = true
+		go c.readLoop(m, c.conn)
+	}
+	body, err := c.seal(pkts, r)
+	m.mu.Unlock()
+	if err != nil {
+		m.release(r)
+		c.Debug("", err)
+		return nil, err
+	}
+	c.Debug("raw:\n"+hex.Dump(body), nil)
+	if err = c.write(ctx, body); err != nil {
+		// 写入不完整时连接上的数据已无法对齐
+		m.close(err)
+		return nil, contextError(ctx, err)
+	}
+	return r, nil
+}
+
+// 计算每个请求的CreditCharge以及总和
+func creditCharges(c *Client, pkts [][]byte) ([]uint16, uint32) {
+	charges := make([]uint16, len(pkts))
+	var total uint32
+	for i, pkt := range pkts {
+		if !smb.IsSMB2(pkt) {
+			continue
+		}
+		charge := smb.RequestCreditCharge(pkt)
+		if h := smb.HeaderCreditCharge(pkt); h > charge {
+			charge = h
+		}
+		// smb2.0.2不支持多信用值请求
+		if c.dialect == smb.SMB2_0_2_Dialect {
+			charge = 1
+		}
+		charges[i] = charge
+		total += uint32(charge)
+	}
+	return charges, total
+}
+
+// 扣减信用值，不足时等待其他请求的响应，ctx结束时放弃等待
+// 没有等待中的请求时信用值不会再增加，直接返回错误
+func (m *multiplexer) acquire(ctx context.Context, total uint32) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for m.err == nil && m.credits < total {
+		if len(m.pending) == 0 && m.reserved == 0 {
+			return ErrInsufficientCredit
+		}
+		wake := m.wake
+		m.mu.Unlock()
+		select {
+		case <-wake:
+		case <-ctx.Done():
+			m.mu.Lock()
+			return ctx.Err()
+		}
+		m.mu.Lock()
+	}
+	if m.err != nil {
+		return m.err
+	}
+	m.credits -= total
+	m.reserved += total
+	return nil
+}
+
+// 归还已扣减但未发送的信用值
+func (m *multiplexer) unreserve(total uint32) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.reserved -= total
+	m.credits += total
+	m.broadcast()
+}
+
+// 为已扣减信用值的请求分配MessageId，需持有sendMu与mu
+func (m *multiplexer) assign(c *Client, pkts [][]byte, charges []uint16, total uint32, r *PendingRequest) error {
+	m.reserved -= total
+	if m.err != nil {
+		return m.err
+	}
+	for i, pkt := range pkts {
+		id := m.messageId
+		cl := &call{done: make(chan struct{}), charge: charges[i]}
+		if smb.IsSMB2(pkt) {
+			cl.treeId = smb.HeaderTreeId(pkt)
+			smb.SetHeaderMessageId(pkt, id)
+			if c.dialect == smb.SMB2_0_2_Dialect {
+				smb.SetHeaderCreditCharge(pkt, 0)
+			} else {
+				smb.SetHeaderCreditCharge(pkt, charges[i])
+			}
+			request := uint32(charges[i])
+			if m.credits < creditTarget {
+				request += creditTarget - m.credits
+			}
+			smb.SetHeaderCreditRequest(pkt, uint16(request))
+			m.messageId += uint64(charges[i])
+		} else {
+			m.messageId++
+		}
+		m.pending[id] = cl
+		r.ids = append(r.ids, id)
+		r.calls = append(r.calls, cl)
+	}
+	return nil
+}
+
+// 拼接、签名并按需加密，需持有mu
+func (c *Client) seal(pkts [][]byte, r *PendingRequest) ([]byte, error) {
+	body, parts := smb.JoinCompound(pkts)
+	encrypt := false
+	for _, pkt := range parts {
+		encrypt = encrypt || c.shouldEncrypt(pkt)
+	}
+	for i, pkt := range parts {
+		r.calls[i].encrypt = encrypt
+		if !encrypt {
+			if err := c.sign(pkt); err != nil {
+				return nil, err
+			}
+		}
+		c.updatePreauthHash(pkt)
+	}
+	if encrypt {
+		return c.encrypt(body)
+	}
+	return body, nil
+}
+
+// 请求未发出时移除等待中的请求并归还信用值
+func (m *multiplexer) release(r *PendingRequest) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i, id := range r.ids {
+		delete(m.pending, id)
+		m.credits += uint32(r.calls[i].charge)
+	}
+	m.broadcast()
+}
+
+// 连接出错时结束所有等待中的请求
+func (m *multiplexer) close(err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.err == nil {
+		m.err = err
+	}
+	for id, cl := range m.pending {
+		cl.err = m.err
+		close(cl.done)
+		delete(m.pending, id)
+	}
+	m.broadcast()
+}
+
+// 后台读取响应，连接关闭或出错时退出
+func (c *Client) readLoop(m *multiplexer, conn net.Conn) {
+	for {
+		data, err := smb.ReadMessage(conn)
+		if err == nil {
+			err = c.dispatch(m, data)
+		}
+		if err != nil {
+			c.Debug("", err)
+			m.close(err)
+			return
+		}
+	}
+}
+
+// 解密并拆分响应，按MessageId交给等待的请求
+func (c *Client) dispatch(m *multiplexer, data []byte) (err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	encrypted := smb.IsTransform(data)
+	if encrypted {
+		// 解密后的消息无需再校验签名
+		if data, err = c.decrypt(data); err != nil {
+			return err
+		}
+	}
+	pkts, err := smb.SplitCompound(data)
+	if err != nil {
+		c.Debug("Raw:\n"+hex.Dump(data), err)
+		return err
+	}
+	for _, pkt := range pkts {
+		if !smb.IsSMB2(pkt) {
+			// smbv1没有MessageId，交给最早的请求
+			m.complete(m.oldest(), pkt, nil)
+			continue
+		}
+		m.credits += uint32(smb.HeaderCreditResponse(pkt))
+		m.broadcast()
+		id := smb.HeaderMessageId(pkt)
+		cl, ok := m.pending[id]
+		if !ok {
+			// 机会锁中断等服务端主动发送的消息
+			c.Debug("Discarding unsolicited SMB2 message", nil)
+			continue
+		}
+		if smb.HeaderStatus(pkt) == ms.STATUS_PENDING && smb.HeaderFlags(pkt)&smb.SMB2_FLAGS_ASYNC_COMMAND != 0 {
+			// 中间响应，最终响应稍后以相同MessageId返回
+			cl.asyncId = smb.HeaderAsyncId(pkt)
+			continue
+		}
+		var verifyErr error
+		if !encrypted {
+			if verifyErr = c.verify(pkt); verifyErr != nil {
+				c.Debug("Raw:\n"+hex.Dump(pkt), verifyErr)
+			}
+		}
+		c.updatePreauthHash(pkt)
+		m.complete(id, pkt, verifyErr)
+	}
+	return nil
+}
+
+func (m *multiplexer) oldest() uint64 {
+	first := true
+	var ret uint64
+	for id := range m.pending {
+		if first || id < ret {
+			ret = id
+			first = false
+		}
+	}
+	return ret
+}
+
+func (m *multiplexer) complete(id uint64, pkt []byte, err error) {
+	cl, ok := m.pending[id]
+	if !ok {
+		return
+	}
+	cl.buf = pkt
+	cl.err = err
+	close(cl.done)
+	delete(m.pending, id)
+}
+
+// 写入一条消息，只设置写截止时间，读取由后台协程负责
+func (c *Client) write(ctx context.Context, body []byte) error {
+	stop := watchContext(ctx, c.conn.SetWriteDeadline)
+	defer stop()
+	c.conn.SetWriteDeadline(deadline(ctx, c.writeTimeout()))
+	return smb.WriteMessage(c.conn, body)
+}
+
+// 等待全部响应
+func (r *PendingRequest) Wait() ([][]byte, error) {
+	return r.WaitContext(context.Background())
+}
+
+// ctx取消或超过ReadTimeout时取消请求，等待服务端完成原请求后返回
+func (r *PendingRequest) WaitContext(ctx context.Context) ([][]byte, error) {
+	return r.wait(ctx, r.c.readTimeout())
+}
+
+// 同WaitContext但不受ReadTimeout限制，只在ctx取消时取消请求
+// 用于服务端有数据时才完成的请求，如管道读取，超时取消可能丢弃已完成的响应
+func (r *PendingRequest) WaitNoTimeoutContext(ctx context.Context) ([][]byte, error) {
+	return r.wait(ctx, 0)
+}
+
+func (r *PendingRequest) wait(ctx context.Context, t time.Duration) ([][]byte, error) {
+	var timeout <-chan time.Time
+	if t > 0 {
+		timer := time.NewTimer(t)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	res := make([][]byte, len(r.calls))
+	for i, cl := range r.calls {
+		select {
+		case <-cl.done:
+		case <-ctx.Done():
+			r.cancelAndWait()
+			return nil, ctx.Err()
+		case <-timeout:
+			r.cancelAndWait()
+			return nil, os.ErrDeadlineExceeded
+		}
+		if cl.err != nil {
+			return nil, cl.err
+		}
+		res[i] = cl.buf
+	}
+	return res, nil
+}
+
+// 请求使用的MessageId
+func (r *PendingRequest) MessageIds() []uint64 {
+	return r.ids
+}
+
+// 取消后等待原请求完成，服务端无响应时最多等待cancelTimeout
+// 完成前MessageId仍在等待列表中，迟到的响应不会被当作未请求的消息
+// 超时后放弃这些请求并归还信用值，否则后续请求会一直等待信用值
+func (r *PendingRequest) cancelAndWait() {
+	if err := r.Cancel(); err != nil {
+		r.c.Debug("", err)
+		return
+	}
+	timer := time.NewTimer(cancelTimeout)
+	defer timer.Stop()
+	for _, cl := range r.calls {
+		select {
+		case <-cl.done:
+		case <-timer.C:
+			r.c.mux.abandon(r)
+			return
+		}
+	}
+}
+
+// 移除仍未完成的请求并归还信用值，迟到的响应按未请求的消息丢弃
+func (m *multiplexer) abandon(r *PendingRequest) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i, id := range r.ids {
+		cl, ok := m.pending[id]
+		if !ok || cl != r.calls[i] {
+			continue
+		}
+		cl.err = ErrCancelTimeout
+		close(cl.done)
+		delete(m.pending, id)
+		m.credits += uint32(cl.charge)
+	}
+	m.broadcast()
+}
+
+// 发送取消请求，服务端随后以STATUS_CANCELLED完成原请求，仍需调用Wait
+// 与SMBSendAsync共用发送锁，取消请求不会与其他消息交错写入
+func (r *PendingRequest) Cancel() error {
+	c := r.c
+	m := c.mux
+	m.sendMu.Lock()
+	defer m.sendMu.Unlock()
+	for i, cl := range r.calls {
+		m.mu.Lock()
+		_, waiting := m.pending[r.ids[i]]
+		if !waiting {
+			m.mu.Unlock()
+			continue
+		}
+		pkt := smb.NewCancelRequest(r.ids[i], cl.asyncId, c.sessionId, cl.treeId)
+		var err error
+		if cl.encrypt {
+			pkt, err = c.encrypt(pkt)
+		} else {
+			err = c.sign(pkt)
+		}
+		m.mu.Unlock()
+		if err != nil {
+			return err
+		}
+		c.Debug("Sending Cancel request", nil)
+		if err = c.write(context.Background(), pkt); err != nil {
+			m.close(err)
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,208 @@
+package common
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/4ra1n/go-impacket/pkg/ms"
+	"github.com/4ra1n/go-impacket/pkg/smb"
+)
+
+// 带标记的ECHO请求，模拟服务端原样返回标记用于核对响应归属
+type testEchoRequest struct {
+	smb.SMB2PacketStruct
+	StructureSize uint16
+	Reserved      uint16
+	Tag           uint32
+}
+
+func newTestEcho(tag uint32) *testEchoRequest {
+	return &testEchoRequest{
+		SMB2PacketStruct: smb.SMB2PacketStruct{
+			ProtocolId:    []byte(smb.ProtocolSMB2),
+			StructureSize: smb.SMB2HeaderSize,
+			Command:       smb.SMB2_ECHO,
+			Signature:     make([]byte, 16),
+		},
+		StructureSize: 4,
+		Tag:           tag,
+	}
+}
+
+// net.Pipe上的模拟服务端，handle不回复时请求保持挂起
+type testServer struct {
+	conn    net.Conn
+	writeMu sync.Mutex
+	handle  func(s *testServer, pkt []byte)
+}
+
+func newTestClient(t *testing.T, handle func(s *testServer, pkt []byte)) *Client {
+	t.Helper()
+	client, server := net.Pipe()
+	s := &testServer{conn: server, handle: handle}
+	go func() {
+		for {
+			data, err := smb.ReadMessage(server)
+			if err != nil {
+				return
+			}
+			s.handle(s, data)
+		}
+	}()
+	c := (&Client{}).WithConn(client).WithDialect(smb.SMB2_1_Dialect)
+	t.Cleanup(func() {
+		c.Close()
+		server.Close()
+	})
+	return c
+}
+
+// 以请求为模板构造响应并写回
+func (s *testServer) reply(req []byte, status uint32, flags uint32, credits uint16) {
+	pkt := append([]byte{}, req...)
+	binary.LittleEndian.PutUint32(pkt[8:], status)
+	binary.LittleEndian.PutUint16(pkt[14:], credits)
+	binary.LittleEndian.PutUint32(pkt[16:], smb.SMB2_FLAGS_SERVER_TO_REDIR|flags)
+	if flags&smb.SMB2_FLAGS_ASYNC_COMMAND != 0 {
+		binary.LittleEndian.PutUint64(pkt[32:], smb.HeaderMessageId(req)+1)
+	}
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	smb.WriteMessage(s.conn, pkt)
+}
+
+func echoTag(pkt []byte) uint32 {
+	return binary.LittleEndian.Uint32(pkt[smb.SMB2HeaderSize+4:])
+}
+
+// 多个协程共享同一客户端，信用值不足时等待，响应乱序返回
+func TestConcurrentSends(t *testing.T) {
+	var mu sync.Mutex
+	seen := make(map[uint64]bool)
+	first := true
+	c := newTestClient(t, func(s *testServer, pkt []byte) {
+		mu.Lock()
+		id := smb.HeaderMessageId(pkt)
+		if seen[id] {
+			t.Errorf("MessageId %d reused", id)
+		}
+		seen[id] = true
+		// 首个响应授予8个信用值，之后只归还请求消耗的信用值
+		credits := uint16(1)
+		if first {
+			credits, first = 8, false
+		}
+		mu.Unlock()
+		go func() {
+			time.Sleep(time.Duration(id%4) * time.Millisecond)
+			s.reply(pkt, 0, 0, credits)
+		}()
+	})
+	if _, err := c.SMBSend(newTestEcho(0)); err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	for i := uint32(1); i <= 32; i++ {
+		wg.Add(1)
+		go func(tag uint32) {
+			defer wg.Done()
+			for j := 0; j < 4; j++ {
+				res, err := c.SMBSend(newTestEcho(tag))
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if got := echoTag(res); got != tag {
+					t.Errorf("got response for %d, want %d", got, tag)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	if len(seen) != 1+32*4 {
+		t.Fatalf("server saw %d requests", len(seen))
+	}
+}
+
+// 长时间挂起的请求占用全部信用值时，等待信用值的请求随ctx结束返回，挂起的请求仍可取消
+func TestCreditExhaustionCancel(t *testing.T) {
+	c := newTestClient(t, func(s *testServer, pkt []byte) {
+		switch {
+		case smb.HeaderCommand(pkt) == smb.SMB2_CANCEL:
+			// 以原请求的MessageId完成被取消的请求
+			res := append([]byte{}, pkt...)
+			binary.LittleEndian.PutUint16(res[12:], smb.SMB2_ECHO)
+			s.reply(res, ms.STATUS_CANCELLED, smb.SMB2_FLAGS_ASYNC_COMMAND, 1)
+		case echoTag(pkt) == 1:
+			// 挂起请求，只返回中间响应
+			s.reply(pkt, ms.STATUS_PENDING, smb.SMB2_FLAGS_ASYNC_COMMAND, 0)
+		default:
+			s.reply(pkt, 0, 0, 1)
+		}
+	})
+	blocked, err := c.SMBSendAsync(newTestEcho(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err = c.SMBSendContext(ctx, newTestEcho(2)); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("send without credits: %v", err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Fatalf("send without credits returned after %v", d)
+	}
+
+	waitCtx, waitCancel := context.WithCancel(context.Background())
+	waitCancel()
+	if _, err = blocked.WaitNoTimeoutContext(waitCtx); !errors.Is(err, context.Canceled) {
+		t.Fatalf("cancelled wait: %v", err)
+	}
+	res, err := c.SMBSend(newTestEcho(3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if echoTag(res) != 3 {
+		t.Fatalf("unexpected response tag %d", echoTag(res))
+	}
+}
+
+// 服务端不响应取消请求时，超时后归还信用值，后续请求不会一直等待
+func TestCancelTimeoutReturnsCredits(t *testing.T) {
+	old := cancelTimeout
+	cancelTimeout = 50 * time.Millisecond
+	defer func() { cancelTimeout = old }()
+	c := newTestClient(t, func(s *testServer, pkt []byte) {
+		if smb.HeaderCommand(pkt) == smb.SMB2_CANCEL || echoTag(pkt) == 1 {
+			return
+		}
+		s.reply(pkt, 0, 0, 1)
+	})
+	for i := 0; i < 3; i++ {
+		blocked, err := c.SMBSendAsync(newTestEcho(1))
+		if err != nil {
+			t.Fatal(err)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		_, err = blocked.WaitContext(ctx)
+		cancel()
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("wait: %v", err)
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	res, err := c.SMBSendContext(ctx, newTestEcho(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if echoTag(res) != 2 {
+		t.Fatalf("unexpected response tag %d", echoTag(res))
+	}
+}
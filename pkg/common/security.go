@@ -0,0 +1,91 @@
+package common
+
+import (
+	"errors"
+
+	"github.com/4ra1n/go-impacket/pkg/ms"
+	"github.com/4ra1n/go-impacket/pkg/smb"
+)
+
+// 此文件提供SMB2消息签名校验、传输加密以及预认证完整性哈希
+
+// 对SMB2请求签名，协商及会话建立请求不签名
+func (c *Client) sign(pkt []byte) error {
+	if !c.IsSigningRequired || c.signingKey == nil || !smb.IsSMB2(pkt) {
+		return nil
+	}
+	switch smb.HeaderCommand(pkt) {
+	case smb.SMB2_NEGOTIATE, smb.SMB2_SESSION_SETUP:
+		return nil
+	}
+	if smb.HeaderSessionId(pkt) == 0 {
+		return nil
+	}
+	return smb.Sign(c.signingAlgorithm, c.signingKey, pkt)
+}
+
+// 校验SMB2响应签名
+// 带签名标识的响应必须校验通过，要求签名时拒绝未签名的响应
+// 会话建立响应由调用方在派生密钥后自行校验
+func (c *Client) verify(pkt []byte) error {
+	if c.signingKey == nil || !smb.IsSMB2(pkt) || smb.HeaderSessionId(pkt) == 0 {
+		return nil
+	}
+	if smb.HeaderCommand(pkt) == smb.SMB2_SESSION_SETUP {
+		return nil
+	}
+	if smb.HeaderFlags(pkt)&smb.SMB2_FLAGS_SIGNED == 0 {
+		if c.IsSigningRequired && c.IsAuthenticated && smb.HeaderStatus(pkt) != ms.STATUS_PENDING {
+			return errors.New("Received unsigned SMB2 response while signing is required")
+		}
+		return nil
+	}
+	return smb.Verify(c.signingAlgorithm, c.signingKey, pkt)
+}
+
+// 更新smb3.1.1预认证完整性哈希
+// 覆盖协商请求/响应以及会话建立请求/响应，最后一个成功的会话建立响应不参与计算
+func (c *Client) updatePreauthHash(pkt []byte) {
+	if c.preauthHash == nil || c.IsAuthenticated || !smb.IsSMB2(pkt) {
+		return
+	}
+	switch smb.HeaderCommand(pkt) {
+	case smb.SMB2_NEGOTIATE:
+	case smb.SMB2_SESSION_SETUP:
+		if smb.HeaderFlags(pkt)&smb.SMB2_FLAGS_SERVER_TO_REDIR != 0 && smb.HeaderStatus(pkt) == ms.STATUS_SUCCESS {
+			return
+		}
+	default:
+		return
+	}
+	c.preauthHash = smb.PreauthHash(c.preauthHash, pkt)
+}
+
+// 判断请求是否需要加密，会话或目标树连接要求加密时加密，协商及会话建立请求不加密
+// 调用方需持有多路复用器的锁
+func (c *Client) shouldEncrypt(pkt []byte) bool {
+	if c.encryptionKey == nil || !smb.IsSMB2(pkt) || smb.HeaderSessionId(pkt) == 0 {
+		return false
+	}
+	switch smb.HeaderCommand(pkt) {
+	case smb.SMB2_NEGOTIATE, smb.SMB2_SESSION_SETUP:
+		return false
+	}
+	return c.IsEncryptionRequired || c.shared().encryptedTrees[smb.HeaderTreeId(pkt)]
+}
+
+// 加密SMB2请求
+func (c *Client) encrypt(pkt []byte) ([]byte, error) {
+	return smb.Encrypt(c.cipherId, c.encryptionKey, smb.HeaderSessionId(pkt), pkt)
+}
+
+// 解密SMB2响应
+func (c *Client) decrypt(pkt []byte) ([]byte, error) {
+	if c.decryptionKey == nil {
+		return nil, errors.New("Received encrypted SMB2 response without decryption key")
+	}
+	if smb.TransformSessionId(pkt) != c.sessionId {
+		return nil, errors.New("Received encrypted SMB2 response for unknown session")
+	}
+	return smb.Decrypt(c.cipherId, c.decryptionKey, pkt)
+}
@@ -0,0 +1,110 @@
+package common
+
+// 此文件用于建立连接以及处理context取消和读写超时
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"time"
+)
+
+// 清理操作的超时时间，ctx取消后关闭句柄、回滚安装等仍需完成
+const CleanupTimeout = 30 * time.Second
+
+// 拨号器，与golang.org/x/net/proxy.ContextDialer一致
+type Dialer interface {
+	DialContext(ctx context.Context, network, address string) (net.Conn, error)
+}
+
+// 按连接参数拨号，DialTimeout为0时只受ctx限制
+// 使用自定义拨号器时DialTimeout包含与代理握手的时间
+func (opt *ClientOptions) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	if opt.Dialer == nil {
+		d := net.Dialer{Timeout: opt.DialTimeout}
+		return d.DialContext(ctx, network, address)
+	}
+	if opt.DialTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, opt.DialTimeout)
+		defer cancel()
+	}
+	return opt.Dialer.DialContext(ctx, network, address)
+}
+
+// 连接目标主机的Host:Port
+func Dial(ctx context.Context, opt *ClientOptions) (net.Conn, error) {
+	return opt.DialContext(ctx, "tcp", net.JoinHostPort(opt.Host, strconv.Itoa(opt.Port)))
+}
+
+func (c *Client) readTimeout() time.Duration {
+	if c.options == nil {
+		return 0
+	}
+	return c.options.ReadTimeout
+}
+
+func (c *Client) writeTimeout() time.Duration {
+	if c.options == nil {
+		return 0
+	}
+	return c.options.WriteTimeout
+}
+
+// 取ctx截止时间与超时中较早者，均未设置时返回零值表示不限制
+func deadline(ctx context.Context, timeout time.Duration) time.Time {
+	var t time.Time
+	if timeout > 0 {
+		t = time.Now().Add(timeout)
+	}
+	if d, ok := ctx.Deadline(); ok && (t.IsZero() || d.Before(t)) {
+		t = d
+	}
+	return t
+}
+
+// ctx取消时把截止时间设为过去，使阻塞的读写立即返回，stop后不再生效
+func watchContext(ctx context.Context, setDeadline func(time.Time) error) (stop func()) {
+	if ctx.Done() == nil {
+		return func() {}
+	}
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			setDeadline(time.Unix(1, 0))
+		case <-done:
+		}
+	}()
+	return func() { close(done) }
+}
+
+// ctx已取消时返回ctx的错误，便于调用方区分超时与网络错误
+func contextError(ctx context.Context, err error) error {
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return ctxErr
+	}
+	return err
+}
+
+// 清理使用的context，保留ctx中的值但不随其取消，超过CleanupTimeout后取消
+func CleanupContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(detachedContext{ctx}, CleanupTimeout)
+}
+
+// 不随父context取消的context，即go1.21的context.WithoutCancel
+type detachedContext struct {
+	context.Context
+}
+
+func (detachedContext) Deadline() (time.Time, bool) {
+	return time.Time{}, false
+}
+
+func (detachedContext) Done() <-chan struct{} {
+	return nil
+}
+
+func (detachedContext) Err() error {
+	return nil
+}
@@ -0,0 +1,31 @@
+package common
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+type testContextKey struct{}
+
+// 父context取消后清理context仍可用，保留其中的值并带有自己的截止时间
+func TestCleanupContext(t *testing.T) {
+	parent, cancelParent := context.WithCancel(context.WithValue(context.Background(), testContextKey{}, "v"))
+	cancelParent()
+	ctx, cancel := CleanupContext(parent)
+	defer cancel()
+	if err := ctx.Err(); err != nil {
+		t.Fatalf("Err() = %v", err)
+	}
+	if ctx.Value(testContextKey{}) != "v" {
+		t.Fatal("value of the parent context was lost")
+	}
+	d, ok := ctx.Deadline()
+	if !ok || time.Until(d) > CleanupTimeout {
+		t.Fatalf("Deadline() = %v, %v", d, ok)
+	}
+	cancel()
+	if ctx.Err() != context.Canceled {
+		t.Fatalf("Err() after cancel = %v", ctx.Err())
+	}
+}
@@ -1,5 +1,7 @@
 package dcerpc
 
+import "fmt"
+
 // 此文件提供rpc状态信息
 
 // status codes, references:
@@ -15,6 +17,7 @@ const (
 	EPT_S_CANT_PERFORM_OP        = 1752
 	EPT_S_INVALID_ENTRY          = 0x000006D7
 	EPT_S_NOT_REGISTERED         = 0x000006D9
+	DCE_EPT_S_NOT_REGISTERED     = 0x16c9a0d6 // ept_lookup、ept_map返回的DCE状态码
 	RPC_S_ACCESS_DENIED          = 0x00000005
 	RPC_S_ADDRESS_ERROR          = 0x000006E8
 	RPC_S_ALREADY_LISTENING      = 0x000006B1
@@ -135,11 +138,78 @@ const (
 	RPC_X_SS_WRONG_STUB_VERSION     = 0x00000725
 )
 
+// 故障PDU中的nca状态码
+// https://pubs.opengroup.org/onlinepubs/9629399/apdxe.htm
+const (
+	NCA_S_FAULT_INT_DIV_BY_ZERO     = 0x1C000001
+	NCA_S_FAULT_ADDR_ERROR          = 0x1C000002
+	NCA_S_FAULT_FP_DIV_ZERO         = 0x1C000003
+	NCA_S_FAULT_FP_UNDERFLOW        = 0x1C000004
+	NCA_S_FAULT_FP_OVERFLOW         = 0x1C000005
+	NCA_S_FAULT_INVALID_TAG         = 0x1C000006
+	NCA_S_FAULT_INVALID_BOUND       = 0x1C000007
+	NCA_S_RPC_VERSION_MISMATCH      = 0x1C000008
+	NCA_S_UNSPEC_REJECT             = 0x1C000009
+	NCA_S_BAD_ACTID                 = 0x1C00000A
+	NCA_S_WHO_ARE_YOU_FAILED        = 0x1C00000B
+	NCA_S_MANAGER_NOT_ENTERED       = 0x1C00000C
+	NCA_S_FAULT_CANCEL              = 0x1C00000D
+	NCA_S_FAULT_ILL_INST            = 0x1C00000E
+	NCA_S_FAULT_FP_ERROR            = 0x1C00000F
+	NCA_S_FAULT_INT_OVERFLOW        = 0x1C000010
+	NCA_S_FAULT_UNSPEC              = 0x1C000012
+	NCA_S_FAULT_REMOTE_COMM_FAILURE = 0x1C000013
+	NCA_S_FAULT_PIPE_EMPTY          = 0x1C000014
+	NCA_S_FAULT_PIPE_CLOSED         = 0x1C000015
+	NCA_S_FAULT_PIPE_ORDER          = 0x1C000016
+	NCA_S_FAULT_PIPE_DISCIPLINE     = 0x1C000017
+	NCA_S_FAULT_PIPE_COMM_ERROR     = 0x1C000018
+	NCA_S_FAULT_PIPE_MEMORY         = 0x1C000019
+	NCA_S_FAULT_CONTEXT_MISMATCH    = 0x1C00001A
+	NCA_S_FAULT_REMOTE_NO_MEMORY    = 0x1C00001B
+	NCA_S_INVALID_PRES_CONTEXT_ID   = 0x1C00001C
+	NCA_S_UNSUPPORTED_AUTHN_LEVEL   = 0x1C00001D
+	NCA_S_INVALID_CHECKSUM          = 0x1C00001F
+	NCA_S_INVALID_CRC               = 0x1C000020
+	NCA_S_FAULT_USER_DEFINED        = 0x1C000021
+	NCA_S_FAULT_TX_OPEN_FAILED      = 0x1C000022
+	NCA_S_FAULT_CODESET_CONV_ERROR  = 0x1C000023
+	NCA_S_FAULT_OBJECT_NOT_FOUND    = 0x1C000024
+	NCA_S_FAULT_NO_CLIENT_STUB      = 0x1C000025
+	NCA_S_COMM_FAILURE              = 0x1C010001
+	NCA_S_OP_RNG_ERROR              = 0x1C010002
+	NCA_S_UNK_IF                    = 0x1C010003
+	NCA_S_WRONG_BOOT_TIME           = 0x1C010006
+	NCA_S_YOU_CRASHED               = 0x1C010009
+	NCA_S_PROTO_ERROR               = 0x1C01000B
+	NCA_S_OUT_ARGS_TOO_BIG          = 0x1C010013
+	NCA_S_SERVER_TOO_BUSY           = 0x1C010014
+	NCA_S_FAULT_STRING_TOO_LONG     = 0x1C010015
+	NCA_S_UNSUPPORTED_TYPE          = 0x1C010017
+)
+
+// 服务控制管理器返回的win32错误码
+const (
+	ERROR_INSUFFICIENT_BUFFER        = 0x0000007A
+	ERROR_MORE_DATA                  = 0x000000EA
+	ERROR_DEPENDENT_SERVICES_RUNNING = 0x0000041B
+	ERROR_INVALID_SERVICE_CONTROL    = 0x0000041C
+	ERROR_SERVICE_REQUEST_TIMEOUT    = 0x0000041D
+	ERROR_SERVICE_ALREADY_RUNNING    = 0x00000420
+	ERROR_SERVICE_DISABLED           = 0x00000422
+	ERROR_SERVICE_DOES_NOT_EXIST     = 0x00000424
+	ERROR_SERVICE_CANNOT_ACCEPT_CTRL = 0x00000425
+	ERROR_SERVICE_NOT_ACTIVE         = 0x00000426
+	ERROR_SERVICE_MARKED_FOR_DELETE  = 0x00000430
+	ERROR_SERVICE_EXISTS             = 0x00000431
+)
+
 var RpcStatusCodes = map[uint32]string{
 	EPT_S_CANT_CREATE:            "An entry into the endpoint mapper database cannot be created.",
 	EPT_S_CANT_PERFORM_OP:        "General failure when trying to perform an operation on the endpoint mapper database.",
 	EPT_S_INVALID_ENTRY:          "The specified endpoint mapper database entry is invalid.",
 	EPT_S_NOT_REGISTERED:         "There are no more endpoints available from the endpoint-map database.",
+	DCE_EPT_S_NOT_REGISTERED:     "There are no more endpoints available from the endpoint-map database.",
 	RPC_S_ACCESS_DENIED:          "Access for making the remote procedure call was denied.",
 	RPC_S_ADDRESS_ERROR:          "An addressing error has occurred on the server.",
 	RPC_S_ALREADY_LISTENING:      "The server is already listening.",
@@ -258,4 +328,72 @@ var RpcStatusCodes = map[uint32]string{
 	RPC_X_SS_INVALID_BUFFER:         "The buffer is not valid for the operation.",
 	RPC_X_SS_WRONG_ES_VERSION:       "The software version is incorrect.",
 	RPC_X_SS_WRONG_STUB_VERSION:     "The stub version is incorrect.",
+	NCA_S_FAULT_INT_DIV_BY_ZERO:     "Integer divide by zero.",
+	NCA_S_FAULT_ADDR_ERROR:          "Address error.",
+	NCA_S_FAULT_FP_DIV_ZERO:         "Floating-point divide by zero.",
+	NCA_S_FAULT_FP_UNDERFLOW:        "Floating-point underflow.",
+	NCA_S_FAULT_FP_OVERFLOW:         "Floating-point overflow.",
+	NCA_S_FAULT_INVALID_TAG:         "Invalid discriminant of a union.",
+	NCA_S_FAULT_INVALID_BOUND:       "Invalid array bounds.",
+	NCA_S_RPC_VERSION_MISMATCH:      "The RPC protocol version is not supported.",
+	NCA_S_UNSPEC_REJECT:             "Unspecified rejection.",
+	NCA_S_BAD_ACTID:                 "Bad activity identifier.",
+	NCA_S_WHO_ARE_YOU_FAILED:        "The conversation manager callback failed.",
+	NCA_S_MANAGER_NOT_ENTERED:       "The manager routine was not entered.",
+	NCA_S_FAULT_CANCEL:              "The call was cancelled.",
+	NCA_S_FAULT_ILL_INST:            "Illegal instruction.",
+	NCA_S_FAULT_FP_ERROR:            "Floating-point error.",
+	NCA_S_FAULT_INT_OVERFLOW:        "Integer overflow.",
+	NCA_S_FAULT_UNSPEC:              "Unspecified fault.",
+	NCA_S_FAULT_REMOTE_COMM_FAILURE: "Remote communication failure.",
+	NCA_S_FAULT_PIPE_EMPTY:          "The pipe is empty.",
+	NCA_S_FAULT_PIPE_CLOSED:         "The pipe is closed.",
+	NCA_S_FAULT_PIPE_ORDER:          "Pipe operations are out of order.",
+	NCA_S_FAULT_PIPE_DISCIPLINE:     "Pipe discipline error.",
+	NCA_S_FAULT_PIPE_COMM_ERROR:     "Pipe communication error.",
+	NCA_S_FAULT_PIPE_MEMORY:         "Pipe memory error.",
+	NCA_S_FAULT_CONTEXT_MISMATCH:    "The context handle does not match any known context handles.",
+	NCA_S_FAULT_REMOTE_NO_MEMORY:    "The server is out of memory.",
+	NCA_S_INVALID_PRES_CONTEXT_ID:   "Invalid presentation context identifier.",
+	NCA_S_UNSUPPORTED_AUTHN_LEVEL:   "The authentication level is not supported.",
+	NCA_S_INVALID_CHECKSUM:          "Invalid checksum.",
+	NCA_S_INVALID_CRC:               "Invalid CRC.",
+	NCA_S_FAULT_USER_DEFINED:        "User-defined fault.",
+	NCA_S_FAULT_TX_OPEN_FAILED:      "Failed to open the transaction.",
+	NCA_S_FAULT_CODESET_CONV_ERROR:  "Code set conversion error.",
+	NCA_S_FAULT_OBJECT_NOT_FOUND:    "The object was not found.",
+	NCA_S_FAULT_NO_CLIENT_STUB:      "No client stub is available.",
+	NCA_S_COMM_FAILURE:              "Communication failure.",
+	NCA_S_OP_RNG_ERROR:              "The operation number is out of range.",
+	NCA_S_UNK_IF:                    "Unknown interface.",
+	NCA_S_WRONG_BOOT_TIME:           "Wrong server boot time.",
+	NCA_S_YOU_CRASHED:               "The client was restarted.",
+	NCA_S_PROTO_ERROR:               "RPC protocol error.",
+	NCA_S_OUT_ARGS_TOO_BIG:          "The output arguments are too big.",
+	NCA_S_SERVER_TOO_BUSY:           "The server is too busy.",
+	NCA_S_FAULT_STRING_TOO_LONG:     "The string is too long.",
+	NCA_S_UNSUPPORTED_TYPE:          "The type UUID is not supported.",
+
+	// 服务控制管理器
+	ERROR_MORE_DATA:                  "More data is available.",
+	ERROR_DEPENDENT_SERVICES_RUNNING: "A stop control has been sent to a service that other running services are dependent on.",
+	ERROR_INVALID_SERVICE_CONTROL:    "The requested control is not valid for this service.",
+	ERROR_SERVICE_REQUEST_TIMEOUT:    "The service did not respond to the start or control request in a timely fashion.",
+	ERROR_SERVICE_ALREADY_RUNNING:    "An instance of the service is already running.",
+	ERROR_SERVICE_DISABLED:           "The service cannot be started, either because it is disabled or because it has no enabled devices associated with it.",
+	ERROR_SERVICE_DOES_NOT_EXIST:     "The specified service does not exist as an installed service.",
+	ERROR_SERVICE_CANNOT_ACCEPT_CTRL: "The service cannot accept control messages at this time.",
+	ERROR_SERVICE_NOT_ACTIVE:         "The service has not been started.",
+	ERROR_SERVICE_EXISTS:             "The specified service already exists.",
+	ERROR_SERVICE_MARKED_FOR_DELETE:  "The specified service has been marked for deletion.",
+}
+
+// rpc状态码错误，可通过errors.As获取状态码
+type StatusError uint32
+
+func (e StatusError) Error() string {
+	if msg, ok := RpcStatusCodes[uint32(e)]; ok {
+		return msg
+	}
+	return fmt.Sprintf("Unknown rpc status 0x%08x", uint32(e))
 }
@@ -0,0 +1,342 @@
+package v5
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/4ra1n/go-impacket/pkg/common"
+	"github.com/4ra1n/go-impacket/pkg/encoder"
+	"github.com/4ra1n/go-impacket/pkg/krb5"
+	"github.com/4ra1n/go-impacket/pkg/krb5/gss"
+	"github.com/4ra1n/go-impacket/pkg/krb5/ntlm"
+)
+
+// 此文件提供rpc连接的认证，之后按认证级别签名或加密请求
+// ntlm认证绑定时完成bind、bind_ack、auth3三次握手
+// Kerberos认证使用DCE风格的三次AP交换，bind携带AP-REQ，bind_ack返回AP-REP，alter_context返回客户端AP-REP
+// https://pubs.opengroup.org/onlinepubs/9629399/chap13.htm
+
+// 认证服务
+const (
+	RPC_C_AUTHN_NONE          = 0
+	RPC_C_AUTHN_GSS_NEGOTIATE = 9
+	RPC_C_AUTHN_WINNT         = 10
+	RPC_C_AUTHN_GSS_SCHANNEL  = 14
+	RPC_C_AUTHN_GSS_KERBEROS  = 16
+	RPC_C_AUTHN_NETLOGON      = 68
+	RPC_C_AUTHN_DEFAULT       = 0xffff // 安全绑定中的默认认证服务
+)
+
+// 认证级别
+const (
+	RPC_C_AUTHN_LEVEL_DEFAULT       = 0
+	RPC_C_AUTHN_LEVEL_NONE          = 1
+	RPC_C_AUTHN_LEVEL_CONNECT       = 2
+	RPC_C_AUTHN_LEVEL_CALL          = 3
+	RPC_C_AUTHN_LEVEL_PKT           = 4
+	RPC_C_AUTHN_LEVEL_PKT_INTEGRITY = 5
+	RPC_C_AUTHN_LEVEL_PKT_PRIVACY   = 6
+)
+
+const (
+	secTrailerSize  = 8
+	authContextId   = 1
+	authStubAlign   = 16 // 存根填充到16字节后再放置sec_trailer
+	auth3PaddingLen = 4
+)
+
+// 认证状态
+type rpcAuth struct {
+	level    uint8
+	authType uint8 // sec_trailer中的认证服务
+	opt      common.ClientOptions
+	flags    uint32           // 向服务端请求的ntlm标志
+	session  *ntlm.Session    // 认证完成后建立，PKT_INTEGRITY及以上使用
+	krb      *krb5.DCEContext // Kerberos认证时在bind中建立
+}
+
+func newRPCAuth(level uint8, opt common.ClientOptions) *rpcAuth {
+	a := &rpcAuth{level: level, authType: RPC_C_AUTHN_WINNT, opt: opt}
+	if opt.Kerberos {
+		a.authType = RPC_C_AUTHN_GSS_NEGOTIATE
+		return a
+	}
+	if level >= RPC_C_AUTHN_LEVEL_PKT_INTEGRITY {
+		a.flags = ntlm.FlgNegSign | ntlm.FlgNegAlwaysSign | ntlm.FlgNegKeyExchange
+	}
+	if level == RPC_C_AUTHN_LEVEL_PKT_PRIVACY {
+		a.flags |= ntlm.FlgNegSeal
+	}
+	return a
+}
+
+// 使用认证，之后的绑定完成三次握手，level为RPC_C_AUTHN_LEVEL_CONNECT至RPC_C_AUTHN_LEVEL_PKT_PRIVACY
+// 凭据取自opt的Domain、User、Password或Hash、Workstation
+// opt.Kerberos为true时使用host/<Host>的服务票据进行Kerberos认证，票据获取方式与SMB会话建立相同
+func (r *RPCConn) WithAuth(level uint8, opt common.ClientOptions) *RPCConn {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if level < RPC_C_AUTHN_LEVEL_CONNECT {
+		r.auth = nil
+		return r
+	}
+	// 面向连接的协议中CALL、PKT级别按PKT_INTEGRITY处理
+	if level == RPC_C_AUTHN_LEVEL_CALL || level == RPC_C_AUTHN_LEVEL_PKT {
+		level = RPC_C_AUTHN_LEVEL_PKT_INTEGRITY
+	}
+	if level > RPC_C_AUTHN_LEVEL_PKT_PRIVACY {
+		level = RPC_C_AUTHN_LEVEL_PKT_PRIVACY
+	}
+	r.auth = newRPCAuth(level, opt)
+	return r
+}
+
+// 认证级别，未认证时为RPC_C_AUTHN_LEVEL_NONE
+func (r *RPCConn) AuthLevel() uint8 {
+	if r.auth == nil {
+		return RPC_C_AUTHN_LEVEL_NONE
+	}
+	return r.auth.level
+}
+
+// bind中携带的negotiate消息，Kerberos认证时为包含AP-REQ的NegTokenInit
+func (a *rpcAuth) negotiateToken(ctx context.Context) ([]byte, error) {
+	if a.opt.Kerberos {
+		return a.kerberosToken(ctx)
+	}
+	neg := ntlm.NewNegotiate("", "")
+	neg.NegotiateFlags |= a.flags
+	return encoder.Marshal(neg)
+}
+
+// 处理bind_ack中的challenge消息，返回auth3中携带的authenticate消息
+func (a *rpcAuth) authenticateToken(token []byte) ([]byte, error) {
+	challenge := ntlm.NewChallenge()
+	if err := encoder.Unmarshal(token, &challenge); err != nil {
+		return nil, fmt.Errorf("Invalid NTLM challenge: %w", err)
+	}
+	if challenge.MessageType != ntlm.NTLMChallenge {
+		return nil, errors.New("Invalid NTLM challenge")
+	}
+	var auth ntlm.NTLMv2Authentication
+	var sessionKey []byte
+	var err error
+	if a.opt.Hash != "" {
+		auth, sessionKey, err = ntlm.NewAuthenticateHashFlags(a.opt.Domain, a.opt.User, a.opt.Workstation, a.opt.Hash, challenge, a.flags)
+	} else {
+		auth, sessionKey, err = ntlm.NewAuthenticatePassFlags(a.opt.Domain, a.opt.User, a.opt.Workstation, a.opt.Password, challenge, a.flags)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if a.level >= RPC_C_AUTHN_LEVEL_PKT_INTEGRITY {
+		if auth.NegotiateFlags&a.flags != a.flags {
+			return nil, errors.New("Server does not support NTLM signing or sealing")
+		}
+		session, err := ntlm.NewClientSession(auth.NegotiateFlags, sessionKey)
+		if err != nil {
+			return nil, err
+		}
+		a.session = session
+	}
+	return encoder.Marshal(auth)
+}
+
+// 获取host服务票据，AP-REQ不经GSS-API封装直接放在SPNEGO中
+func (a *rpcAuth) kerberosToken(ctx context.Context) ([]byte, error) {
+	cred, err := a.opt.ServiceTicketContext(ctx, "host/"+strings.ToLower(a.opt.Host))
+	if err != nil {
+		return nil, err
+	}
+	var flags uint32
+	if a.level >= RPC_C_AUTHN_LEVEL_PKT_INTEGRITY {
+		flags |= krb5.GSS_C_INTEG_FLAG | krb5.GSS_C_REPLAY_FLAG | krb5.GSS_C_SEQUENCE_FLAG
+	}
+	if a.level == RPC_C_AUTHN_LEVEL_PKT_PRIVACY {
+		flags |= krb5.GSS_C_CONF_FLAG
+	}
+	d, apReq, err := krb5.NewDCEContext(cred, flags)
+	if err != nil {
+		return nil, err
+	}
+	init, err := gss.NewNegTokenInitKerberos(apReq)
+	if err != nil {
+		return nil, err
+	}
+	token, err := init.MarshalBinary(nil)
+	if err != nil {
+		return nil, err
+	}
+	a.krb = d
+	return token, nil
+}
+
+// 校验bind_ack中服务端的AP-REP，返回alter_context中携带的客户端AP-REP
+func (a *rpcAuth) kerberosAcceptToken(token []byte) ([]byte, error) {
+	var resp gss.NegTokenResp
+	if err := resp.UnmarshalBinary(token, nil); err != nil {
+		return nil, fmt.Errorf("Invalid SPNEGO response: %w", err)
+	}
+	if resp.NegState == gss.GssStateReject || len(resp.ResponseToken) == 0 {
+		return nil, errors.New("Kerberos authentication rejected by server")
+	}
+	rep, err := a.krb.Accept(resp.ResponseToken)
+	if err != nil {
+		return nil, err
+	}
+	if a.level >= RPC_C_AUTHN_LEVEL_PKT_INTEGRITY {
+		if err = a.krb.CheckProtection(); err != nil {
+			return nil, err
+		}
+	}
+	ret := gss.NegTokenResp{ResponseToken: rep}
+	return ret.MarshalBinary(nil)
+}
+
+// CONNECT级别的Kerberos认证请求不携带校验数据
+func (a *rpcAuth) kerberosConnect() bool {
+	return a.krb != nil && a.level < RPC_C_AUTHN_LEVEL_PKT_INTEGRITY
+}
+
+// 校验数据长度，Kerberos加密时存根已按16字节对齐，Wrap令牌不含EC填充
+func (a *rpcAuth) verifierSize() int {
+	if a.krb == nil {
+		return ntlm.SignatureSize
+	}
+	if a.level == RPC_C_AUTHN_LEVEL_PKT_PRIVACY {
+		return krb5.DCEWrapSize
+	}
+	return krb5.DCEMICSize
+}
+
+// 在pdu之后追加sec_trailer与认证数据，并更新FragLength、AuthLength
+func (a *rpcAuth) appendToken(pdu []byte, pad int, token []byte) []byte {
+	pdu = append(pdu, make([]byte, pad)...)
+	trailer := make([]byte, secTrailerSize)
+	trailer[0] = a.authType
+	trailer[1] = a.level
+	trailer[2] = byte(pad)
+	binary.LittleEndian.PutUint32(trailer[4:], authContextId)
+	pdu = append(pdu, trailer...)
+	pdu = append(pdu, token...)
+	binary.LittleEndian.PutUint16(pdu[8:], uint16(len(pdu)))
+	binary.LittleEndian.PutUint16(pdu[10:], uint16(len(token)))
+	return pdu
+}
+
+// 请求分片中存根数据的最大长度，按填充对齐向下取整
+func (a *rpcAuth) maxStub(maxXmitFrag uint16) int {
+	if a.kerberosConnect() {
+		return int(maxXmitFrag) - msrpcRequestHeaderSize
+	}
+	n := int(maxXmitFrag) - msrpcRequestHeaderSize - secTrailerSize - a.verifierSize()
+	return n &^ (authStubAlign - 1)
+}
+
+// 保护请求分片：填充存根后追加sec_trailer与校验数据
+// PKT_INTEGRITY对整个pdu签名，PKT_PRIVACY另外加密存根与填充，CONNECT只携带空的校验数据
+// Kerberos认证只保护存根与填充，不对头部签名
+func (a *rpcAuth) protect(pdu []byte) ([]byte, error) {
+	if a.kerberosConnect() {
+		return pdu, nil
+	}
+	stubLen := len(pdu) - msrpcRequestHeaderSize
+	pad := (authStubAlign - stubLen%authStubAlign) % authStubAlign
+	if a.krb != nil {
+		return a.protectKerberos(pdu, pad)
+	}
+	verifier := make([]byte, ntlm.SignatureSize)
+	verifier[0] = 1
+	pdu = a.appendToken(pdu, pad, verifier)
+	if a.session == nil {
+		return pdu, nil
+	}
+	data := pdu[msrpcRequestHeaderSize : msrpcRequestHeaderSize+stubLen+pad]
+	var sealed []byte
+	if a.level == RPC_C_AUTHN_LEVEL_PKT_PRIVACY {
+		sealed = a.session.Seal(data)
+	}
+	// 签名覆盖明文的整个pdu，不含校验数据本身
+	copy(pdu[len(pdu)-ntlm.SignatureSize:], a.session.Sign(pdu[:len(pdu)-ntlm.SignatureSize]))
+	if sealed != nil {
+		copy(data, sealed)
+	}
+	return pdu, nil
+}
+
+// PKT_INTEGRITY计算MIC令牌，PKT_PRIVACY原地加密存根与填充，Wrap令牌作为校验数据
+func (a *rpcAuth) protectKerberos(pdu []byte, pad int) ([]byte, error) {
+	data := append(append([]byte(nil), pdu[msrpcRequestHeaderSize:]...), make([]byte, pad)...)
+	var token []byte
+	var err error
+	if a.level == RPC_C_AUTHN_LEVEL_PKT_PRIVACY {
+		if data, token, err = a.krb.Wrap(data); err != nil {
+			return nil, err
+		}
+	} else if token, err = a.krb.GetMIC(data); err != nil {
+		return nil, err
+	}
+	pdu = a.appendToken(pdu, pad, token)
+	copy(pdu[msrpcRequestHeaderSize:], data)
+	return pdu, nil
+}
+
+// 响应分片中的存根数据，去除填充与认证数据，按认证级别解密并校验签名
+func (r *RPCConn) responseStub(buf []byte) ([]byte, error) {
+	authLength := int(binary.LittleEndian.Uint16(buf[10:]))
+	protected := r.auth != nil && (r.auth.session != nil || r.auth.krb != nil && !r.auth.kerberosConnect())
+	if authLength == 0 {
+		if protected {
+			return nil, errors.New("Missing rpc response verifier")
+		}
+		return buf[msrpcRequestHeaderSize:], nil
+	}
+	trailer := len(buf) - authLength - secTrailerSize
+	if trailer < msrpcRequestHeaderSize {
+		return nil, errors.New("Invalid rpc response")
+	}
+	end := trailer - int(buf[trailer+2])
+	if end < msrpcRequestHeaderSize {
+		return nil, errors.New("Invalid rpc response")
+	}
+	if !protected {
+		return buf[msrpcRequestHeaderSize:end], nil
+	}
+	if r.auth.krb != nil {
+		return r.auth.kerberosStub(buf, trailer, end-msrpcRequestHeaderSize)
+	}
+	if authLength != ntlm.SignatureSize {
+		return nil, errors.New("Invalid rpc response verifier")
+	}
+	msg := append([]byte(nil), buf[:len(buf)-authLength]...)
+	if r.auth.level == RPC_C_AUTHN_LEVEL_PKT_PRIVACY {
+		copy(msg[msrpcRequestHeaderSize:trailer], r.auth.session.Unseal(msg[msrpcRequestHeaderSize:trailer]))
+	}
+	if err := r.auth.session.Verify(msg, buf[len(buf)-authLength:]); err != nil {
+		return nil, err
+	}
+	return msg[msrpcRequestHeaderSize:end], nil
+}
+
+// 校验或解密Kerberos保护的存根与填充，n为去除填充后的存根长度
+func (a *rpcAuth) kerberosStub(buf []byte, trailer, n int) ([]byte, error) {
+	data := buf[msrpcRequestHeaderSize:trailer]
+	token := buf[trailer+secTrailerSize:]
+	if a.level == RPC_C_AUTHN_LEVEL_PKT_PRIVACY {
+		plain, err := a.krb.Unwrap(data, token)
+		if err != nil {
+			return nil, err
+		}
+		if len(plain) < n {
+			return nil, errors.New("Invalid rpc response")
+		}
+		return plain[:n], nil
+	}
+	if err := a.krb.VerifyMIC(data, token); err != nil {
+		return nil, err
+	}
+	return data[:n], nil
+}
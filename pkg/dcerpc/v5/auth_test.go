@@ -0,0 +1,306 @@
+package v5
+
+import (
+	"bytes"
+	"context"
+	"encoding/asn1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/4ra1n/go-impacket/pkg/common"
+	"github.com/4ra1n/go-impacket/pkg/krb5"
+	"github.com/4ra1n/go-impacket/pkg/krb5/gss"
+	"github.com/4ra1n/go-impacket/pkg/ms"
+	"github.com/4ra1n/go-impacket/pkg/util"
+)
+
+// 本地服务端按DCE风格完成Kerberos的bind、alter_context交换，并处理一次加密调用
+// 服务端的令牌按RFC-4121在测试中独立构造，不复用客户端的实现
+
+const (
+	testServerSeq  = 0x5555
+	testAssocGroup = 0x1234
+)
+
+// 同步传输，写入的pdu交给handle处理，其返回的pdu依次读出
+type testTransport struct {
+	handle func(pdu []byte) ([]byte, error)
+	queue  [][]byte
+}
+
+func (t *testTransport) WritePDUContext(ctx context.Context, pdu []byte) error {
+	res, err := t.handle(pdu)
+	if err != nil {
+		return err
+	}
+	if res != nil {
+		t.queue = append(t.queue, res)
+	}
+	return nil
+}
+
+func (t *testTransport) ReadPDUContext(ctx context.Context) ([]byte, error) {
+	if len(t.queue) == 0 {
+		return nil, io.EOF
+	}
+	pdu := t.queue[0]
+	t.queue = t.queue[1:]
+	return pdu, nil
+}
+
+func (t *testTransport) Close() error {
+	return nil
+}
+
+type testAPReq struct {
+	PVNO          int32              `asn1:"explicit,tag:0"`
+	MsgType       int32              `asn1:"explicit,tag:1"`
+	Options       asn1.BitString     `asn1:"explicit,tag:2"`
+	Ticket        asn1.RawValue      `asn1:"explicit,tag:3"`
+	Authenticator krb5.EncryptedData `asn1:"explicit,tag:4"`
+}
+
+type testAuthenticator struct {
+	AVNO      int32              `asn1:"explicit,tag:0"`
+	CRealm    string             `asn1:"explicit,tag:1"`
+	CName     krb5.PrincipalName `asn1:"explicit,tag:2"`
+	Cksum     krb5.Checksum      `asn1:"optional,explicit,tag:3"`
+	CUSec     int32              `asn1:"explicit,tag:4"`
+	CTime     time.Time          `asn1:"generalized,explicit,tag:5"`
+	SubKey    krb5.EncryptionKey `asn1:"optional,explicit,tag:6"`
+	SeqNumber int64              `asn1:"optional,explicit,tag:7"`
+}
+
+func marshalApplication(tag int, v interface{}) ([]byte, error) {
+	inner, err := asn1.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return asn1.Marshal(asn1.RawValue{Class: asn1.ClassApplication, Tag: tag, IsCompound: true, Bytes: inner})
+}
+
+// 服务端状态，sessionKey为票据会话密钥，subKey为AP-REP中返回的子密钥
+type testKerberosServer struct {
+	sessionKey krb5.EncryptionKey
+	subKey     krb5.EncryptionKey
+	clientSeq  uint64
+	serverSeq  uint64
+	stub       []byte // 请求中收到的存根
+	reply      []byte // 响应存根
+}
+
+func (s *testKerberosServer) handle(pdu []byte) ([]byte, error) {
+	authLength := int(binary.LittleEndian.Uint16(pdu[10:]))
+	if authLength == 0 {
+		return nil, errors.New("missing auth verifier")
+	}
+	trailer := len(pdu) - authLength - secTrailerSize
+	if pdu[trailer] != RPC_C_AUTHN_GSS_NEGOTIATE || pdu[trailer+1] != RPC_C_AUTHN_LEVEL_PKT_PRIVACY {
+		return nil, fmt.Errorf("unexpected sec_trailer %x", pdu[trailer:trailer+secTrailerSize])
+	}
+	token := pdu[len(pdu)-authLength:]
+	switch pdu[2] {
+	case PDUBind:
+		if pdu[3]&SupportHeaderSign != 0 {
+			return nil, errors.New("header signing requested for Kerberos")
+		}
+		return s.bindAck(pdu, token)
+	case PDUAlter_Context:
+		var resp gss.NegTokenResp
+		if err := resp.UnmarshalBinary(token, nil); err != nil {
+			return nil, err
+		}
+		part, err := krb5.ParseAPRep(resp.ResponseToken, s.sessionKey)
+		if err != nil {
+			return nil, err
+		}
+		if part.SeqNumber != testServerSeq || len(part.SubKey.KeyValue) != 0 {
+			return nil, fmt.Errorf("unexpected client AP-REP %+v", part)
+		}
+		return testBindAckPDU(PDUAlter_Context_Resp, pdu, nil), nil
+	case PDURequest:
+		return s.response(pdu, trailer, token)
+	}
+	return nil, fmt.Errorf("unexpected packet type %d", pdu[2])
+}
+
+// 解密认证器取得时间与初始序号，返回带子密钥的AP-REP
+func (s *testKerberosServer) bindAck(pdu, token []byte) ([]byte, error) {
+	var init gss.NegTokenInit
+	if err := init.UnmarshalBinary(token, nil); err != nil {
+		return nil, err
+	}
+	var ap testAPReq
+	if _, err := asn1.UnmarshalWithParams(init.Data.MechToken, &ap, fmt.Sprintf("application,explicit,tag:%d", krb5.KRB_AP_REQ)); err != nil {
+		return nil, fmt.Errorf("mech token is not a raw AP-REQ: %w", err)
+	}
+	plain, err := krb5.DecryptData(s.sessionKey, krb5.KeyUsageAPReqAuthenticator, ap.Authenticator)
+	if err != nil {
+		return nil, err
+	}
+	var auth testAuthenticator
+	if _, err = asn1.UnmarshalWithParams(plain, &auth, "application,explicit,tag:2"); err != nil {
+		return nil, err
+	}
+	flags := binary.LittleEndian.Uint32(auth.Cksum.Checksum[20:])
+	want := uint32(krb5.GSS_C_DCE_STYLE | krb5.GSS_C_MUTUAL_FLAG | krb5.GSS_C_CONF_FLAG | krb5.GSS_C_INTEG_FLAG)
+	if flags&want != want {
+		return nil, fmt.Errorf("unexpected GSS flags 0x%x", flags)
+	}
+	s.clientSeq = uint64(auth.SeqNumber)
+	s.serverSeq = testServerSeq
+	part, err := marshalApplication(27, krb5.EncAPRepPart{CTime: auth.CTime, CUSec: auth.CUSec, SubKey: s.subKey, SeqNumber: testServerSeq})
+	if err != nil {
+		return nil, err
+	}
+	enc, err := krb5.EncryptData(s.sessionKey, krb5.KeyUsageAPRepEncPart, part)
+	if err != nil {
+		return nil, err
+	}
+	apRep, err := marshalApplication(krb5.KRB_AP_REP, krb5.APRep{PVNO: krb5.PVNO, MsgType: krb5.KRB_AP_REP, EncPart: enc})
+	if err != nil {
+		return nil, err
+	}
+	resp := gss.NegTokenResp{NegState: gss.GssStateAcceptIncomplete, ResponseToken: apRep}
+	tok, err := resp.MarshalBinary(nil)
+	if err != nil {
+		return nil, err
+	}
+	return testBindAckPDU(PDUBind_Ack, pdu, tok), nil
+}
+
+// 解密请求存根，返回加密的响应
+func (s *testKerberosServer) response(pdu []byte, trailer int, token []byte) ([]byte, error) {
+	data := pdu[msrpcRequestHeaderSize:trailer]
+	if len(token) != 60 || binary.BigEndian.Uint16(token) != 0x0504 || token[2] != 0x06 ||
+		binary.BigEndian.Uint16(token[6:]) != 28 || binary.BigEndian.Uint64(token[8:]) != s.clientSeq {
+		return nil, fmt.Errorf("unexpected wrap token header %x", token[:16])
+	}
+	rotated := append(append([]byte{}, token[16:]...), data...)
+	cipher := append(append([]byte{}, rotated[28:]...), rotated[:28]...)
+	plain, err := krb5.Decrypt(s.subKey, krb5.KeyUsageInitiatorSeal, cipher)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(plain[len(plain)-16:len(plain)-10], token[:6]) {
+		return nil, errors.New("encrypted header mismatch")
+	}
+	s.stub = plain[:len(data)-int(pdu[trailer+2])]
+
+	pad := (16 - len(s.reply)%16) % 16
+	stub := append(append([]byte{}, s.reply...), make([]byte, pad)...)
+	header := []byte{0x05, 0x04, 0x07, 0xff, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}
+	binary.BigEndian.PutUint64(header[8:], s.serverSeq)
+	if cipher, err = krb5.Encrypt(s.subKey, krb5.KeyUsageAcceptorSeal, append(append([]byte{}, stub...), header...)); err != nil {
+		return nil, err
+	}
+	binary.BigEndian.PutUint16(header[6:], 28)
+	rotated = append(append([]byte{}, cipher[len(cipher)-28:]...), cipher[:len(cipher)-28]...)
+	n := len(cipher) - len(stub)
+
+	res := make([]byte, msrpcRequestHeaderSize, msrpcRequestHeaderSize+len(stub)+secTrailerSize+16+n)
+	copy(res, pdu[:16])
+	res[2] = PDUResponse
+	binary.LittleEndian.PutUint32(res[16:], uint32(len(s.reply)))
+	res = append(res, rotated[n:]...)
+	res = append(res, RPC_C_AUTHN_GSS_NEGOTIATE, RPC_C_AUTHN_LEVEL_PKT_PRIVACY, byte(pad), 0, authContextId, 0, 0, 0)
+	res = append(res, header...)
+	res = append(res, rotated[:n]...)
+	binary.LittleEndian.PutUint16(res[8:], uint16(len(res)))
+	binary.LittleEndian.PutUint16(res[10:], uint16(16+n))
+	return res, nil
+}
+
+// bind_ack或alter_context_resp，接受唯一的上下文
+func testBindAckPDU(ptype uint8, req, token []byte) []byte {
+	res := make([]byte, 56)
+	copy(res, req[:16])
+	res[2] = ptype
+	binary.LittleEndian.PutUint16(res[16:], defaultMaxFragSize)
+	binary.LittleEndian.PutUint16(res[18:], defaultMaxFragSize)
+	binary.LittleEndian.PutUint32(res[20:], testAssocGroup)
+	res[28] = 1
+	copy(res[36:], util.PDUUuidFromBytes(ms.NDR_UUID))
+	binary.LittleEndian.PutUint32(res[52:], ms.NDR_VERSION)
+	if token != nil {
+		res = append(res, RPC_C_AUTHN_GSS_NEGOTIATE, RPC_C_AUTHN_LEVEL_PKT_PRIVACY, 0, 0, authContextId, 0, 0, 0)
+		res = append(res, token...)
+	}
+	binary.LittleEndian.PutUint16(res[8:], uint16(len(res)))
+	binary.LittleEndian.PutUint16(res[10:], uint16(len(token)))
+	return res
+}
+
+func TestRPCKerberosBind(t *testing.T) {
+	sessionKey, err := krb5.RandomKey(krb5.ETYPE_AES256_CTS_HMAC_SHA1_96)
+	if err != nil {
+		t.Fatal(err)
+	}
+	subKey, err := krb5.RandomKey(krb5.ETYPE_AES128_CTS_HMAC_SHA1_96)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 服务票据放在凭据缓存中，不需要KDC
+	client := krb5.NewPrincipalName(krb5.KRB_NT_PRINCIPAL, "alice")
+	cc := krb5.NewCCache(client, "EXAMPLE.COM")
+	ticket, err := marshalApplication(1, krb5.Ticket{TktVNO: krb5.PVNO, Realm: "EXAMPLE.COM", SName: krb5.NewPrincipalName(krb5.KRB_NT_SRV_INST, "host/fs01.example.com")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cc.AddCredential(&krb5.Credential{
+		Client:     client,
+		CRealm:     "EXAMPLE.COM",
+		Server:     krb5.NewPrincipalName(krb5.KRB_NT_SRV_INST, "host/fs01.example.com"),
+		SRealm:     "EXAMPLE.COM",
+		Ticket:     ticket,
+		SessionKey: sessionKey,
+		AuthTime:   time.Now(),
+		EndTime:    time.Now().Add(time.Hour),
+	})
+	path := filepath.Join(t.TempDir(), "ccache")
+	if err = cc.Save(path); err != nil {
+		t.Fatal(err)
+	}
+
+	s := &testKerberosServer{sessionKey: sessionKey, subKey: subKey, reply: []byte("pong")}
+	opt := common.ClientOptions{Kerberos: true, CCache: path, Host: "FS01.example.com"}
+	r := NewRPCConn(&testTransport{handle: s.handle}).WithAuth(RPC_C_AUTHN_LEVEL_PKT_PRIVACY, opt)
+	_, err = r.Bind([]CtxItemStruct{{
+		NumTransItems:  1,
+		AbstractSyntax: SyntaxIDStruct{UUID: util.PDUUuidFromBytes(ms.SRVSVC_UUID), Version: ms.SRVSVC_VERSION},
+		TransferSyntax: SyntaxIDStruct{UUID: util.PDUUuidFromBytes(ms.NDR_UUID), Version: ms.NDR_VERSION},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.AssocGroup() != testAssocGroup {
+		t.Fatalf("AssocGroup() = 0x%x", r.AssocGroup())
+	}
+	out, err := r.Call(1, []byte("ping"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(s.stub) != "ping" || string(out) != "pong" {
+		t.Fatalf("request stub %q, response stub %q", s.stub, out)
+	}
+}
+
+// ntlm绑定仍携带negotiate消息
+func TestRPCAuthNegotiateNTLM(t *testing.T) {
+	a := newRPCAuth(RPC_C_AUTHN_LEVEL_PKT_INTEGRITY, common.ClientOptions{User: "u", Password: "p"})
+	if a.authType != RPC_C_AUTHN_WINNT {
+		t.Fatalf("authType = %d", a.authType)
+	}
+	token, err := a.negotiateToken(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(token, []byte("NTLMSSP\x00")) {
+		t.Fatalf("unexpected negotiate token %x", token)
+	}
+}
@@ -0,0 +1,275 @@
+package v5
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/4ra1n/go-impacket/pkg/common"
+	"github.com/4ra1n/go-impacket/pkg/ms"
+	"github.com/4ra1n/go-impacket/pkg/smb/smb2"
+)
+
+// 此文件提供字符串绑定的解析，以及按字符串绑定建立rpc连接
+// https://learn.microsoft.com/en-us/windows/win32/rpc/string-binding
+
+// 协议序列
+const (
+	ProtSeqNamedPipe = "ncacn_np"
+	ProtSeqTCP       = "ncacn_ip_tcp"
+	ProtSeqHTTP      = "ncacn_http"
+	ProtSeqUDP       = "ncadg_ip_udp"
+	ProtSeqLRPC      = "ncalrpc"
+)
+
+// 各传输的默认端口
+const (
+	defaultSMBPort  = 445
+	defaultHTTPPort = 593
+	defaultEPMPort  = 135
+)
+
+// ncacn_http直连时服务端首先发送的标识
+const httpBanner = "ncacn_http/1.0"
+
+// 字符串绑定，格式为[ObjectUUID@]ProtocolSequence:NetworkAddress[Endpoint,Option=Value,...]
+// 如ncacn_np:10.0.0.1[\pipe\svcctl]、ncacn_ip_tcp:10.0.0.1[49667]
+type StringBinding struct {
+	ObjectUUID       string
+	ProtocolSequence string
+	NetworkAddress   string
+	Endpoint         string
+	Options          []string
+}
+
+// 解析字符串绑定
+func ParseStringBinding(s string) (StringBinding, error) {
+	var b StringBinding
+	rest := strings.TrimSpace(s)
+	if i := strings.IndexByte(rest, '@'); i >= 0 && i < strings.IndexByte(rest, ':') {
+		b.ObjectUUID = rest[:i]
+		rest = rest[i+1:]
+	}
+	i := strings.IndexByte(rest, ':')
+	if i <= 0 {
+		return StringBinding{}, fmt.Errorf("Invalid string binding %q: missing protocol sequence", s)
+	}
+	b.ProtocolSequence = strings.ToLower(rest[:i])
+	rest = rest[i+1:]
+	if i = strings.IndexByte(rest, '['); i >= 0 {
+		if !strings.HasSuffix(rest, "]") {
+			return StringBinding{}, fmt.Errorf("Invalid string binding %q: unterminated endpoint", s)
+		}
+		for j, field := range strings.Split(rest[i+1:len(rest)-1], ",") {
+			field = strings.TrimSpace(field)
+			switch {
+			case strings.HasPrefix(strings.ToLower(field), "endpoint="):
+				b.Endpoint = field[len("endpoint="):]
+			case j == 0 && !strings.Contains(field, "="):
+				b.Endpoint = field
+			case field != "":
+				b.Options = append(b.Options, field)
+			}
+		}
+		rest = rest[:i]
+	}
+	b.NetworkAddress = rest
+	return b, nil
+}
+
+// 转换为字符串绑定
+func (b StringBinding) String() string {
+	var sb strings.Builder
+	if b.ObjectUUID != "" {
+		sb.WriteString(b.ObjectUUID)
+		sb.WriteByte('@')
+	}
+	sb.WriteString(b.ProtocolSequence)
+	sb.WriteByte(':')
+	sb.WriteString(b.NetworkAddress)
+	if b.Endpoint != "" || len(b.Options) > 0 {
+		sb.WriteByte('[')
+		sb.WriteString(strings.Join(append([]string{b.Endpoint}, b.Options...), ","))
+		sb.WriteByte(']')
+	}
+	return sb.String()
+}
+
+// 按字符串绑定建立rpc连接，opt中的Host、Port由绑定覆盖，认证等其余参数保持不变
+// ncacn_np使用smb会话打开命名管道，端口为445，绑定中的port选项可以指定其他端口，如ncacn_np:10.0.0.1[\pipe\svcctl,port=4445]
+// ncacn_ip_tcp与ncacn_http直接建立tcp连接，端口取自绑定的终端
+// 返回的连接尚未绑定接口，关闭连接时同时关闭底层会话
+func DialBinding(binding string, opt common.ClientOptions, debug bool) (*RPCConn, error) {
+	return DialBindingContext(context.Background(), binding, opt, debug)
+}
+
+func DialBindingContext(ctx context.Context, binding string, opt common.ClientOptions, debug bool) (*RPCConn, error) {
+	b, err := ParseStringBinding(binding)
+	if err != nil {
+		return nil, err
+	}
+	if b.NetworkAddress != "" {
+		opt.Host = b.NetworkAddress
+	}
+	if opt.Host == "" {
+		return nil, fmt.Errorf("Invalid string binding %q: missing network address", binding)
+	}
+	switch b.ProtocolSequence {
+	case ProtSeqNamedPipe:
+		if b.Endpoint == "" {
+			return nil, fmt.Errorf("Invalid string binding %q: missing pipe name", binding)
+		}
+		if opt.Port, err = namedPipePort(b); err != nil {
+			return nil, err
+		}
+		session, err := smb2.NewSessionContext(ctx, opt, debug)
+		if err != nil {
+			return nil, err
+		}
+		c := &SMBClient{Client: *session}
+		pipe, err := c.OpenPipeContext(ctx, b.Endpoint)
+		if err != nil {
+			c.Close()
+			return nil, err
+		}
+		pipe.ownsConn = true
+		return newRPCConn(pipe, opt.Host, 1), nil
+	case ProtSeqTCP, ProtSeqHTTP:
+		port, err := bindingPort(b)
+		if err != nil {
+			return nil, err
+		}
+		opt.Port = port
+		c, err := NewTCPSessionContext(ctx, opt, debug)
+		if err != nil {
+			return nil, err
+		}
+		if b.ProtocolSequence == ProtSeqHTTP {
+			if err = c.readHTTPBanner(ctx); err != nil {
+				c.Close()
+				return nil, err
+			}
+		}
+		return newRPCConn(c, opt.Host, 1), nil
+	default:
+		return nil, fmt.Errorf("Unsupported protocol sequence %q", b.ProtocolSequence)
+	}
+}
+
+// 按字符串绑定建立rpc连接并绑定接口，uuid与version取自ms包中的接口定义
+// ncacn_ip_tcp未指定端口时先通过终端映射查询接口的动态端口
+func DialInterface(binding, uuid string, version uint32, opt common.ClientOptions, debug bool) (*RPCConn, error) {
+	return DialInterfaceContext(context.Background(), binding, uuid, version, opt, debug)
+}
+
+func DialInterfaceContext(ctx context.Context, binding, uuid string, version uint32, opt common.ClientOptions, debug bool) (*RPCConn, error) {
+	b, err := ParseStringBinding(binding)
+	if err != nil {
+		return nil, err
+	}
+	if b.ProtocolSequence == ProtSeqTCP && b.Endpoint == "" {
+		if b, err = ResolveBindingContext(ctx, b, uuid, version, opt, debug); err != nil {
+			return nil, err
+		}
+	}
+	r, err := DialBindingContext(ctx, b.String(), opt, debug)
+	if err != nil {
+		return nil, err
+	}
+	if err = r.BindInterfaceContext(ctx, uuid, version); err != nil {
+		r.Close()
+		return nil, err
+	}
+	return r, nil
+}
+
+// 通过目标135端口的终端映射查询接口的终端，返回补全端点后的绑定，网络地址保持不变
+func ResolveBinding(b StringBinding, uuid string, version uint32, opt common.ClientOptions, debug bool) (StringBinding, error) {
+	return ResolveBindingContext(context.Background(), b, uuid, version, opt, debug)
+}
+
+func ResolveBindingContext(ctx context.Context, b StringBinding, uuid string, version uint32, opt common.ClientOptions, debug bool) (StringBinding, error) {
+	host := b.NetworkAddress
+	if host == "" {
+		host = opt.Host
+	}
+	epm, err := DialBindingContext(ctx, fmt.Sprintf("%s:%s[%d]", ProtSeqTCP, host, defaultEPMPort), opt, debug)
+	if err != nil {
+		return StringBinding{}, err
+	}
+	defer epm.Close()
+	if err = epm.BindInterfaceContext(ctx, ms.EPMv4_UUID, ms.EPMv4_VERSION); err != nil {
+		return StringBinding{}, err
+	}
+	resolved, err := epm.EPMMapContext(ctx, b.ProtocolSequence, uuid, version)
+	if err != nil {
+		return StringBinding{}, err
+	}
+	if resolved.Endpoint == "" || resolved.Endpoint == "0" {
+		return StringBinding{}, fmt.Errorf("Failed to resolve endpoint of %s on %s", uuid, host)
+	}
+	b.NetworkAddress = host
+	b.Endpoint = resolved.Endpoint
+	return b, nil
+}
+
+// tcp类绑定的端口
+func bindingPort(b StringBinding) (int, error) {
+	if b.Endpoint == "" {
+		if b.ProtocolSequence == ProtSeqHTTP {
+			return defaultHTTPPort, nil
+		}
+		return 0, fmt.Errorf("String binding %s has no endpoint, use DialInterface to resolve it", b)
+	}
+	port, err := strconv.Atoi(b.Endpoint)
+	if err != nil || port <= 0 || port > 65535 {
+		return 0, fmt.Errorf("Invalid %s endpoint %q", b.ProtocolSequence, b.Endpoint)
+	}
+	return port, nil
+}
+
+// ncacn_np的smb端口，未通过port选项指定时为445
+func namedPipePort(b StringBinding) (int, error) {
+	for _, option := range b.Options {
+		if !strings.HasPrefix(strings.ToLower(option), "port=") {
+			continue
+		}
+		port, err := strconv.Atoi(option[len("port="):])
+		if err != nil || port <= 0 || port > 65535 {
+			return 0, fmt.Errorf("Invalid %s port %q", b.ProtocolSequence, option[len("port="):])
+		}
+		return port, nil
+	}
+	return defaultSMBPort, nil
+}
+
+// ncacn_http直连方式，读取服务端发送的协议标识后即为普通的面向连接rpc
+func (c *TCPClient) readHTTPBanner(ctx context.Context) error {
+	conn := c.GetConn()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetReadDeadline(deadline)
+		defer conn.SetReadDeadline(time.Time{})
+	}
+	banner := make([]byte, len(httpBanner))
+	if _, err := io.ReadFull(conn, banner); err != nil {
+		c.Debug("", err)
+		return err
+	}
+	if string(banner) != httpBanner {
+		return errors.New("Invalid ncacn_http banner")
+	}
+	return nil
+}
+
+// 去除\pipe\前缀得到管道名
+func pipeName(endpoint string) string {
+	name := strings.TrimLeft(strings.ReplaceAll(endpoint, "/", "\\"), "\\")
+	if len(name) > 5 && strings.EqualFold(name[:5], "pipe\\") {
+		name = name[5:]
+	}
+	return name
+}
@@ -0,0 +1,51 @@
+package v5
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseStringBinding(t *testing.T) {
+	tests := []struct {
+		in   string
+		want StringBinding
+	}{
+		{`ncacn_np:10.0.0.1[\pipe\svcctl]`, StringBinding{ProtocolSequence: ProtSeqNamedPipe, NetworkAddress: "10.0.0.1", Endpoint: `\pipe\svcctl`}},
+		{`ncacn_np:10.0.0.1[\pipe\svcctl,port=4445]`, StringBinding{ProtocolSequence: ProtSeqNamedPipe, NetworkAddress: "10.0.0.1", Endpoint: `\pipe\svcctl`, Options: []string{"port=4445"}}},
+		{`ncacn_ip_tcp:10.0.0.1[endpoint=49667]`, StringBinding{ProtocolSequence: ProtSeqTCP, NetworkAddress: "10.0.0.1", Endpoint: "49667"}},
+		{`6bffd098-a112-3610-9833-46c3f87e345a@NCACN_IP_TCP:host`, StringBinding{ObjectUUID: "6bffd098-a112-3610-9833-46c3f87e345a", ProtocolSequence: ProtSeqTCP, NetworkAddress: "host"}},
+	}
+	for _, tt := range tests {
+		got, err := ParseStringBinding(tt.in)
+		if err != nil {
+			t.Fatalf("ParseStringBinding(%q): %v", tt.in, err)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Fatalf("ParseStringBinding(%q) = %+v, want %+v", tt.in, got, tt.want)
+		}
+	}
+}
+
+// ncacn_np不使用选项中的Port，只认绑定中的port选项
+func TestNamedPipePort(t *testing.T) {
+	tests := []struct {
+		in   string
+		port int
+		ok   bool
+	}{
+		{`ncacn_np:10.0.0.1[\pipe\svcctl]`, defaultSMBPort, true},
+		{`ncacn_np:10.0.0.1[\pipe\svcctl,Port=4445]`, 4445, true},
+		{`ncacn_np:10.0.0.1[\pipe\svcctl,port=x]`, 0, false},
+		{`ncacn_np:10.0.0.1[\pipe\svcctl,port=70000]`, 0, false},
+	}
+	for _, tt := range tests {
+		b, err := ParseStringBinding(tt.in)
+		if err != nil {
+			t.Fatal(err)
+		}
+		port, err := namedPipePort(b)
+		if (err == nil) != tt.ok || port != tt.port {
+			t.Fatalf("namedPipePort(%q) = %d, %v", tt.in, port, err)
+		}
+	}
+}
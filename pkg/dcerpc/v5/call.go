@@ -0,0 +1,598 @@
+package v5
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/4ra1n/go-impacket/pkg/dcerpc"
+	"github.com/4ra1n/go-impacket/pkg/encoder"
+	"github.com/4ra1n/go-impacket/pkg/ms"
+	"github.com/4ra1n/go-impacket/pkg/util"
+)
+
+// 此文件提供与传输无关的DCE/RPC调用层，负责绑定、请求分片以及响应重组
+// https://pubs.opengroup.org/onlinepubs/9629399/chap12.htm
+
+const (
+	msrpcHeaderSize     = 16
+	defaultMaxFragSize  = 4280
+	minMaxXmitFrag      = 1432 // 连接型协议要求的最小分片大小
+	bindAckResultSize   = 24
+	faultStatusOffset   = msrpcRequestHeaderSize
+	bindNakReasonOffset = msrpcHeaderSize
+)
+
+// 上下文协商结果
+// https://pubs.opengroup.org/onlinepubs/9629399/chap12.htm#tagcjh_17_06_03_05
+const (
+	ContextAcceptance      = 0
+	ContextUserRejection   = 1
+	ContextProviderReject  = 2
+	ContextNegotiateAck    = 3
+	ReasonNotSpecified     = 0
+	ReasonAbstractSyntax   = 1
+	ReasonTransferSyntaxes = 2
+	ReasonLocalLimit       = 3
+)
+
+// 绑定时协商的特性，由协商上下文的结果原因字段返回
+const (
+	FeatureSecurityContextMultiplexing = 0x0001
+	FeatureKeepConnectionOnOrphan      = 0x0002
+)
+
+// bind_nak拒绝原因
+var bindRejectReasons = map[uint16]string{
+	0: "reason not specified",
+	1: "temporary congestion",
+	2: "local limit exceeded",
+	3: "called paddr unknown",
+	4: "protocol version not supported",
+	5: "default context not supported",
+	6: "user data not readable",
+	7: "no psap available",
+	8: "authentication type not recognized",
+	9: "invalid checksum",
+}
+
+// 上下文协商结果
+type BindResult struct {
+	Result         uint16
+	Reason         uint16
+	TransferSyntax SyntaxIDStruct
+}
+
+// bind_ack中的协商信息
+type BindAck struct {
+	MaxXmitFrag   uint16
+	MaxRecvFrag   uint16
+	AssocGroup    uint32
+	SecondaryAddr string
+	Results       []BindResult
+}
+
+// 已建立的rpc连接，绑定接口后通过Call调用
+type RPCConn struct {
+	t           Transport
+	host        string // 服务端地址，用于部分接口的ServerName参数
+	mu          sync.Mutex
+	callId      uint32
+	contextId   uint16
+	maxXmitFrag uint16
+	maxRecvFrag uint16
+	assocGroup  uint32
+	ndr64       bool     // 服务端接受了NDR64传输语法
+	features    uint16   // 服务端确认的绑定时特性
+	auth        *rpcAuth // 由WithAuth设置的认证
+}
+
+// 在任意传输上建立rpc连接，调用id从1开始
+func NewRPCConn(t Transport) *RPCConn {
+	return newRPCConn(t, "", 1)
+}
+
+func newRPCConn(t Transport, host string, callId uint32) *RPCConn {
+	return &RPCConn{
+		t:           t,
+		host:        host,
+		callId:      callId,
+		maxXmitFrag: defaultMaxFragSize,
+		maxRecvFrag: defaultMaxFragSize,
+	}
+}
+
+// 底层传输
+func (r *RPCConn) Transport() Transport {
+	return r.t
+}
+
+// 关闭底层传输
+func (r *RPCConn) Close() error {
+	return r.t.Close()
+}
+
+// 协商得到的单个请求分片大小上限
+func (r *RPCConn) MaxXmitFrag() uint16 {
+	return r.maxXmitFrag
+}
+
+// 关联组id，可用于在同一关联中建立新连接
+func (r *RPCConn) AssocGroup() uint32 {
+	return r.assocGroup
+}
+
+// 是否使用NDR64传输语法
+func (r *RPCConn) NDR64() bool {
+	return r.ndr64
+}
+
+// 绑定时协商得到的特性
+func (r *RPCConn) Features() uint16 {
+	return r.features
+}
+
+// 绑定接口，ctxs中第一个被接受的上下文用于后续调用，其传输语法决定存根的编码方式
+func (r *RPCConn) Bind(ctxs []CtxItemStruct) (BindAck, error) {
+	return r.BindContext(context.Background(), ctxs)
+}
+
+func (r *RPCConn) BindContext(ctx context.Context, ctxs []CtxItemStruct) (BindAck, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	callId := r.nextCallId()
+	header := NewMSRPCHeader()
+	header.CallId = callId
+	header.PacketType = PDUBind
+	header.PacketFlags = FirstFrag | LastFrag
+	// Kerberos认证不对头部签名
+	if r.auth != nil && !r.auth.opt.Kerberos {
+		header.PacketFlags |= SupportHeaderSign
+	}
+	bindStruct := MSRPCBindStruct{
+		MSRPCHeaderStruct: header,
+		MaxXmitFrag:       r.maxRecvFrag,
+		MaxRecvFrag:       r.maxRecvFrag,
+		AssocGroup:        r.assocGroup,
+		NumCtxItems:       uint8(len(ctxs)),
+		CtxItems:          ctxs,
+	}
+	bindStruct.FragLength = uint16(util.SizeOfStruct(bindStruct))
+	pdu, err := encoder.Marshal(bindStruct)
+	if err != nil {
+		return BindAck{}, err
+	}
+	if r.auth != nil {
+		// 绑定请求携带ntlm negotiate消息或Kerberos AP-REQ
+		token, err := r.auth.negotiateToken(ctx)
+		if err != nil {
+			return BindAck{}, err
+		}
+		pdu = r.auth.appendToken(pdu, (4-len(pdu)%4)%4, token)
+	}
+	if err = r.t.WritePDUContext(ctx, pdu); err != nil {
+		return BindAck{}, err
+	}
+	buf, err := r.t.ReadPDUContext(ctx)
+	if err != nil {
+		return BindAck{}, err
+	}
+	if len(buf) < msrpcHeaderSize {
+		return BindAck{}, errors.New("Invalid rpc bind response")
+	}
+	switch buf[2] {
+	case PDUBind_Ack:
+	case PDUBind_Nak:
+		if len(buf) < bindNakReasonOffset+2 {
+			return BindAck{}, errors.New("Failed to rpc bind")
+		}
+		reason := binary.LittleEndian.Uint16(buf[bindNakReasonOffset:])
+		return BindAck{}, fmt.Errorf("Failed to rpc bind: %s", bindRejectReasons[reason])
+	case PDUFault:
+		return BindAck{}, faultError(buf)
+	default:
+		return BindAck{}, fmt.Errorf("Unexpected rpc packet type %d", buf[2])
+	}
+	ack, err := parseBindAck(buf)
+	if err != nil {
+		return BindAck{}, err
+	}
+	accepted := -1
+	for i, res := range ack.Results {
+		if res.Result == ContextAcceptance && i < len(ctxs) {
+			accepted = i
+			break
+		}
+	}
+	if accepted < 0 {
+		if len(ack.Results) > 0 && ack.Results[0].Result == ContextProviderReject {
+			if ack.Results[0].Reason == ReasonAbstractSyntax {
+				return ack, errors.New("Failed to rpc bind: abstract syntax not supported")
+			}
+			return ack, errors.New("Failed to rpc bind: transfer syntax not supported")
+		}
+		return ack, errors.New("Failed to rpc bind")
+	}
+	if r.auth != nil {
+		if r.auth.krb != nil {
+			err = r.alterContext(ctx, callId, buf, ack.AssocGroup, ctxs[accepted])
+		} else {
+			err = r.auth3(ctx, callId, buf)
+		}
+		if err != nil {
+			return ack, err
+		}
+	}
+	r.contextId = ctxs[accepted].ContextId
+	r.ndr64 = bytes.Equal(ack.Results[accepted].TransferSyntax.UUID, util.PDUUuidFromBytes(ms.NDR64_UUID))
+	for _, res := range ack.Results {
+		if res.Result == ContextNegotiateAck {
+			r.features = res.Reason
+		}
+	}
+	if ack.MaxXmitFrag >= minMaxXmitFrag && ack.MaxXmitFrag < r.maxXmitFrag {
+		r.maxXmitFrag = ack.MaxXmitFrag
+	}
+	r.assocGroup = ack.AssocGroup
+	return ack, nil
+}
+
+// 从bind_ack中取出ntlm challenge消息，通过auth3发送authenticate消息，服务端不返回响应
+func (r *RPCConn) auth3(ctx context.Context, callId uint32, ack []byte) error {
+	authLength := int(binary.LittleEndian.Uint16(ack[10:]))
+	if authLength == 0 || authLength > len(ack)-msrpcHeaderSize {
+		return errors.New("Failed to rpc bind: missing NTLM challenge")
+	}
+	token, err := r.auth.authenticateToken(ack[len(ack)-authLength:])
+	if err != nil {
+		return err
+	}
+	header := NewMSRPCHeader()
+	header.CallId = callId
+	header.PacketType = PDUAuth3
+	header.PacketFlags = FirstFrag | LastFrag
+	pdu, err := encoder.Marshal(header)
+	if err != nil {
+		return err
+	}
+	// 头部之后为4字节的保留字段，不计入sec_trailer的填充长度
+	pdu = append(pdu, make([]byte, auth3PaddingLen)...)
+	pdu = r.auth.appendToken(pdu, 0, token)
+	return r.t.WritePDUContext(ctx, pdu)
+}
+
+// 从bind_ack中取出服务端AP-REP，通过alter_context发送客户端AP-REP完成Kerberos认证
+func (r *RPCConn) alterContext(ctx context.Context, callId uint32, ack []byte, assocGroup uint32, item CtxItemStruct) error {
+	authLength := int(binary.LittleEndian.Uint16(ack[10:]))
+	if authLength == 0 || authLength > len(ack)-msrpcHeaderSize {
+		return errors.New("Failed to rpc bind: missing Kerberos AP-REP")
+	}
+	token, err := r.auth.kerberosAcceptToken(ack[len(ack)-authLength:])
+	if err != nil {
+		return err
+	}
+	header := NewMSRPCHeader()
+	header.CallId = callId
+	header.PacketType = PDUAlter_Context
+	header.PacketFlags = FirstFrag | LastFrag
+	alter := MSRPCBindStruct{
+		MSRPCHeaderStruct: header,
+		MaxXmitFrag:       r.maxRecvFrag,
+		MaxRecvFrag:       r.maxRecvFrag,
+		AssocGroup:        assocGroup,
+		NumCtxItems:       1,
+		CtxItems:          []CtxItemStruct{item},
+	}
+	alter.FragLength = uint16(util.SizeOfStruct(alter))
+	pdu, err := encoder.Marshal(alter)
+	if err != nil {
+		return err
+	}
+	pdu = r.auth.appendToken(pdu, (4-len(pdu)%4)%4, token)
+	if err = r.t.WritePDUContext(ctx, pdu); err != nil {
+		return err
+	}
+	buf, err := r.t.ReadPDUContext(ctx)
+	if err != nil {
+		return err
+	}
+	if len(buf) < msrpcHeaderSize {
+		return errors.New("Invalid rpc alter_context response")
+	}
+	switch buf[2] {
+	case PDUAlter_Context_Resp:
+	case PDUFault:
+		return faultError(buf)
+	default:
+		return fmt.Errorf("Unexpected rpc packet type %d", buf[2])
+	}
+	resp, err := parseBindAck(buf)
+	if err != nil {
+		return err
+	}
+	if len(resp.Results) == 0 || resp.Results[0].Result != ContextAcceptance {
+		return errors.New("Failed to rpc bind: alter_context rejected")
+	}
+	return nil
+}
+
+// 绑定接口，uuid与version取自ms包中的接口定义，同时提供NDR、NDR64传输语法以及绑定时特性协商
+func (r *RPCConn) BindInterface(uuid string, version uint32) error {
+	return r.BindInterfaceContext(context.Background(), uuid, version)
+}
+
+func (r *RPCConn) BindInterfaceContext(ctx context.Context, uuid string, version uint32) error {
+	_, err := r.BindContext(ctx, negotiateCtxItems([]CtxItemStruct{{
+		NumTransItems: 1,
+		AbstractSyntax: SyntaxIDStruct{
+			UUID:    util.PDUUuidFromBytes(uuid),
+			Version: version,
+		},
+		TransferSyntax: SyntaxIDStruct{
+			UUID:    util.PDUUuidFromBytes(ms.NDR_UUID),
+			Version: ms.NDR_VERSION,
+		}}}, true))
+	return err
+}
+
+// 追加一个绑定时特性协商上下文，ndr64为true时为使用NDR传输语法的上下文追加对应的NDR64上下文
+// 服务端对同一接口只接受其中一种传输语法，协商上下文的结果为ContextNegotiateAck
+// 只有通过ndrCall按协商结果编码存根的调用方才能提供NDR64
+func negotiateCtxItems(ctxs []CtxItemStruct, ndr64 bool) []CtxItemStruct {
+	if len(ctxs) == 0 {
+		return ctxs
+	}
+	ndr := util.PDUUuidFromBytes(ms.NDR_UUID)
+	feature := util.PDUUuidFromBytes(ms.Time_Feature_Negotiation_UUID)
+	var next uint16
+	for _, item := range ctxs {
+		// 已包含协商上下文时按调用方提供的上下文绑定
+		if bytes.HasPrefix(item.TransferSyntax.UUID, feature[:8]) {
+			return ctxs
+		}
+		if item.ContextId >= next {
+			next = item.ContextId + 1
+		}
+	}
+	items := append([]CtxItemStruct(nil), ctxs...)
+	for _, item := range ctxs {
+		if !ndr64 || !bytes.Equal(item.TransferSyntax.UUID, ndr) {
+			continue
+		}
+		item.ContextId = next
+		item.TransferSyntax = SyntaxIDStruct{
+			UUID:    util.PDUUuidFromBytes(ms.NDR64_UUID),
+			Version: ms.NDR64_VERSION,
+		}
+		items = append(items, item)
+		next++
+	}
+	items = append(items, CtxItemStruct{
+		ContextId:      next,
+		NumTransItems:  1,
+		AbstractSyntax: ctxs[0].AbstractSyntax,
+		TransferSyntax: SyntaxIDStruct{
+			UUID:    feature,
+			Version: ms.Time_Feature_Negotiation_VERSION,
+		},
+	})
+	return items
+}
+
+// 按协商得到的传输语法编码输入参数并调用，输出参数解码到out，op用于错误信息
+func (r *RPCConn) ndrCall(ctx context.Context, opnum uint16, in, out interface{}, op string) error {
+	stub, err := r.marshal(in)
+	if err != nil {
+		return err
+	}
+	buf, err := r.CallContext(ctx, opnum, stub)
+	if err != nil {
+		return err
+	}
+	if err = r.unmarshal(buf, out); err != nil {
+		return fmt.Errorf("Invalid %s response: %w", op, err)
+	}
+	return nil
+}
+
+// 带返回值的输出参数
+type ndrResult interface {
+	status() uint32
+}
+
+// 按协商得到的传输语法编码存根
+func (r *RPCConn) marshal(v interface{}) ([]byte, error) {
+	if r.ndr64 {
+		return encoder.MarshalNDR64(v)
+	}
+	return encoder.MarshalNDR(v)
+}
+
+// 按协商得到的传输语法解码存根
+func (r *RPCConn) unmarshal(buf []byte, v interface{}) error {
+	if r.ndr64 {
+		return encoder.UnmarshalNDR64(buf, v)
+	}
+	return encoder.UnmarshalNDR(buf, v)
+}
+
+// 调用接口方法，stub为NDR编码的输入参数，返回输出参数
+// 超过MaxXmitFrag的请求自动分片，多个分片的响应按FirstFrag/LastFrag重组
+// 服务端返回故障PDU时错误中包含dcerpc.StatusError
+func (r *RPCConn) Call(opnum uint16, stub []byte) ([]byte, error) {
+	return r.CallContext(context.Background(), opnum, stub)
+}
+
+func (r *RPCConn) CallContext(ctx context.Context, opnum uint16, stub []byte) ([]byte, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	callId := r.nextCallId()
+	maxStub := int(r.maxXmitFrag) - msrpcRequestHeaderSize
+	if r.auth != nil {
+		maxStub = r.auth.maxStub(r.maxXmitFrag)
+	}
+	offset := 0
+	for {
+		end := offset + maxStub
+		if end > len(stub) {
+			end = len(stub)
+		}
+		header := NewMSRPCHeader()
+		header.CallId = callId
+		header.PacketType = PDURequest
+		if offset == 0 {
+			header.PacketFlags |= FirstFrag
+		}
+		if end == len(stub) {
+			header.PacketFlags |= LastFrag
+		}
+		header.FragLength = uint16(msrpcRequestHeaderSize + end - offset)
+		pdu, err := encoder.Marshal(header)
+		if err != nil {
+			return nil, err
+		}
+		// AllocHint为剩余未发送的存根长度
+		w := ndrWriter{buf: pdu}
+		w.uint32(uint32(len(stub) - offset))
+		w.uint16(r.contextId)
+		w.uint16(opnum)
+		w.bytes(stub[offset:end])
+		pdu = w.buf
+		if r.auth != nil {
+			if pdu, err = r.auth.protect(pdu); err != nil {
+				return nil, err
+			}
+		}
+		if err = r.t.WritePDUContext(ctx, pdu); err != nil {
+			return nil, err
+		}
+		offset = end
+		if offset == len(stub) {
+			break
+		}
+	}
+	var out []byte
+	for {
+		buf, err := r.t.ReadPDUContext(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if len(buf) < msrpcRequestHeaderSize {
+			return nil, errors.New("Invalid rpc response")
+		}
+		if id := binary.LittleEndian.Uint32(buf[12:]); id != callId {
+			return nil, fmt.Errorf("Unexpected rpc call id %d", id)
+		}
+		switch buf[2] {
+		case PDUResponse:
+		case PDUFault:
+			return nil, fmt.Errorf("Failed to rpc request opnum %d : %w", opnum, faultError(buf))
+		default:
+			return nil, fmt.Errorf("Unexpected rpc packet type %d", buf[2])
+		}
+		data, err := r.responseStub(buf)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, data...)
+		if buf[3]&LastFrag != 0 {
+			return out, nil
+		}
+	}
+}
+
+// 指定下一个请求使用的调用id
+func (r *RPCConn) setCallId(callId uint32) {
+	r.mu.Lock()
+	r.callId = callId
+	r.mu.Unlock()
+}
+
+// 调用方需持有mu
+func (r *RPCConn) nextCallId() uint32 {
+	callId := r.callId
+	r.callId++
+	return callId
+}
+
+// 解析bind_ack，次级地址之后按4字节对齐
+func parseBindAck(buf []byte) (BindAck, error) {
+	if len(buf) < 26 {
+		return BindAck{}, errors.New("Invalid rpc bind response")
+	}
+	ack := BindAck{
+		MaxXmitFrag: binary.LittleEndian.Uint16(buf[16:]),
+		MaxRecvFrag: binary.LittleEndian.Uint16(buf[18:]),
+		AssocGroup:  binary.LittleEndian.Uint32(buf[20:]),
+	}
+	addrLen := int(binary.LittleEndian.Uint16(buf[24:]))
+	off := 26 + addrLen
+	if off > len(buf) {
+		return BindAck{}, errors.New("Invalid rpc bind response")
+	}
+	if addrLen > 0 {
+		ack.SecondaryAddr = string(buf[26 : off-1])
+	}
+	off = (off + 3) &^ 3
+	if off+4 > len(buf) {
+		return BindAck{}, errors.New("Invalid rpc bind response")
+	}
+	n := int(buf[off])
+	off += 4
+	if off+n*bindAckResultSize > len(buf) {
+		return BindAck{}, errors.New("Invalid rpc bind response")
+	}
+	for i := 0; i < n; i++ {
+		res := buf[off : off+bindAckResultSize]
+		ack.Results = append(ack.Results, BindResult{
+			Result: binary.LittleEndian.Uint16(res[0:]),
+			Reason: binary.LittleEndian.Uint16(res[2:]),
+			TransferSyntax: SyntaxIDStruct{
+				UUID:    append([]byte(nil), res[4:20]...),
+				Version: binary.LittleEndian.Uint32(res[20:]),
+			},
+		})
+		off += bindAckResultSize
+	}
+	return ack, nil
+}
+
+// 故障PDU转换为错误
+func faultError(buf []byte) error {
+	if len(buf) < faultStatusOffset+4 {
+		return errors.New("Invalid rpc fault response")
+	}
+	return dcerpc.StatusError(binary.LittleEndian.Uint32(buf[faultStatusOffset:]))
+}
+
+// smb->在已打开的命名管道上建立rpc连接，callId为第一个请求使用的调用id
+// 管道已通过MSRPCBind绑定时返回绑定得到的连接，沿用协商的上下文与传输语法
+func (c *SMBClient) NewPipeConn(treeId uint32, fileId []byte, callId uint32) *RPCConn {
+	if v, ok := c.pipes.Load(string(fileId)); ok {
+		r := v.(*RPCConn)
+		r.setCallId(callId)
+		return r
+	}
+	return newRPCConn(&SMBPipe{c: c, treeId: treeId, fileId: fileId}, c.host(), callId)
+}
+
+// tcp->在当前连接上建立rpc连接，callId为第一个请求使用的调用id
+// 已通过MSRPCBind绑定时返回绑定得到的连接
+func (c *TCPClient) NewConn(callId uint32) *RPCConn {
+	if c.conn != nil {
+		c.conn.setCallId(callId)
+		return c.conn
+	}
+	return newRPCConn(c, c.host(), callId)
+}
+
+// 请求中的ServerName参数，未知时使用空指针
+func (r *RPCConn) serverName() string {
+	if r.host == "" {
+		return ""
+	}
+	return "\\\\" + r.host
+}
@@ -1,8 +1,9 @@
 package v5
 
 import (
-	"encoding/hex"
-	"github.com/4ra1n/go-impacket/pkg/encoder"
+	"context"
+
+	"github.com/4ra1n/go-impacket/pkg/dcerpc"
 	"github.com/4ra1n/go-impacket/pkg/ms"
 	"github.com/4ra1n/go-impacket/pkg/util"
 )
@@ -12,6 +13,10 @@ import (
 
 // 绑定epmapper接口
 func (c *TCPClient) RpcBindEpmapper(callId uint32) (err error) {
+	return c.RpcBindEpmapperContext(context.Background(), callId)
+}
+
+func (c *TCPClient) RpcBindEpmapperContext(ctx context.Context, callId uint32) (err error) {
 	ctxs := []CtxItemStruct{{
 		NumTransItems: 1,
 		AbstractSyntax: SyntaxIDStruct{
@@ -22,7 +27,7 @@ func (c *TCPClient) RpcBindEpmapper(callId uint32) (err error) {
 			UUID:    util.PDUUuidFromBytes(ms.NDR_UUID),
 			Version: ms.NDR_VERSION,
 		}}}
-	_, err = c.MSRPCBind(callId, ctxs)
+	err = c.ndrBindContext(ctx, callId, ctxs)
 	if err != nil {
 		c.Debug("", err)
 		return err
@@ -40,12 +45,19 @@ type EPMLookupRequestStruct struct {
 }
 
 type endpointMapperLookup struct {
-	InquiryType          uint32
-	NullPointerObject    uint32
-	NullPointerInterface uint32
-	VersionOption        uint32
-	EntryHandle          []byte `smb:"fixed:20"`
-	MaxEntries           uint32
+	InquiryType   uint32
+	Object        *[16]byte
+	Interface     *RPCIfID
+	VersionOption uint32
+	EntryHandle   ContextHandle
+	MaxEntries    uint32
+}
+
+// 接口标识
+type RPCIfID struct {
+	UUID         [16]byte
+	VersionMajor uint16
+	VersionMinor uint16
 }
 
 func NewEPMLookupRequest() EPMLookupRequestStruct {
@@ -57,67 +69,143 @@ func NewEPMLookupRequest() EPMLookupRequestStruct {
 		MSRPCHeaderStruct: header,
 		Opnum:             2,
 		EndpointMapperLookup: endpointMapperLookup{
-			InquiryType:          0,
-			NullPointerObject:    0,
-			NullPointerInterface: 0,
-			VersionOption:        1,
-			EntryHandle:          make([]byte, 20),
-			MaxEntries:           500,
+			InquiryType:   0,
+			VersionOption: 1,
+			MaxEntries:    500,
 		},
 	}
 }
 
-type EPMLookupResponseStruct struct {
-	MSRPCHeaderStruct
-	AllocHint   uint32
-	ContextId   uint16
-	CancelCount uint8
-	Reserved    uint8
-	// epm结构
-	EntryHandle        []byte `smb:"fixed:20"`
-	NumEntries         uint32
-	EntriesMaxCount    uint32
-	EntriesOffset      uint32
-	EntriesActualCount uint32
-	// 块结构
-	Entry     []EntryStruct `smb:"value:EntriesActualCount"`
-	Reserved2 []byte        `smb:"fixed:3"`
-	// 块的具体数据
-	EntryTowerPointer []EntryTowerPointerStruct `smb:"value:EntriesActualCount"`
-	ReturnCode        uint32
-}
-
-type EntryStruct struct {
-	Object           []byte `smb:"fixed:16"`
-	ReferentID       []byte `smb:"fixed:4"`
-	AnnotationOffset uint32
-	AnnotationLength uint32
-	Annotation       []byte `smb:"dynamic:AnnotationLength:4"` // 根据AnnotationLength动态设置长度，最小长度4字节，并且如果长度不能整除4就填充00直到能整除
-}
-
-type EntryTowerPointerStruct struct {
-	Length         uint32 // 数据总长度
-	Length1        uint32
-	NumberOfFloors uint16 // 数量
-	Buffer         []byte `smb:"value:Length"` // 可变的
-}
-
-func NewEPMLookupResponse() EPMLookupResponseStruct {
-	return EPMLookupResponseStruct{}
-}
-
-func (c *TCPClient) EPMLookupRequest(callId uint32) (res EPMLookupResponseStruct, err error) {
+// ept_lookup的输出参数
+type eptLookupResult struct {
+	EntryHandle ContextHandle
+	NumEntries  uint32
+	Entries     []EPMEntry `ndr:"conformant,varying"`
+	ReturnCode  uint32
+}
+
+// 终端映射表项，对应ept_entry_t
+type EPMEntry struct {
+	Object     [16]byte
+	Tower      *EPMTower `ndr:"ptr"`
+	Annotation string    `ndr:"varying,ansi"`
+}
+
+// 协议塔，对应twr_t，Octets为各层floor的编码
+type EPMTower struct {
+	Length uint32
+	Octets []byte `ndr:"size_is:Length"`
+}
+
+func (c *TCPClient) EPMLookupRequest(callId uint32) ([]EPMEntry, error) {
+	return c.EPMLookupRequestContext(context.Background(), callId)
+}
+
+func (c *TCPClient) EPMLookupRequestContext(ctx context.Context, callId uint32) ([]EPMEntry, error) {
 	c.Debug("Sending EPM Lookup request", nil)
+	entries, err := c.NewConn(callId).EPMLookupContext(ctx)
+	if err != nil {
+		c.Debug("", err)
+		return nil, err
+	}
+	return entries, nil
+}
+
+// 查询终端映射，连接需先绑定ms.EPMv4_UUID接口
+// 按返回的查找句柄分页查询，直到服务端返回EPT_S_NOT_REGISTERED，返回完整的终端映射
+func (r *RPCConn) EPMLookup() ([]EPMEntry, error) {
+	return r.EPMLookupContext(context.Background())
+}
+
+func (r *RPCConn) EPMLookupContext(ctx context.Context) ([]EPMEntry, error) {
 	req := NewEPMLookupRequest()
-	fragLength := util.SizeOfStruct(req.EndpointMapperLookup)
-	req.FragLength += uint16(fragLength)
-	req.CallId = callId
-	buf, err := c.TCPSend(req)
-	// 解析响应内容
-	res = NewEPMLookupResponse()
-	c.Debug("Unmarshalling EPMLookup response", nil)
-	if err = encoder.Unmarshal(buf, &res); err != nil {
-		c.Debug("Raw:\n"+hex.Dump(buf), err)
+	var entries []EPMEntry
+	for {
+		var res eptLookupResult
+		if err := r.ndrCall(ctx, req.Opnum, req.EndpointMapperLookup, &res, "ept_lookup"); err != nil {
+			return nil, err
+		}
+		switch res.ReturnCode {
+		case dcerpc.RPC_S_OK:
+		case dcerpc.EPT_S_NOT_REGISTERED, dcerpc.DCE_EPT_S_NOT_REGISTERED:
+			return entries, nil
+		default:
+			return nil, rpcStatusError("ept_lookup", res.ReturnCode)
+		}
+		entries = append(entries, res.Entries...)
+		// 查找句柄为空表示已无更多表项
+		if res.EntryHandle.IsZero() {
+			return entries, nil
+		}
+		req.EndpointMapperLookup.EntryHandle = res.EntryHandle
+	}
+}
+
+// ept_map的输入参数
+type eptMapRequest struct {
+	Object      *[16]byte `ndr:"ptr"`
+	MapTower    *EPMTower `ndr:"ptr"`
+	EntryHandle ContextHandle
+	MaxTowers   uint32
+}
+
+// ept_map的输出参数
+type eptMapResult struct {
+	EntryHandle ContextHandle
+	NumTowers   uint32
+	Towers      []*EPMTower `ndr:"conformant,varying"`
+	ReturnCode  uint32
+}
+
+// ept_map的操作号
+const eptMapOpnum = 3
+
+func (c *TCPClient) EPMMapRequest(callId uint32, protseq, uuid string, version uint32) (StringBinding, error) {
+	return c.EPMMapRequestContext(context.Background(), callId, protseq, uuid, version)
+}
+
+func (c *TCPClient) EPMMapRequestContext(ctx context.Context, callId uint32, protseq, uuid string, version uint32) (StringBinding, error) {
+	c.Debug("Sending EPM Map request", nil)
+	b, err := c.NewConn(callId).EPMMapContext(ctx, protseq, uuid, version)
+	if err != nil {
+		c.Debug("", err)
+		return StringBinding{}, err
+	}
+	return b, nil
+}
+
+// 查询接口在协议序列上的终端，uuid与version取自ms包中的接口定义，连接需先绑定ms.EPMv4_UUID接口
+// 返回服务端协议塔中的绑定，其中的网络地址可能为服务端自身的地址
+func (r *RPCConn) EPMMap(protseq, uuid string, version uint32) (StringBinding, error) {
+	return r.EPMMapContext(context.Background(), protseq, uuid, version)
+}
+
+func (r *RPCConn) EPMMapContext(ctx context.Context, protseq, uuid string, version uint32) (StringBinding, error) {
+	tower, err := NewEPMMapTower(protseq, uuid, version)
+	if err != nil {
+		return StringBinding{}, err
+	}
+	req := eptMapRequest{
+		Object:    new([16]byte),
+		MapTower:  tower,
+		MaxTowers: 1,
+	}
+	var res eptMapResult
+	if err = r.ndrCall(ctx, eptMapOpnum, req, &res, "ept_map"); err != nil {
+		return StringBinding{}, err
+	}
+	if res.ReturnCode != dcerpc.RPC_S_OK {
+		return StringBinding{}, rpcStatusError("ept_map", res.ReturnCode)
+	}
+	for _, t := range res.Towers {
+		if t == nil {
+			continue
+		}
+		b, err := t.Decode()
+		if err != nil {
+			return StringBinding{}, err
+		}
+		return b.StringBinding, nil
 	}
-	return res, nil
+	return StringBinding{}, rpcStatusError("ept_map", dcerpc.EPT_S_NOT_REGISTERED)
 }
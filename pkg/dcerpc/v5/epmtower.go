@@ -0,0 +1,238 @@
+package v5
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/4ra1n/go-impacket/pkg/ms"
+	"github.com/4ra1n/go-impacket/pkg/util"
+)
+
+// 此文件提供协议塔的编解码，将终端映射中的twr_t转换为接口、传输语法以及字符串绑定
+// https://pubs.opengroup.org/onlinepubs/9629399/apdxl.htm
+
+// 协议塔floor中的协议标识
+// https://pubs.opengroup.org/onlinepubs/9629399/apdxi.htm
+const (
+	TowerProtocolDNetNSP   = 0x04
+	TowerProtocolTCP       = 0x07
+	TowerProtocolUDP       = 0x08
+	TowerProtocolIP        = 0x09
+	TowerProtocolRPCCL     = 0x0a // 无连接rpc，ncadg
+	TowerProtocolRPCCO     = 0x0b // 面向连接rpc，ncacn
+	TowerProtocolLRPC      = 0x0c // 本地rpc，ncalrpc
+	TowerProtocolUUID      = 0x0d
+	TowerProtocolNamedPipe = 0x0f // 命名管道名称
+	TowerProtocolLRPCName  = 0x10 // 本地rpc端口名称
+	TowerProtocolNetBIOS   = 0x11 // NetBIOS主机名
+	TowerProtocolHTTP      = 0x1f
+)
+
+// 协议塔中的一层
+type TowerFloor struct {
+	Protocol uint8
+	LHS      []byte // 左侧协议标识之后的数据
+	RHS      []byte // 右侧的地址或端点数据
+}
+
+// 协议塔解码结果
+type TowerBinding struct {
+	Interface      RPCIfID
+	TransferSyntax RPCIfID
+	StringBinding  StringBinding
+}
+
+// 解析协议塔的各层，floor依次为接口、传输语法、rpc协议以及地址与端点
+func (t *EPMTower) Floors() ([]TowerFloor, error) {
+	buf := t.Octets
+	if len(buf) < 2 {
+		return nil, errors.New("Invalid protocol tower")
+	}
+	count := int(binary.LittleEndian.Uint16(buf))
+	buf = buf[2:]
+	floors := make([]TowerFloor, 0, count)
+	for i := 0; i < count; i++ {
+		var lhs, rhs []byte
+		var err error
+		if lhs, buf, err = towerOctets(buf); err != nil {
+			return nil, err
+		}
+		if rhs, buf, err = towerOctets(buf); err != nil {
+			return nil, err
+		}
+		if len(lhs) == 0 {
+			return nil, errors.New("Invalid protocol tower floor")
+		}
+		floors = append(floors, TowerFloor{Protocol: lhs[0], LHS: lhs[1:], RHS: rhs})
+	}
+	return floors, nil
+}
+
+// 读取2字节长度前缀的数据
+func towerOctets(buf []byte) ([]byte, []byte, error) {
+	if len(buf) < 2 {
+		return nil, nil, errors.New("Invalid protocol tower floor")
+	}
+	n := int(binary.LittleEndian.Uint16(buf))
+	if len(buf) < 2+n {
+		return nil, nil, errors.New("Invalid protocol tower floor")
+	}
+	return buf[2 : 2+n], buf[2+n:], nil
+}
+
+// 解码协议塔，得到如ncacn_ip_tcp:10.0.0.1[49667]、ncacn_np:\\HOST[\PIPE\lsass]的字符串绑定
+func (t *EPMTower) Decode() (TowerBinding, error) {
+	floors, err := t.Floors()
+	if err != nil {
+		return TowerBinding{}, err
+	}
+	if len(floors) < 3 {
+		return TowerBinding{}, errors.New("Invalid protocol tower: too few floors")
+	}
+	var res TowerBinding
+	if res.Interface, err = floors[0].ifID(); err != nil {
+		return TowerBinding{}, err
+	}
+	if res.TransferSyntax, err = floors[1].ifID(); err != nil {
+		return TowerBinding{}, err
+	}
+	b := &res.StringBinding
+	rpcProtocol := floors[2].Protocol
+	for _, f := range floors[3:] {
+		switch f.Protocol {
+		case TowerProtocolTCP:
+			b.ProtocolSequence = ProtSeqTCP
+			b.Endpoint = f.port()
+		case TowerProtocolUDP:
+			b.ProtocolSequence = ProtSeqUDP
+			b.Endpoint = f.port()
+		case TowerProtocolHTTP:
+			b.ProtocolSequence = ProtSeqHTTP
+			b.Endpoint = f.port()
+		case TowerProtocolNamedPipe:
+			b.ProtocolSequence = ProtSeqNamedPipe
+			b.Endpoint = towerString(f.RHS)
+		case TowerProtocolLRPCName:
+			b.ProtocolSequence = ProtSeqLRPC
+			b.Endpoint = towerString(f.RHS)
+		case TowerProtocolIP:
+			if len(f.RHS) == net.IPv4len {
+				b.NetworkAddress = net.IP(f.RHS).String()
+			}
+		case TowerProtocolNetBIOS:
+			if name := towerString(f.RHS); name != "" {
+				b.NetworkAddress = "\\\\" + name
+			}
+		default:
+			if b.ProtocolSequence == "" {
+				b.ProtocolSequence = fmt.Sprintf("unknown_proto_0x%02x", f.Protocol)
+			}
+		}
+	}
+	if b.ProtocolSequence == "" {
+		switch rpcProtocol {
+		case TowerProtocolLRPC:
+			b.ProtocolSequence = ProtSeqLRPC
+		default:
+			b.ProtocolSequence = fmt.Sprintf("unknown_proto_0x%02x", rpcProtocol)
+		}
+	}
+	return res, nil
+}
+
+// 构造ept_map查询使用的协议塔，接口版本的低16位为主版本号、高16位为次版本号
+// 传输语法为NDR，端口、地址等floor为空值，由服务端填充
+func NewEPMMapTower(protseq, uuid string, version uint32) (*EPMTower, error) {
+	floors := []TowerFloor{
+		uuidFloor(uuid, version),
+		uuidFloor(ms.NDR_UUID, ms.NDR_VERSION),
+		{Protocol: TowerProtocolRPCCO, RHS: []byte{0, 0}},
+	}
+	switch strings.ToLower(protseq) {
+	case ProtSeqTCP:
+		floors = append(floors, TowerFloor{Protocol: TowerProtocolTCP, RHS: []byte{0, 0}}, TowerFloor{Protocol: TowerProtocolIP, RHS: make([]byte, net.IPv4len)})
+	case ProtSeqHTTP:
+		floors = append(floors, TowerFloor{Protocol: TowerProtocolHTTP, RHS: []byte{0, 0}}, TowerFloor{Protocol: TowerProtocolIP, RHS: make([]byte, net.IPv4len)})
+	case ProtSeqNamedPipe:
+		floors = append(floors, TowerFloor{Protocol: TowerProtocolNamedPipe, RHS: []byte{0}}, TowerFloor{Protocol: TowerProtocolNetBIOS, RHS: []byte{0}})
+	default:
+		return nil, fmt.Errorf("Unsupported protocol sequence %q", protseq)
+	}
+	octets := make([]byte, 2)
+	binary.LittleEndian.PutUint16(octets, uint16(len(floors)))
+	for _, f := range floors {
+		octets = appendTowerOctets(octets, append([]byte{f.Protocol}, f.LHS...))
+		octets = appendTowerOctets(octets, f.RHS)
+	}
+	return &EPMTower{Length: uint32(len(octets)), Octets: octets}, nil
+}
+
+func uuidFloor(uuid string, version uint32) TowerFloor {
+	lhs := make([]byte, 18)
+	copy(lhs, util.PDUUuidFromBytes(uuid))
+	binary.LittleEndian.PutUint16(lhs[16:], uint16(version))
+	rhs := make([]byte, 2)
+	binary.LittleEndian.PutUint16(rhs, uint16(version>>16))
+	return TowerFloor{Protocol: TowerProtocolUUID, LHS: lhs, RHS: rhs}
+}
+
+// 追加2字节长度前缀的数据
+func appendTowerOctets(buf, b []byte) []byte {
+	n := make([]byte, 2)
+	binary.LittleEndian.PutUint16(n, uint16(len(b)))
+	return append(append(buf, n...), b...)
+}
+
+// uuid floor，左侧为uuid与主版本号，右侧为次版本号
+func (f TowerFloor) ifID() (RPCIfID, error) {
+	if f.Protocol != TowerProtocolUUID || len(f.LHS) < 18 || len(f.RHS) < 2 {
+		return RPCIfID{}, errors.New("Invalid protocol tower uuid floor")
+	}
+	var id RPCIfID
+	copy(id.UUID[:], f.LHS)
+	id.VersionMajor = binary.LittleEndian.Uint16(f.LHS[16:])
+	id.VersionMinor = binary.LittleEndian.Uint16(f.RHS)
+	return id, nil
+}
+
+// 端口按大端序编码
+func (f TowerFloor) port() string {
+	if len(f.RHS) < 2 {
+		return ""
+	}
+	return fmt.Sprint(binary.BigEndian.Uint16(f.RHS))
+}
+
+// 以NUL结尾的字符串
+func towerString(b []byte) string {
+	return strings.TrimRight(string(b), "\x00")
+}
+
+// 接口uuid字符串
+func (id RPCIfID) UUIDString() string {
+	return util.PDUUuidToString(id.UUID[:])
+}
+
+// 如e1af8308-5d1f-11c9-91a4-08002b14a0fa v3.0
+func (id RPCIfID) String() string {
+	return fmt.Sprintf("%s v%d.%d", id.UUIDString(), id.VersionMajor, id.VersionMinor)
+}
+
+// 表项的对象uuid，未指定时为空
+func (e EPMEntry) ObjectUUID() string {
+	if e.Object == [16]byte{} {
+		return ""
+	}
+	return util.PDUUuidToString(e.Object[:])
+}
+
+// 解码表项的协议塔
+func (e EPMEntry) Decode() (TowerBinding, error) {
+	if e.Tower == nil {
+		return TowerBinding{}, errors.New("Invalid endpoint mapper entry: missing tower")
+	}
+	return e.Tower.Decode()
+}
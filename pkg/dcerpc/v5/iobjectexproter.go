@@ -1,10 +1,11 @@
 package v5
 
 import (
-	"bytes"
-	"encoding/hex"
+	"context"
+	"fmt"
+	"unicode/utf16"
 
-	"github.com/4ra1n/go-impacket/pkg/encoder"
+	"github.com/4ra1n/go-impacket/pkg/dcerpc"
 	"github.com/4ra1n/go-impacket/pkg/ms"
 	"github.com/4ra1n/go-impacket/pkg/util"
 )
@@ -32,47 +33,6 @@ type ServerAlive2RequestStruct struct {
 	Opnum     uint16
 }
 
-type ServerAlive2ResponseStruct struct {
-	MSRPCHeaderStruct
-	AllocHint       uint32
-	ContextId       uint16
-	CancelCount     uint8
-	Reserved        uint8
-	VersionMajor    uint16
-	VersionMinor    uint16
-	Unknown         uint64
-	PpdsaOrBindings AddressStruct
-	Reserved2       uint64
-}
-
-// 解析的地址结构
-type AddressStruct struct {
-	NumEntries     uint16
-	SecurityOffset uint16
-	//Buf            []byte
-	//stringBindingStruct
-	//securityBindingStruct
-}
-
-//type AddressStruct struct {
-//	NumEntries     uint16
-//	SecurityOffset uint16
-//	stringBindingStruct
-//	securityBindingStruct
-//}
-
-// 绑定地址结构
-//type stringBindingStruct struct {
-//	TowerId     uint16
-//	NetworkAddr []byte // 长度不固定
-//}
-//
-//type securityBindingStruct struct {
-//	AuthnSvc  uint16
-//	AuthzSvc  uint16
-//	PrincName uint16
-//}
-
 func NewServerAlive2Request() ServerAlive2RequestStruct {
 	header := NewMSRPCHeader()
 	header.PacketType = PDURequest
@@ -86,12 +46,12 @@ func NewServerAlive2Request() ServerAlive2RequestStruct {
 	}
 }
 
-func NewServerAlive2Response() ServerAlive2ResponseStruct {
-	return ServerAlive2ResponseStruct{}
-}
-
 // 绑定IOXIDResolver接口
 func (c *TCPClient) RpcBindIOXIDResolver(callId uint32) (err error) {
+	return c.RpcBindIOXIDResolverContext(context.Background(), callId)
+}
+
+func (c *TCPClient) RpcBindIOXIDResolverContext(ctx context.Context, callId uint32) (err error) {
 	ctxs := []CtxItemStruct{{
 		NumTransItems: 1,
 		AbstractSyntax: SyntaxIDStruct{
@@ -102,7 +62,7 @@ func (c *TCPClient) RpcBindIOXIDResolver(callId uint32) (err error) {
 			UUID:    util.PDUUuidFromBytes(ms.NDR_UUID),
 			Version: ms.NDR_VERSION,
 		}}}
-	_, err = c.MSRPCBind(callId, ctxs)
+	err = c.ndrBindContext(ctx, callId, ctxs)
 	if err != nil {
 		c.Debug("", err)
 		return err
@@ -111,28 +71,202 @@ func (c *TCPClient) RpcBindIOXIDResolver(callId uint32) (err error) {
 }
 
 func (c *TCPClient) ServerAlive2Request(callId uint32) (address []string, err error) {
+	return c.ServerAlive2RequestContext(context.Background(), callId)
+}
+
+func (c *TCPClient) ServerAlive2RequestContext(ctx context.Context, callId uint32) (address []string, err error) {
+	c.Debug("Sending ServerAlive2 request", nil)
+	address, err = c.NewConn(callId).ServerAlive2Context(ctx)
+	if err != nil {
+		c.Debug("", err)
+		return nil, err
+	}
+	return address, nil
+}
+
+func (c *TCPClient) ServerAlive2BindingsRequest(callId uint32) (COMVersion, *DualStringArray, error) {
+	return c.ServerAlive2BindingsRequestContext(context.Background(), callId)
+}
+
+func (c *TCPClient) ServerAlive2BindingsRequestContext(ctx context.Context, callId uint32) (COMVersion, *DualStringArray, error) {
 	c.Debug("Sending ServerAlive2 request", nil)
-	req := NewServerAlive2Request()
-	req.CallId = callId
-	buf, err := c.TCPSend(req)
-	res := NewServerAlive2Response()
-	c.Debug("Unmarshalling ServerAlive2 response", nil)
-	if err = encoder.Unmarshal(buf, &res); err != nil {
-		c.Debug("Raw:\n"+hex.Dump(buf), err)
-	}
-	// 解析address
-	addressBuf := buf[40:]
-	// 去除securityBinding数据，只保留网卡、ip信息
-	securityBindingIndex := bytes.Index(addressBuf, []byte{9, 00})
-	newAddressBuf := bytes.Split(addressBuf[:securityBindingIndex], []byte{07, 00})
-	for _, i := range newAddressBuf {
-		if i != nil {
-			address = append(address, string(i))
-		}
+	version, bindings, err := c.NewConn(callId).ServerAlive2BindingsContext(ctx)
+	if err != nil {
+		c.Debug("", err)
+		return COMVersion{}, nil, err
+	}
+	return version, bindings, nil
+}
+
+// 查询对象导出器的网络地址，连接需先绑定ms.IID_IObjectExporter接口
+func (r *RPCConn) ServerAlive2() ([]string, error) {
+	return r.ServerAlive2Context(context.Background())
+}
+
+func (r *RPCConn) ServerAlive2Context(ctx context.Context) (address []string, err error) {
+	_, bindings, err := r.ServerAlive2BindingsContext(ctx)
+	if err != nil || bindings == nil {
+		return nil, err
+	}
+	for _, b := range bindings.StringBindings() {
+		address = append(address, b.NetworkAddr)
 	}
 	return address, nil
 }
 
+// 查询对象导出器的COM版本以及字符串绑定、安全绑定，连接需先绑定ms.IID_IObjectExporter接口
+func (r *RPCConn) ServerAlive2Bindings() (COMVersion, *DualStringArray, error) {
+	return r.ServerAlive2BindingsContext(context.Background())
+}
+
+func (r *RPCConn) ServerAlive2BindingsContext(ctx context.Context) (COMVersion, *DualStringArray, error) {
+	var res serverAlive2Result
+	if err := r.ndrCall(ctx, ServerAlive2, struct{}{}, &res, "ServerAlive2"); err != nil {
+		return COMVersion{}, nil, err
+	}
+	if res.ReturnCode != dcerpc.RPC_S_OK {
+		return COMVersion{}, nil, rpcStatusError("ServerAlive2", res.ReturnCode)
+	}
+	return res.Version, res.Bindings, nil
+}
+
+// ServerAlive2的输出参数
+type serverAlive2Result struct {
+	Version    COMVersion
+	Bindings   *DualStringArray
+	Reserved   uint32
+	ReturnCode uint32
+}
+
+// COM版本
+type COMVersion struct {
+	MajorVersion uint16
+	MinorVersion uint16
+}
+
+func (v COMVersion) String() string {
+	return fmt.Sprintf("%d.%d", v.MajorVersion, v.MinorVersion)
+}
+
+// DUALSTRINGARRAY，StringArray中依次为字符串绑定与安全绑定，SecurityOffset为安全绑定的起始位置
+type DualStringArray struct {
+	NumEntries     uint16
+	SecurityOffset uint16
+	StringArray    []uint16 `ndr:"size_is:NumEntries"`
+}
+
+// 字符串绑定中的塔id
+const (
+	TowerIdDNetNSP = 0x0004
+	TowerIdTCP     = 0x0007
+	TowerIdUDP     = 0x0008
+	TowerIdSPX     = 0x000c
+	TowerIdNBIPX   = 0x000d
+	TowerIdIPX     = 0x000e
+	TowerIdNBNB    = 0x0012
+	TowerIdHTTP    = 0x001f
+)
+
+var towerIdNames = map[uint16]string{
+	TowerIdDNetNSP: "ncacn_dnet_nsp",
+	TowerIdTCP:     ProtSeqTCP,
+	TowerIdUDP:     ProtSeqUDP,
+	TowerIdSPX:     "ncacn_spx",
+	TowerIdNBIPX:   "ncacn_nb_ipx",
+	TowerIdIPX:     "ncadg_ipx",
+	TowerIdNBNB:    "ncacn_nb_nb",
+	TowerIdHTTP:    ProtSeqHTTP,
+}
+
+// 字符串绑定，对应STRINGBINDING
+type DualStringBinding struct {
+	TowerId     uint16
+	NetworkAddr string
+}
+
+// 塔id对应的协议序列
+func (b DualStringBinding) ProtocolSequence() string {
+	if name, ok := towerIdNames[b.TowerId]; ok {
+		return name
+	}
+	return fmt.Sprintf("unknown_tower_0x%04x", b.TowerId)
+}
+
+func (b DualStringBinding) String() string {
+	return b.ProtocolSequence() + ":" + b.NetworkAddr
+}
+
+// 安全绑定，对应SECURITYBINDING，PrincName为服务端的主体名称
+type SecurityBinding struct {
+	AuthnSvc  uint16
+	AuthzSvc  uint16
+	PrincName string
+}
+
+var authnSvcNames = map[uint16]string{
+	RPC_C_AUTHN_NONE:          "NONE",
+	RPC_C_AUTHN_GSS_NEGOTIATE: "GSS_NEGOTIATE",
+	RPC_C_AUTHN_WINNT:         "WINNT",
+	RPC_C_AUTHN_GSS_SCHANNEL:  "GSS_SCHANNEL",
+	RPC_C_AUTHN_GSS_KERBEROS:  "GSS_KERBEROS",
+	RPC_C_AUTHN_NETLOGON:      "NETLOGON",
+	RPC_C_AUTHN_DEFAULT:       "DEFAULT",
+}
+
+// 认证服务名称
+func (b SecurityBinding) AuthnName() string {
+	if name, ok := authnSvcNames[b.AuthnSvc]; ok {
+		return name
+	}
+	return fmt.Sprintf("0x%04x", b.AuthnSvc)
+}
+
+// 字符串绑定，每项为塔id与以空字符结尾的网络地址，以空的塔id结束
+func (a *DualStringArray) StringBindings() []DualStringBinding {
+	var res []DualStringBinding
+	array := a.entries(0, int(a.SecurityOffset))
+	for i := 0; i < len(array) && array[i] != 0; {
+		addr, next := utf16String(array, i+1)
+		res = append(res, DualStringBinding{TowerId: array[i], NetworkAddr: addr})
+		i = next
+	}
+	return res
+}
+
+// 安全绑定，每项为认证服务、授权服务与以空字符结尾的主体名称，以空的认证服务结束
+func (a *DualStringArray) SecurityBindings() []SecurityBinding {
+	var res []SecurityBinding
+	array := a.entries(int(a.SecurityOffset), len(a.StringArray))
+	for i := 0; i+1 < len(array) && array[i] != 0; {
+		name, next := utf16String(array, i+2)
+		res = append(res, SecurityBinding{AuthnSvc: array[i], AuthzSvc: array[i+1], PrincName: name})
+		i = next
+	}
+	return res
+}
+
+func (a *DualStringArray) entries(start, end int) []uint16 {
+	if end > len(a.StringArray) {
+		end = len(a.StringArray)
+	}
+	if start > end {
+		return nil
+	}
+	return a.StringArray[start:end]
+}
+
+// 读取从i开始以空字符结尾的字符串，返回字符串与之后的位置
+func utf16String(array []uint16, i int) (string, int) {
+	j := i
+	for j < len(array) && array[j] != 0 {
+		j++
+	}
+	if i > j {
+		return "", j + 1
+	}
+	return string(utf16.Decode(array[i:j])), j + 1
+}
+
 // ResolveOxid2请求结构
 // https://learn.microsoft.com/en-us/openspecs/windows_protocols/ms-dcom/65292e10-ef0c-43ee-bce7-788e271cc794
 type ResolveOxid2RequestStruct struct {
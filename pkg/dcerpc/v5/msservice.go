@@ -1,7 +1,8 @@
 package v5
 
 import (
-	"encoding/hex"
+	"context"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"github.com/4ra1n/go-impacket/pkg/dcerpc"
@@ -9,53 +10,41 @@ import (
 	"github.com/4ra1n/go-impacket/pkg/ms"
 	"github.com/4ra1n/go-impacket/pkg/smb/smb2"
 	"github.com/4ra1n/go-impacket/pkg/util"
+	"os"
+	"path/filepath"
 	"strings"
 )
 
 // 此文件提供访问windows服务管理安装/删除
 
-// smb->上传文件，返回文件名
-func (c *SMBClient) FileUpload(file, Path string) (filename string, err error) {
-	treeId, err := c.TreeConnect("C$")
-	if err != nil {
-		c.Debug("", err)
-		return "", err
-	}
-	createRequestStruct := smb2.CreateRequestStruct{
-		OpLock:             smb2.SMB2_OPLOCK_LEVEL_NONE,
-		ImpersonationLevel: smb2.Impersonation,
-		AccessMask:         smb2.FILE_CREATE,
-		FileAttributes:     smb2.FILE_ATTRIBUTE_NORMAL,
-		ShareAccess:        smb2.FILE_SHARE_WRITE,
-		CreateDisposition:  smb2.FILE_OVERWRITE_IF,
-		CreateOptions:      smb2.FILE_NON_DIRECTORY_FILE,
-	}
-	// 文件名不能超过11位，如果超过则随机生成
-	var newFilename string
-	if len(file) <= 11 {
-		newFilename = file
-	} else {
-		// 切分拿到扩展名
-		fileInfo := strings.Split(file, ".")
-		newFilename = string(util.Random(7)) + "." + fileInfo[len(fileInfo)-1]
-	}
-	fileId, err := c.CreateRequest(treeId, newFilename, createRequestStruct)
+// 服务可执行文件上传到的共享，服务通过%systemdrive%下的路径启动
+const serviceShare = "C$"
+
+// smb->上传本地文件到共享中的remote，remote为共享内的相对路径，已存在时覆盖
+func (c *SMBClient) FileUpload(local, share, remote string) (err error) {
+	return c.FileUploadContext(context.Background(), local, share, remote)
+}
+
+func (c *SMBClient) FileUploadContext(ctx context.Context, local, share, remote string) (err error) {
+	f, err := os.Open(local)
 	if err != nil {
 		c.Debug("", err)
-		return "", err
+		return err
 	}
-	err = c.WriteRequest(treeId, Path, file, fileId)
-	if err != nil {
+	defer f.Close()
+	if _, err = c.UploadContext(ctx, share, remote, f); err != nil {
 		c.Debug("", err)
-		return newFilename, err
+		return err
 	}
-	// 关闭目录连接
-	c.TreeDisconnect("C$")
-	return newFilename, nil
+	return nil
 }
 
 // smb->打开scm，返回scm服务句柄
 func (c *SMBClient) OpenSvcManager(treeId, callId uint32) (fileid, handler []byte, err error) {
+	return c.OpenSvcManagerContext(context.Background(), treeId, callId)
+}
+
+func (c *SMBClient) OpenSvcManagerContext(ctx context.Context, treeId, callId uint32) (fileid, handler []byte, err error) {
 	createRequestStruct := smb2.CreateRequestStruct{
 		OpLock:             smb2.SMB2_OPLOCK_LEVEL_NONE,
 		ImpersonationLevel: smb2.Impersonation,
@@ -65,7 +54,7 @@ func (c *SMBClient) OpenSvcManager(treeId, callId uint32) (fileid, handler []byt
 		CreateDisposition:  smb2.FILE_OPEN,
 		CreateOptions:      smb2.FILE_NON_DIRECTORY_FILE,
 	}
-	fileId, err := c.CreateRequest(treeId, "svcctl", createRequestStruct)
+	fileId, err := c.CreateRequestContext(ctx, treeId, "svcctl", createRequestStruct)
 	if err != nil {
 		c.Debug("", err)
 		return nil, nil, err
@@ -81,272 +70,571 @@ func (c *SMBClient) OpenSvcManager(treeId, callId uint32) (fileid, handler []byt
 			UUID:    util.PDUUuidFromBytes(ms.NDR_UUID),
 			Version: ms.NDR_VERSION,
 		}}}
-	err = c.MSRPCBind(treeId, fileId, callId, ctxs)
-	if err != nil {
-		c.Debug("", err)
-		return nil, nil, err
-	}
-	openSvcManagerRequest := NewOpenSCManagerWRequest()
-	openSvcManagerRequest.CallId = callId
-	req := c.NewWriteRequest(treeId, fileId, openSvcManagerRequest)
-	_, err = c.SMBSend(req)
+	err = c.ndrBindContext(ctx, treeId, fileId, callId, ctxs)
 	if err != nil {
 		c.Debug("", err)
 		return nil, nil, err
 	}
-	c.Debug("Read OpenSCManagerW response", nil)
-	reqRead := c.NewReadRequest(treeId, fileId)
-	buf, err := c.SMBSend(reqRead)
+	c.Debug("Sending svcctl OpenSCManagerW request", nil)
+	contextHandle, err := c.NewPipeConn(treeId, fileId, callId).OpenSCManagerContext(ctx)
 	if err != nil {
 		c.Debug("", err)
 		return nil, nil, err
 	}
-	smbRes := smb2.NewReadResponse()
-	res := NewOpenSCManagerWResponse()
-	c.Debug("Unmarshalling OpenSCManagerW response", nil)
-	if err = encoder.Unmarshal(buf, &smbRes); err != nil {
-		c.Debug("Raw:\n"+hex.Dump(buf), err)
-	}
-	// 切开smb头
-	startIndex := len(buf) - int(smbRes.BlobLength)
-	if err = encoder.Unmarshal(buf[startIndex:], &res); err != nil {
-		c.Debug("Raw:\n"+hex.Dump(buf), err)
-	}
-	if res.ReturnCode != dcerpc.RPC_S_OK {
-		if len(dcerpc.RpcStatusCodes[res.ReturnCode]) == 0 {
-			msg := fmt.Sprintf("Failed to OpenSCManagerW service active code : 0x%08x", res.ReturnCode)
-			return nil, nil, errors.New(msg)
-		} else {
-			return nil, nil, errors.New("Failed to OpenSCManagerW service active : " + dcerpc.RpcStatusCodes[res.ReturnCode])
-		}
-	}
 	c.Debug("Completed OpenSCManagerW ", nil)
-	// 获取OpenSCManagerW句柄
-	contextHandle := res.ContextHandle
 	return fileId, contextHandle, nil
 }
 
-// smb->打开服务
-func (c *SMBClient) OpenService(treeId uint32, fileId, contextHandle []byte, servicename string, callId uint32) (err error) {
+// smb->打开服务，返回服务句柄
+func (c *SMBClient) OpenService(treeId uint32, fileId, contextHandle []byte, servicename string, callId uint32) (handler []byte, err error) {
+	return c.OpenServiceContext(context.Background(), treeId, fileId, contextHandle, servicename, callId)
+}
+
+func (c *SMBClient) OpenServiceContext(ctx context.Context, treeId uint32, fileId, contextHandle []byte, servicename string, callId uint32) (handler []byte, err error) {
 	// 打开服务
 	c.Debug("Sending svcctl OpenServiceW request", nil)
-	rOpenServiceRequest := NewROpenServiceWRequest(contextHandle, servicename)
-	rOpenServiceRequest.CallId = callId
-	req := c.NewWriteRequest(treeId, fileId, rOpenServiceRequest)
-	buf, err := c.SMBSend(req)
+	serviceHandle, err := c.NewPipeConn(treeId, fileId, callId).OpenServiceContext(ctx, contextHandle, servicename)
 	if err != nil {
 		c.Debug("", err)
-		return err
-	}
-	c.Debug("Read svcctl OpenServiceW response", nil)
-	reqRead := c.NewReadRequest(treeId, fileId)
-	buf, err = c.SMBSend(reqRead)
-	if err != nil {
-		c.Debug("", err)
-		return err
-	}
-	smbRes := smb2.NewReadResponse()
-	res := NewROpenServiceWResponse()
-	c.Debug("Unmarshalling ROpenServiceW response", nil)
-	if err = encoder.Unmarshal(buf, &smbRes); err != nil {
-		c.Debug("Raw:\n"+hex.Dump(buf), err)
-	}
-	// 切开smb头
-	startIndex := len(buf) - int(smbRes.BlobLength)
-	if err = encoder.Unmarshal(buf[startIndex:], &res); err != nil {
-		c.Debug("Raw:\n"+hex.Dump(buf), err)
-	}
-	if res.ReturnCode != dcerpc.RPC_S_OK {
-		if len(dcerpc.RpcStatusCodes[res.ReturnCode]) == 0 {
-			msg := fmt.Sprintf("Failed to ROpenServiceW service active code : 0x%08x", res.ReturnCode)
-			return errors.New(msg)
-		} else {
-			return errors.New("Failed to ROpenServiceW service active : " + dcerpc.RpcStatusCodes[res.ReturnCode])
-		}
+		return nil, err
 	}
 	c.Debug("Completed ROpenServiceW ", nil)
-	return nil
+	return serviceHandle, nil
 }
 
 // smb->创建服务，返回创建服务后的实例句柄
 func (c *SMBClient) CreateService(treeId uint32, fileId, contextHandle []byte, servicename, uploadPathFile string, callId uint32) (handler []byte, err error) {
+	return c.CreateServiceContext(context.Background(), treeId, fileId, contextHandle, servicename, uploadPathFile, callId)
+}
+
+func (c *SMBClient) CreateServiceContext(ctx context.Context, treeId uint32, fileId, contextHandle []byte, servicename, uploadPathFile string, callId uint32) (handler []byte, err error) {
 	// 创建服务
 	c.Debug("Sending svcctl RCreateServiceW request", nil)
-	rCreateServiceWRequest := NewRCreateServiceWRequest(contextHandle, servicename, uploadPathFile)
-	rCreateServiceWRequest.CallId = callId
-	req := c.NewWriteRequest(treeId, fileId, rCreateServiceWRequest)
-	buf, err := c.SMBSend(req)
+	serviceHandle, err := c.NewPipeConn(treeId, fileId, callId).CreateServiceContext(ctx, contextHandle, servicename, uploadPathFile)
 	if err != nil {
 		c.Debug("", err)
 		return nil, err
 	}
-	c.Debug("Read svcctl RCreateServiceW response", nil)
-	reqRead := c.NewReadRequest(treeId, fileId)
-	buf, err = c.SMBSend(reqRead)
-	if err != nil {
-		c.Debug("", err)
-		return nil, err
-	}
-	smbRes := smb2.NewReadResponse()
-	res := NewRCreateServiceWResponse()
-	c.Debug("Unmarshalling RCreateServiceW response", nil)
-	if err = encoder.Unmarshal(buf, &smbRes); err != nil {
-		c.Debug("Raw:\n"+hex.Dump(buf), err)
-	}
-	// 切开smb头
-	startIndex := len(buf) - int(smbRes.BlobLength)
-	if err = encoder.Unmarshal(buf[startIndex:], &res); err != nil {
-		c.Debug("Raw:\n"+hex.Dump(buf), err)
-	}
-	if res.ReturnCode != dcerpc.RPC_S_OK {
-		if len(dcerpc.RpcStatusCodes[res.ReturnCode]) == 0 {
-			msg := fmt.Sprintf("Failed to RCreateServiceW service active code : 0x%08x", res.ReturnCode)
-			return nil, errors.New(msg)
-		} else {
-			return nil, errors.New("Failed to RCreateServiceW service active : " + dcerpc.RpcStatusCodes[res.ReturnCode])
-		}
-	}
 	c.Debug("Completed RCreateServiceW to ["+servicename+"] ", nil)
-	// 得到创建服务后的服务句柄
-	serviceHandle := res.ContextHandle
 	return serviceHandle, nil
 }
 
 // smb->启动服务
 func (c *SMBClient) StartService(treeId uint32, fileId, serviceHandle []byte, callId uint32) (err error) {
+	return c.StartServiceContext(context.Background(), treeId, fileId, serviceHandle, callId)
+}
+
+func (c *SMBClient) StartServiceContext(ctx context.Context, treeId uint32, fileId, serviceHandle []byte, callId uint32) (err error) {
 	// 启动服务
 	c.Debug("Sending svcctl RStartServiceW request", nil)
-	rStartServiceWRequest := NewRStartServiceWRequest(serviceHandle)
-	rStartServiceWRequest.CallId = callId
-	req := c.NewWriteRequest(treeId, fileId, rStartServiceWRequest)
-	buf, err := c.SMBSend(req)
-	if err != nil {
-		c.Debug("", err)
-		return err
-	}
-	c.Debug("Read svcctl RStartServiceW response", nil)
-	reqRead := c.NewReadRequest(treeId, fileId)
-	buf, err = c.SMBSend(reqRead)
-	if err != nil {
+	if err = c.NewPipeConn(treeId, fileId, callId).StartServiceContext(ctx, serviceHandle); err != nil {
 		c.Debug("", err)
 		return err
 	}
-	smbRes := smb2.NewReadResponse()
-	res := NewRStartServiceWResponse()
-	c.Debug("Unmarshalling RStartServiceW response", nil)
-	if err = encoder.Unmarshal(buf, &smbRes); err != nil {
-		c.Debug("Raw:\n"+hex.Dump(buf), err)
-	}
-	// 切开smb头
-	startIndex := len(buf) - int(smbRes.BlobLength)
-	if err = encoder.Unmarshal(buf[startIndex:], &res); err != nil {
-		c.Debug("Raw:\n"+hex.Dump(buf), err)
-	}
-	if res.StubData != dcerpc.RPC_S_OK {
-		if len(dcerpc.RpcStatusCodes[res.StubData]) == 0 {
-			msg := fmt.Sprintf("Failed to RStartServiceW service active code : 0x%08x", res.StubData)
-			return errors.New(msg)
-		} else {
-			return errors.New("Failed to RStartServiceW service active : " + dcerpc.RpcStatusCodes[res.StubData])
-		}
-	}
 	c.Debug("Completed RStartServiceW ", nil)
 	return nil
 }
 
 // smb->删除服务
 func (c *SMBClient) DeleteService(treeId uint32, fileId, serviceHandle []byte, callId uint32) (err error) {
+	return c.DeleteServiceContext(context.Background(), treeId, fileId, serviceHandle, callId)
+}
+
+func (c *SMBClient) DeleteServiceContext(ctx context.Context, treeId uint32, fileId, serviceHandle []byte, callId uint32) (err error) {
 	c.Debug("Sending svcctl RDeleteService request", nil)
-	rDeleteServiceRequest := NewRDeleteServiceRequest(serviceHandle)
-	rDeleteServiceRequest.CallId = callId
-	req := c.NewWriteRequest(treeId, fileId, rDeleteServiceRequest)
-	buf, err := c.SMBSend(req)
-	if err != nil {
-		c.Debug("", err)
-		return err
-	}
-	c.Debug("Read svcctl RDeleteService response", nil)
-	reqRead := c.NewReadRequest(treeId, fileId)
-	buf, err = c.SMBSend(reqRead)
-	if err != nil {
+	if err = c.NewPipeConn(treeId, fileId, callId).DeleteServiceContext(ctx, serviceHandle); err != nil {
 		c.Debug("", err)
 		return err
 	}
-	smbRes := smb2.NewReadResponse()
-	res := NewRDeleteServiceResponse()
-	c.Debug("Unmarshalling RDeleteService response", nil)
-	if err = encoder.Unmarshal(buf, &smbRes); err != nil {
-		c.Debug("Raw:\n"+hex.Dump(buf), err)
-	}
-	// 切开smb头
-	startIndex := len(buf) - int(smbRes.BlobLength)
-	if err = encoder.Unmarshal(buf[startIndex:], &res); err != nil {
-		c.Debug("Raw:\n"+hex.Dump(buf), err)
-	}
-	if res.ReturnCode != dcerpc.RPC_S_OK {
-		if len(dcerpc.RpcStatusCodes[res.ReturnCode]) == 0 {
-			msg := fmt.Sprintf("Failed to RDeleteService service active code : 0x%08x", res.ReturnCode)
-			return errors.New(msg)
-		} else {
-			return errors.New("Failed to RDeleteService service active : " + dcerpc.RpcStatusCodes[res.ReturnCode])
-		}
-	}
 	c.Debug("Completed RDeleteService ", nil)
 	return nil
 }
 
 // smb->关闭scm句柄
 func (c *SMBClient) CloseService(treeId uint32, fileId, serviceHandle []byte, callId uint32) error {
+	return c.CloseServiceContext(context.Background(), treeId, fileId, serviceHandle, callId)
+}
+
+func (c *SMBClient) CloseServiceContext(ctx context.Context, treeId uint32, fileId, serviceHandle []byte, callId uint32) error {
 	// 关闭服务管理句柄
 	c.Debug("Sending svcctl RCloseServiceHandle request", nil)
-	rCloseServiceHandleRequest := NewRCloseServiceHandleRequest(serviceHandle)
-	rCloseServiceHandleRequest.CallId = callId
-	req := c.NewWriteRequest(treeId, fileId, rCloseServiceHandleRequest)
-	buf, err := c.SMBSend(req)
-	if err != nil {
+	if err := c.NewPipeConn(treeId, fileId, callId).CloseServiceHandleContext(ctx, serviceHandle); err != nil {
 		c.Debug("", err)
 		return err
 	}
-	c.Debug("Read svcctl RCloseServiceHandle response", nil)
-	reqRead := c.NewReadRequest(treeId, fileId)
-	buf, err = c.SMBSend(reqRead)
+	c.Debug("Completed RCloseServiceHandle ", nil)
+	return nil
+}
+
+// smb->枚举服务，serviceType如SERVICE_WIN32，serviceState如SERVICE_STATE_ALL
+func (c *SMBClient) EnumServicesStatus(treeId uint32, fileId, contextHandle []byte, serviceType, serviceState, callId uint32) ([]ServiceEntry, error) {
+	return c.EnumServicesStatusContext(context.Background(), treeId, fileId, contextHandle, serviceType, serviceState, callId)
+}
+
+func (c *SMBClient) EnumServicesStatusContext(ctx context.Context, treeId uint32, fileId, contextHandle []byte, serviceType, serviceState, callId uint32) ([]ServiceEntry, error) {
+	c.Debug("Sending svcctl REnumServicesStatusW request", nil)
+	services, err := c.NewPipeConn(treeId, fileId, callId).EnumServicesStatusContext(ctx, contextHandle, serviceType, serviceState)
+	if err != nil {
+		c.Debug("", err)
+		return nil, err
+	}
+	c.Debug(fmt.Sprintf("Completed REnumServicesStatusW, %d services", len(services)), nil)
+	return services, nil
+}
+
+// smb->查询服务状态
+func (c *SMBClient) QueryServiceStatus(treeId uint32, fileId, serviceHandle []byte, callId uint32) (ServiceStatus, error) {
+	return c.QueryServiceStatusContext(context.Background(), treeId, fileId, serviceHandle, callId)
+}
+
+func (c *SMBClient) QueryServiceStatusContext(ctx context.Context, treeId uint32, fileId, serviceHandle []byte, callId uint32) (ServiceStatus, error) {
+	c.Debug("Sending svcctl RQueryServiceStatus request", nil)
+	status, err := c.NewPipeConn(treeId, fileId, callId).QueryServiceStatusContext(ctx, serviceHandle)
+	if err != nil {
+		c.Debug("", err)
+		return ServiceStatus{}, err
+	}
+	c.Debug("Completed RQueryServiceStatus ", nil)
+	return status, nil
+}
+
+// smb->查询服务配置
+func (c *SMBClient) QueryServiceConfig(treeId uint32, fileId, serviceHandle []byte, callId uint32) (ServiceConfig, error) {
+	return c.QueryServiceConfigContext(context.Background(), treeId, fileId, serviceHandle, callId)
+}
+
+func (c *SMBClient) QueryServiceConfigContext(ctx context.Context, treeId uint32, fileId, serviceHandle []byte, callId uint32) (ServiceConfig, error) {
+	c.Debug("Sending svcctl RQueryServiceConfigW request", nil)
+	config, err := c.NewPipeConn(treeId, fileId, callId).QueryServiceConfigContext(ctx, serviceHandle)
 	if err != nil {
+		c.Debug("", err)
+		return ServiceConfig{}, err
+	}
+	c.Debug("Completed RQueryServiceConfigW ", nil)
+	return config, nil
+}
+
+// smb->修改服务配置
+func (c *SMBClient) ChangeServiceConfig(treeId uint32, fileId, serviceHandle []byte, change ServiceConfigChange, callId uint32) error {
+	return c.ChangeServiceConfigContext(context.Background(), treeId, fileId, serviceHandle, change, callId)
+}
+
+func (c *SMBClient) ChangeServiceConfigContext(ctx context.Context, treeId uint32, fileId, serviceHandle []byte, change ServiceConfigChange, callId uint32) error {
+	c.Debug("Sending svcctl RChangeServiceConfigW request", nil)
+	if err := c.NewPipeConn(treeId, fileId, callId).ChangeServiceConfigContext(ctx, serviceHandle, change); err != nil {
 		c.Debug("", err)
 		return err
 	}
-	smbRes := smb2.NewReadResponse()
-	res := NewRCloseServiceHandleResponse()
-	c.Debug("Unmarshalling RCloseServiceHandle response", nil)
-	if err = encoder.Unmarshal(buf, &smbRes); err != nil {
-		c.Debug("Raw:\n"+hex.Dump(buf), err)
-	}
-	// 切开smb头
-	startIndex := len(buf) - int(smbRes.BlobLength)
-	if err = encoder.Unmarshal(buf[startIndex:], &res); err != nil {
-		c.Debug("Raw:\n"+hex.Dump(buf), err)
-	}
-	if res.ReturnCode != dcerpc.RPC_S_OK {
-		if len(dcerpc.RpcStatusCodes[res.ReturnCode]) == 0 {
-			msg := fmt.Sprintf("Failed to RCloseServiceHandle service active code : 0x%08x", res.ReturnCode)
-			return errors.New(msg)
-		} else {
-			return errors.New("Failed to RCloseServiceHandle service active : " + dcerpc.RpcStatusCodes[res.ReturnCode])
+	c.Debug("Completed RChangeServiceConfigW ", nil)
+	return nil
+}
+
+// smb->控制服务，control为SERVICE_CONTROL_STOP、SERVICE_CONTROL_PAUSE、SERVICE_CONTROL_CONTINUE等，返回控制后的服务状态
+func (c *SMBClient) ControlService(treeId uint32, fileId, serviceHandle []byte, control, callId uint32) (ServiceStatus, error) {
+	return c.ControlServiceContext(context.Background(), treeId, fileId, serviceHandle, control, callId)
+}
+
+func (c *SMBClient) ControlServiceContext(ctx context.Context, treeId uint32, fileId, serviceHandle []byte, control, callId uint32) (ServiceStatus, error) {
+	c.Debug(fmt.Sprintf("Sending svcctl RControlService request, control %d", control), nil)
+	status, err := c.NewPipeConn(treeId, fileId, callId).ControlServiceContext(ctx, serviceHandle, control)
+	if err != nil {
+		c.Debug("", err)
+		return ServiceStatus{}, err
+	}
+	c.Debug("Completed RControlService ", nil)
+	return status, nil
+}
+
+// smb->由服务名查询显示名
+func (c *SMBClient) GetServiceDisplayName(treeId uint32, fileId, contextHandle []byte, servicename string, callId uint32) (string, error) {
+	return c.GetServiceDisplayNameContext(context.Background(), treeId, fileId, contextHandle, servicename, callId)
+}
+
+func (c *SMBClient) GetServiceDisplayNameContext(ctx context.Context, treeId uint32, fileId, contextHandle []byte, servicename string, callId uint32) (string, error) {
+	c.Debug("Sending svcctl RGetServiceDisplayNameW request", nil)
+	name, err := c.NewPipeConn(treeId, fileId, callId).GetServiceDisplayNameContext(ctx, contextHandle, servicename)
+	if err != nil {
+		c.Debug("", err)
+		return "", err
+	}
+	c.Debug("Completed RGetServiceDisplayNameW ", nil)
+	return name, nil
+}
+
+// smb->由显示名查询服务名
+func (c *SMBClient) GetServiceKeyName(treeId uint32, fileId, contextHandle []byte, displayname string, callId uint32) (string, error) {
+	return c.GetServiceKeyNameContext(context.Background(), treeId, fileId, contextHandle, displayname, callId)
+}
+
+func (c *SMBClient) GetServiceKeyNameContext(ctx context.Context, treeId uint32, fileId, contextHandle []byte, displayname string, callId uint32) (string, error) {
+	c.Debug("Sending svcctl RGetServiceKeyNameW request", nil)
+	name, err := c.NewPipeConn(treeId, fileId, callId).GetServiceKeyNameContext(ctx, contextHandle, displayname)
+	if err != nil {
+		c.Debug("", err)
+		return "", err
+	}
+	c.Debug("Completed RGetServiceKeyNameW ", nil)
+	return name, nil
+}
+
+// 以下为与传输无关的svcctl方法，连接需先绑定ms.NTSVCS_UUID接口
+
+// svcctl方法的输出参数
+type scmrHandleResult struct {
+	ContextHandle ContextHandle
+	ReturnCode    uint32
+}
+
+type scmrCreateResult struct {
+	TagId         *uint32
+	ContextHandle ContextHandle
+	ReturnCode    uint32
+}
+
+type scmrResult struct {
+	ReturnCode uint32
+}
+
+type scmrStatusResult struct {
+	Status     ServiceStatus
+	ReturnCode uint32
+}
+
+type scmrEnumResult struct {
+	Buffer           []byte // ENUM_SERVICE_STATUSW数组，名称按偏移存放在其后
+	BytesNeeded      uint32
+	ServicesReturned uint32
+	ResumeIndex      *uint32
+	ReturnCode       uint32
+}
+
+type scmrConfigResult struct {
+	Config      queryServiceConfigW
+	BytesNeeded uint32
+	ReturnCode  uint32
+}
+
+type scmrChangeResult struct {
+	TagId      *uint32
+	ReturnCode uint32
+}
+
+type scmrNameResult struct {
+	Name         string
+	BufferLength uint32
+	ReturnCode   uint32
+}
+
+func (r *scmrHandleResult) status() uint32 { return r.ReturnCode }
+func (r *scmrCreateResult) status() uint32 { return r.ReturnCode }
+func (r *scmrResult) status() uint32       { return r.ReturnCode }
+func (r *scmrStatusResult) status() uint32 { return r.ReturnCode }
+func (r *scmrEnumResult) status() uint32   { return r.ReturnCode }
+func (r *scmrConfigResult) status() uint32 { return r.ReturnCode }
+func (r *scmrChangeResult) status() uint32 { return r.ReturnCode }
+func (r *scmrNameResult) status() uint32   { return r.ReturnCode }
+
+// QUERY_SERVICE_CONFIGW
+type queryServiceConfigW struct {
+	ServiceType      uint32
+	StartType        uint32
+	ErrorControl     uint32
+	BinaryPathName   string `ndr:"unique"`
+	LoadOrderGroup   string `ndr:"unique"`
+	TagId            uint32
+	Dependencies     string `ndr:"unique"` // 以空字符分隔的多个名称
+	ServiceStartName string `ndr:"unique"`
+	DisplayName      string `ndr:"unique"`
+}
+
+// 打开服务管理，返回scm句柄
+func (r *RPCConn) OpenSCManager() ([]byte, error) {
+	return r.OpenSCManagerContext(context.Background())
+}
+
+func (r *RPCConn) OpenSCManagerContext(ctx context.Context) ([]byte, error) {
+	var res scmrHandleResult
+	if err := r.scmrCall(ctx, NewOpenSCManagerWRequest(), &res, "OpenSCManagerW"); err != nil {
+		return nil, err
+	}
+	return res.ContextHandle.Bytes(), nil
+}
+
+// 打开服务，返回服务句柄
+func (r *RPCConn) OpenService(scHandle []byte, servicename string) ([]byte, error) {
+	return r.OpenServiceContext(context.Background(), scHandle, servicename)
+}
+
+func (r *RPCConn) OpenServiceContext(ctx context.Context, scHandle []byte, servicename string) ([]byte, error) {
+	var res scmrHandleResult
+	if err := r.scmrCall(ctx, NewROpenServiceWRequest(scHandle, servicename), &res, "ROpenServiceW"); err != nil {
+		return nil, err
+	}
+	return res.ContextHandle.Bytes(), nil
+}
+
+// 创建服务，返回服务句柄
+func (r *RPCConn) CreateService(scHandle []byte, servicename, binaryPath string) ([]byte, error) {
+	return r.CreateServiceContext(context.Background(), scHandle, servicename, binaryPath)
+}
+
+func (r *RPCConn) CreateServiceContext(ctx context.Context, scHandle []byte, servicename, binaryPath string) ([]byte, error) {
+	var res scmrCreateResult
+	if err := r.scmrCall(ctx, NewRCreateServiceWRequest(scHandle, servicename, binaryPath), &res, "RCreateServiceW"); err != nil {
+		return nil, err
+	}
+	return res.ContextHandle.Bytes(), nil
+}
+
+// 启动服务
+func (r *RPCConn) StartService(handle []byte) error {
+	return r.StartServiceContext(context.Background(), handle)
+}
+
+func (r *RPCConn) StartServiceContext(ctx context.Context, handle []byte) error {
+	var res scmrResult
+	return r.scmrCall(ctx, NewRStartServiceWRequest(handle), &res, "RStartServiceW")
+}
+
+// 删除服务
+func (r *RPCConn) DeleteService(handle []byte) error {
+	return r.DeleteServiceContext(context.Background(), handle)
+}
+
+func (r *RPCConn) DeleteServiceContext(ctx context.Context, handle []byte) error {
+	var res scmrResult
+	return r.scmrCall(ctx, NewRDeleteServiceRequest(handle), &res, "RDeleteService")
+}
+
+// 关闭scm或服务句柄
+func (r *RPCConn) CloseServiceHandle(handle []byte) error {
+	return r.CloseServiceHandleContext(context.Background(), handle)
+}
+
+func (r *RPCConn) CloseServiceHandleContext(ctx context.Context, handle []byte) error {
+	var res scmrHandleResult
+	return r.scmrCall(ctx, NewRCloseServiceHandleRequest(handle), &res, "RCloseServiceHandle")
+}
+
+// REnumServicesStatusW接收缓冲区的最大长度
+const maxEnumServicesBufSize = 256 * 1024
+
+// ENUM_SERVICE_STATUSW长度，服务名与显示名偏移以及SERVICE_STATUS
+const enumServiceStatusSize = 36
+
+// 枚举服务，缓冲区不足时按服务端返回的长度继续枚举剩余的服务
+func (r *RPCConn) EnumServicesStatus(scHandle []byte, serviceType, serviceState uint32) ([]ServiceEntry, error) {
+	return r.EnumServicesStatusContext(context.Background(), scHandle, serviceType, serviceState)
+}
+
+func (r *RPCConn) EnumServicesStatusContext(ctx context.Context, scHandle []byte, serviceType, serviceState uint32) ([]ServiceEntry, error) {
+	var services []ServiceEntry
+	var resumeIndex, bufSize uint32
+	for {
+		var res scmrEnumResult
+		req := NewREnumServicesStatusWRequest(scHandle, serviceType, serviceState, bufSize, &resumeIndex)
+		if err := r.ndrCall(ctx, req.OpNum, req.Buffer, &res, "REnumServicesStatusW"); err != nil {
+			return nil, err
+		}
+		if res.ReturnCode != dcerpc.RPC_S_OK && res.ReturnCode != dcerpc.ERROR_MORE_DATA {
+			return nil, rpcStatusError("REnumServicesStatusW service active", res.ReturnCode)
+		}
+		entries, err := parseEnumServiceStatus(res.Buffer, res.ServicesReturned)
+		if err != nil {
+			return nil, err
+		}
+		services = append(services, entries...)
+		if res.ReturnCode == dcerpc.RPC_S_OK {
+			return services, nil
+		}
+		// 没有返回服务且所需长度未增加时无法继续
+		if len(entries) == 0 && res.BytesNeeded <= bufSize {
+			return nil, errors.New("Invalid REnumServicesStatusW response")
+		}
+		if res.ResumeIndex != nil {
+			resumeIndex = *res.ResumeIndex
+		}
+		bufSize = res.BytesNeeded
+		if bufSize > maxEnumServicesBufSize {
+			bufSize = maxEnumServicesBufSize
+		}
+	}
+}
+
+// 解析ENUM_SERVICE_STATUSW数组，名称为相对缓冲区开头的偏移
+func parseEnumServiceStatus(buf []byte, count uint32) ([]ServiceEntry, error) {
+	if uint64(len(buf)) < uint64(count)*enumServiceStatusSize {
+		return nil, errors.New("Invalid REnumServicesStatusW response")
+	}
+	services := make([]ServiceEntry, 0, count)
+	for i := 0; i < int(count); i++ {
+		e := buf[i*enumServiceStatusSize:]
+		name, err := bufferString(buf, binary.LittleEndian.Uint32(e))
+		if err != nil {
+			return nil, err
+		}
+		display, err := bufferString(buf, binary.LittleEndian.Uint32(e[4:]))
+		if err != nil {
+			return nil, err
+		}
+		services = append(services, ServiceEntry{
+			ServiceName: name,
+			DisplayName: display,
+			Status: ServiceStatus{
+				ServiceType:             binary.LittleEndian.Uint32(e[8:]),
+				CurrentState:            binary.LittleEndian.Uint32(e[12:]),
+				ControlsAccepted:        binary.LittleEndian.Uint32(e[16:]),
+				Win32ExitCode:           binary.LittleEndian.Uint32(e[20:]),
+				ServiceSpecificExitCode: binary.LittleEndian.Uint32(e[24:]),
+				CheckPoint:              binary.LittleEndian.Uint32(e[28:]),
+				WaitHint:                binary.LittleEndian.Uint32(e[32:]),
+			},
+		})
+	}
+	return services, nil
+}
+
+// 读取缓冲区中偏移处以空字符结尾的unicode字符串
+func bufferString(buf []byte, offset uint32) (string, error) {
+	if uint64(offset) >= uint64(len(buf)) {
+		return "", errors.New("Invalid REnumServicesStatusW response: string offset out of range")
+	}
+	b := buf[offset:]
+	for i := 0; i+1 < len(b); i += 2 {
+		if b[i] == 0 && b[i+1] == 0 {
+			return encoder.FromUnicode(b[:i]), nil
 		}
 	}
-	c.Debug("Completed RCloseServiceHandle ", nil)
+	return encoder.FromUnicode(b), nil
+}
+
+// 查询服务状态
+func (r *RPCConn) QueryServiceStatus(handle []byte) (ServiceStatus, error) {
+	return r.QueryServiceStatusContext(context.Background(), handle)
+}
+
+func (r *RPCConn) QueryServiceStatusContext(ctx context.Context, handle []byte) (ServiceStatus, error) {
+	var res scmrStatusResult
+	if err := r.scmrCall(ctx, NewRQueryServiceStatusRequest(handle), &res, "RQueryServiceStatus"); err != nil {
+		return ServiceStatus{}, err
+	}
+	return res.Status, nil
+}
+
+// 查询服务配置，首次调用获取所需的缓冲区长度
+func (r *RPCConn) QueryServiceConfig(handle []byte) (ServiceConfig, error) {
+	return r.QueryServiceConfigContext(context.Background(), handle)
+}
+
+func (r *RPCConn) QueryServiceConfigContext(ctx context.Context, handle []byte) (ServiceConfig, error) {
+	var res scmrConfigResult
+	req := NewRQueryServiceConfigWRequest(handle, 0)
+	if err := r.ndrCall(ctx, req.OpNum, req.Buffer, &res, "RQueryServiceConfigW"); err != nil {
+		return ServiceConfig{}, err
+	}
+	if res.ReturnCode == dcerpc.ERROR_INSUFFICIENT_BUFFER {
+		needed := res.BytesNeeded
+		res = scmrConfigResult{}
+		if err := r.scmrCall(ctx, NewRQueryServiceConfigWRequest(handle, needed), &res, "RQueryServiceConfigW"); err != nil {
+			return ServiceConfig{}, err
+		}
+	} else if res.ReturnCode != dcerpc.RPC_S_OK {
+		return ServiceConfig{}, rpcStatusError("RQueryServiceConfigW service active", res.ReturnCode)
+	}
+	c := res.Config
+	config := ServiceConfig{
+		ServiceType:      c.ServiceType,
+		StartType:        c.StartType,
+		ErrorControl:     c.ErrorControl,
+		BinaryPathName:   c.BinaryPathName,
+		LoadOrderGroup:   c.LoadOrderGroup,
+		TagId:            c.TagId,
+		ServiceStartName: c.ServiceStartName,
+		DisplayName:      c.DisplayName,
+	}
+	for _, name := range strings.Split(c.Dependencies, "\x00") {
+		if name != "" {
+			config.Dependencies = append(config.Dependencies, name)
+		}
+	}
+	return config, nil
+}
+
+// 修改服务配置
+func (r *RPCConn) ChangeServiceConfig(handle []byte, change ServiceConfigChange) error {
+	return r.ChangeServiceConfigContext(context.Background(), handle, change)
+}
+
+func (r *RPCConn) ChangeServiceConfigContext(ctx context.Context, handle []byte, change ServiceConfigChange) error {
+	var res scmrChangeResult
+	return r.scmrCall(ctx, NewRChangeServiceConfigWRequest(handle, change), &res, "RChangeServiceConfigW")
+}
+
+// 控制服务，返回服务的最新状态
+func (r *RPCConn) ControlService(handle []byte, control uint32) (ServiceStatus, error) {
+	return r.ControlServiceContext(context.Background(), handle, control)
+}
+
+func (r *RPCConn) ControlServiceContext(ctx context.Context, handle []byte, control uint32) (ServiceStatus, error) {
+	var res scmrStatusResult
+	if err := r.scmrCall(ctx, NewRControlServiceRequest(handle, control), &res, "RControlService"); err != nil {
+		return ServiceStatus{}, err
+	}
+	return res.Status, nil
+}
+
+// 由服务名查询显示名
+func (r *RPCConn) GetServiceDisplayName(scHandle []byte, servicename string) (string, error) {
+	return r.GetServiceDisplayNameContext(context.Background(), scHandle, servicename)
+}
+
+func (r *RPCConn) GetServiceDisplayNameContext(ctx context.Context, scHandle []byte, servicename string) (string, error) {
+	var res scmrNameResult
+	if err := r.scmrCall(ctx, NewRGetServiceDisplayNameWRequest(scHandle, servicename), &res, "RGetServiceDisplayNameW"); err != nil {
+		return "", err
+	}
+	return res.Name, nil
+}
+
+// 由显示名查询服务名
+func (r *RPCConn) GetServiceKeyName(scHandle []byte, displayname string) (string, error) {
+	return r.GetServiceKeyNameContext(context.Background(), scHandle, displayname)
+}
+
+func (r *RPCConn) GetServiceKeyNameContext(ctx context.Context, scHandle []byte, displayname string) (string, error) {
+	var res scmrNameResult
+	if err := r.scmrCall(ctx, NewRGetServiceKeyNameWRequest(scHandle, displayname), &res, "RGetServiceKeyNameW"); err != nil {
+		return "", err
+	}
+	return res.Name, nil
+}
+
+// 按NDR编码请求的Buffer并调用，响应解码到out并检查返回值
+func (r *RPCConn) scmrCall(ctx context.Context, req MSRPCRequestHeaderStruct, out ndrResult, op string) error {
+	if err := r.ndrCall(ctx, req.OpNum, req.Buffer, out, op); err != nil {
+		return err
+	}
+	if code := out.status(); code != dcerpc.RPC_S_OK {
+		return rpcStatusError(op+" service active", code)
+	}
 	return nil
 }
 
 // 服务安装
 func (c *SMBClient) ServiceInstall(servicename, file, path string) (service string, servicehandle []byte, err error) {
+	return c.ServiceInstallContext(context.Background(), servicename, file, path)
+}
+
+func (c *SMBClient) ServiceInstallContext(ctx context.Context, servicename, file, path string) (service string, servicehandle []byte, err error) {
 	// 上传文件
-	filename, err := c.FileUpload(file, path)
+	filename := filepath.Base(file)
+	err = c.FileUploadContext(ctx, filepath.Join(path, file), serviceShare, filename)
 	if err != nil {
 		fmt.Println("[-]", err)
 		return "", nil, err
 	}
 	//建立ipc$管道
-	treeId, err := c.TreeConnect("IPC$")
+	treeId, err := c.TreeConnectContext(ctx, "IPC$")
 	if err != nil {
 		fmt.Println("[-]", err)
 		return "", nil, err
@@ -354,14 +642,14 @@ func (c *SMBClient) ServiceInstall(servicename, file, path string) (service stri
 	var callId uint32
 	callId = 2
 	// 打开服务管理
-	svcctlFileId, svcctlHandler, err := c.OpenSvcManager(treeId, callId)
+	svcctlFileId, svcctlHandler, err := c.OpenSvcManagerContext(ctx, treeId, callId)
 	callId++
 	if err != nil {
 		fmt.Println("[-]", err)
 		return "", nil, err
 	}
 	// 打开服务
-	err = c.OpenService(treeId, svcctlFileId, svcctlHandler, servicename, callId)
+	_, err = c.OpenServiceContext(ctx, treeId, svcctlFileId, svcctlHandler, servicename, callId)
 	if err != nil {
 		fmt.Println("[-]", err)
 		//return "", err
@@ -369,21 +657,21 @@ func (c *SMBClient) ServiceInstall(servicename, file, path string) (service stri
 	callId++
 	// 创建服务
 	uploadFilePath := "%systemdrive%\\" + filename
-	serviceHandle, err := c.CreateService(treeId, svcctlFileId, svcctlHandler, servicename, uploadFilePath, callId)
+	serviceHandle, err := c.CreateServiceContext(ctx, treeId, svcctlFileId, svcctlHandler, servicename, uploadFilePath, callId)
 	if err != nil {
 		fmt.Println("[-]", err)
 		return "", nil, err
 	}
 	callId++
 	// 启动服务
-	err = c.StartService(treeId, svcctlFileId, serviceHandle, callId)
+	err = c.StartServiceContext(ctx, treeId, svcctlFileId, serviceHandle, callId)
 	if err != nil {
 		fmt.Println("[-]", err)
 		return servicename, serviceHandle, err
 	}
 	callId++
 	// 关闭服务管理
-	err = c.CloseService(treeId, svcctlFileId, svcctlHandler, callId)
+	err = c.CloseServiceContext(ctx, treeId, svcctlFileId, svcctlHandler, callId)
 	if err != nil {
 		fmt.Println("[-]", err)
 		return servicename, serviceHandle, err
@@ -393,8 +681,12 @@ func (c *SMBClient) ServiceInstall(servicename, file, path string) (service stri
 
 // 服务删除
 func (c *SMBClient) ServiceDelete(serviceHandle []byte) (err error) {
+	return c.ServiceDeleteContext(context.Background(), serviceHandle)
+}
+
+func (c *SMBClient) ServiceDeleteContext(ctx context.Context, serviceHandle []byte) (err error) {
 	//建立ipc$管道
-	treeId, err := c.TreeConnect("IPC$")
+	treeId, err := c.TreeConnectContext(ctx, "IPC$")
 	if err != nil {
 		fmt.Println("[-]", err)
 		return err
@@ -402,21 +694,21 @@ func (c *SMBClient) ServiceDelete(serviceHandle []byte) (err error) {
 	var callId uint32
 	callId = 7
 	// 打开服务管理
-	svcctlFileId, svcctlHandler, err := c.OpenSvcManager(treeId, callId)
+	svcctlFileId, svcctlHandler, err := c.OpenSvcManagerContext(ctx, treeId, callId)
 	if err != nil {
 		fmt.Println("[-]", err)
 		return err
 	}
 	callId++
 	// 删除服务
-	err = c.DeleteService(treeId, svcctlFileId, serviceHandle, callId)
+	err = c.DeleteServiceContext(ctx, treeId, svcctlFileId, serviceHandle, callId)
 	if err != nil {
 		fmt.Println("[-]", err)
 		return err
 	}
 	callId++
 	// 关闭服务管理
-	err = c.CloseService(treeId, svcctlFileId, svcctlHandler, callId)
+	err = c.CloseServiceContext(ctx, treeId, svcctlFileId, svcctlHandler, callId)
 	if err != nil {
 		fmt.Println("[-]", err)
 		return err
@@ -0,0 +1,64 @@
+package v5
+
+import "encoding/binary"
+
+// 此文件提供手工构造PDU的辅助方法以及接口共用的NDR类型，存根数据由encoder包按结构体标签编码
+// https://pubs.opengroup.org/onlinepubs/9629399/chap14.htm
+
+// 上下文句柄，对应ndr_context_handle，由uint32与uuid组成，按4字节对齐
+// 不能用[20]byte描述，否则跟在非4字节对齐的字段之后时缺少填充
+// https://pubs.opengroup.org/onlinepubs/9629399/apdxn.htm
+type ContextHandle struct {
+	Attributes uint32
+	UUID       [16]byte
+}
+
+// 由20字节的句柄构造，长度不足时返回空句柄
+func NewContextHandle(b []byte) ContextHandle {
+	var h ContextHandle
+	if len(b) < 20 {
+		return h
+	}
+	h.Attributes = binary.LittleEndian.Uint32(b)
+	copy(h.UUID[:], b[4:20])
+	return h
+}
+
+// 20字节的句柄，与NDR编码一致
+func (h ContextHandle) Bytes() []byte {
+	b := make([]byte, 20)
+	binary.LittleEndian.PutUint32(b, h.Attributes)
+	copy(b[4:], h.UUID[:])
+	return b
+}
+
+// 是否为空句柄
+func (h ContextHandle) IsZero() bool {
+	return h == ContextHandle{}
+}
+
+// NDR写入
+type ndrWriter struct {
+	buf []byte
+}
+
+// 按n字节对齐，填充0
+func (w *ndrWriter) align(n int) {
+	for len(w.buf)%n != 0 {
+		w.buf = append(w.buf, 0)
+	}
+}
+
+func (w *ndrWriter) uint16(v uint16) {
+	w.align(2)
+	w.buf = append(w.buf, byte(v), byte(v>>8))
+}
+
+func (w *ndrWriter) uint32(v uint32) {
+	w.align(4)
+	w.buf = append(w.buf, byte(v), byte(v>>8), byte(v>>16), byte(v>>24))
+}
+
+func (w *ndrWriter) bytes(b []byte) {
+	w.buf = append(w.buf, b...)
+}
@@ -0,0 +1,239 @@
+package v5
+
+import (
+	"bytes"
+	"encoding/hex"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/4ra1n/go-impacket/pkg/encoder"
+)
+
+// 各接口存根的测试向量按NDR规范与接口idl手工推导，引用id从0x00020000开始每次加4
+
+func ndrHex(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(strings.Join(strings.Fields(s), ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func testHandle() ContextHandle {
+	b := make([]byte, 20)
+	b[0] = 1
+	for i := 4; i < 20; i++ {
+		b[i] = byte(i - 3)
+	}
+	return NewContextHandle(b)
+}
+
+const testHandleHex = `01000000 0102030405060708090a0b0c0d0e0f10`
+
+func TestContextHandle(t *testing.T) {
+	h := testHandle()
+	if h.Attributes != 1 || h.UUID[0] != 1 || h.UUID[15] != 16 {
+		t.Fatalf("unexpected handle %+v", h)
+	}
+	if !bytes.Equal(h.Bytes(), ndrHex(t, testHandleHex)) {
+		t.Fatalf("Bytes() = %x", h.Bytes())
+	}
+	if h.IsZero() || !NewContextHandle(nil).IsZero() {
+		t.Fatal("IsZero mismatch")
+	}
+	// 句柄跟在单字节字段之后时按4字节对齐
+	v := struct {
+		Flag   uint8
+		Handle ContextHandle
+	}{Flag: 0xff, Handle: h}
+	got, err := encoder.MarshalNDR(&v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := ndrHex(t, `ff000000`+testHandleHex); !bytes.Equal(got, want) {
+		t.Fatalf("got %x\nwant %x", got, want)
+	}
+}
+
+func TestNDRStubVectors(t *testing.T) {
+	resume := uint32(0)
+	tower := &EPMTower{Length: 3, Octets: []byte{0xde, 0xad, 0xbe}}
+	tests := []struct {
+		name  string
+		v     interface{}
+		ndr20 string
+		ndr64 string
+	}{
+		{
+			name: "NetrShareEnum level 1 request",
+			v: &netrShareEnumRequest{
+				ServerName: `\\x`,
+				InfoStruct: shareEnumStruct{
+					Level:     1,
+					ShareInfo: shareEnumUnion{Level: 1, Level1: &shareInfo1Container{}},
+				},
+				PreferedMaximumLength: 0xffffffff,
+				ResumeHandle:          &resume,
+			},
+			ndr20: `00000200 04000000 00000000 04000000 5c005c00 78000000
+				01000000 01000000 04000200
+				00000000 00000000
+				ffffffff
+				08000200 00000000`,
+			ndr64: `0000020000000000 0400000000000000 0000000000000000 0400000000000000 5c005c00 78000000
+				01000000 00000000 01000000 00000000 0400020000000000
+				00000000 00000000 0000000000000000
+				ffffffff 00000000
+				0800020000000000 00000000`,
+		},
+		{
+			name: "NetrShareEnum level 1 response",
+			v: &netrShareEnumResult{
+				InfoStruct: shareEnumStruct{
+					Level: 1,
+					ShareInfo: shareEnumUnion{Level: 1, Level1: &shareInfo1Container{
+						EntriesRead: 2,
+						Buffer: []shareInfo1{
+							{Name: "A"},
+							{Name: "IPC$", Type: 0x80000003, Remark: "x"},
+						},
+					}},
+				},
+				TotalEntries: 2,
+			},
+			ndr20: `01000000 01000000 00000200
+				02000000 04000200
+				02000000
+				08000200 00000000 00000000
+				0c000200 03000080 10000200
+				02000000 00000000 02000000 41000000
+				05000000 00000000 05000000 49005000 43002400 0000 0000
+				02000000 00000000 02000000 78000000
+				02000000 00000000 00000000`,
+			ndr64: `01000000 00000000 01000000 00000000 0000020000000000
+				02000000 00000000 0400020000000000
+				0200000000000000
+				0800020000000000 00000000 00000000 0000000000000000
+				0c00020000000000 03000080 00000000 1000020000000000
+				0200000000000000 0000000000000000 0200000000000000 41000000
+				00000000 0500000000000000 0000000000000000 0500000000000000 49005000 43002400 0000
+				000000000000 0200000000000000 0000000000000000 0200000000000000 78000000
+				02000000 0000000000000000 00000000`,
+		},
+		{
+			// 塔的长度为3，句柄前需要1字节填充
+			name: "ept_map request",
+			v: &eptMapRequest{
+				Object:      new([16]byte),
+				MapTower:    tower,
+				EntryHandle: testHandle(),
+				MaxTowers:   4,
+			},
+			ndr20: `00000200 00000000000000000000000000000000
+				04000200 03000000 03000000 deadbe 00
+				` + testHandleHex + `
+				04000000`,
+			ndr64: `0000020000000000 00000000000000000000000000000000
+				0400020000000000 0300000000000000 03000000 deadbe 00
+				` + testHandleHex + `
+				04000000`,
+		},
+		{
+			name: "ept_map response",
+			v: &eptMapResult{
+				NumTowers: 1,
+				Towers:    []*EPMTower{tower},
+			},
+			ndr20: `00000000 00000000000000000000000000000000
+				01000000
+				01000000 00000000 01000000 00000200
+				03000000 03000000 deadbe 00
+				00000000`,
+			ndr64: `00000000 00000000000000000000000000000000
+				01000000
+				0100000000000000 0000000000000000 0100000000000000 0000020000000000
+				0300000000000000 03000000 deadbe 00
+				00000000`,
+		},
+		{
+			name:  "RQueryServiceConfigW request",
+			v:     &RQueryServiceConfigWRequestStruct{ContextHandle: testHandle(), BufSize: 8192},
+			ndr20: testHandleHex + `00200000`,
+			ndr64: testHandleHex + `00200000`,
+		},
+		{
+			name: "RQueryServiceConfigW response",
+			v: &scmrConfigResult{
+				Config: queryServiceConfigW{
+					ServiceType:      0x10,
+					StartType:        3,
+					ErrorControl:     1,
+					BinaryPathName:   "a.exe",
+					ServiceStartName: "LocalSystem",
+					DisplayName:      "A",
+				},
+				BytesNeeded: 0x70,
+			},
+			ndr20: `10000000 03000000 01000000 00000200 00000000 00000000 00000000 04000200 08000200
+				06000000 00000000 06000000 6100 2e00 6500 7800 6500 0000
+				0c000000 00000000 0c000000 4c006f00 63006100 6c005300 79007300 74006500 6d000000
+				02000000 00000000 02000000 41000000
+				70000000 00000000`,
+			ndr64: `10000000 03000000 01000000 00000000 0000020000000000 0000000000000000
+				00000000 00000000 0000000000000000 0400020000000000 0800020000000000
+				0600000000000000 0000000000000000 0600000000000000 6100 2e00 6500 7800 6500 0000
+				00000000 0c00000000000000 0000000000000000 0c00000000000000
+				4c006f00 63006100 6c005300 79007300 74006500 6d000000
+				0200000000000000 0000000000000000 0200000000000000 41000000
+				70000000 00000000`,
+		},
+	}
+	for _, tt := range tests {
+		for _, ndr64 := range []bool{false, true} {
+			want, name := tt.ndr20, tt.name+"/ndr20"
+			marshal, unmarshal := encoder.MarshalNDR, encoder.UnmarshalNDR
+			if ndr64 {
+				want, name = tt.ndr64, tt.name+"/ndr64"
+				marshal, unmarshal = encoder.MarshalNDR64, encoder.UnmarshalNDR64
+			}
+			t.Run(name, func(t *testing.T) {
+				wantBytes := ndrHex(t, want)
+				got, err := marshal(tt.v)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(got, wantBytes) {
+					t.Fatalf("marshal mismatch\n got %x\nwant %x", got, wantBytes)
+				}
+				out := reflect.New(reflect.TypeOf(tt.v).Elem())
+				if err = unmarshal(wantBytes, out.Interface()); err != nil {
+					t.Fatal(err)
+				}
+				if !reflect.DeepEqual(out.Interface(), tt.v) {
+					t.Fatalf("unmarshal mismatch\n got %+v\nwant %+v", out.Elem(), reflect.ValueOf(tt.v).Elem())
+				}
+			})
+		}
+	}
+}
+
+// 服务端按max_towers返回一致数组的最大数量，大于实际数量
+func TestEptMapResponseMaxTowers(t *testing.T) {
+	buf := ndrHex(t, `00000000 00000000000000000000000000000000
+		01000000
+		04000000 00000000 01000000 00000200
+		03000000 03000000 deadbe 00
+		00000000`)
+	var res eptMapResult
+	if err := encoder.UnmarshalNDR(buf, &res); err != nil {
+		t.Fatal(err)
+	}
+	if !res.EntryHandle.IsZero() || res.NumTowers != 1 || len(res.Towers) != 1 {
+		t.Fatalf("unexpected result %+v", res)
+	}
+	if !bytes.Equal(res.Towers[0].Octets, []byte{0xde, 0xad, 0xbe}) {
+		t.Fatalf("tower octets %x", res.Towers[0].Octets)
+	}
+}
@@ -0,0 +1,361 @@
+package v5
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/4ra1n/go-impacket/pkg/common"
+	"github.com/4ra1n/go-impacket/pkg/dcerpc"
+	"github.com/4ra1n/go-impacket/pkg/encoder"
+	"github.com/4ra1n/go-impacket/pkg/util"
+)
+
+// 此文件提供RemCom服务的客户端，通过命名管道在目标上执行命令并转发标准输入输出
+// 服务端为RemComSvc，需先作为服务安装并启动
+
+// RemCom使用的管道名称，通信管道名称沿用服务端的拼写
+const (
+	RemComCommunicationPipe = "RemCom_communicaton"
+	RemComStdInPipe         = "RemCom_stdin"
+	RemComStdOutPipe        = "RemCom_stdout"
+	RemComStdErrPipe        = "RemCom_stderr"
+)
+
+const (
+	remComNormalPriority = 0x20 // NORMAL_PRIORITY_CLASS
+	remComPipeRetries    = 20   // 服务启动后创建管道前等待的次数
+	remComPipeRetryDelay = 500 * time.Millisecond
+	remComRemoveRetries  = 5 // 进程退出前可执行文件无法删除
+	remComRemoveDelay    = time.Second
+	remComDrainTimeout   = 5 * time.Second // 进程退出后等待剩余输出的时间
+)
+
+// 发送到通信管道的执行请求，字符串为单字节定长字段
+type RemComMessage struct {
+	Command    []byte // 4096字节
+	WorkingDir []byte // 260字节
+	Priority   uint32
+	ProcessID  uint32
+	Machine    []byte // 260字节
+	NoWait     uint32
+}
+
+// 进程退出后从通信管道返回的结果
+type RemComResponse struct {
+	ErrorCode  uint32
+	ReturnCode uint32
+}
+
+// 初始化执行请求，Machine与ProcessID共同组成本次会话的输入输出管道名称
+func NewRemComMessage(command, workingDir string) RemComMessage {
+	return RemComMessage{
+		Command:    fixedString(command, 4096),
+		WorkingDir: fixedString(workingDir, 260),
+		Priority:   remComNormalPriority,
+		ProcessID:  uint32(os.Getpid()),
+		Machine:    fixedString(string(util.Random(4)), 260),
+	}
+}
+
+// 以空字符结尾的定长字段
+func fixedString(s string, n int) []byte {
+	b := make([]byte, n)
+	copy(b[:n-1], s)
+	return b
+}
+
+// 会话的管道名称后缀
+func (m RemComMessage) session() string {
+	return fmt.Sprintf("%s%d", strings.TrimRight(string(m.Machine), "\x00"), m.ProcessID)
+}
+
+// 已安装的RemCom服务，记录清理时需要的服务名与上传的文件名
+type RemComService struct {
+	c    *SMBClient
+	Name string
+	File string // serviceShare下的文件名
+}
+
+// smb->上传RemComSvc并安装为服务后启动，失败时清理已完成的步骤
+func (c *SMBClient) RemComInstall(servicename, file, path string) (*RemComService, error) {
+	return c.RemComInstallContext(context.Background(), servicename, file, path)
+}
+
+func (c *SMBClient) RemComInstallContext(ctx context.Context, servicename, file, path string) (*RemComService, error) {
+	filename := filepath.Base(file)
+	if err := c.FileUploadContext(ctx, filepath.Join(path, file), serviceShare, filename); err != nil {
+		return nil, err
+	}
+	s := &RemComService{c: c, Name: servicename, File: filename}
+	err := s.withSvcManager(ctx, func(treeId uint32, fileId, scHandle []byte, callId *uint32) error {
+		handle, err := c.CreateServiceContext(ctx, treeId, fileId, scHandle, servicename, "%systemdrive%\\"+filename, *callId)
+		*callId++
+		if err != nil {
+			return err
+		}
+		err = c.StartServiceContext(ctx, treeId, fileId, handle, *callId)
+		*callId++
+		cleanup, cancel := common.CleanupContext(ctx)
+		defer cancel()
+		if err != nil {
+			c.DeleteServiceContext(cleanup, treeId, fileId, handle, *callId)
+			*callId++
+		}
+		c.CloseServiceContext(cleanup, treeId, fileId, handle, *callId)
+		*callId++
+		return err
+	})
+	if err != nil {
+		cleanup, cancel := common.CleanupContext(ctx)
+		defer cancel()
+		s.removeFile(cleanup)
+		return nil, err
+	}
+	return s, nil
+}
+
+// 停止并删除服务，再删除上传的文件
+func (s *RemComService) Remove() error {
+	return s.RemoveContext(context.Background())
+}
+
+func (s *RemComService) RemoveContext(ctx context.Context) error {
+	c := s.c
+	err := s.withSvcManager(ctx, func(treeId uint32, fileId, scHandle []byte, callId *uint32) error {
+		handle, err := c.OpenServiceContext(ctx, treeId, fileId, scHandle, s.Name, *callId)
+		*callId++
+		if err != nil {
+			return err
+		}
+		defer func() {
+			c.CloseServiceContext(ctx, treeId, fileId, handle, *callId)
+			*callId++
+		}()
+		_, err = c.ControlServiceContext(ctx, treeId, fileId, handle, SERVICE_CONTROL_STOP, *callId)
+		*callId++
+		var status dcerpc.StatusError
+		if err != nil && !(errors.As(err, &status) && status == dcerpc.ERROR_SERVICE_NOT_ACTIVE) {
+			c.Debug("", err)
+		}
+		err = c.DeleteServiceContext(ctx, treeId, fileId, handle, *callId)
+		*callId++
+		return err
+	})
+	if fileErr := s.removeFile(ctx); err == nil {
+		err = fileErr
+	}
+	return err
+}
+
+// 服务停止后进程退出需要一定时间，期间文件仍被占用
+func (s *RemComService) removeFile(ctx context.Context) error {
+	var err error
+	for i := 0; i < remComRemoveRetries; i++ {
+		if err = s.c.RemoveContext(ctx, serviceShare, s.File); err == nil {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(remComRemoveDelay):
+		}
+	}
+	return err
+}
+
+// 打开服务管理并在结束后关闭句柄与管道
+func (s *RemComService) withSvcManager(ctx context.Context, fn func(treeId uint32, fileId, scHandle []byte, callId *uint32) error) error {
+	c := s.c
+	treeId, err := c.TreeConnectContext(ctx, "IPC$")
+	if err != nil {
+		return err
+	}
+	var callId uint32 = 1
+	fileId, scHandle, err := c.OpenSvcManagerContext(ctx, treeId, callId)
+	if err != nil {
+		return err
+	}
+	// ctx取消后仍关闭句柄，服务标记删除后需关闭全部句柄才会真正删除
+	cleanup, cancel := common.CleanupContext(ctx)
+	defer cancel()
+	defer c.CloseRequestContext(cleanup, treeId, fileId)
+	callId++
+	err = fn(treeId, fileId, scHandle, &callId)
+	c.CloseServiceContext(cleanup, treeId, fileId, scHandle, callId)
+	return err
+}
+
+// RemCom会话，每个会话使用独立的输入、输出以及错误管道
+type RemComSession struct {
+	c      *SMBClient
+	treeId uint32
+	comm   []byte
+	stdin  []byte
+	stdout []byte
+	stderr []byte
+}
+
+// smb->连接通信管道并发送执行请求，打开本次会话的输入输出管道
+func (c *SMBClient) RemComExec(command, workingDir string) (*RemComSession, error) {
+	return c.RemComExecContext(context.Background(), command, workingDir)
+}
+
+func (c *SMBClient) RemComExecContext(ctx context.Context, command, workingDir string) (*RemComSession, error) {
+	treeId, err := c.TreeConnectContext(ctx, "IPC$")
+	if err != nil {
+		c.Debug("", err)
+		return nil, err
+	}
+	s := &RemComSession{c: c, treeId: treeId}
+	if s.comm, err = s.openPipe(ctx, RemComCommunicationPipe); err != nil {
+		return nil, err
+	}
+	msg := NewRemComMessage(command, workingDir)
+	buf, err := encoder.Marshal(msg)
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
+	c.Debug("Sending RemCom request ["+command+"]", nil)
+	if err = c.WritePipeRequestContext(ctx, treeId, buf, s.comm); err != nil {
+		s.Close()
+		return nil, err
+	}
+	session := msg.session()
+	for _, p := range []struct {
+		name   string
+		handle *[]byte
+	}{
+		{RemComStdInPipe, &s.stdin},
+		{RemComStdOutPipe, &s.stdout},
+		{RemComStdErrPipe, &s.stderr},
+	} {
+		if *p.handle, err = s.openPipe(ctx, p.name+session); err != nil {
+			s.Close()
+			return nil, err
+		}
+	}
+	c.Debug("Completed RemCom session ["+session+"]", nil)
+	return s, nil
+}
+
+// 服务启动或收到请求后才创建管道，管道不存在时重试
+func (s *RemComSession) openPipe(ctx context.Context, name string) ([]byte, error) {
+	var err error
+	for i := 0; i < remComPipeRetries; i++ {
+		var fileId []byte
+		if fileId, err = s.c.OpenNamedPipeContext(ctx, s.treeId, name); err == nil {
+			return fileId, nil
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(remComPipeRetryDelay):
+		}
+	}
+	s.c.Debug("", err)
+	return nil, err
+}
+
+// 并发转发输入输出直到远程进程退出，返回进程的退出码
+// stdin按行发送，行尾统一为\r\n；stdin为nil时不转发输入
+func (s *RemComSession) Relay(stdin io.Reader, stdout, stderr io.Writer) (uint32, error) {
+	return s.RelayContext(context.Background(), stdin, stdout, stderr)
+}
+
+func (s *RemComSession) RelayContext(ctx context.Context, stdin io.Reader, stdout, stderr io.Writer) (uint32, error) {
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		s.copyOutput(ctx, stdout, s.stdout)
+	}()
+	go func() {
+		defer wg.Done()
+		s.copyOutput(ctx, stderr, s.stderr)
+	}()
+	if stdin != nil {
+		go s.copyInput(ctx, stdin)
+	}
+	// 进程退出后通信管道返回结果
+	buf, err := s.c.ReadPipeRequestContext(ctx, s.treeId, s.comm)
+	if err == io.EOF {
+		return 0, errors.New("RemCom communication pipe closed")
+	}
+	if err != nil {
+		return 0, err
+	}
+	var res RemComResponse
+	if err = encoder.Unmarshal(buf, &res); err != nil {
+		return 0, fmt.Errorf("Invalid RemCom response: %w", err)
+	}
+	// 等待剩余输出，输出管道随进程退出关闭
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+	case <-time.After(remComDrainTimeout):
+	}
+	if res.ErrorCode != 0 {
+		return res.ReturnCode, fmt.Errorf("Failed to execute RemCom command : %w", dcerpc.StatusError(res.ErrorCode))
+	}
+	return res.ReturnCode, nil
+}
+
+// 输出管道关闭时结束
+func (s *RemComSession) copyOutput(ctx context.Context, w io.Writer, fileId []byte) {
+	for {
+		buf, err := s.c.ReadPipeRequestContext(ctx, s.treeId, fileId)
+		if err != nil {
+			if err != io.EOF {
+				s.c.Debug("", err)
+			}
+			return
+		}
+		if _, err = w.Write(buf); err != nil {
+			return
+		}
+	}
+}
+
+func (s *RemComSession) copyInput(ctx context.Context, r io.Reader) {
+	br := bufio.NewReader(r)
+	for {
+		line, err := br.ReadString('\n')
+		if line != "" {
+			line = strings.TrimRight(line, "\r\n") + "\r\n"
+			if werr := s.c.WritePipeRequestContext(ctx, s.treeId, []byte(line), s.stdin); werr != nil {
+				return
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// 关闭会话的全部管道
+func (s *RemComSession) Close() error {
+	var err error
+	for _, fileId := range [][]byte{s.stdin, s.stdout, s.stderr, s.comm} {
+		if fileId == nil {
+			continue
+		}
+		if closeErr := s.c.CloseRequest(s.treeId, fileId); err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
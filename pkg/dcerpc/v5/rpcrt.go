@@ -1,12 +1,10 @@
 package v5
 
 import (
-	"encoding/hex"
+	"context"
 	"errors"
-	"github.com/4ra1n/go-impacket/pkg/encoder"
-	"github.com/4ra1n/go-impacket/pkg/ms"
-	"github.com/4ra1n/go-impacket/pkg/smb/smb2"
-	"github.com/4ra1n/go-impacket/pkg/util"
+	"fmt"
+	"github.com/4ra1n/go-impacket/pkg/dcerpc"
 )
 
 // 此文件提供ms-rpce封装
@@ -56,53 +54,6 @@ type MSRPCBindStruct struct {
 	CtxItems    []CtxItemStruct //多个对象
 }
 
-// 带认证的函数绑定请求结构
-type MSRPCAuthByNTLMSSPBindStruct struct {
-	MSRPCHeaderStruct
-	MaxXmitFrag uint16
-	MaxRecvFrag uint16
-	AssocGroup  uint32
-	NumCtxItems uint8
-	Reserved    uint8
-	Reserved2   uint16
-	CtxItems    []CtxItemStruct
-	AuthInfo    AuthInfoByNTLMSSPStruct
-}
-
-type AuthInfoByNTLMSSPStruct struct {
-	AuthType                  uint8
-	AuthLevel                 uint8
-	AuthPadLen                uint8
-	AuthRsrvd                 uint8
-	AuthContextID             uint32
-	NTLMSecureServiceProvider NTLMSecureServiceProviderStruct // 俩种认证方式，ntlm、kerberos
-}
-
-// ntlm ssp
-type NTLMSecureServiceProviderStruct struct {
-	NTLMSSPIdentifier       []byte `smb:"fixed:8"`
-	NTLMMessageType         uint32
-	NegotiateFlags          uint32
-	DomainNameLen           uint16 //`smb:"len:DomainName"`
-	DomainNameMaxLen        uint16 //`smb:"len:DomainName"`
-	DomainNameBufferOffset  uint32 //`smb:"offset:DomainName"` // 从NEGOTIATE_MESSAGE的开头到DomainName中的偏移量
-	WorkstationLen          uint16 //`smb:"len:Workstation"`
-	WorkstationMaxLen       uint16 //`smb:"len:Workstation"`
-	WorkstationBufferOffset uint32 //`smb:"offset:WorkstationName"` // 从NEGOTIATE_MESSAGE的开头到WorkstationName中的偏移量
-	Version                 NTLMVersion
-	WorkstationName         []byte
-	DomainName              []byte
-}
-
-type NTLMVersion struct {
-	MajorVersion        uint8
-	MinorVersion        uint8
-	BuildNumber         uint16
-	Reserved            uint8
-	Reserved2           uint16
-	NTLMCurrentRevision uint8
-}
-
 // 函数绑定响应结构
 type MSRPCBindAckStruct struct {
 	MSRPCHeaderStruct
@@ -156,6 +107,7 @@ const (
 	PDUBind_Nak           = 13
 	PDUAlter_Context      = 14
 	PDUAlter_Context_Resp = 15
+	PDUAuth3              = 16
 	PDUShutdown           = 17
 	PDUCo_Cancel          = 18
 	PDUOrphaned           = 19
@@ -170,6 +122,8 @@ const (
 	//PDUFlagLastFrag    = 0x02
 	PDUFlagPending = 0x03
 	CancelPending  = 0x04
+	// bind与alter_context中表示支持对头部签名，与CancelPending取值相同
+	SupportHeaderSign = 0x04
 	//PDUFlagFrag        = 0x04
 	PDUFlagNoFack      = 0x08
 	PDUFlagMayBe       = 0x10
@@ -187,122 +141,175 @@ func NewMSRPCBindAck() MSRPCBindAckStruct {
 	}
 }
 
-// smb->函数绑定
+// smb->函数绑定，只提供ctxs中的传输语法并附加绑定时特性协商，之后MSRPCRequest按NDR编码的存根调用
 func (c *SMBClient) MSRPCBind(treeId uint32, fileId []byte, callId uint32, ctxs []CtxItemStruct) (err error) {
-	header := NewMSRPCHeader()
-	header.CallId = callId
-	header.PacketType = PDUBind
-	header.PacketFlags = PDUFlagPending
-	bindStruct := MSRPCBindStruct{
-		MSRPCHeaderStruct: header,
-		MaxXmitFrag:       4280,
-		MaxRecvFrag:       4280,
-		AssocGroup:        0,
-		CtxItems:          ctxs,
-	}
-	bindStruct.NumCtxItems = uint8(len(ctxs))
-	// 重新修改FragLength
-	fragLength := util.SizeOfStruct(bindStruct)
-	bindStruct.FragLength = uint16(fragLength)
-	req := c.NewWriteRequest(treeId, fileId, bindStruct)
+	return c.MSRPCBindContext(context.Background(), treeId, fileId, callId, ctxs)
+}
+
+func (c *SMBClient) MSRPCBindContext(ctx context.Context, treeId uint32, fileId []byte, callId uint32, ctxs []CtxItemStruct) (err error) {
+	return c.bindPipe(ctx, treeId, fileId, callId, negotiateCtxItems(ctxs, false))
+}
+
+// smb->同MSRPCBind，但同时提供NDR64传输语法，只用于之后通过ndrCall按协商结果编码的调用
+func (c *SMBClient) ndrBindContext(ctx context.Context, treeId uint32, fileId []byte, callId uint32, ctxs []CtxItemStruct) error {
+	return c.bindPipe(ctx, treeId, fileId, callId, negotiateCtxItems(ctxs, true))
+}
+
+func (c *SMBClient) bindPipe(ctx context.Context, treeId uint32, fileId []byte, callId uint32, ctxs []CtxItemStruct) error {
 	c.Debug("Sending rpc bind", nil)
-	_, err = c.SMBSend(req)
-	if err != nil {
+	r := newRPCConn(&SMBPipe{c: c, treeId: treeId, fileId: fileId}, c.host(), callId)
+	if _, err := r.BindContext(ctx, ctxs); err != nil {
 		c.Debug("", err)
 		return err
 	}
-	c.Debug("Read rpc response", nil)
-	req1 := c.NewReadRequest(treeId, fileId)
-	buf, err1 := c.SMBSend(req1)
-	if err1 != nil {
-		c.Debug("", err1)
-		return err1
-	}
-	smbRes := smb2.NewReadResponse()
-	res := NewMSRPCBindAck()
-	c.Debug("Unmarshalling rpc bind", nil)
-	if err = encoder.Unmarshal(buf, &smbRes); err != nil {
-		c.Debug("Raw:\n"+hex.Dump(buf), err)
-	}
-	// 切开smb头
-	startIndex := len(buf) - int(smbRes.BlobLength)
-	if err = encoder.Unmarshal(buf[startIndex:], &res); err != nil {
-		c.Debug("Raw:\n"+hex.Dump(buf), err)
-	}
-	if res.NumResults < 1 {
-		return errors.New("Failed to rpc bind code : " + ms.StatusMap[smbRes.Status])
-	}
+	c.pipes.Store(string(fileId), r)
 	c.Debug("Completed rpc bind", nil)
 	return nil
 }
 
-// tcp->函数绑定
+// tcp->函数绑定，只提供ctxs中的传输语法并附加绑定时特性协商，之后MSRPCRequest按NDR编码的存根调用
 func (c *TCPClient) MSRPCBind(callId uint32, ctxs []CtxItemStruct) (res MSRPCBindAckStruct, err error) {
-	header := NewMSRPCHeader()
-	header.CallId = callId
-	header.PacketType = PDUBind
-	header.PacketFlags = PDUFlagPending
-	bindStruct := MSRPCBindStruct{
-		MSRPCHeaderStruct: header,
-		MaxXmitFrag:       4280,
-		MaxRecvFrag:       4280,
-		AssocGroup:        0,
-		CtxItems:          ctxs,
-	}
-	bindStruct.NumCtxItems = uint8(len(ctxs))
-	// 重新修改FragLength
-	fragLength := util.SizeOfStruct(bindStruct)
-	bindStruct.FragLength = uint16(fragLength)
+	return c.MSRPCBindContext(context.Background(), callId, ctxs)
+}
+
+func (c *TCPClient) MSRPCBindContext(ctx context.Context, callId uint32, ctxs []CtxItemStruct) (res MSRPCBindAckStruct, err error) {
+	return c.bind(ctx, callId, negotiateCtxItems(ctxs, false))
+}
+
+// tcp->同MSRPCBind，但同时提供NDR64传输语法，只用于之后通过ndrCall按协商结果编码的调用
+func (c *TCPClient) ndrBindContext(ctx context.Context, callId uint32, ctxs []CtxItemStruct) error {
+	_, err := c.bind(ctx, callId, negotiateCtxItems(ctxs, true))
+	return err
+}
+
+func (c *TCPClient) bind(ctx context.Context, callId uint32, ctxs []CtxItemStruct) (res MSRPCBindAckStruct, err error) {
 	c.Debug("Sending rpc bind", nil)
-	buf, err := c.TCPSend(bindStruct)
+	r := newRPCConn(c, c.host(), callId)
+	ack, err := r.BindContext(ctx, ctxs)
+	if err != nil {
+		c.Debug("", err)
+		return MSRPCBindAckStruct{}, err
+	}
+	c.conn = r
 	res = NewMSRPCBindAck()
-	c.Debug("Unmarshalling rpc bind", nil)
-	if err = encoder.Unmarshal(buf, &res); err != nil {
-		c.Debug("Raw:\n"+hex.Dump(buf), err)
+	res.PacketType = PDUBind_Ack
+	res.CallId = callId
+	res.MaxXmitFrag = ack.MaxXmitFrag
+	res.MaxRecvFrag = ack.MaxRecvFrag
+	res.AssocGroup = ack.AssocGroup
+	if ack.SecondaryAddr != "" {
+		res.ScndryAddr = []byte(ack.SecondaryAddr + "\x00")
+		res.ScndryAddrlen = uint16(len(res.ScndryAddr))
 	}
-	if res.NumResults < 1 {
-		return MSRPCBindAckStruct{}, errors.New("Failed to rpc bind")
+	res.NumResults = uint8(len(ack.Results))
+	// 返回被接受的上下文结果
+	for _, result := range ack.Results {
+		if result.Result == ContextAcceptance {
+			res.CtxItem = CtxEItemResponseStruct{
+				AckResult:      result.Result,
+				AckReason:      result.Reason,
+				TransferSyntax: result.TransferSyntax.UUID,
+				SyntaxVer:      result.TransferSyntax.Version,
+			}
+			break
+		}
 	}
 	c.Debug("Completed rpc bind", nil)
-	return res, err
+	return res, nil
 }
 
-// 带认证场景的msrpc绑定
-func (c *TCPClient) MSRPCAuthBind(callId uint32, ctxs []CtxItemStruct, auth AuthInfoByNTLMSSPStruct, assocGroup uint32, domainNameLen, workstationNameLen uint16) (err error) {
-	header := NewMSRPCHeader()
-	header.CallId = callId
-	header.PacketType = PDUBind
-	header.PacketFlags = CancelPending | LastFrag | FirstFrag
-	// 修改AuthLength
-	authLength := util.SizeOfStruct(auth.NTLMSecureServiceProvider)
-	header.AuthLength = uint16(authLength)
-	// 计算并、修改domainName、workstationName偏移量
-	domainNameOffset := header.AuthLength - domainNameLen
-	workstationNameOffset := header.AuthLength - domainNameLen - workstationNameLen
-	auth.NTLMSecureServiceProvider.DomainNameBufferOffset = uint32(domainNameOffset)
-	auth.NTLMSecureServiceProvider.WorkstationBufferOffset = uint32(workstationNameOffset)
-	bindStruct := MSRPCAuthByNTLMSSPBindStruct{
-		MSRPCHeaderStruct: header,
-		MaxXmitFrag:       5840,
-		MaxRecvFrag:       5840,
-		AssocGroup:        assocGroup,
-		CtxItems:          ctxs,
-		AuthInfo:          auth,
+// smb->带认证的函数绑定，ntlm完成bind、auth3三次握手，Kerberos完成bind、alter_context三次交换，凭据取自会话选项
+// level为RPC_C_AUTHN_LEVEL_CONNECT、RPC_C_AUTHN_LEVEL_PKT_INTEGRITY、RPC_C_AUTHN_LEVEL_PKT_PRIVACY等，之后在该管道上的请求按级别签名或加密
+func (c *SMBClient) MSRPCAuthBind(treeId uint32, fileId []byte, callId uint32, ctxs []CtxItemStruct, level uint8) (err error) {
+	return c.MSRPCAuthBindContext(context.Background(), treeId, fileId, callId, ctxs, level)
+}
+
+func (c *SMBClient) MSRPCAuthBindContext(ctx context.Context, treeId uint32, fileId []byte, callId uint32, ctxs []CtxItemStruct, level uint8) (err error) {
+	opt := c.GetOptions()
+	if opt == nil {
+		return errors.New("Missing client options")
 	}
-	bindStruct.NumCtxItems = uint8(len(ctxs))
-	// 重新修改FragLength
-	fragLength := util.SizeOfStruct(bindStruct)
-	bindStruct.FragLength = uint16(fragLength)
-	c.Debug("Sending rpc bind", nil)
-	buf, err := c.TCPSend(bindStruct)
-	res := NewMSRPCBindAck()
-	c.Debug("Unmarshalling rpc bind", nil)
-	if err = encoder.Unmarshal(buf, &res); err != nil {
-		c.Debug("Raw:\n"+hex.Dump(buf), err)
+	c.Debug("Sending rpc auth bind", nil)
+	r := newRPCConn(&SMBPipe{c: c, treeId: treeId, fileId: fileId}, c.host(), callId).WithAuth(level, *opt)
+	if _, err = r.BindContext(ctx, negotiateCtxItems(ctxs, false)); err != nil {
+		c.Debug("", err)
+		return err
+	}
+	c.pipes.Store(string(fileId), r)
+	c.Debug("Completed rpc auth bind", nil)
+	return nil
+}
+
+// tcp->带认证的函数绑定，握手方式同SMBClient.MSRPCAuthBind，凭据取自连接选项
+// level同SMBClient.MSRPCAuthBind，之后在该连接上的请求按级别签名或加密
+func (c *TCPClient) MSRPCAuthBind(callId uint32, ctxs []CtxItemStruct, level uint8) (err error) {
+	return c.MSRPCAuthBindContext(context.Background(), callId, ctxs, level)
+}
+
+func (c *TCPClient) MSRPCAuthBindContext(ctx context.Context, callId uint32, ctxs []CtxItemStruct, level uint8) (err error) {
+	opt := c.GetOptions()
+	if opt == nil {
+		return errors.New("Missing client options")
 	}
-	if res.NumResults < 1 {
-		return errors.New("Failed to rpc bind")
+	c.Debug("Sending rpc auth bind", nil)
+	r := newRPCConn(c, c.host(), callId).WithAuth(level, *opt)
+	if _, err = r.BindContext(ctx, negotiateCtxItems(ctxs, false)); err != nil {
+		c.Debug("", err)
+		return err
 	}
-	c.Debug("Completed rpc bind", nil)
-	return err
+	c.conn = r
+	c.Debug("Completed rpc auth bind", nil)
+	return nil
+}
+
+// 请求PDU头部大小，包含AllocHint、ContextId、OpNum
+const msrpcRequestHeaderSize = 24
+
+// MSRPCRequest的存根由调用方按NDR编码，不能在协商为NDR64的上下文上发送
+var errNDR64Request = errors.New("Connection negotiated NDR64, MSRPCRequest only sends NDR stubs")
+
+// smb->通过命名管道发送请求并读取响应，返回响应的存根数据，stub需按NDR编码
+// 请求超过分片大小时自动分片，多个分片的响应按FirstFrag/LastFrag拼接
+func (c *SMBClient) MSRPCRequest(treeId uint32, fileId []byte, callId uint32, opnum uint16, stub []byte) ([]byte, error) {
+	return c.MSRPCRequestContext(context.Background(), treeId, fileId, callId, opnum, stub)
+}
+
+func (c *SMBClient) MSRPCRequestContext(ctx context.Context, treeId uint32, fileId []byte, callId uint32, opnum uint16, stub []byte) ([]byte, error) {
+	c.Debug(fmt.Sprintf("Sending rpc request opnum %d", opnum), nil)
+	r := c.NewPipeConn(treeId, fileId, callId)
+	if r.NDR64() {
+		return nil, errNDR64Request
+	}
+	out, err := r.CallContext(ctx, opnum, stub)
+	if err != nil {
+		c.Debug("", err)
+		return nil, err
+	}
+	c.Debug(fmt.Sprintf("Completed rpc request opnum %d", opnum), nil)
+	return out, nil
+}
+
+// tcp->发送请求并读取响应，返回响应的存根数据，stub需按NDR编码
+func (c *TCPClient) MSRPCRequest(callId uint32, opnum uint16, stub []byte) ([]byte, error) {
+	return c.MSRPCRequestContext(context.Background(), callId, opnum, stub)
+}
+
+func (c *TCPClient) MSRPCRequestContext(ctx context.Context, callId uint32, opnum uint16, stub []byte) ([]byte, error) {
+	c.Debug(fmt.Sprintf("Sending rpc request opnum %d", opnum), nil)
+	r := c.NewConn(callId)
+	if r.NDR64() {
+		return nil, errNDR64Request
+	}
+	out, err := r.CallContext(ctx, opnum, stub)
+	if err != nil {
+		c.Debug("", err)
+		return nil, err
+	}
+	c.Debug(fmt.Sprintf("Completed rpc request opnum %d", opnum), nil)
+	return out, nil
+}
+
+// rpc返回码转换为错误，可通过errors.As获取dcerpc.StatusError
+func rpcStatusError(op string, code uint32) error {
+	return fmt.Errorf("Failed to %s : %w", op, dcerpc.StatusError(code))
 }
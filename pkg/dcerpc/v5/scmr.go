@@ -1,7 +1,9 @@
 package v5
 
 import (
-	"github.com/4ra1n/go-impacket/pkg/encoder"
+	"fmt"
+	"strings"
+
 	"github.com/4ra1n/go-impacket/pkg/util"
 )
 
@@ -10,35 +12,30 @@ import (
 // 打开服务管理结构
 // https://docs.microsoft.com/en-us/openspecs/windows_protocols/ms-scmr/dc84adb3-d51d-48eb-820d-ba1c6ca5faf2
 type OpenSCManagerWStruct struct {
-	MachineName machineName
-	Database    database
+	MachineName string `ndr:"unique"`
+	Database    string `ndr:"unique"`
 	AccessMask  uint32
 }
 
-type machineName struct {
-	ReferentId  uint32 `smb:"offset:MachineName"`
-	MaxCount    uint32
-	Offset      uint32
-	ActualCount uint32 //机器名的长度
-	MachineName []byte //任意长度,unicode编码
-	Reserved    uint16
-}
-
-type database struct {
-	ReferentId  uint32 `smb:"offset:Database"`
-	MaxCount    uint32
-	Offset      uint32
-	ActualCount uint32 //机器名的长度
-	Database    []byte //任意长度,unicode编码
-	Reserved    uint16
-}
-
 // https://docs.microsoft.com/en-us/openspecs/windows_protocols/ms-scmr/0d7a7011-9f41-470d-ad52-8535b47ac282
 // 安全描述符
 const (
-	SERVICE_ALL_ACCESS        = 0x000F01FF
-	SC_MANAGER_CREATE_SERVICE = 0x00000002
-	SC_MANAGER_CONNECT        = 0x00000001
+	SERVICE_ALL_ACCESS           = 0x000F01FF
+	SC_MANAGER_CREATE_SERVICE    = 0x00000002
+	SC_MANAGER_CONNECT           = 0x00000001
+	SC_MANAGER_ENUMERATE_SERVICE = 0x00000004
+)
+
+// 服务句柄的访问权限
+const (
+	SERVICE_QUERY_CONFIG         = 0x00000001
+	SERVICE_CHANGE_CONFIG        = 0x00000002
+	SERVICE_QUERY_STATUS         = 0x00000004
+	SERVICE_ENUMERATE_DEPENDENTS = 0x00000008
+	SERVICE_START                = 0x00000010
+	SERVICE_STOP                 = 0x00000020
+	SERVICE_PAUSE_CONTINUE       = 0x00000040
+	SERVICE_INTERROGATE          = 0x00000080
 )
 
 // OpenSCManagerW响应结构
@@ -126,24 +123,12 @@ func NewOpenSCManagerWRequest() MSRPCRequestHeaderStruct {
 	//header.CallId = 2
 	header.PacketType = PDURequest
 	header.PacketFlags = PDUFault
-	// 服务请求
-	machinename := string(util.Random(6)) + "\x00"
-	databaseName := "ServicesActive\x00"
+	// 服务请求，Buffer按NDR编码后由RPCConn发送
 	buffer := OpenSCManagerWStruct{
-		MachineName: machineName{
-			MaxCount:    uint32(len(machinename)),
-			ActualCount: uint32(len(machinename)),
-			MachineName: encoder.ToUnicode(machinename),
-		},
-		Database: database{
-			MaxCount:    uint32(len(databaseName)),
-			ActualCount: uint32(len(databaseName)),
-			Database:    encoder.ToUnicode(databaseName),
-		},
-		AccessMask: SC_MANAGER_CREATE_SERVICE | SC_MANAGER_CONNECT,
+		MachineName: string(util.Random(6)),
+		Database:    "ServicesActive",
+		AccessMask:  SC_MANAGER_CREATE_SERVICE | SC_MANAGER_CONNECT | SC_MANAGER_ENUMERATE_SERVICE,
 	}
-	fragLength := 24 + util.SizeOfStruct(buffer)
-	header.FragLength = uint16(fragLength)
 	return MSRPCRequestHeaderStruct{
 		MSRPCHeaderStruct: header,
 		ContextId:         0,
@@ -161,8 +146,8 @@ func NewOpenSCManagerWResponse() OpenSCManagerWResponse {
 // 打开服务
 // https://docs.microsoft.com/en-us/openspecs/windows_protocols/ms-scmr/6d0a4225-451b-4132-894d-7cef7aecfd2d
 type ROpenServiceWRequestStruct struct {
-	ContextHandle []byte `smb:"fixed:20"` //OpenSCManagerW 句柄
-	ServiceName   serviceName
+	ContextHandle ContextHandle //OpenSCManagerW 句柄
+	ServiceName   string
 	AccessMask    uint32
 }
 
@@ -182,18 +167,11 @@ func NewROpenServiceWRequest(contextHandle []byte, servicename string) MSRPCRequ
 	//header.CallId = 3
 	header.PacketType = PDURequest
 	header.PacketFlags = PDUFault
-	serName := servicename + "\x00"
 	buffer := ROpenServiceWRequestStruct{
-		ContextHandle: contextHandle,
-		ServiceName: serviceName{
-			MaxCount:    uint32(len(serName)),
-			ActualCount: uint32(len(serName)),
-			ServiceName: encoder.ToUnicode(serName),
-		},
-		AccessMask: SERVICE_ALL_ACCESS,
+		ServiceName: servicename,
+		AccessMask:  SERVICE_ALL_ACCESS,
 	}
-	fragLength := 24 + util.SizeOfStruct(buffer) // 头固定大小24
-	header.FragLength = uint16(fragLength)
+	buffer.ContextHandle = NewContextHandle(contextHandle)
 	return MSRPCRequestHeaderStruct{
 		MSRPCHeaderStruct: header,
 		ContextId:         0,
@@ -211,47 +189,23 @@ func NewROpenServiceWResponse() ROpenServiceWResponseStruct {
 // 创建服务
 // https://docs.microsoft.com/en-us/openspecs/windows_protocols/ms-scmr/6a8ca926-9477-4dd4-b766-692fab07227e
 type RCreateServiceWRequestStruct struct {
-	ContextHandle       []byte `smb:"fixed:20"` //OpenSCManagerW 句柄
-	ServiceName         serviceName
-	DisplayName         displayName
+	ContextHandle       ContextHandle //OpenSCManagerW 句柄
+	ServiceName         string
+	DisplayName         string `ndr:"unique"`
 	AccessMask          uint32
 	ServiceType         uint32
 	ServiceStartType    uint32
 	ServiceErrorControl uint32
-	BinaryPathName      binaryPathName
-	NULLPointer         uint32
-	TagId               uint32
-	NULLPointer2        uint32
+	BinaryPathName      string
+	LoadOrderGroup      string `ndr:"unique"`
+	TagId               *uint32
+	Dependencies        []byte `ndr:"unique"`
 	DependSize          uint32
-	NULLPointer3        uint32
-	NULLPointer4        uint32
+	ServiceStartName    string `ndr:"unique"`
+	Password            []byte `ndr:"unique"`
 	PasswordSize        uint32
 }
 
-type serviceName struct {
-	MaxCount    uint32
-	Offset      uint32
-	ActualCount uint32
-	ServiceName []byte
-	Reserved    uint16
-}
-
-type displayName struct {
-	ReferentId  uint32 `smb:"offset:DisplayName"`
-	MaxCount    uint32
-	Offset      uint32
-	ActualCount uint32
-	DisplayName []byte
-	Reserved    uint16
-}
-
-type binaryPathName struct {
-	MaxCount       uint32
-	Offset         uint32
-	ActualCount    uint32
-	BinaryPathName []byte `smb:"fixed:26"` // 长度不能超过26字节
-}
-
 // RCreateServiceW响应结构
 type RCreateServiceWResponseStruct struct {
 	MSRPCHeaderStruct
@@ -272,6 +226,8 @@ const (
 	SERVICE_WIN32_OWN_PROCESS   = 0x00000010
 	SERVICE_WIN32_SHARE_PROCESS = 0x00000020
 	SERVICE_INTERACTIVE_PROCESS = 0x00000100
+	SERVICE_DRIVER              = SERVICE_KERNEL_DRIVER | SERVICE_FILE_SYSTEM_DRIVER
+	SERVICE_WIN32               = SERVICE_WIN32_OWN_PROCESS | SERVICE_WIN32_SHARE_PROCESS
 )
 
 // dwStartType类型
@@ -291,37 +247,24 @@ const (
 	SERVICE_ERROR_CRITICAL = 0x00000003
 )
 
+// 修改服务配置时表示保持不变
+const SERVICE_NO_CHANGE = 0xFFFFFFFF
+
 func NewRCreateServiceWRequest(contextHandle []byte, servicename, uploadPathFile string) MSRPCRequestHeaderStruct {
 	header := NewMSRPCHeader()
 	//header.CallId = 4
 	header.PacketType = PDURequest
 	header.PacketFlags = PDUFault
-	serName := servicename + "\x00"
-	uploadpathFile := uploadPathFile + "\x00"
 	buffer := RCreateServiceWRequestStruct{
-		ContextHandle: contextHandle,
-		ServiceName: serviceName{
-			MaxCount:    uint32(len(serName)),
-			ActualCount: uint32(len(serName)),
-			ServiceName: encoder.ToUnicode(serName),
-		},
-		DisplayName: displayName{
-			MaxCount:    uint32(len(serName)),
-			ActualCount: uint32(len(serName)),
-			DisplayName: encoder.ToUnicode(serName),
-		},
+		ServiceName:         servicename,
+		DisplayName:         servicename,
 		AccessMask:          SERVICE_ALL_ACCESS,
 		ServiceType:         SERVICE_WIN32_OWN_PROCESS,
 		ServiceStartType:    SERVICE_DEMAND_START,
 		ServiceErrorControl: SERVICE_ERROR_IGNORE,
-		BinaryPathName: binaryPathName{
-			MaxCount:       uint32(len(uploadpathFile)),
-			ActualCount:    uint32(len(uploadpathFile)),
-			BinaryPathName: encoder.ToUnicode(uploadpathFile),
-		},
+		BinaryPathName:      uploadPathFile,
 	}
-	fragLength := 24 + util.SizeOfStruct(buffer) // 头固定大小24
-	header.FragLength = uint16(fragLength)
+	buffer.ContextHandle = NewContextHandle(contextHandle)
 	return MSRPCRequestHeaderStruct{
 		MSRPCHeaderStruct: header,
 		ContextId:         0,
@@ -339,9 +282,9 @@ func NewRCreateServiceWResponse() RCreateServiceWResponseStruct {
 // 启动服务
 // https://docs.microsoft.com/en-us/openspecs/windows_protocols/ms-scmr/d9be95a2-cf01-4bdc-b30f-6fe4b37ada16
 type RStartServiceWRequestStruct struct {
-	ContextHandle []byte `smb:"fixed:20"` //20字节，创建服务返回的句柄
-	Argc          uint32 //argv字符串数量
-	Argv          []byte `smb:"fixed:4"` //4字节，unicode对象指针
+	ContextHandle ContextHandle //20字节，创建服务返回的句柄
+	Argc          uint32        //argv字符串数量
+	Argv          []*string     `ndr:"unique"`
 }
 
 type RStartServiceWResponseStruct struct {
@@ -359,14 +302,8 @@ func NewRStartServiceWRequest(contextHandle []byte) MSRPCRequestHeaderStruct {
 	//header.CallId = 5
 	header.PacketType = PDURequest
 	header.PacketFlags = PDUFault
-	argv := encoder.ToUnicode(string(make([]byte, 4)))
-	buffer := RStartServiceWRequestStruct{
-		ContextHandle: contextHandle,
-		Argc:          0,
-		Argv:          argv[:4],
-	}
-	fragLength := 24 + util.SizeOfStruct(buffer) // 头固定大小24
-	header.FragLength = uint16(fragLength)
+	var buffer RStartServiceWRequestStruct
+	buffer.ContextHandle = NewContextHandle(contextHandle)
 	return MSRPCRequestHeaderStruct{
 		MSRPCHeaderStruct: header,
 		ContextId:         0,
@@ -383,7 +320,7 @@ func NewRStartServiceWResponse() RStartServiceWResponseStruct {
 // 删除服务结构
 // https://learn.microsoft.com/en-us/openspecs/windows_protocols/ms-scmr/6744cdb8-f162-4be0-bb31-98996b6495be
 type RDeleteServiceRequestStruct struct {
-	ContextHandle []byte `smb:"fixed:20"` //20字节，创建服务返回的句柄
+	ContextHandle ContextHandle //20字节，创建服务返回的句柄
 }
 
 type RDeleteServiceResponseStruct struct {
@@ -401,11 +338,8 @@ func NewRDeleteServiceRequest(contextHandle []byte) MSRPCRequestHeaderStruct {
 	//header.CallId = 5
 	header.PacketType = PDURequest
 	header.PacketFlags = PDUFault
-	buffer := RDeleteServiceRequestStruct{
-		ContextHandle: contextHandle,
-	}
-	fragLength := 24 + util.SizeOfStruct(buffer) // 头固定大小24
-	header.FragLength = uint16(fragLength)
+	var buffer RDeleteServiceRequestStruct
+	buffer.ContextHandle = NewContextHandle(contextHandle)
 	return MSRPCRequestHeaderStruct{
 		MSRPCHeaderStruct: header,
 		ContextId:         0,
@@ -421,7 +355,7 @@ func NewRDeleteServiceResponse() RDeleteServiceResponseStruct {
 
 // 关闭服务句柄
 type RCloseServiceHandleRequestStruct struct {
-	ContextHandle []byte `smb:"fixed:20"`
+	ContextHandle ContextHandle
 }
 
 type RCloseServiceHandleResponseStruct struct {
@@ -440,9 +374,8 @@ func NewRCloseServiceHandleRequest(contextHandle []byte) MSRPCRequestHeaderStruc
 	//header.CallId = 6
 	header.PacketType = PDURequest
 	header.PacketFlags = PDUFault
-	buffer := RCloseServiceHandleRequestStruct{ContextHandle: contextHandle}
-	fragLength := 24 + util.SizeOfStruct(buffer) // 头固定大小24
-	header.FragLength = uint16(fragLength)
+	var buffer RCloseServiceHandleRequestStruct
+	buffer.ContextHandle = NewContextHandle(contextHandle)
 	return MSRPCRequestHeaderStruct{
 		MSRPCHeaderStruct: header,
 		ContextId:         0,
@@ -456,3 +389,324 @@ func NewRCloseServiceHandleResponse() RCloseServiceHandleResponseStruct {
 		ContextHandle: make([]byte, 20),
 	}
 }
+
+// 控制服务
+type RControlServiceRequestStruct struct {
+	ContextHandle ContextHandle //20字节，打开服务返回的句柄
+	Control       uint32
+}
+
+// dwControl类型
+const (
+	SERVICE_CONTROL_STOP        = 0x00000001
+	SERVICE_CONTROL_PAUSE       = 0x00000002
+	SERVICE_CONTROL_CONTINUE    = 0x00000003
+	SERVICE_CONTROL_INTERROGATE = 0x00000004
+)
+
+// dwCurrentState类型
+const (
+	SERVICE_STOPPED          = 0x00000001
+	SERVICE_START_PENDING    = 0x00000002
+	SERVICE_STOP_PENDING     = 0x00000003
+	SERVICE_RUNNING          = 0x00000004
+	SERVICE_CONTINUE_PENDING = 0x00000005
+	SERVICE_PAUSE_PENDING    = 0x00000006
+	SERVICE_PAUSED           = 0x00000007
+)
+
+// 初始化控制服务请求
+func NewRControlServiceRequest(contextHandle []byte, control uint32) MSRPCRequestHeaderStruct {
+	header := NewMSRPCHeader()
+	header.PacketType = PDURequest
+	header.PacketFlags = PDUFault
+	buffer := RControlServiceRequestStruct{Control: control}
+	buffer.ContextHandle = NewContextHandle(contextHandle)
+	return MSRPCRequestHeaderStruct{
+		MSRPCHeaderStruct: header,
+		ContextId:         0,
+		OpNum:             RControlService,
+		Buffer:            buffer,
+	}
+}
+
+// 查询服务状态
+type RQueryServiceStatusRequestStruct struct {
+	ContextHandle ContextHandle
+}
+
+// 初始化查询服务状态请求
+func NewRQueryServiceStatusRequest(contextHandle []byte) MSRPCRequestHeaderStruct {
+	header := NewMSRPCHeader()
+	header.PacketType = PDURequest
+	header.PacketFlags = PDUFault
+	var buffer RQueryServiceStatusRequestStruct
+	buffer.ContextHandle = NewContextHandle(contextHandle)
+	return MSRPCRequestHeaderStruct{
+		MSRPCHeaderStruct: header,
+		ContextId:         0,
+		OpNum:             RQueryServiceStatus,
+		Buffer:            buffer,
+	}
+}
+
+// 枚举服务
+type REnumServicesStatusWRequestStruct struct {
+	ContextHandle ContextHandle //OpenSCManagerW 句柄
+	ServiceType   uint32
+	ServiceState  uint32
+	BufSize       uint32
+	ResumeIndex   *uint32
+}
+
+// dwServiceState类型
+const (
+	SERVICE_ACTIVE    = 0x00000001
+	SERVICE_INACTIVE  = 0x00000002
+	SERVICE_STATE_ALL = 0x00000003
+)
+
+// 初始化枚举服务请求，bufSize为接收缓冲区大小，最大256K
+func NewREnumServicesStatusWRequest(contextHandle []byte, serviceType, serviceState, bufSize uint32, resumeIndex *uint32) MSRPCRequestHeaderStruct {
+	header := NewMSRPCHeader()
+	header.PacketType = PDURequest
+	header.PacketFlags = PDUFault
+	buffer := REnumServicesStatusWRequestStruct{
+		ServiceType:  serviceType,
+		ServiceState: serviceState,
+		BufSize:      bufSize,
+		ResumeIndex:  resumeIndex,
+	}
+	buffer.ContextHandle = NewContextHandle(contextHandle)
+	return MSRPCRequestHeaderStruct{
+		MSRPCHeaderStruct: header,
+		ContextId:         0,
+		OpNum:             REnumServicesStatusW,
+		Buffer:            buffer,
+	}
+}
+
+// 查询服务配置
+type RQueryServiceConfigWRequestStruct struct {
+	ContextHandle ContextHandle
+	BufSize       uint32
+}
+
+// 初始化查询服务配置请求，bufSize最大8K
+func NewRQueryServiceConfigWRequest(contextHandle []byte, bufSize uint32) MSRPCRequestHeaderStruct {
+	header := NewMSRPCHeader()
+	header.PacketType = PDURequest
+	header.PacketFlags = PDUFault
+	buffer := RQueryServiceConfigWRequestStruct{BufSize: bufSize}
+	buffer.ContextHandle = NewContextHandle(contextHandle)
+	return MSRPCRequestHeaderStruct{
+		MSRPCHeaderStruct: header,
+		ContextId:         0,
+		OpNum:             RQueryServiceConfigW,
+		Buffer:            buffer,
+	}
+}
+
+// 修改服务配置，字符串为空时编码为空指针，表示保持不变
+type RChangeServiceConfigWRequestStruct struct {
+	ContextHandle    ContextHandle
+	ServiceType      uint32
+	StartType        uint32
+	ErrorControl     uint32
+	BinaryPathName   string `ndr:"unique"`
+	LoadOrderGroup   string `ndr:"unique"`
+	TagId            *uint32
+	Dependencies     []byte `ndr:"unique"`
+	DependSize       uint32
+	ServiceStartName string `ndr:"unique"`
+	Password         []byte `ndr:"unique"`
+	PasswordSize     uint32
+	DisplayName      string `ndr:"unique"`
+}
+
+// 初始化修改服务配置请求，不支持修改依赖与密码
+func NewRChangeServiceConfigWRequest(contextHandle []byte, change ServiceConfigChange) MSRPCRequestHeaderStruct {
+	header := NewMSRPCHeader()
+	header.PacketType = PDURequest
+	header.PacketFlags = PDUFault
+	buffer := RChangeServiceConfigWRequestStruct{
+		ServiceType:      change.ServiceType,
+		StartType:        change.StartType,
+		ErrorControl:     change.ErrorControl,
+		BinaryPathName:   change.BinaryPathName,
+		LoadOrderGroup:   change.LoadOrderGroup,
+		ServiceStartName: change.ServiceStartName,
+		DisplayName:      change.DisplayName,
+	}
+	buffer.ContextHandle = NewContextHandle(contextHandle)
+	return MSRPCRequestHeaderStruct{
+		MSRPCHeaderStruct: header,
+		ContextId:         0,
+		OpNum:             RChangeServiceConfigW,
+		Buffer:            buffer,
+	}
+}
+
+// 服务名与显示名互查，RGetServiceDisplayNameW与RGetServiceKeyNameW参数相同
+type RGetServiceNameWRequestStruct struct {
+	ContextHandle ContextHandle //OpenSCManagerW 句柄
+	Name          string
+	BufferLength  uint32 //缓冲区可容纳的字符数，不含结尾的空字符
+}
+
+// 名称最大长度
+const SC_MAX_NAME_LENGTH = 256
+
+// 初始化查询显示名请求
+func NewRGetServiceDisplayNameWRequest(contextHandle []byte, servicename string) MSRPCRequestHeaderStruct {
+	return newRGetServiceNameWRequest(contextHandle, servicename, RGetServiceDisplayNameW)
+}
+
+// 初始化查询服务名请求
+func NewRGetServiceKeyNameWRequest(contextHandle []byte, displayname string) MSRPCRequestHeaderStruct {
+	return newRGetServiceNameWRequest(contextHandle, displayname, RGetServiceKeyNameW)
+}
+
+func newRGetServiceNameWRequest(contextHandle []byte, name string, opnum uint16) MSRPCRequestHeaderStruct {
+	header := NewMSRPCHeader()
+	header.PacketType = PDURequest
+	header.PacketFlags = PDUFault
+	buffer := RGetServiceNameWRequestStruct{
+		Name:         name,
+		BufferLength: SC_MAX_NAME_LENGTH,
+	}
+	buffer.ContextHandle = NewContextHandle(contextHandle)
+	return MSRPCRequestHeaderStruct{
+		MSRPCHeaderStruct: header,
+		ContextId:         0,
+		OpNum:             opnum,
+		Buffer:            buffer,
+	}
+}
+
+// 服务状态，对应SERVICE_STATUS
+type ServiceStatus struct {
+	ServiceType             uint32
+	CurrentState            uint32
+	ControlsAccepted        uint32
+	Win32ExitCode           uint32
+	ServiceSpecificExitCode uint32
+	CheckPoint              uint32
+	WaitHint                uint32
+}
+
+// 服务状态名称
+func (s ServiceStatus) StateName() string {
+	switch s.CurrentState {
+	case SERVICE_STOPPED:
+		return "STOPPED"
+	case SERVICE_START_PENDING:
+		return "START_PENDING"
+	case SERVICE_STOP_PENDING:
+		return "STOP_PENDING"
+	case SERVICE_RUNNING:
+		return "RUNNING"
+	case SERVICE_CONTINUE_PENDING:
+		return "CONTINUE_PENDING"
+	case SERVICE_PAUSE_PENDING:
+		return "PAUSE_PENDING"
+	case SERVICE_PAUSED:
+		return "PAUSED"
+	}
+	return fmt.Sprintf("0x%x", s.CurrentState)
+}
+
+// 枚举得到的服务，对应ENUM_SERVICE_STATUSW
+type ServiceEntry struct {
+	ServiceName string
+	DisplayName string
+	Status      ServiceStatus
+}
+
+// 服务配置，对应QUERY_SERVICE_CONFIGW
+type ServiceConfig struct {
+	ServiceType      uint32
+	StartType        uint32
+	ErrorControl     uint32
+	BinaryPathName   string
+	LoadOrderGroup   string
+	TagId            uint32
+	Dependencies     []string // 依赖的服务，组名以+开头
+	ServiceStartName string
+	DisplayName      string
+}
+
+// 服务类型名称
+func (c ServiceConfig) TypeName() string {
+	var names []string
+	for _, t := range []struct {
+		flag uint32
+		name string
+	}{
+		{SERVICE_KERNEL_DRIVER, "KERNEL_DRIVER"},
+		{SERVICE_FILE_SYSTEM_DRIVER, "FILE_SYSTEM_DRIVER"},
+		{SERVICE_WIN32_OWN_PROCESS, "WIN32_OWN_PROCESS"},
+		{SERVICE_WIN32_SHARE_PROCESS, "WIN32_SHARE_PROCESS"},
+		{SERVICE_INTERACTIVE_PROCESS, "INTERACTIVE_PROCESS"},
+	} {
+		if c.ServiceType&t.flag != 0 {
+			names = append(names, t.name)
+		}
+	}
+	if len(names) == 0 {
+		return fmt.Sprintf("0x%x", c.ServiceType)
+	}
+	return strings.Join(names, "|")
+}
+
+// 启动类型名称
+func (c ServiceConfig) StartTypeName() string {
+	switch c.StartType {
+	case SERVICE_BOOT_START:
+		return "BOOT_START"
+	case SERVICE_SYSTEM_START:
+		return "SYSTEM_START"
+	case SERVICE_AUTO_START:
+		return "AUTO_START"
+	case SERVICE_DEMAND_START:
+		return "DEMAND_START"
+	case SERVICE_DISABLED:
+		return "DISABLED"
+	}
+	return fmt.Sprintf("0x%x", c.StartType)
+}
+
+// 错误控制名称
+func (c ServiceConfig) ErrorControlName() string {
+	switch c.ErrorControl {
+	case SERVICE_ERROR_IGNORE:
+		return "IGNORE"
+	case SERVICE_ERROR_NORMAL:
+		return "NORMAL"
+	case SERVICE_ERROR_SEVERE:
+		return "SEVERE"
+	case SERVICE_ERROR_CRITICAL:
+		return "CRITICAL"
+	}
+	return fmt.Sprintf("0x%x", c.ErrorControl)
+}
+
+// 修改服务配置的参数，数值为SERVICE_NO_CHANGE、字符串为空时保持不变
+type ServiceConfigChange struct {
+	ServiceType      uint32
+	StartType        uint32
+	ErrorControl     uint32
+	BinaryPathName   string
+	LoadOrderGroup   string
+	ServiceStartName string
+	DisplayName      string
+}
+
+// 初始化全部保持不变的配置修改
+func NewServiceConfigChange() ServiceConfigChange {
+	return ServiceConfigChange{
+		ServiceType:  SERVICE_NO_CHANGE,
+		StartType:    SERVICE_NO_CHANGE,
+		ErrorControl: SERVICE_NO_CHANGE,
+	}
+}
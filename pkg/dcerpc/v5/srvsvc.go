@@ -0,0 +1,620 @@
+package v5
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/4ra1n/go-impacket/pkg/dcerpc"
+	"github.com/4ra1n/go-impacket/pkg/ms"
+	"github.com/4ra1n/go-impacket/pkg/util"
+)
+
+// 此文件提供srvsvc服务接口，用于枚举共享、会话以及查询服务器信息
+// https://learn.microsoft.com/en-us/openspecs/windows_protocols/ms-srvs/accf23b0-0f57-441c-9185-43041f1b0ee9
+
+// opnum
+// https://learn.microsoft.com/en-us/openspecs/windows_protocols/ms-srvs/0b7f8ce2-ea7a-4ed3-8b57-e0c5b3ac1a8e
+const (
+	NetrConnectionEnum = 8
+	NetrFileEnum       = 9
+	NetrSessionEnum    = 12
+	NetrShareAdd       = 14
+	NetrShareEnum      = 15
+	NetrShareGetInfo   = 16
+	NetrServerGetInfo  = 21
+	NetrRemoteTOD      = 28
+)
+
+// 共享类型
+// https://learn.microsoft.com/en-us/openspecs/windows_protocols/ms-srvs/6069f8c0-c93f-43a0-a5b4-7ed447eb4b84
+const (
+	STYPE_DISKTREE  = 0x00000000
+	STYPE_PRINTQ    = 0x00000001
+	STYPE_DEVICE    = 0x00000002
+	STYPE_IPC       = 0x00000003
+	STYPE_CLUSTER   = 0x02000000
+	STYPE_TEMPORARY = 0x40000000
+	STYPE_SPECIAL   = 0x80000000
+	STYPE_MASK      = 0x000000FF
+)
+
+// 枚举时不限制返回数据大小
+const maxPreferredLength = 0xFFFFFFFF
+
+// 共享信息，对应SHARE_INFO_1、SHARE_INFO_2
+// https://learn.microsoft.com/en-us/openspecs/windows_protocols/ms-srvs/fc69f110-998d-4c16-9667-514e22ad0f41
+type ShareInfo struct {
+	Name        string
+	Type        uint32
+	Remark      string
+	Permissions uint32 // 以下字段仅level 2返回
+	MaxUses     uint32
+	CurrentUses uint32
+	Path        string
+	Password    string
+}
+
+// 共享类型名称
+func (s ShareInfo) TypeName() string {
+	var name string
+	switch s.Type & STYPE_MASK {
+	case STYPE_DISKTREE:
+		name = "DISK"
+	case STYPE_PRINTQ:
+		name = "PRINTQ"
+	case STYPE_DEVICE:
+		name = "DEVICE"
+	case STYPE_IPC:
+		name = "IPC"
+	default:
+		name = fmt.Sprintf("0x%02x", s.Type&STYPE_MASK)
+	}
+	if s.Type&STYPE_SPECIAL != 0 {
+		name += "|SPECIAL"
+	}
+	if s.Type&STYPE_TEMPORARY != 0 {
+		name += "|TEMPORARY"
+	}
+	return name
+}
+
+// 服务器信息，对应SERVER_INFO_100、SERVER_INFO_101、SERVER_INFO_102
+// https://learn.microsoft.com/en-us/openspecs/windows_protocols/ms-srvs/39c502f6-8443-4fe5-89e5-9b1fd7d03ee6
+type ServerInfo struct {
+	PlatformId   uint32
+	Name         string
+	VersionMajor uint32 // 以下字段level 101及以上返回
+	VersionMinor uint32
+	Type         uint32
+	Comment      string
+	Users        uint32 // 以下字段仅level 102返回
+	Disc         uint32
+	Hidden       uint32
+	Announce     uint32
+	AnnDelta     uint32
+	Licenses     uint32
+	UserPath     string
+}
+
+// 会话信息，对应SESSION_INFO_0、1、2、10、502
+// https://learn.microsoft.com/en-us/openspecs/windows_protocols/ms-srvs/6de4b0d9-1b5e-4ef8-8a8d-0a0a1f2a0e14
+type SessionInfo struct {
+	ClientName string
+	UserName   string
+	NumOpens   uint32
+	Time       uint32 // 会话建立的秒数
+	IdleTime   uint32 // 空闲的秒数
+	UserFlags  uint32
+	ClientType string
+	Transport  string
+}
+
+// smb->打开srvsvc管道并绑定接口，返回管道句柄
+func (c *SMBClient) OpenSrvsvc(treeId, callId uint32) (fileId []byte, err error) {
+	return c.OpenSrvsvcContext(context.Background(), treeId, callId)
+}
+
+func (c *SMBClient) OpenSrvsvcContext(ctx context.Context, treeId, callId uint32) (fileId []byte, err error) {
+	fileId, err = c.CreatePipeRequestContext(ctx, treeId, "srvsvc")
+	if err != nil {
+		c.Debug("", err)
+		return nil, err
+	}
+	ctxs := []CtxItemStruct{{
+		NumTransItems: 1,
+		AbstractSyntax: SyntaxIDStruct{
+			UUID:    util.PDUUuidFromBytes(ms.SRVSVC_UUID),
+			Version: ms.SRVSVC_VERSION,
+		},
+		TransferSyntax: SyntaxIDStruct{
+			UUID:    util.PDUUuidFromBytes(ms.NDR_UUID),
+			Version: ms.NDR_VERSION,
+		}}}
+	if err = c.ndrBindContext(ctx, treeId, fileId, callId, ctxs); err != nil {
+		c.Debug("", err)
+		c.CloseRequestContext(ctx, treeId, fileId)
+		return nil, err
+	}
+	return fileId, nil
+}
+
+// smb->枚举共享，level支持1和2，level 2需要管理员权限
+//
+//	NET_API_STATUS NetrShareEnum(
+//	  [in, string, unique] SRVSVC_HANDLE ServerName,
+//	  [in, out] LPSHARE_ENUM_STRUCT InfoStruct,
+//	  [in] DWORD PreferedMaximumLength,
+//	  [out] DWORD* TotalEntries,
+//	  [in, out, unique] DWORD* ResumeHandle
+//	);
+func (c *SMBClient) NetShareEnum(treeId uint32, fileId []byte, level, callId uint32) ([]ShareInfo, error) {
+	return c.NetShareEnumContext(context.Background(), treeId, fileId, level, callId)
+}
+
+func (c *SMBClient) NetShareEnumContext(ctx context.Context, treeId uint32, fileId []byte, level, callId uint32) ([]ShareInfo, error) {
+	c.Debug("Sending NetrShareEnum request", nil)
+	res, err := c.NewPipeConn(treeId, fileId, callId).NetShareEnumContext(ctx, level)
+	if err != nil {
+		c.Debug("", err)
+		return nil, err
+	}
+	c.Debug("Completed NetrShareEnum", nil)
+	return res, nil
+}
+
+// 枚举共享，level支持1和2
+func (r *RPCConn) NetShareEnum(level uint32) ([]ShareInfo, error) {
+	return r.NetShareEnumContext(context.Background(), level)
+}
+
+func (r *RPCConn) NetShareEnumContext(ctx context.Context, level uint32) ([]ShareInfo, error) {
+	if level != 1 && level != 2 {
+		return nil, fmt.Errorf("Unsupported NetrShareEnum level %d", level)
+	}
+	// 指向空容器，由服务端填充
+	info := shareEnumStruct{Level: level, ShareInfo: shareEnumUnion{Level: level}}
+	if level == 1 {
+		info.ShareInfo.Level1 = &shareInfo1Container{}
+	} else {
+		info.ShareInfo.Level2 = &shareInfo2Container{}
+	}
+	var res netrShareEnumResult
+	err := r.srvsCall(ctx, NetrShareEnum, &netrShareEnumRequest{
+		ServerName:            r.serverName(),
+		InfoStruct:            info,
+		PreferedMaximumLength: maxPreferredLength,
+		ResumeHandle:          new(uint32),
+	}, &res, "NetrShareEnum")
+	if err != nil {
+		return nil, err
+	}
+	var shares []ShareInfo
+	if c := res.InfoStruct.ShareInfo.Level1; c != nil {
+		for _, i := range c.Buffer {
+			shares = append(shares, ShareInfo{Name: i.Name, Type: i.Type, Remark: i.Remark})
+		}
+	}
+	if c := res.InfoStruct.ShareInfo.Level2; c != nil {
+		for _, i := range c.Buffer {
+			shares = append(shares, ShareInfo{
+				Name:        i.Name,
+				Type:        i.Type,
+				Remark:      i.Remark,
+				Permissions: i.Permissions,
+				MaxUses:     i.MaxUses,
+				CurrentUses: i.CurrentUses,
+				Path:        i.Path,
+				Password:    i.Password,
+			})
+		}
+	}
+	return shares, nil
+}
+
+// smb->查询服务器信息，level支持100、101和102
+//
+//	NET_API_STATUS NetrServerGetInfo(
+//	  [in, string, unique] SRVSVC_HANDLE ServerName,
+//	  [in] DWORD Level,
+//	  [out, switch_is(Level)] LPSERVER_INFO InfoStruct
+//	);
+func (c *SMBClient) NetServerGetInfo(treeId uint32, fileId []byte, level, callId uint32) (ServerInfo, error) {
+	return c.NetServerGetInfoContext(context.Background(), treeId, fileId, level, callId)
+}
+
+func (c *SMBClient) NetServerGetInfoContext(ctx context.Context, treeId uint32, fileId []byte, level, callId uint32) (ServerInfo, error) {
+	c.Debug("Sending NetrServerGetInfo request", nil)
+	res, err := c.NewPipeConn(treeId, fileId, callId).NetServerGetInfoContext(ctx, level)
+	if err != nil {
+		c.Debug("", err)
+		return ServerInfo{}, err
+	}
+	c.Debug("Completed NetrServerGetInfo", nil)
+	return res, nil
+}
+
+// 查询服务器信息，level支持100、101和102
+func (r *RPCConn) NetServerGetInfo(level uint32) (ServerInfo, error) {
+	return r.NetServerGetInfoContext(context.Background(), level)
+}
+
+func (r *RPCConn) NetServerGetInfoContext(ctx context.Context, level uint32) (ServerInfo, error) {
+	if level != 100 && level != 101 && level != 102 {
+		return ServerInfo{}, fmt.Errorf("Unsupported NetrServerGetInfo level %d", level)
+	}
+	var res netrServerGetInfoResult
+	err := r.srvsCall(ctx, NetrServerGetInfo, &netrServerGetInfoRequest{
+		ServerName: r.serverName(),
+		Level:      level,
+	}, &res, "NetrServerGetInfo")
+	if err != nil {
+		return ServerInfo{}, err
+	}
+	var info ServerInfo
+	switch u := res.InfoStruct; {
+	case u.Info100 != nil:
+		info = ServerInfo{PlatformId: u.Info100.PlatformId, Name: u.Info100.Name}
+	case u.Info101 != nil:
+		i := u.Info101
+		info = ServerInfo{
+			PlatformId:   i.PlatformId,
+			Name:         i.Name,
+			VersionMajor: i.VersionMajor,
+			VersionMinor: i.VersionMinor,
+			Type:         i.Type,
+			Comment:      i.Comment,
+		}
+	case u.Info102 != nil:
+		i := u.Info102
+		info = ServerInfo{
+			PlatformId:   i.PlatformId,
+			Name:         i.Name,
+			VersionMajor: i.VersionMajor,
+			VersionMinor: i.VersionMinor,
+			Type:         i.Type,
+			Comment:      i.Comment,
+			Users:        i.Users,
+			Disc:         i.Disc,
+			Hidden:       i.Hidden,
+			Announce:     i.Announce,
+			AnnDelta:     i.AnnDelta,
+			Licenses:     i.Licenses,
+			UserPath:     i.UserPath,
+		}
+	}
+	return info, nil
+}
+
+// smb->枚举会话，level支持0、1、2、10和502，除0和10外需要管理员权限
+//
+//	NET_API_STATUS NetrSessionEnum(
+//	  [in, string, unique] SRVSVC_HANDLE ServerName,
+//	  [in, string, unique] WCHAR* ClientName,
+//	  [in, string, unique] WCHAR* UserName,
+//	  [in, out] PSESSION_ENUM_STRUCT InfoStruct,
+//	  [in] DWORD PreferedMaximumLength,
+//	  [out] DWORD* TotalEntries,
+//	  [in, out, unique] DWORD* ResumeHandle
+//	);
+func (c *SMBClient) NetSessionEnum(treeId uint32, fileId []byte, level, callId uint32) ([]SessionInfo, error) {
+	return c.NetSessionEnumContext(context.Background(), treeId, fileId, level, callId)
+}
+
+func (c *SMBClient) NetSessionEnumContext(ctx context.Context, treeId uint32, fileId []byte, level, callId uint32) ([]SessionInfo, error) {
+	c.Debug("Sending NetrSessionEnum request", nil)
+	res, err := c.NewPipeConn(treeId, fileId, callId).NetSessionEnumContext(ctx, level)
+	if err != nil {
+		c.Debug("", err)
+		return nil, err
+	}
+	c.Debug("Completed NetrSessionEnum", nil)
+	return res, nil
+}
+
+// 枚举会话，level支持0、1、2、10和502
+func (r *RPCConn) NetSessionEnum(level uint32) ([]SessionInfo, error) {
+	return r.NetSessionEnumContext(context.Background(), level)
+}
+
+func (r *RPCConn) NetSessionEnumContext(ctx context.Context, level uint32) ([]SessionInfo, error) {
+	info := sessionEnumStruct{Level: level, SessionInfo: sessionEnumUnion{Level: level}}
+	switch level {
+	case 0:
+		info.SessionInfo.Level0 = &sessionInfo0Container{}
+	case 1:
+		info.SessionInfo.Level1 = &sessionInfo1Container{}
+	case 2:
+		info.SessionInfo.Level2 = &sessionInfo2Container{}
+	case 10:
+		info.SessionInfo.Level10 = &sessionInfo10Container{}
+	case 502:
+		info.SessionInfo.Level502 = &sessionInfo502Container{}
+	default:
+		return nil, fmt.Errorf("Unsupported NetrSessionEnum level %d", level)
+	}
+	var res netrSessionEnumResult
+	err := r.srvsCall(ctx, NetrSessionEnum, &netrSessionEnumRequest{
+		ServerName:            r.serverName(),
+		InfoStruct:            info,
+		PreferedMaximumLength: maxPreferredLength,
+		ResumeHandle:          new(uint32),
+	}, &res, "NetrSessionEnum")
+	if err != nil {
+		return nil, err
+	}
+	var sessions []SessionInfo
+	u := res.InfoStruct.SessionInfo
+	if u.Level0 != nil {
+		for _, i := range u.Level0.Buffer {
+			sessions = append(sessions, SessionInfo{ClientName: i.ClientName})
+		}
+	}
+	if u.Level1 != nil {
+		for _, i := range u.Level1.Buffer {
+			sessions = append(sessions, SessionInfo{
+				ClientName: i.ClientName,
+				UserName:   i.UserName,
+				NumOpens:   i.NumOpens,
+				Time:       i.Time,
+				IdleTime:   i.IdleTime,
+				UserFlags:  i.UserFlags,
+			})
+		}
+	}
+	if u.Level2 != nil {
+		for _, i := range u.Level2.Buffer {
+			sessions = append(sessions, SessionInfo{
+				ClientName: i.ClientName,
+				UserName:   i.UserName,
+				NumOpens:   i.NumOpens,
+				Time:       i.Time,
+				IdleTime:   i.IdleTime,
+				UserFlags:  i.UserFlags,
+				ClientType: i.ClientType,
+			})
+		}
+	}
+	if u.Level10 != nil {
+		for _, i := range u.Level10.Buffer {
+			sessions = append(sessions, SessionInfo{
+				ClientName: i.ClientName,
+				UserName:   i.UserName,
+				Time:       i.Time,
+				IdleTime:   i.IdleTime,
+			})
+		}
+	}
+	if u.Level502 != nil {
+		for _, i := range u.Level502.Buffer {
+			sessions = append(sessions, SessionInfo{
+				ClientName: i.ClientName,
+				UserName:   i.UserName,
+				NumOpens:   i.NumOpens,
+				Time:       i.Time,
+				IdleTime:   i.IdleTime,
+				UserFlags:  i.UserFlags,
+				ClientType: i.ClientType,
+				Transport:  i.Transport,
+			})
+		}
+	}
+	return sessions, nil
+}
+
+// 调用并检查返回值
+func (r *RPCConn) srvsCall(ctx context.Context, opnum uint16, req interface{}, out ndrResult, op string) error {
+	if err := r.ndrCall(ctx, opnum, req, out, op); err != nil {
+		return err
+	}
+	if code := out.status(); code != dcerpc.RPC_S_OK {
+		return rpcStatusError(op, code)
+	}
+	return nil
+}
+
+// NetrShareEnum的参数
+type netrShareEnumRequest struct {
+	ServerName            string `ndr:"unique"`
+	InfoStruct            shareEnumStruct
+	PreferedMaximumLength uint32
+	ResumeHandle          *uint32
+}
+
+type netrShareEnumResult struct {
+	InfoStruct   shareEnumStruct
+	TotalEntries uint32
+	ResumeHandle *uint32
+	ReturnCode   uint32
+}
+
+func (r *netrShareEnumResult) status() uint32 { return r.ReturnCode }
+
+// SHARE_ENUM_STRUCT
+type shareEnumStruct struct {
+	Level     uint32
+	ShareInfo shareEnumUnion `ndr:"union"`
+}
+
+type shareEnumUnion struct {
+	Level  uint32               `ndr:"switch"`
+	Level1 *shareInfo1Container `ndr:"case:1"`
+	Level2 *shareInfo2Container `ndr:"case:2"`
+}
+
+type shareInfo1Container struct {
+	EntriesRead uint32
+	Buffer      []shareInfo1 `ndr:"unique"`
+}
+
+type shareInfo1 struct {
+	Name   string `ndr:"unique"`
+	Type   uint32
+	Remark string `ndr:"unique"`
+}
+
+type shareInfo2Container struct {
+	EntriesRead uint32
+	Buffer      []shareInfo2 `ndr:"unique"`
+}
+
+type shareInfo2 struct {
+	Name        string `ndr:"unique"`
+	Type        uint32
+	Remark      string `ndr:"unique"`
+	Permissions uint32
+	MaxUses     uint32
+	CurrentUses uint32
+	Path        string `ndr:"unique"`
+	Password    string `ndr:"unique"`
+}
+
+// NetrServerGetInfo的参数
+type netrServerGetInfoRequest struct {
+	ServerName string `ndr:"unique"`
+	Level      uint32
+}
+
+type netrServerGetInfoResult struct {
+	InfoStruct serverInfoUnion `ndr:"union"`
+	ReturnCode uint32
+}
+
+func (r *netrServerGetInfoResult) status() uint32 { return r.ReturnCode }
+
+// LPSERVER_INFO
+type serverInfoUnion struct {
+	Level   uint32         `ndr:"switch"`
+	Info100 *serverInfo100 `ndr:"case:100"`
+	Info101 *serverInfo101 `ndr:"case:101"`
+	Info102 *serverInfo102 `ndr:"case:102"`
+}
+
+type serverInfo100 struct {
+	PlatformId uint32
+	Name       string `ndr:"unique"`
+}
+
+type serverInfo101 struct {
+	PlatformId   uint32
+	Name         string `ndr:"unique"`
+	VersionMajor uint32
+	VersionMinor uint32
+	Type         uint32
+	Comment      string `ndr:"unique"`
+}
+
+type serverInfo102 struct {
+	PlatformId   uint32
+	Name         string `ndr:"unique"`
+	VersionMajor uint32
+	VersionMinor uint32
+	Type         uint32
+	Comment      string `ndr:"unique"`
+	Users        uint32
+	Disc         uint32
+	Hidden       uint32
+	Announce     uint32
+	AnnDelta     uint32
+	Licenses     uint32
+	UserPath     string `ndr:"unique"`
+}
+
+// NetrSessionEnum的参数，ClientName与UserName为空时不过滤
+type netrSessionEnumRequest struct {
+	ServerName            string `ndr:"unique"`
+	ClientName            string `ndr:"unique"`
+	UserName              string `ndr:"unique"`
+	InfoStruct            sessionEnumStruct
+	PreferedMaximumLength uint32
+	ResumeHandle          *uint32
+}
+
+type netrSessionEnumResult struct {
+	InfoStruct   sessionEnumStruct
+	TotalEntries uint32
+	ResumeHandle *uint32
+	ReturnCode   uint32
+}
+
+func (r *netrSessionEnumResult) status() uint32 { return r.ReturnCode }
+
+// SESSION_ENUM_STRUCT
+type sessionEnumStruct struct {
+	Level       uint32
+	SessionInfo sessionEnumUnion `ndr:"union"`
+}
+
+type sessionEnumUnion struct {
+	Level    uint32                   `ndr:"switch"`
+	Level0   *sessionInfo0Container   `ndr:"case:0"`
+	Level1   *sessionInfo1Container   `ndr:"case:1"`
+	Level2   *sessionInfo2Container   `ndr:"case:2"`
+	Level10  *sessionInfo10Container  `ndr:"case:10"`
+	Level502 *sessionInfo502Container `ndr:"case:502"`
+}
+
+type sessionInfo0Container struct {
+	EntriesRead uint32
+	Buffer      []sessionInfo0 `ndr:"unique"`
+}
+
+type sessionInfo0 struct {
+	ClientName string `ndr:"unique"`
+}
+
+type sessionInfo1Container struct {
+	EntriesRead uint32
+	Buffer      []sessionInfo1 `ndr:"unique"`
+}
+
+type sessionInfo1 struct {
+	ClientName string `ndr:"unique"`
+	UserName   string `ndr:"unique"`
+	NumOpens   uint32
+	Time       uint32
+	IdleTime   uint32
+	UserFlags  uint32
+}
+
+type sessionInfo2Container struct {
+	EntriesRead uint32
+	Buffer      []sessionInfo2 `ndr:"unique"`
+}
+
+type sessionInfo2 struct {
+	ClientName string `ndr:"unique"`
+	UserName   string `ndr:"unique"`
+	NumOpens   uint32
+	Time       uint32
+	IdleTime   uint32
+	UserFlags  uint32
+	ClientType string `ndr:"unique"`
+}
+
+type sessionInfo10Container struct {
+	EntriesRead uint32
+	Buffer      []sessionInfo10 `ndr:"unique"`
+}
+
+type sessionInfo10 struct {
+	ClientName string `ndr:"unique"`
+	UserName   string `ndr:"unique"`
+	Time       uint32
+	IdleTime   uint32
+}
+
+type sessionInfo502Container struct {
+	EntriesRead uint32
+	Buffer      []sessionInfo502 `ndr:"unique"`
+}
+
+type sessionInfo502 struct {
+	ClientName string `ndr:"unique"`
+	UserName   string `ndr:"unique"`
+	NumOpens   uint32
+	Time       uint32
+	IdleTime   uint32
+	UserFlags  uint32
+	ClientType string `ndr:"unique"`
+	Transport  string `ndr:"unique"`
+}
@@ -1,18 +1,31 @@
 package v5
 
 import (
-	"fmt"
+	"context"
+	"encoding/binary"
+	"errors"
+	"sync"
+
 	"github.com/4ra1n/go-impacket/pkg/common"
 	"github.com/4ra1n/go-impacket/pkg/smb/smb2"
-	"net"
 )
 
 type SMBClient struct {
 	smb2.Client
+	pipes sync.Map // 通过MSRPCBind绑定的管道连接，键为fileId
 }
 
 type TCPClient struct {
 	common.Client
+	conn *RPCConn // 通过MSRPCBind绑定的连接
+}
+
+// rpc传输，负责收发完整的PDU分片，RPCConn在其上完成绑定与调用
+// *TCPClient与*SMBPipe均实现该接口
+type Transport interface {
+	WritePDUContext(ctx context.Context, pdu []byte) error
+	ReadPDUContext(ctx context.Context) ([]byte, error)
+	Close() error
 }
 
 // 连接封装
@@ -23,8 +36,11 @@ func SMBTransport() (client *SMBClient, err error) {
 
 // tcp连接封装
 func NewTCPSession(opt common.ClientOptions, debug bool) (client *TCPClient, err error) {
-	address := fmt.Sprintf("%s:%d", opt.Host, opt.Port)
-	conn, err := net.Dial("tcp", address)
+	return NewTCPSessionContext(context.Background(), opt, debug)
+}
+
+func NewTCPSessionContext(ctx context.Context, opt common.ClientOptions, debug bool) (client *TCPClient, err error) {
+	conn, err := common.Dial(ctx, &opt)
 	if err != nil {
 		return
 	}
@@ -39,3 +55,98 @@ func NewTCPSession(opt common.ClientOptions, debug bool) (client *TCPClient, err
 func TCPTransport() (client *TCPClient, err error) {
 	return &TCPClient{}, nil
 }
+
+func (c *TCPClient) host() string {
+	if opt := c.GetOptions(); opt != nil {
+		return opt.Host
+	}
+	return ""
+}
+
+// smb命名管道传输，一次读取可能包含不完整或多个分片
+type SMBPipe struct {
+	c        *SMBClient
+	treeId   uint32
+	fileId   []byte
+	buf      []byte
+	ownsConn bool // 由DialBinding建立时关闭管道同时关闭会话
+}
+
+// smb->在IPC$上打开命名管道，pipe可带\pipe\前缀
+func (c *SMBClient) OpenPipe(pipe string) (*SMBPipe, error) {
+	return c.OpenPipeContext(context.Background(), pipe)
+}
+
+func (c *SMBClient) OpenPipeContext(ctx context.Context, pipe string) (*SMBPipe, error) {
+	treeId, ok := c.GetTreeId("IPC$")
+	if !ok {
+		var err error
+		if treeId, err = c.TreeConnectContext(ctx, "IPC$"); err != nil {
+			c.Debug("", err)
+			return nil, err
+		}
+	}
+	fileId, err := c.CreatePipeRequestContext(ctx, treeId, pipeName(pipe))
+	if err != nil {
+		c.Debug("", err)
+		return nil, err
+	}
+	return &SMBPipe{c: c, treeId: treeId, fileId: fileId}, nil
+}
+
+func (p *SMBPipe) WritePDUContext(ctx context.Context, pdu []byte) error {
+	_, err := p.c.WriteAtRequestContext(ctx, p.treeId, p.fileId, 0, pdu)
+	return err
+}
+
+func (p *SMBPipe) ReadPDUContext(ctx context.Context) ([]byte, error) {
+	for {
+		if len(p.buf) >= msrpcHeaderSize {
+			fragLength := int(binary.LittleEndian.Uint16(p.buf[8:]))
+			if fragLength < msrpcHeaderSize {
+				return nil, errors.New("Invalid rpc fragment length")
+			}
+			if len(p.buf) >= fragLength {
+				pdu := p.buf[:fragLength:fragLength]
+				p.buf = p.buf[fragLength:]
+				return pdu, nil
+			}
+		}
+		data, err := p.c.ReadAtRequestContext(ctx, p.treeId, p.fileId, 0, 65536)
+		if err != nil {
+			return nil, err
+		}
+		p.buf = append(p.buf, data...)
+	}
+}
+
+// smb->关闭文件或管道句柄，同时移除管道上通过MSRPCBind绑定的连接
+// fileId可能被服务端复用，不能沿用旧连接的上下文与传输语法
+func (c *SMBClient) CloseRequest(treeId uint32, fileId []byte) error {
+	return c.CloseRequestContext(context.Background(), treeId, fileId)
+}
+
+func (c *SMBClient) CloseRequestContext(ctx context.Context, treeId uint32, fileId []byte) error {
+	c.pipes.Delete(string(fileId))
+	return c.Client.CloseRequestContext(ctx, treeId, fileId)
+}
+
+// 关闭管道句柄
+func (p *SMBPipe) Close() error {
+	if p.fileId == nil {
+		return nil
+	}
+	err := p.c.CloseRequest(p.treeId, p.fileId)
+	p.fileId = nil
+	if p.ownsConn {
+		p.c.Close()
+	}
+	return err
+}
+
+func (c *SMBClient) host() string {
+	if opt := c.GetOptions(); opt != nil {
+		return opt.Host
+	}
+	return ""
+}
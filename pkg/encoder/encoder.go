@@ -21,6 +21,15 @@ func ToUnicode(s string) []byte {
 	return b.Bytes()
 }
 
+// UTF-16LE解码，奇数长度时忽略最后一个字节
+func FromUnicode(buf []byte) string {
+	uints := make([]uint16, len(buf)/2)
+	for i := range uints {
+		uints[i] = binary.LittleEndian.Uint16(buf[i*2:])
+	}
+	return string(utf16.Decode(uints))
+}
+
 // SMB数据包解码
 type BinaryMarshallable interface {
 	MarshalBinary(*Metadata) ([]byte, error)
@@ -347,16 +356,19 @@ func marshal(v interface{}, meta *Metadata) ([]byte, error) {
 			fieldValue := valuev.Field(j)
 			// 处理结构体中的切片类型，用来应对多变情况
 			if fieldValue.Kind() == reflect.Slice {
+				// 缓存整个切片的长度，供后续offset计算使用
+				var total uint64
 				for k := 0; k < fieldValue.Len(); k++ {
 					buf, err := marshal(fieldValue.Index(k).Interface(), m)
 					if err != nil {
 						return nil, err
 					}
-					m.Lens[typev.Field(j).Name] = uint64(len(buf))
+					total += uint64(len(buf))
 					if err := binary.Write(w, binary.LittleEndian, buf); err != nil {
 						return nil, err
 					}
 				}
+				m.Lens[typev.Field(j).Name] = total
 			} else {
 				buf, err := marshal(fieldValue.Interface(), m)
 				if err != nil {
@@ -0,0 +1,957 @@
+package encoder
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// 此文件提供由结构体标签驱动的NDR20、NDR64编解码，用于描述rpc接口的存根数据
+// https://pubs.opengroup.org/onlinepubs/9629399/chap14.htm
+//
+// 根结构体的每个导出字段对应一个顶层参数，按声明顺序编码，字段标签使用ndr:
+//
+//	unique、ref、ptr      指针类型，Go指针字段默认为unique；string与切片加此标签时表示指向它们的指针，空值编码为空指针
+//	conformant、varying   切片默认为一致数组，varying为可变数组，两者同时指定为一致可变数组；string默认为一致可变数组
+//	size_is:F、length_is:F 编码时从同级字段F取最大数量、实际数量，可写为F/2
+//	ansi                  string按单字节字符编码，默认按unicode编码，均包含结尾的空字符
+//	union                 字段为联合体，联合体结构中switch标记鉴别字段，case:1|2与default标记分支
+//	-                     忽略该字段
+//
+// 顶层ref指针没有引用id，嵌入的指针指向的数据延迟到所在顶层参数之后编码；
+// 结构体最后一个成员为一致数组时，数组的最大数量提前到结构体开头
+// Go数组按定长数组编码，[N]byte可用于uuid等定长数据，上下文句柄需用按4字节对齐的结构体描述
+//
+// NDR64中引用id与数组的数量信息为8字节，结构体末尾按自身对齐填充，联合体的分支按各分支的最大对齐开始
+
+// 引用id起始值，与windows客户端保持一致
+const ndrReferentBase = 0x00020000
+
+var errNDRTruncated = errors.New("Truncated NDR data")
+
+// 指针类型
+const (
+	ndrNoPointer = iota
+	ndrRef
+	ndrUnique
+	ndrFull
+)
+
+type ndrTag struct {
+	pointer    int
+	conformant bool
+	varying    bool
+	ansi       bool
+	union      bool
+	sw         bool
+	def        bool
+	skip       bool
+	cases      []uint64
+	sizeIs     string
+	sizeDiv    uint64
+	lengthIs   string
+	lengthDiv  uint64
+}
+
+func parseNDRTag(sf reflect.StructField) (ndrTag, error) {
+	var t ndrTag
+	tag := sf.Tag.Get("ndr")
+	if tag == "-" {
+		t.skip = true
+		return t, nil
+	}
+	for _, item := range strings.Split(tag, ",") {
+		key, val := item, ""
+		if i := strings.IndexByte(item, ':'); i >= 0 {
+			key, val = item[:i], item[i+1:]
+		}
+		switch key {
+		case "":
+		case "ref":
+			t.pointer = ndrRef
+		case "unique":
+			t.pointer = ndrUnique
+		case "ptr":
+			t.pointer = ndrFull
+		case "conformant":
+			t.conformant = true
+		case "varying":
+			t.varying = true
+		case "ansi":
+			t.ansi = true
+		case "union":
+			t.union = true
+		case "switch":
+			t.sw = true
+		case "default":
+			t.def = true
+		case "case":
+			for _, c := range strings.Split(val, "|") {
+				n, err := strconv.ParseUint(c, 0, 64)
+				if err != nil {
+					return t, fmt.Errorf("Invalid NDR case %q on field %s", c, sf.Name)
+				}
+				t.cases = append(t.cases, n)
+			}
+		case "size_is", "length_is":
+			name, div := val, uint64(1)
+			if i := strings.IndexByte(val, '/'); i >= 0 {
+				n, err := strconv.ParseUint(val[i+1:], 10, 64)
+				if err != nil || n == 0 {
+					return t, fmt.Errorf("Invalid NDR %s %q on field %s", key, val, sf.Name)
+				}
+				name, div = val[:i], n
+			}
+			if key == "size_is" {
+				t.sizeIs, t.sizeDiv = name, div
+			} else {
+				t.lengthIs, t.lengthDiv = name, div
+			}
+		default:
+			return t, fmt.Errorf("Unknown NDR tag %q on field %s", key, sf.Name)
+		}
+	}
+	return t.defaults(sf.Type), nil
+}
+
+// 补全类型的默认属性：切片未指定数组类型时为一致数组，string总是可变的，仅指定varying时不是一致的
+// 也用于没有标签的数组元素
+func (t ndrTag) defaults(typ reflect.Type) ndrTag {
+	switch typ.Kind() {
+	case reflect.Slice:
+		t.conformant = t.conformant || !t.varying
+	case reflect.String:
+		t.conformant = t.conformant || !t.varying
+		t.varying = true
+	case reflect.Ptr:
+		t = t.defaults(typ.Elem())
+		if t.pointer == ndrNoPointer {
+			t.pointer = ndrUnique
+		}
+	}
+	return t
+}
+
+// 字段除去指针属性后的标签，用于编码指针指向的数据
+func (t ndrTag) referent() ndrTag {
+	t.pointer = ndrNoPointer
+	return t
+}
+
+// 指针是否为空
+func ndrIsNull(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Slice:
+		return v.IsNil()
+	case reflect.String:
+		return v.Len() == 0
+	}
+	return false
+}
+
+// 类型对齐，指针与数组的数量信息在NDR64中按8字节对齐
+func ndrAlign(t reflect.Type, ndr64 bool) int {
+	size := 4
+	if ndr64 {
+		size = 8
+	}
+	switch t.Kind() {
+	case reflect.Bool, reflect.Uint8, reflect.Int8:
+		return 1
+	case reflect.Uint16, reflect.Int16:
+		return 2
+	case reflect.Uint32, reflect.Int32, reflect.Float32:
+		return 4
+	case reflect.Uint64, reflect.Int64, reflect.Float64:
+		return 8
+	case reflect.Ptr, reflect.String:
+		return size
+	case reflect.Slice:
+		if a := ndrAlign(t.Elem(), ndr64); a > size {
+			return a
+		}
+		return size
+	case reflect.Array:
+		return ndrAlign(t.Elem(), ndr64)
+	case reflect.Struct:
+		return ndrFieldsAlign(t, ndr64, false)
+	}
+	return 1
+}
+
+// 结构体成员的最大对齐，armsOnly时只计算联合体的分支
+func ndrFieldsAlign(t reflect.Type, ndr64, armsOnly bool) int {
+	align := 1
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		if sf.PkgPath != "" {
+			continue
+		}
+		tag, err := parseNDRTag(sf)
+		if err != nil || tag.skip || (armsOnly && tag.sw) {
+			continue
+		}
+		a := ndrAlign(sf.Type, ndr64)
+		if tag.pointer != ndrNoPointer {
+			a = ndrAlign(reflect.PtrTo(sf.Type), ndr64)
+		}
+		if a > align {
+			align = a
+		}
+	}
+	return align
+}
+
+// 读取同级字段的值，用于size_is、length_is
+func ndrFieldValue(parent reflect.Value, name string, div uint64) (uint64, error) {
+	if !parent.IsValid() {
+		return 0, fmt.Errorf("NDR field %s is not available", name)
+	}
+	f := parent.FieldByName(name)
+	switch f.Kind() {
+	case reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return f.Uint() / div, nil
+	case reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return uint64(f.Int()) / div, nil
+	}
+	return 0, fmt.Errorf("NDR field %s is not an integer", name)
+}
+
+// 数组的最大数量与实际数量
+func ndrCounts(v reflect.Value, tag ndrTag, parent reflect.Value) (max, actual uint64, err error) {
+	n := uint64(v.Len())
+	if v.Kind() == reflect.String {
+		n = uint64(len(ndrStringBytes(v.String(), tag.ansi)))
+		if !tag.ansi {
+			n /= 2
+		}
+	}
+	max, actual = n, n
+	if tag.sizeIs != "" {
+		if max, err = ndrFieldValue(parent, tag.sizeIs, tag.sizeDiv); err != nil {
+			return 0, 0, err
+		}
+	}
+	if tag.lengthIs != "" {
+		if actual, err = ndrFieldValue(parent, tag.lengthIs, tag.lengthDiv); err != nil {
+			return 0, 0, err
+		}
+	}
+	if actual > n || (!tag.varying && max != n) || actual > max {
+		return 0, 0, fmt.Errorf("NDR array counts max %d actual %d do not match length %d", max, actual, n)
+	}
+	return max, actual, nil
+}
+
+// 字符串的编码，包含结尾的空字符
+func ndrStringBytes(s string, ansi bool) []byte {
+	if ansi {
+		return append([]byte(s), 0)
+	}
+	return ToUnicode(s + "\x00")
+}
+
+// 结构体最后一个成员为内联的一致数组时，返回该成员
+func ndrConformantField(t reflect.Type) (int, ndrTag, bool) {
+	last := -1
+	for i := 0; i < t.NumField(); i++ {
+		if t.Field(i).PkgPath == "" {
+			if tag, err := parseNDRTag(t.Field(i)); err == nil && !tag.skip {
+				last = i
+			}
+		}
+	}
+	if last < 0 {
+		return 0, ndrTag{}, false
+	}
+	sf := t.Field(last)
+	tag, _ := parseNDRTag(sf)
+	if tag.pointer != ndrNoPointer || tag.union {
+		return 0, ndrTag{}, false
+	}
+	switch sf.Type.Kind() {
+	case reflect.Slice, reflect.String:
+		return last, tag, tag.conformant
+	case reflect.Struct:
+		_, _, ok := ndrConformantField(sf.Type)
+		return last, tag, ok
+	}
+	return 0, ndrTag{}, false
+}
+
+// NDR编码
+type ndrEncoder struct {
+	buf      []byte
+	ndr64    bool
+	referent uint64
+	full     map[uintptr]uint64
+	deferred []func() error
+}
+
+// 按NDR20编码v，v为结构体或其指针，每个字段为一个顶层参数
+func MarshalNDR(v interface{}) ([]byte, error) {
+	return marshalNDR(v, false)
+}
+
+// 按NDR64编码v，规则同MarshalNDR
+func MarshalNDR64(v interface{}) ([]byte, error) {
+	return marshalNDR(v, true)
+}
+
+func marshalNDR(v interface{}, ndr64 bool) ([]byte, error) {
+	rv := reflect.Indirect(reflect.ValueOf(v))
+	if rv.Kind() != reflect.Struct {
+		return nil, errors.New("MarshalNDR requires a struct")
+	}
+	e := &ndrEncoder{ndr64: ndr64, full: make(map[uintptr]uint64)}
+	t := rv.Type()
+	for i := 0; i < rv.NumField(); i++ {
+		sf := t.Field(i)
+		if sf.PkgPath != "" {
+			continue
+		}
+		tag, err := parseNDRTag(sf)
+		if err != nil {
+			return nil, err
+		}
+		if tag.skip {
+			continue
+		}
+		if err = e.field(rv.Field(i), tag, rv, true, false); err != nil {
+			return nil, fmt.Errorf("NDR field %s: %w", sf.Name, err)
+		}
+		if err = e.flush(); err != nil {
+			return nil, fmt.Errorf("NDR field %s: %w", sf.Name, err)
+		}
+	}
+	return e.buf, nil
+}
+
+func (e *ndrEncoder) align(n int) {
+	for len(e.buf)%n != 0 {
+		e.buf = append(e.buf, 0)
+	}
+}
+
+func (e *ndrEncoder) uint16(v uint16) {
+	e.align(2)
+	e.buf = append(e.buf, byte(v), byte(v>>8))
+}
+
+func (e *ndrEncoder) uint32(v uint32) {
+	e.align(4)
+	e.buf = append(e.buf, byte(v), byte(v>>8), byte(v>>16), byte(v>>24))
+}
+
+func (e *ndrEncoder) uint64(v uint64) {
+	e.align(8)
+	for i := 0; i < 8; i++ {
+		e.buf = append(e.buf, byte(v>>(8*i)))
+	}
+}
+
+// 引用id与数组的数量信息，NDR20为4字节，NDR64为8字节
+func (e *ndrEncoder) size(v uint64) {
+	if e.ndr64 {
+		e.uint64(v)
+	} else {
+		e.uint32(uint32(v))
+	}
+}
+
+// 依次编码延迟的指针数据，每个数据自身的延迟数据紧随其后
+func (e *ndrEncoder) flush() error {
+	for len(e.deferred) > 0 {
+		fn := e.deferred[0]
+		e.deferred = e.deferred[1:]
+		saved := e.deferred
+		e.deferred = nil
+		if err := fn(); err != nil {
+			return err
+		}
+		if err := e.flush(); err != nil {
+			return err
+		}
+		e.deferred = saved
+	}
+	return nil
+}
+
+// 编码字段，top表示顶层参数，hoisted表示一致数组的最大数量已在结构体开头编码
+func (e *ndrEncoder) field(v reflect.Value, tag ndrTag, parent reflect.Value, top, hoisted bool) error {
+	if tag.union {
+		return e.union(v)
+	}
+	if tag.pointer == ndrNoPointer {
+		return e.value(v, tag, parent, hoisted)
+	}
+	null := ndrIsNull(v)
+	target := v
+	if v.Kind() == reflect.Ptr && !null {
+		target = v.Elem()
+	}
+	referent := func() error {
+		return e.value(target, tag.referent(), parent, false)
+	}
+	if tag.pointer == ndrRef {
+		if null {
+			return errors.New("NDR ref pointer is null")
+		}
+		if top {
+			return referent()
+		}
+	}
+	if null {
+		e.size(0)
+		return nil
+	}
+	if tag.pointer == ndrFull && v.Kind() == reflect.Ptr {
+		if id, ok := e.full[v.Pointer()]; ok {
+			e.size(id)
+			return nil
+		}
+	}
+	id := ndrReferentBase + e.referent*4
+	e.referent++
+	if tag.pointer == ndrFull && v.Kind() == reflect.Ptr {
+		e.full[v.Pointer()] = id
+	}
+	e.size(id)
+	e.deferred = append(e.deferred, referent)
+	return nil
+}
+
+func (e *ndrEncoder) value(v reflect.Value, tag ndrTag, parent reflect.Value, hoisted bool) error {
+	switch v.Kind() {
+	case reflect.Bool:
+		if v.Bool() {
+			e.buf = append(e.buf, 1)
+		} else {
+			e.buf = append(e.buf, 0)
+		}
+	case reflect.Uint8:
+		e.buf = append(e.buf, byte(v.Uint()))
+	case reflect.Int8:
+		e.buf = append(e.buf, byte(v.Int()))
+	case reflect.Uint16:
+		e.uint16(uint16(v.Uint()))
+	case reflect.Int16:
+		e.uint16(uint16(v.Int()))
+	case reflect.Uint32:
+		e.uint32(uint32(v.Uint()))
+	case reflect.Int32:
+		e.uint32(uint32(v.Int()))
+	case reflect.Uint64:
+		e.uint64(v.Uint())
+	case reflect.Int64:
+		e.uint64(uint64(v.Int()))
+	case reflect.Ptr:
+		// 数组元素中的指针
+		return e.field(v, ndrTag{}.defaults(v.Type()), reflect.Value{}, false, false)
+	case reflect.Array:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			for i := 0; i < v.Len(); i++ {
+				e.buf = append(e.buf, byte(v.Index(i).Uint()))
+			}
+			return nil
+		}
+		for i := 0; i < v.Len(); i++ {
+			if err := e.value(v.Index(i), ndrTag{}.defaults(v.Type().Elem()), reflect.Value{}, false); err != nil {
+				return err
+			}
+		}
+	case reflect.Slice:
+		max, actual, err := ndrCounts(v, tag, parent)
+		if err != nil {
+			return err
+		}
+		e.counts(tag, max, actual, hoisted)
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			e.buf = append(e.buf, v.Bytes()[:actual]...)
+			return nil
+		}
+		for i := 0; i < int(actual); i++ {
+			if err = e.value(v.Index(i), ndrTag{}.defaults(v.Type().Elem()), reflect.Value{}, false); err != nil {
+				return err
+			}
+		}
+	case reflect.String:
+		max, actual, err := ndrCounts(v, tag, parent)
+		if err != nil {
+			return err
+		}
+		e.counts(tag, max, actual, hoisted)
+		b := ndrStringBytes(v.String(), tag.ansi)
+		if !tag.ansi {
+			actual *= 2
+		}
+		e.buf = append(e.buf, b[:actual]...)
+	case reflect.Struct:
+		return e.structure(v, hoisted)
+	default:
+		return fmt.Errorf("NDR cannot encode %s", v.Type())
+	}
+	return nil
+}
+
+// 数组头部的数量信息
+func (e *ndrEncoder) counts(tag ndrTag, max, actual uint64, hoisted bool) {
+	if tag.conformant && !hoisted {
+		e.size(max)
+	}
+	if tag.varying {
+		e.size(0)
+		e.size(actual)
+	}
+}
+
+func (e *ndrEncoder) structure(v reflect.Value, hoisted bool) error {
+	t := v.Type()
+	last, lastTag, conformant := ndrConformantField(t)
+	if conformant && !hoisted {
+		max, err := ndrHoistedCount(v, last, lastTag)
+		if err != nil {
+			return err
+		}
+		e.size(max)
+		hoisted = true
+	}
+	align := ndrAlign(t, e.ndr64)
+	e.align(align)
+	for i := 0; i < v.NumField(); i++ {
+		sf := t.Field(i)
+		if sf.PkgPath != "" {
+			continue
+		}
+		tag, err := parseNDRTag(sf)
+		if err != nil {
+			return err
+		}
+		if tag.skip {
+			continue
+		}
+		if err = e.field(v.Field(i), tag, v, false, conformant && hoisted && i == last); err != nil {
+			return fmt.Errorf("%s: %w", sf.Name, err)
+		}
+	}
+	if e.ndr64 {
+		e.align(align)
+	}
+	return nil
+}
+
+// 结构体中一致数组的最大数量
+func ndrHoistedCount(v reflect.Value, last int, tag ndrTag) (uint64, error) {
+	f := v.Field(last)
+	if f.Kind() == reflect.Struct {
+		i, t, _ := ndrConformantField(f.Type())
+		return ndrHoistedCount(f, i, t)
+	}
+	max, _, err := ndrCounts(f, tag, v)
+	return max, err
+}
+
+// 联合体先编码鉴别值，再编码对应的分支
+func (e *ndrEncoder) union(v reflect.Value) error {
+	sw, arm, tag, err := ndrUnionArm(v)
+	if err != nil {
+		return err
+	}
+	if e.ndr64 {
+		e.align(ndrAlign(v.Type(), true))
+	}
+	if err = e.value(v.Field(sw), ndrTag{}, v, false); err != nil {
+		return err
+	}
+	if e.ndr64 {
+		e.align(ndrFieldsAlign(v.Type(), true, true))
+	}
+	if arm < 0 {
+		return nil
+	}
+	return e.field(v.Field(arm), tag, v, false, false)
+}
+
+// 查找联合体的鉴别字段与当前分支，没有匹配的分支时arm为-1
+func ndrUnionArm(v reflect.Value) (sw, arm int, armTag ndrTag, err error) {
+	t := v.Type()
+	if t.Kind() != reflect.Struct {
+		return 0, 0, armTag, fmt.Errorf("NDR union %s must be a struct", t)
+	}
+	sw, arm = -1, -1
+	def := -1
+	var defTag ndrTag
+	for i := 0; i < t.NumField(); i++ {
+		if t.Field(i).PkgPath != "" {
+			continue
+		}
+		tag, err := parseNDRTag(t.Field(i))
+		if err != nil {
+			return 0, 0, armTag, err
+		}
+		if tag.sw {
+			sw = i
+		}
+		if tag.def {
+			def, defTag = i, tag
+		}
+	}
+	if sw < 0 {
+		return 0, 0, armTag, fmt.Errorf("NDR union %s has no switch field", t)
+	}
+	var disc uint64
+	switch f := v.Field(sw); f.Kind() {
+	case reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		disc = f.Uint()
+	case reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		disc = uint64(f.Int())
+	default:
+		return 0, 0, armTag, fmt.Errorf("NDR union %s switch must be an integer", t)
+	}
+	for i := 0; i < t.NumField(); i++ {
+		if t.Field(i).PkgPath != "" {
+			continue
+		}
+		tag, _ := parseNDRTag(t.Field(i))
+		for _, c := range tag.cases {
+			if c == disc {
+				return sw, i, tag, nil
+			}
+		}
+	}
+	if def >= 0 {
+		return sw, def, defTag, nil
+	}
+	return sw, -1, armTag, nil
+}
+
+// NDR解码
+type ndrDecoder struct {
+	buf      []byte
+	off      int
+	ndr64    bool
+	full     map[uint64]reflect.Value
+	deferred []func() error
+}
+
+// 按NDR20解码到v，v为结构体指针，每个字段为一个顶层参数
+func UnmarshalNDR(buf []byte, v interface{}) error {
+	return unmarshalNDR(buf, v, false)
+}
+
+// 按NDR64解码到v，规则同UnmarshalNDR
+func UnmarshalNDR64(buf []byte, v interface{}) error {
+	return unmarshalNDR(buf, v, true)
+}
+
+func unmarshalNDR(buf []byte, v interface{}, ndr64 bool) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.Elem().Kind() != reflect.Struct {
+		return errors.New("UnmarshalNDR requires a pointer to struct")
+	}
+	rv = rv.Elem()
+	d := &ndrDecoder{buf: buf, ndr64: ndr64, full: make(map[uint64]reflect.Value)}
+	t := rv.Type()
+	for i := 0; i < rv.NumField(); i++ {
+		sf := t.Field(i)
+		if sf.PkgPath != "" {
+			continue
+		}
+		tag, err := parseNDRTag(sf)
+		if err != nil {
+			return err
+		}
+		if tag.skip {
+			continue
+		}
+		if err = d.field(rv.Field(i), tag, true, 0, false); err != nil {
+			return fmt.Errorf("NDR field %s: %w", sf.Name, err)
+		}
+		if err = d.flush(); err != nil {
+			return fmt.Errorf("NDR field %s: %w", sf.Name, err)
+		}
+	}
+	return nil
+}
+
+func (d *ndrDecoder) align(n int) {
+	if d.off%n != 0 {
+		d.off += n - d.off%n
+	}
+}
+
+func (d *ndrDecoder) read(n int) ([]byte, error) {
+	if n < 0 || d.off+n > len(d.buf) {
+		return nil, errNDRTruncated
+	}
+	b := d.buf[d.off : d.off+n]
+	d.off += n
+	return b, nil
+}
+
+func (d *ndrDecoder) uint(size int) (uint64, error) {
+	d.align(size)
+	b, err := d.read(size)
+	if err != nil {
+		return 0, err
+	}
+	var v uint64
+	for i := size - 1; i >= 0; i-- {
+		v = v<<8 | uint64(b[i])
+	}
+	return v, nil
+}
+
+func (d *ndrDecoder) size() (uint64, error) {
+	if d.ndr64 {
+		return d.uint(8)
+	}
+	return d.uint(4)
+}
+
+func (d *ndrDecoder) flush() error {
+	for len(d.deferred) > 0 {
+		fn := d.deferred[0]
+		d.deferred = d.deferred[1:]
+		saved := d.deferred
+		d.deferred = nil
+		if err := fn(); err != nil {
+			return err
+		}
+		if err := d.flush(); err != nil {
+			return err
+		}
+		d.deferred = saved
+	}
+	return nil
+}
+
+// 解码字段，conf为结构体开头已读取的一致数组最大数量
+func (d *ndrDecoder) field(v reflect.Value, tag ndrTag, top bool, conf uint64, hoisted bool) error {
+	if tag.union {
+		return d.union(v)
+	}
+	if tag.pointer == ndrNoPointer {
+		return d.value(v, tag, conf, hoisted)
+	}
+	referent := func() error {
+		target := v
+		if v.Kind() == reflect.Ptr {
+			if v.IsNil() {
+				v.Set(reflect.New(v.Type().Elem()))
+			}
+			target = v.Elem()
+		}
+		return d.value(target, tag.referent(), 0, false)
+	}
+	if tag.pointer == ndrRef && top {
+		return referent()
+	}
+	id, err := d.size()
+	if err != nil {
+		return err
+	}
+	if id == 0 {
+		v.Set(reflect.Zero(v.Type()))
+		return nil
+	}
+	if tag.pointer == ndrFull && v.Kind() == reflect.Ptr {
+		if p, ok := d.full[id]; ok {
+			v.Set(p)
+			return nil
+		}
+		v.Set(reflect.New(v.Type().Elem()))
+		d.full[id] = v
+	}
+	d.deferred = append(d.deferred, referent)
+	return nil
+}
+
+func (d *ndrDecoder) value(v reflect.Value, tag ndrTag, conf uint64, hoisted bool) error {
+	switch v.Kind() {
+	case reflect.Bool, reflect.Uint8, reflect.Int8:
+		b, err := d.read(1)
+		if err != nil {
+			return err
+		}
+		switch v.Kind() {
+		case reflect.Bool:
+			v.SetBool(b[0] != 0)
+		case reflect.Uint8:
+			v.SetUint(uint64(b[0]))
+		default:
+			v.SetInt(int64(int8(b[0])))
+		}
+	case reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n, err := d.uint(int(v.Type().Size()))
+		if err != nil {
+			return err
+		}
+		v.SetUint(n)
+	case reflect.Int16:
+		n, err := d.uint(2)
+		v.SetInt(int64(int16(n)))
+		return err
+	case reflect.Int32:
+		n, err := d.uint(4)
+		v.SetInt(int64(int32(n)))
+		return err
+	case reflect.Int64:
+		n, err := d.uint(8)
+		v.SetInt(int64(n))
+		return err
+	case reflect.Ptr:
+		return d.field(v, ndrTag{}.defaults(v.Type()), false, 0, false)
+	case reflect.Array:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			b, err := d.read(v.Len())
+			if err != nil {
+				return err
+			}
+			reflect.Copy(v, reflect.ValueOf(b))
+			return nil
+		}
+		for i := 0; i < v.Len(); i++ {
+			if err := d.value(v.Index(i), ndrTag{}.defaults(v.Type().Elem()), 0, false); err != nil {
+				return err
+			}
+		}
+	case reflect.Slice:
+		n, err := d.counts(tag, conf, hoisted)
+		if err != nil {
+			return err
+		}
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			b, err := d.read(n)
+			if err != nil {
+				return err
+			}
+			v.SetBytes(append([]byte(nil), b...))
+			return nil
+		}
+		s := reflect.MakeSlice(v.Type(), n, n)
+		for i := 0; i < n; i++ {
+			if err = d.value(s.Index(i), ndrTag{}.defaults(v.Type().Elem()), 0, false); err != nil {
+				return err
+			}
+		}
+		v.Set(s)
+	case reflect.String:
+		n, err := d.counts(tag, conf, hoisted)
+		if err != nil {
+			return err
+		}
+		var s string
+		if tag.ansi {
+			b, err := d.read(n)
+			if err != nil {
+				return err
+			}
+			s = string(b)
+		} else {
+			b, err := d.read(n * 2)
+			if err != nil {
+				return err
+			}
+			s = FromUnicode(b)
+		}
+		v.SetString(strings.TrimRight(s, "\x00"))
+	case reflect.Struct:
+		return d.structure(v, conf, hoisted)
+	default:
+		return fmt.Errorf("NDR cannot decode %s", v.Type())
+	}
+	return nil
+}
+
+// 读取数组头部的数量信息，返回实际传输的元素数量
+func (d *ndrDecoder) counts(tag ndrTag, conf uint64, hoisted bool) (int, error) {
+	n := conf
+	var err error
+	if tag.conformant && !hoisted {
+		if n, err = d.size(); err != nil {
+			return 0, err
+		}
+	}
+	if tag.varying {
+		if _, err = d.size(); err != nil {
+			return 0, err
+		}
+		if n, err = d.size(); err != nil {
+			return 0, err
+		}
+	}
+	if n > uint64(len(d.buf)-d.off) {
+		return 0, errNDRTruncated
+	}
+	return int(n), nil
+}
+
+func (d *ndrDecoder) structure(v reflect.Value, conf uint64, hoisted bool) error {
+	t := v.Type()
+	last, _, conformant := ndrConformantField(t)
+	if conformant && !hoisted {
+		var err error
+		if conf, err = d.size(); err != nil {
+			return err
+		}
+		hoisted = true
+	}
+	align := ndrAlign(t, d.ndr64)
+	d.align(align)
+	for i := 0; i < v.NumField(); i++ {
+		sf := t.Field(i)
+		if sf.PkgPath != "" {
+			continue
+		}
+		tag, err := parseNDRTag(sf)
+		if err != nil {
+			return err
+		}
+		if tag.skip {
+			continue
+		}
+		isLast := conformant && hoisted && i == last
+		c := uint64(0)
+		if isLast {
+			c = conf
+		}
+		if err = d.field(v.Field(i), tag, false, c, isLast); err != nil {
+			return fmt.Errorf("%s: %w", sf.Name, err)
+		}
+	}
+	if d.ndr64 {
+		d.align(align)
+	}
+	return nil
+}
+
+func (d *ndrDecoder) union(v reflect.Value) error {
+	t := v.Type()
+	sw := -1
+	for i := 0; i < t.NumField(); i++ {
+		if tag, err := parseNDRTag(t.Field(i)); err == nil && tag.sw && t.Field(i).PkgPath == "" {
+			sw = i
+			break
+		}
+	}
+	if sw < 0 {
+		return fmt.Errorf("NDR union %s has no switch field", t)
+	}
+	if d.ndr64 {
+		d.align(ndrAlign(t, true))
+	}
+	if err := d.value(v.Field(sw), ndrTag{}, 0, false); err != nil {
+		return err
+	}
+	if d.ndr64 {
+		d.align(ndrFieldsAlign(t, true, true))
+	}
+	_, arm, tag, err := ndrUnionArm(v)
+	if err != nil || arm < 0 {
+		return err
+	}
+	return d.field(v.Field(arm), tag, false, 0, false)
+}
@@ -0,0 +1,195 @@
+package encoder
+
+import (
+	"bytes"
+	"encoding/hex"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// 测试向量按NDR规范手工推导，引用id从0x00020000开始每次加4
+// https://pubs.opengroup.org/onlinepubs/9629399/chap14.htm
+
+func ndrHex(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(strings.Join(strings.Fields(s), ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+type ndrAlignArgs struct {
+	A uint8
+	B uint16
+	C uint32
+	D uint64
+	E uint8
+	F [2]uint16
+}
+
+type ndrPointerArgs struct {
+	P *uint32
+	Q *uint32
+}
+
+type ndrStringArgs struct {
+	W string `ndr:"ref"`
+	A string `ndr:"ref,ansi"`
+}
+
+type ndrVaryingArgs struct {
+	Max    uint32
+	Length uint32
+	Data   []uint16 `ndr:"ref,conformant,varying,size_is:Max,length_is:Length"`
+}
+
+type ndrConformantStruct struct {
+	Count uint32
+	Data  []uint16 `ndr:"size_is:Count"`
+}
+
+type ndrConformantArgs struct {
+	S ndrConformantStruct
+}
+
+type ndrFullArgs struct {
+	A *uint32 `ndr:"ptr"`
+	B *uint32 `ndr:"ptr"`
+}
+
+type ndrUnion struct {
+	Tag   uint16  `ndr:"switch"`
+	Short *uint16 `ndr:"case:1"`
+	Long  uint64  `ndr:"case:2|3"`
+	Other uint8   `ndr:"default"`
+}
+
+type ndrUnionArgs struct {
+	Pad uint8
+	U   ndrUnion `ndr:"union"`
+}
+
+func TestNDRVectors(t *testing.T) {
+	five := uint32(5)
+	nine := uint32(9)
+	seven := uint16(7)
+	tests := []struct {
+		name  string
+		v     interface{}
+		ndr20 string
+		ndr64 string
+	}{
+		{
+			name: "alignment",
+			v:    &ndrAlignArgs{A: 1, B: 2, C: 3, D: 4, E: 5, F: [2]uint16{6, 7}},
+			ndr20: `01 00 0200 03000000 0400000000000000
+				05 00 0600 0700`,
+			ndr64: `01 00 0200 03000000 0400000000000000
+				05 00 0600 0700`,
+		},
+		{
+			name:  "unique pointers",
+			v:     &ndrPointerArgs{P: &five},
+			ndr20: `00000200 05000000 00000000`,
+			ndr64: `0000020000000000 05000000 00000000 0000000000000000`,
+		},
+		{
+			name: "strings",
+			v:    &ndrStringArgs{W: "ab", A: "hi"},
+			ndr20: `03000000 00000000 03000000 6100 6200 0000
+				0000 03000000 00000000 03000000 686900`,
+			ndr64: `0300000000000000 0000000000000000 0300000000000000 6100 6200 0000
+				0000 0300000000000000 0000000000000000 0300000000000000 686900`,
+		},
+		{
+			name:  "conformant varying array",
+			v:     &ndrVaryingArgs{Max: 4, Length: 2, Data: []uint16{1, 2}},
+			ndr20: `04000000 02000000 04000000 00000000 02000000 0100 0200`,
+			ndr64: `04000000 02000000 0400000000000000 0000000000000000 0200000000000000 0100 0200`,
+		},
+		{
+			// 一致数组的最大数量提前到结构体开头，NDR64中结构体末尾按8字节对齐填充
+			name:  "conformant structure",
+			v:     &ndrConformantArgs{S: ndrConformantStruct{Count: 3, Data: []uint16{7, 8, 9}}},
+			ndr20: `03000000 03000000 0700 0800 0900`,
+			ndr64: `0300000000000000 03000000 0700 0800 0900 000000000000`,
+		},
+		{
+			// 指向同一数据的全指针使用相同的引用id，数据只编码一次
+			name:  "full pointers",
+			v:     &ndrFullArgs{A: &nine, B: &nine},
+			ndr20: `00000200 09000000 00000200`,
+			ndr64: `0000020000000000 09000000 00000000 0000020000000000`,
+		},
+		{
+			name:  "union pointer arm",
+			v:     &ndrUnionArgs{Pad: 0xff, U: ndrUnion{Tag: 1, Short: &seven}},
+			ndr20: `ff 00 0100 00000200 0700`,
+			ndr64: `ff 00000000000000 0100 000000000000 0000020000000000 0700`,
+		},
+		{
+			name:  "union case list",
+			v:     &ndrUnionArgs{Pad: 0xff, U: ndrUnion{Tag: 3, Long: 0x1122334455667788}},
+			ndr20: `ff 00 0300 00000000 8877665544332211`,
+			ndr64: `ff 00000000000000 0300 000000000000 8877665544332211`,
+		},
+		{
+			name:  "union default arm",
+			v:     &ndrUnionArgs{Pad: 0xff, U: ndrUnion{Tag: 9, Other: 0x42}},
+			ndr20: `ff 00 0900 42`,
+			ndr64: `ff 00000000000000 0900 000000000000 42`,
+		},
+	}
+	for _, tt := range tests {
+		for _, ndr64 := range []bool{false, true} {
+			want := tt.ndr20
+			name := tt.name + "/ndr20"
+			if ndr64 {
+				want = tt.ndr64
+				name = tt.name + "/ndr64"
+			}
+			t.Run(name, func(t *testing.T) {
+				wantBytes := ndrHex(t, want)
+				got, err := marshalNDR(tt.v, ndr64)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(got, wantBytes) {
+					t.Fatalf("marshal mismatch\n got %x\nwant %x", got, wantBytes)
+				}
+				out := reflect.New(reflect.TypeOf(tt.v).Elem())
+				if err = unmarshalNDR(wantBytes, out.Interface(), ndr64); err != nil {
+					t.Fatal(err)
+				}
+				if !reflect.DeepEqual(out.Interface(), tt.v) {
+					t.Fatalf("unmarshal mismatch\n got %+v\nwant %+v", out.Elem(), reflect.ValueOf(tt.v).Elem())
+				}
+			})
+		}
+	}
+}
+
+func TestNDRErrors(t *testing.T) {
+	if _, err := MarshalNDR(&ndrStringArgs{W: "", A: "a"}); err == nil {
+		t.Error("null ref pointer encoded without error")
+	}
+	if _, err := MarshalNDR(&ndrVaryingArgs{Max: 1, Length: 2, Data: []uint16{1, 2}}); err == nil {
+		t.Error("actual count above max encoded without error")
+	}
+	var bad struct {
+		A uint32 `ndr:"bogus"`
+	}
+	if _, err := MarshalNDR(&bad); err == nil {
+		t.Error("unknown tag accepted")
+	}
+	var s ndrStringArgs
+	if err := UnmarshalNDR(ndrHex(t, `ffffff7f 00000000 ffffff7f 6100`), &s); err == nil {
+		t.Error("truncated string decoded without error")
+	}
+	var a ndrAlignArgs
+	if err := UnmarshalNDR(ndrHex(t, `01 00 0200 03000000`), &a); err == nil {
+		t.Error("truncated data decoded without error")
+	}
+}
@@ -0,0 +1,316 @@
+package krb5
+
+// 此文件用于读写MIT凭据缓存(ccache)文件，仅支持第4版格式
+// https://web.mit.edu/kerberos/krb5-devel/doc/formats/ccache_file_format.html
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	CCacheVersion4  = 0x0504
+	ccacheConfRealm = "X-CACHECONF:"
+)
+
+// 凭据缓存
+type CCache struct {
+	Version          uint16
+	Header           []CCacheHeaderField
+	DefaultPrincipal PrincipalName
+	DefaultRealm     string
+	Credentials      []*Credential
+}
+
+// 头部字段，目前只有KDC时间偏移
+type CCacheHeaderField struct {
+	Tag   uint16
+	Value []byte
+}
+
+// 新建只包含默认主体的凭据缓存
+func NewCCache(principal PrincipalName, realm string) *CCache {
+	return &CCache{
+		Version:          CCacheVersion4,
+		DefaultPrincipal: principal,
+		DefaultRealm:     realm,
+	}
+}
+
+// 获取凭据缓存路径，遵循KRB5CCNAME环境变量，只支持FILE类型
+func CCachePath() (string, error) {
+	name := os.Getenv("KRB5CCNAME")
+	if name == "" {
+		return fmt.Sprintf("/tmp/krb5cc_%d", os.Getuid()), nil
+	}
+	if i := strings.Index(name, ":"); i > 1 {
+		if strings.ToUpper(name[:i]) != "FILE" {
+			return "", errors.New("Unsupported credential cache type: " + name[:i])
+		}
+		return name[i+1:], nil
+	}
+	return name, nil
+}
+
+// 读取KRB5CCNAME指定的凭据缓存
+func LoadDefaultCCache() (*CCache, error) {
+	path, err := CCachePath()
+	if err != nil {
+		return nil, err
+	}
+	return LoadCCache(path)
+}
+
+func LoadCCache(path string) (*CCache, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParseCCache(data)
+}
+
+// 写入凭据缓存文件，权限与MIT一致为0600
+func (c *CCache) Save(path string) error {
+	data, err := c.Marshal()
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0600)
+}
+
+// 解析凭据缓存
+func ParseCCache(data []byte) (*CCache, error) {
+	r := &ccacheReader{r: bytes.NewReader(data)}
+	c := &CCache{Version: r.uint16()}
+	if r.err != nil {
+		return nil, r.err
+	}
+	if c.Version != CCacheVersion4 {
+		return nil, fmt.Errorf("Unsupported ccache version 0x%04x", c.Version)
+	}
+	headerLen := int(r.uint16())
+	for headerLen > 0 && r.err == nil {
+		field := CCacheHeaderField{Tag: r.uint16()}
+		field.Value = r.bytes(int(r.uint16()))
+		c.Header = append(c.Header, field)
+		headerLen -= 4 + len(field.Value)
+	}
+	c.DefaultPrincipal, c.DefaultRealm = r.principal()
+	for r.err == nil && r.r.Len() > 0 {
+		cred := &Credential{}
+		cred.Client, cred.CRealm = r.principal()
+		cred.Server, cred.SRealm = r.principal()
+		cred.SessionKey.KeyType = int32(r.uint16())
+		cred.SessionKey.KeyValue = r.data()
+		cred.AuthTime = r.time()
+		cred.StartTime = r.time()
+		cred.EndTime = r.time()
+		cred.RenewTill = r.time()
+		cred.IsSKey = r.uint8() != 0
+		cred.Flags.Bytes = r.bytes(4)
+		cred.Flags.BitLength = 32
+		for i := r.uint32(); i > 0 && r.err == nil; i-- {
+			cred.Addresses = append(cred.Addresses, HostAddress{AddrType: int32(r.uint16()), Address: r.data()})
+		}
+		for i := r.uint32(); i > 0 && r.err == nil; i-- {
+			cred.AuthData = append(cred.AuthData, AuthorizationData{ADType: int32(r.uint16()), ADData: r.data()})
+		}
+		cred.Ticket = r.data()
+		cred.SecondTicket = r.data()
+		if r.err != nil {
+			break
+		}
+		c.Credentials = append(c.Credentials, cred)
+	}
+	if r.err != nil {
+		return nil, r.err
+	}
+	return c, nil
+}
+
+// 序列化凭据缓存
+func (c *CCache) Marshal() ([]byte, error) {
+	w := &bytes.Buffer{}
+	version := c.Version
+	if version == 0 {
+		version = CCacheVersion4
+	}
+	if version != CCacheVersion4 {
+		return nil, fmt.Errorf("Unsupported ccache version 0x%04x", version)
+	}
+	binary.Write(w, binary.BigEndian, version)
+	headerLen := 0
+	for _, field := range c.Header {
+		headerLen += 4 + len(field.Value)
+	}
+	binary.Write(w, binary.BigEndian, uint16(headerLen))
+	for _, field := range c.Header {
+		binary.Write(w, binary.BigEndian, field.Tag)
+		binary.Write(w, binary.BigEndian, uint16(len(field.Value)))
+		w.Write(field.Value)
+	}
+	writeCCachePrincipal(w, c.DefaultPrincipal, c.DefaultRealm)
+	for _, cred := range c.Credentials {
+		writeCCachePrincipal(w, cred.Client, cred.CRealm)
+		writeCCachePrincipal(w, cred.Server, cred.SRealm)
+		binary.Write(w, binary.BigEndian, uint16(cred.SessionKey.KeyType))
+		writeCCacheData(w, cred.SessionKey.KeyValue)
+		for _, t := range []time.Time{cred.AuthTime, cred.StartTime, cred.EndTime, cred.RenewTill} {
+			binary.Write(w, binary.BigEndian, ccacheTime(t))
+		}
+		if cred.IsSKey {
+			w.WriteByte(1)
+		} else {
+			w.WriteByte(0)
+		}
+		flags := make([]byte, 4)
+		copy(flags, cred.Flags.Bytes)
+		w.Write(flags)
+		binary.Write(w, binary.BigEndian, uint32(len(cred.Addresses)))
+		for _, addr := range cred.Addresses {
+			binary.Write(w, binary.BigEndian, uint16(addr.AddrType))
+			writeCCacheData(w, addr.Address)
+		}
+		binary.Write(w, binary.BigEndian, uint32(len(cred.AuthData)))
+		for _, ad := range cred.AuthData {
+			binary.Write(w, binary.BigEndian, uint16(ad.ADType))
+			writeCCacheData(w, ad.ADData)
+		}
+		writeCCacheData(w, cred.Ticket)
+		writeCCacheData(w, cred.SecondTicket)
+	}
+	return w.Bytes(), nil
+}
+
+// 添加凭据，相同客户端与服务的旧凭据会被替换
+func (c *CCache) AddCredential(cred *Credential) {
+	for i, old := range c.Credentials {
+		if old.Client.String() == cred.Client.String() && old.CRealm == cred.CRealm &&
+			strings.EqualFold(old.Server.String(), cred.Server.String()) && strings.EqualFold(old.SRealm, cred.SRealm) {
+			c.Credentials[i] = cred
+			return
+		}
+	}
+	c.Credentials = append(c.Credentials, cred)
+}
+
+// 查找指定服务的凭据，服务名不区分大小写，跳过缓存配置项以及过期凭据
+func (c *CCache) GetCredential(spn, realm string) *Credential {
+	now := time.Now()
+	for _, cred := range c.Credentials {
+		if strings.HasPrefix(cred.SRealm, ccacheConfRealm) || strings.HasPrefix(cred.Server.String(), ccacheConfRealm) {
+			continue
+		}
+		if !cred.EndTime.IsZero() && cred.EndTime.Before(now) {
+			continue
+		}
+		if !strings.EqualFold(cred.Server.String(), spn) {
+			continue
+		}
+		if realm != "" && !strings.EqualFold(cred.SRealm, realm) {
+			continue
+		}
+		return cred
+	}
+	return nil
+}
+
+// 获取默认域的TGT
+func (c *CCache) TGT() *Credential {
+	return c.GetCredential("krbtgt/"+c.DefaultRealm, c.DefaultRealm)
+}
+
+func writeCCachePrincipal(w *bytes.Buffer, p PrincipalName, realm string) {
+	binary.Write(w, binary.BigEndian, uint32(p.NameType))
+	binary.Write(w, binary.BigEndian, uint32(len(p.NameString)))
+	writeCCacheData(w, []byte(realm))
+	for _, s := range p.NameString {
+		writeCCacheData(w, []byte(s))
+	}
+}
+
+func writeCCacheData(w *bytes.Buffer, data []byte) {
+	binary.Write(w, binary.BigEndian, uint32(len(data)))
+	w.Write(data)
+}
+
+func ccacheTime(t time.Time) uint32 {
+	if t.IsZero() {
+		return 0
+	}
+	return uint32(t.Unix())
+}
+
+// 按大端序读取，出错后后续读取均返回零值
+type ccacheReader struct {
+	r   *bytes.Reader
+	err error
+}
+
+func (r *ccacheReader) read(v interface{}) {
+	if r.err != nil {
+		return
+	}
+	if err := binary.Read(r.r, binary.BigEndian, v); err != nil {
+		r.err = errors.New("Truncated ccache file")
+	}
+}
+
+func (r *ccacheReader) uint8() uint8 {
+	var v uint8
+	r.read(&v)
+	return v
+}
+
+func (r *ccacheReader) uint16() uint16 {
+	var v uint16
+	r.read(&v)
+	return v
+}
+
+func (r *ccacheReader) uint32() uint32 {
+	var v uint32
+	r.read(&v)
+	return v
+}
+
+func (r *ccacheReader) bytes(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if n > r.r.Len() {
+		r.err = errors.New("Truncated ccache file")
+		return nil
+	}
+	buf := make([]byte, n)
+	io.ReadFull(r.r, buf)
+	return buf
+}
+
+func (r *ccacheReader) data() []byte {
+	return r.bytes(int(r.uint32()))
+}
+
+func (r *ccacheReader) time() time.Time {
+	v := r.uint32()
+	if v == 0 {
+		return time.Time{}
+	}
+	return time.Unix(int64(v), 0).UTC()
+}
+
+func (r *ccacheReader) principal() (PrincipalName, string) {
+	p := PrincipalName{NameType: int32(r.uint32())}
+	count := r.uint32()
+	realm := string(r.data())
+	for i := uint32(0); i < count && r.err == nil; i++ {
+		p.NameString = append(p.NameString, string(r.data()))
+	}
+	return p, realm
+}
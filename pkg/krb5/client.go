@@ -0,0 +1,395 @@
+package krb5
+
+// 此文件用于与KDC交互，获取TGT以及服务票据
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/asn1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+// KDC响应的最大长度，防止按恶意的长度前缀分配过大内存
+const maxKDCMessageSize = 1 << 20
+
+// 凭据，包含票据以及对应的会话密钥
+type Credential struct {
+	Client     PrincipalName
+	CRealm     string
+	Server     PrincipalName
+	SRealm     string
+	Ticket     []byte // APPLICATION 1编码的票据，原样转发
+	SessionKey EncryptionKey
+	Flags      asn1.BitString
+	AuthTime   time.Time
+	StartTime  time.Time
+	EndTime    time.Time
+	RenewTill  time.Time
+	// 以下字段仅用于ccache读写
+	IsSKey       bool
+	Addresses    []HostAddress
+	AuthData     []AuthorizationData
+	SecondTicket []byte
+}
+
+// Kerberos客户端
+type Client struct {
+	Username    string
+	Realm       string
+	KDC         string                                                               // KDC地址，格式为 host:port
+	DialContext func(ctx context.Context, network, address string) (net.Conn, error) // 为空时直接连接
+	Timeout     time.Duration                                                        // 单次请求收发的超时，0为不限制
+	password    string
+	key         *EncryptionKey
+	tgt         *Credential
+}
+
+// 明文密码认证，AES密钥的盐值从KDC返回的ETYPE-INFO2中获取
+func NewClientWithPassword(username, realm, kdc, password string) *Client {
+	return &Client{Username: username, Realm: strings.ToUpper(realm), KDC: kdc, password: password}
+}
+
+// 长期密钥认证，NT hash对应RC4-HMAC，AES密钥对应AES128/AES256
+func NewClientWithKey(username, realm, kdc string, key EncryptionKey) *Client {
+	return &Client{Username: username, Realm: strings.ToUpper(realm), KDC: kdc, key: &key}
+}
+
+// 使用凭据缓存中的TGT，用户名与域名取自缓存的默认主体
+func NewClientWithCCache(cc *CCache, kdc string) (*Client, error) {
+	tgt := cc.TGT()
+	if tgt == nil {
+		return nil, errors.New("No valid TGT found in credential cache")
+	}
+	return &Client{Username: cc.DefaultPrincipal.String(), Realm: strings.ToUpper(cc.DefaultRealm), KDC: kdc, tgt: tgt}, nil
+}
+
+// 默认盐值为大写域名加用户名
+func (c *Client) defaultSalt() string {
+	return c.Realm + c.Username
+}
+
+// 请求中声明支持的加密类型
+func (c *Client) etypes() []int32 {
+	if c.key != nil {
+		return []int32{c.key.KeyType}
+	}
+	return []int32{ETYPE_AES256_CTS_HMAC_SHA1_96, ETYPE_AES128_CTS_HMAC_SHA1_96, ETYPE_RC4_HMAC}
+}
+
+func newNonce() (int32, error) {
+	buf := make([]byte, 4)
+	if _, err := rand.Read(buf); err != nil {
+		return 0, err
+	}
+	return int32(binary.BigEndian.Uint32(buf) & 0x7fffffff), nil
+}
+
+// 构造加密时间戳预认证数据
+func newEncTimestamp(key EncryptionKey) (PAData, error) {
+	now := time.Now().UTC()
+	enc, err := EncryptData(key, KeyUsageASReqTimestamp, marshalPAEncTimestamp(now, now.Nanosecond()/1000))
+	if err != nil {
+		return PAData{}, err
+	}
+	return PAData{PADataType: PA_ENC_TIMESTAMP, PADataValue: enc.marshal()}, nil
+}
+
+// 获取TGT
+func (c *Client) Login() error {
+	return c.LoginContext(context.Background())
+}
+
+func (c *Client) LoginContext(ctx context.Context) error {
+	cname := NewPrincipalName(KRB_NT_PRINCIPAL, c.Username)
+	nonce, err := newNonce()
+	if err != nil {
+		return err
+	}
+	body := kdcReqBody{
+		options: []int{KDCOptionForwardable, KDCOptionRenewable, KDCOptionCanonicalize},
+		cname:   &cname,
+		realm:   c.Realm,
+		sname:   NewPrincipalName(KRB_NT_SRV_INST, "krbtgt/"+c.Realm),
+		till:    time.Now().Add(24 * time.Hour),
+		nonce:   nonce,
+		etypes:  c.etypes(),
+	}
+	pacRequest := PAData{PADataType: PA_PAC_REQUEST, PADataValue: marshalPACRequest(true)}
+	padata := []PAData{pacRequest}
+	if c.key != nil {
+		ts, err := newEncTimestamp(*c.key)
+		if err != nil {
+			return err
+		}
+		padata = append([]PAData{ts}, padata...)
+	}
+	buf, err := c.send(ctx, marshalKDCReq(KRB_AS_REQ, padata, body.marshal()))
+	var krbErr *Error
+	if errors.As(err, &krbErr) && krbErr.Code == KDC_ERR_PREAUTH_REQUIRED && c.key == nil {
+		// 根据KDC返回的加密类型以及盐值计算密钥后重新发送
+		key, err := c.keyFromETypeInfo(krbErr.methodData, 0)
+		if err != nil {
+			return err
+		}
+		c.key = &key
+		ts, err := newEncTimestamp(key)
+		if err != nil {
+			return err
+		}
+		buf, err = c.send(ctx, marshalKDCReq(KRB_AS_REQ, []PAData{ts, pacRequest}, body.marshal()))
+		if err != nil {
+			return err
+		}
+	} else if err != nil {
+		return err
+	}
+	rep, err := parseKDCRep(buf, KRB_AS_REP)
+	if err != nil {
+		return err
+	}
+	if c.key == nil || c.key.KeyType != rep.EncPart.EType {
+		// KDC未要求预认证，按响应中的加密类型计算密钥
+		key, err := c.keyFromETypeInfo(rep.PAData, rep.EncPart.EType)
+		if err != nil {
+			return err
+		}
+		c.key = &key
+	}
+	cred, err := decryptKDCRep(rep, *c.key, KeyUsageASRepEncPart, nonce)
+	if err != nil {
+		return err
+	}
+	c.tgt = cred
+	return nil
+}
+
+// 根据ETYPE-INFO2计算密钥，etype为0时选择首个支持的加密类型
+func (c *Client) keyFromETypeInfo(padata []PAData, etype int32) (EncryptionKey, error) {
+	if c.password == "" {
+		return EncryptionKey{}, errors.New("KDC does not accept the supplied key type")
+	}
+	salt := c.defaultSalt()
+	for _, pa := range padata {
+		if pa.PADataType != PA_ETYPE_INFO2 {
+			continue
+		}
+		var entries []ETypeInfo2Entry
+		if _, err := asn1.Unmarshal(pa.PADataValue, &entries); err != nil {
+			return EncryptionKey{}, err
+		}
+		for _, entry := range entries {
+			if KeySize(entry.EType) == 0 || (etype != 0 && entry.EType != etype) {
+				continue
+			}
+			if entry.Salt != "" {
+				salt = entry.Salt
+			}
+			return StringToKey(entry.EType, c.password, salt)
+		}
+	}
+	if etype == 0 {
+		etype = ETYPE_RC4_HMAC
+	}
+	return StringToKey(etype, c.password, salt)
+}
+
+// 设置已有的TGT
+func (c *Client) WithTGT(tgt *Credential) *Client {
+	c.tgt = tgt
+	return c
+}
+
+func (c *Client) GetTGT() *Credential {
+	return c.tgt
+}
+
+// 获取服务票据，spn格式如 cifs/host
+func (c *Client) GetServiceTicket(spn string) (*Credential, error) {
+	return c.GetServiceTicketContext(context.Background(), spn)
+}
+
+func (c *Client) GetServiceTicketContext(ctx context.Context, spn string) (*Credential, error) {
+	if c.tgt == nil {
+		if err := c.LoginContext(ctx); err != nil {
+			return nil, err
+		}
+	}
+	nonce, err := newNonce()
+	if err != nil {
+		return nil, err
+	}
+	etypes := []int32{c.tgt.SessionKey.KeyType}
+	for _, e := range []int32{ETYPE_AES256_CTS_HMAC_SHA1_96, ETYPE_AES128_CTS_HMAC_SHA1_96, ETYPE_RC4_HMAC} {
+		if e != c.tgt.SessionKey.KeyType {
+			etypes = append(etypes, e)
+		}
+	}
+	body := kdcReqBody{
+		options: []int{KDCOptionForwardable, KDCOptionRenewable, KDCOptionCanonicalize, KDCOptionRenewableOK},
+		realm:   c.Realm,
+		sname:   NewPrincipalName(KRB_NT_SRV_INST, spn),
+		till:    time.Now().Add(24 * time.Hour),
+		nonce:   nonce,
+		etypes:  etypes,
+	}
+	bodyBytes := body.marshal()
+	cksum, err := MakeChecksum(c.tgt.SessionKey, KeyUsageTGSReqAuthChecksum, bodyBytes)
+	if err != nil {
+		return nil, err
+	}
+	apReq, err := NewAPReq(c.tgt, KeyUsageTGSReqAuthenticator, &cksum, nil)
+	if err != nil {
+		return nil, err
+	}
+	buf, err := c.send(ctx, marshalKDCReq(KRB_TGS_REQ, []PAData{{PADataType: PA_TGS_REQ, PADataValue: apReq}}, bodyBytes))
+	if err != nil {
+		return nil, err
+	}
+	rep, err := parseKDCRep(buf, KRB_TGS_REP)
+	if err != nil {
+		return nil, err
+	}
+	return decryptKDCRep(rep, c.tgt.SessionKey, KeyUsageTGSRepEncPartSession, nonce)
+}
+
+// 构造AP-REQ，cred为目标服务的凭据
+func NewAPReq(cred *Credential, usage uint32, cksum *Checksum, options []int) ([]byte, error) {
+	apReq, _, err := newAPReq(cred, usage, cksum, options)
+	return apReq, err
+}
+
+func newAPReq(cred *Credential, usage uint32, cksum *Checksum, options []int) ([]byte, authenticatorData, error) {
+	now := time.Now().UTC()
+	seq, err := newNonce()
+	if err != nil {
+		return nil, authenticatorData{}, err
+	}
+	auth := authenticatorData{
+		crealm:    cred.CRealm,
+		cname:     cred.Client,
+		cksum:     cksum,
+		cusec:     now.Nanosecond() / 1000,
+		ctime:     now,
+		seqNumber: uint32(seq),
+	}
+	enc, err := EncryptData(cred.SessionKey, usage, auth.marshal())
+	if err != nil {
+		return nil, authenticatorData{}, err
+	}
+	return marshalAPReq(options, cred.Ticket, enc), auth, nil
+}
+
+// 解析AS-REP/TGS-REP
+func parseKDCRep(buf []byte, msgType int) (KDCRep, error) {
+	var rep KDCRep
+	if _, err := asn1.UnmarshalWithParams(buf, &rep, fmt.Sprintf("application,explicit,tag:%d", msgType)); err != nil {
+		return KDCRep{}, err
+	}
+	return rep, nil
+}
+
+// 解密KDC响应中的加密部分并生成凭据
+func decryptKDCRep(rep KDCRep, key EncryptionKey, usage uint32, nonce int32) (*Credential, error) {
+	plain, err := DecryptData(key, usage, rep.EncPart)
+	if err != nil {
+		return nil, err
+	}
+	var part EncKDCRepPart
+	// 部分KDC对AS-REP也使用EncTGSRepPart的标签
+	tag := encASRepPart
+	if len(plain) > 0 && plain[0] == 0x60|encTGSRepPart {
+		tag = encTGSRepPart
+	}
+	if _, err = asn1.UnmarshalWithParams(plain, &part, fmt.Sprintf("application,explicit,tag:%d", tag)); err != nil {
+		return nil, err
+	}
+	if part.Nonce != nonce {
+		return nil, errors.New("Kerberos reply nonce mismatch")
+	}
+	return &Credential{
+		Client:     rep.CName,
+		CRealm:     rep.CRealm,
+		Server:     part.SName,
+		SRealm:     part.SRealm,
+		Ticket:     rep.Ticket.Bytes,
+		SessionKey: part.Key,
+		Flags:      part.Flags,
+		AuthTime:   part.AuthTime,
+		StartTime:  part.StartTime,
+		EndTime:    part.EndTime,
+		RenewTill:  part.RenewTill,
+	}, nil
+}
+
+// 通过TCP发送请求，消息前带4字节大端长度
+func (c *Client) send(ctx context.Context, req []byte) ([]byte, error) {
+	dial := c.DialContext
+	if dial == nil {
+		var d net.Dialer
+		dial = d.DialContext
+	}
+	conn, err := dial(ctx, "tcp", c.KDC)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	// ctx取消时关闭连接以中断阻塞的读写
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+	if c.Timeout > 0 {
+		conn.SetDeadline(time.Now().Add(c.Timeout))
+	}
+	buf := make([]byte, 4, 4+len(req))
+	binary.BigEndian.PutUint32(buf, uint32(len(req)))
+	if _, err = conn.Write(append(buf, req...)); err != nil {
+		return nil, err
+	}
+	if _, err = io.ReadFull(conn, buf); err != nil {
+		return nil, err
+	}
+	size := binary.BigEndian.Uint32(buf)
+	if size > maxKDCMessageSize {
+		return nil, fmt.Errorf("KDC response too large: %d bytes", size)
+	}
+	resp := make([]byte, size)
+	if _, err = io.ReadFull(conn, resp); err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, err
+	}
+	if err = parseKRBError(resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// 判断是否为KRB-ERROR
+func parseKRBError(buf []byte) error {
+	if len(buf) == 0 || buf[0] != 0x60|KRB_ERROR {
+		return nil
+	}
+	var krbErr KRBError
+	if _, err := asn1.UnmarshalWithParams(buf, &krbErr, fmt.Sprintf("application,explicit,tag:%d", KRB_ERROR)); err != nil {
+		return err
+	}
+	ret := &Error{Code: krbErr.ErrorCode, Text: krbErr.EText}
+	if len(krbErr.EData) > 0 {
+		// e-data为METHOD-DATA，解析失败时忽略
+		asn1.Unmarshal(krbErr.EData, &ret.methodData)
+	}
+	return ret
+}
@@ -0,0 +1,36 @@
+package krb5
+
+import (
+	"context"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// 长度前缀超过上限时在分配内存之前拒绝
+func TestSendRejectsOversizedResponse(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		buf := make([]byte, 4+3)
+		if _, err = io.ReadFull(conn, buf); err != nil {
+			return
+		}
+		conn.Write([]byte{0xff, 0xff, 0xff, 0xff})
+	}()
+	c := &Client{KDC: ln.Addr().String(), Timeout: 5 * time.Second}
+	_, err = c.send(context.Background(), []byte{1, 2, 3})
+	if err == nil || !strings.Contains(err.Error(), "too large") {
+		t.Fatalf("got %v, want oversized response error", err)
+	}
+}
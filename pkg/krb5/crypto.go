@@ -0,0 +1,376 @@
+package krb5
+
+// 此文件实现Kerberos加密类型
+// RC4-HMAC 遵循RFC-4757，AES-CTS-HMAC-SHA1-96 遵循RFC-3961、RFC-3962
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/rc4"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+
+	"golang.org/x/crypto/pbkdf2"
+
+	"github.com/4ra1n/go-impacket/pkg/krb5/ntlm"
+)
+
+var ErrIntegrity = errors.New("Kerberos message integrity check failed")
+
+// AES string-to-key默认的PBKDF2迭代次数
+// https://datatracker.ietf.org/doc/html/rfc3962#section-4
+const aesDefaultIterations = 4096
+
+// 加密类型对应的密钥长度
+func KeySize(etype int32) int {
+	switch etype {
+	case ETYPE_AES256_CTS_HMAC_SHA1_96:
+		return 32
+	case ETYPE_AES128_CTS_HMAC_SHA1_96, ETYPE_RC4_HMAC:
+		return 16
+	default:
+		return 0
+	}
+}
+
+// 根据密码以及盐值计算长期密钥，RC4-HMAC即NT hash，不使用盐值
+func StringToKey(etype int32, password, salt string) (EncryptionKey, error) {
+	switch etype {
+	case ETYPE_RC4_HMAC:
+		return EncryptionKey{KeyType: etype, KeyValue: ntlm.NTOWFv1(password)}, nil
+	case ETYPE_AES128_CTS_HMAC_SHA1_96, ETYPE_AES256_CTS_HMAC_SHA1_96:
+		return aesStringToKey(etype, password, salt, aesDefaultIterations)
+	default:
+		return EncryptionKey{}, errors.New("Unsupported encryption type")
+	}
+}
+
+// 指定迭代次数计算AES长期密钥
+func aesStringToKey(etype int32, password, salt string, iterations int) (EncryptionKey, error) {
+	tkey := pbkdf2.Key([]byte(password), []byte(salt), iterations, KeySize(etype), sha1.New)
+	key, err := deriveKey(tkey, []byte("kerberos"))
+	if err != nil {
+		return EncryptionKey{}, err
+	}
+	return EncryptionKey{KeyType: etype, KeyValue: key}, nil
+}
+
+// 生成随机密钥，用于子密钥
+func RandomKey(etype int32) (EncryptionKey, error) {
+	n := KeySize(etype)
+	if n == 0 {
+		return EncryptionKey{}, errors.New("Unsupported encryption type")
+	}
+	key := make([]byte, n)
+	if _, err := rand.Read(key); err != nil {
+		return EncryptionKey{}, err
+	}
+	return EncryptionKey{KeyType: etype, KeyValue: key}, nil
+}
+
+// 使用指定密钥用途加密
+func Encrypt(key EncryptionKey, usage uint32, plaintext []byte) ([]byte, error) {
+	switch key.KeyType {
+	case ETYPE_RC4_HMAC:
+		return rc4Encrypt(key.KeyValue, usage, plaintext)
+	case ETYPE_AES128_CTS_HMAC_SHA1_96, ETYPE_AES256_CTS_HMAC_SHA1_96:
+		return aesEncrypt(key.KeyValue, usage, plaintext)
+	default:
+		return nil, errors.New("Unsupported encryption type")
+	}
+}
+
+// 使用指定密钥用途解密并校验完整性
+func Decrypt(key EncryptionKey, usage uint32, ciphertext []byte) ([]byte, error) {
+	switch key.KeyType {
+	case ETYPE_RC4_HMAC:
+		return rc4Decrypt(key.KeyValue, usage, ciphertext)
+	case ETYPE_AES128_CTS_HMAC_SHA1_96, ETYPE_AES256_CTS_HMAC_SHA1_96:
+		return aesDecrypt(key.KeyValue, usage, ciphertext)
+	default:
+		return nil, errors.New("Unsupported encryption type")
+	}
+}
+
+// 加密并封装为EncryptedData
+func EncryptData(key EncryptionKey, usage uint32, plaintext []byte) (EncryptedData, error) {
+	cipher, err := Encrypt(key, usage, plaintext)
+	if err != nil {
+		return EncryptedData{}, err
+	}
+	return EncryptedData{EType: key.KeyType, Cipher: cipher}, nil
+}
+
+// 解密EncryptedData
+func DecryptData(key EncryptionKey, usage uint32, data EncryptedData) ([]byte, error) {
+	if data.EType != key.KeyType {
+		return nil, errors.New("Kerberos encryption type mismatch")
+	}
+	return Decrypt(key, usage, data.Cipher)
+}
+
+// 计算带密钥的校验和
+func MakeChecksum(key EncryptionKey, usage uint32, data []byte) (Checksum, error) {
+	switch key.KeyType {
+	case ETYPE_RC4_HMAC:
+		ksign := hmacMD5(key.KeyValue, []byte("signaturekey\x00"))
+		h := md5.New()
+		h.Write(usageBytes(rc4Usage(usage)))
+		h.Write(data)
+		return Checksum{CksumType: CKSUMTYPE_HMAC_MD5, Checksum: hmacMD5(ksign, h.Sum(nil))}, nil
+	case ETYPE_AES128_CTS_HMAC_SHA1_96, ETYPE_AES256_CTS_HMAC_SHA1_96:
+		kc, err := deriveKey(key.KeyValue, append(usageBytes(usage), 0x99))
+		if err != nil {
+			return Checksum{}, err
+		}
+		cksumType := int32(CKSUMTYPE_HMAC_SHA1_96_AES128)
+		if key.KeyType == ETYPE_AES256_CTS_HMAC_SHA1_96 {
+			cksumType = CKSUMTYPE_HMAC_SHA1_96_AES256
+		}
+		return Checksum{CksumType: cksumType, Checksum: hmacSHA1(kc, data)[:12]}, nil
+	default:
+		return Checksum{}, errors.New("Unsupported encryption type")
+	}
+}
+
+func usageBytes(usage uint32) []byte {
+	buf := make([]byte, 4)
+	binary.BigEndian.PutUint32(buf, usage)
+	return buf
+}
+
+func hmacMD5(key, data []byte) []byte {
+	h := hmac.New(md5.New, key)
+	h.Write(data)
+	return h.Sum(nil)
+}
+
+func hmacSHA1(key, data []byte) []byte {
+	h := hmac.New(sha1.New, key)
+	h.Write(data)
+	return h.Sum(nil)
+}
+
+// RC4-HMAC的密钥用途转换，AS-REP与TGS-REP加密部分均使用8
+func rc4Usage(usage uint32) uint32 {
+	switch usage {
+	case KeyUsageASRepEncPart, KeyUsageTGSRepEncPartSubkey:
+		return KeyUsageTGSRepEncPartSession
+	}
+	return usage
+}
+
+func rc4Encrypt(key []byte, usage uint32, plaintext []byte) ([]byte, error) {
+	k1 := hmacMD5(key, leUsage(rc4Usage(usage)))
+	data := make([]byte, 8+len(plaintext))
+	if _, err := rand.Read(data[:8]); err != nil {
+		return nil, err
+	}
+	copy(data[8:], plaintext)
+	cksum := hmacMD5(k1, data)
+	c, err := rc4.NewCipher(hmacMD5(k1, cksum))
+	if err != nil {
+		return nil, err
+	}
+	ret := make([]byte, 16+len(data))
+	copy(ret, cksum)
+	c.XORKeyStream(ret[16:], data)
+	return ret, nil
+}
+
+func rc4Decrypt(key []byte, usage uint32, ciphertext []byte) ([]byte, error) {
+	if len(ciphertext) < 24 {
+		return nil, errors.New("Kerberos ciphertext too short")
+	}
+	k1 := hmacMD5(key, leUsage(rc4Usage(usage)))
+	cksum := ciphertext[:16]
+	c, err := rc4.NewCipher(hmacMD5(k1, cksum))
+	if err != nil {
+		return nil, err
+	}
+	data := make([]byte, len(ciphertext)-16)
+	c.XORKeyStream(data, ciphertext[16:])
+	if !hmac.Equal(hmacMD5(k1, data), cksum) {
+		return nil, ErrIntegrity
+	}
+	return data[8:], nil
+}
+
+func leUsage(usage uint32) []byte {
+	buf := make([]byte, 4)
+	binary.LittleEndian.PutUint32(buf, usage)
+	return buf
+}
+
+func aesEncrypt(key []byte, usage uint32, plaintext []byte) ([]byte, error) {
+	ke, err := deriveKey(key, append(usageBytes(usage), 0xAA))
+	if err != nil {
+		return nil, err
+	}
+	ki, err := deriveKey(key, append(usageBytes(usage), 0x55))
+	if err != nil {
+		return nil, err
+	}
+	data := make([]byte, aes.BlockSize+len(plaintext))
+	if _, err = rand.Read(data[:aes.BlockSize]); err != nil {
+		return nil, err
+	}
+	copy(data[aes.BlockSize:], plaintext)
+	ret, err := ctsEncrypt(ke, data)
+	if err != nil {
+		return nil, err
+	}
+	return append(ret, hmacSHA1(ki, data)[:12]...), nil
+}
+
+func aesDecrypt(key []byte, usage uint32, ciphertext []byte) ([]byte, error) {
+	if len(ciphertext) < aes.BlockSize+12 {
+		return nil, errors.New("Kerberos ciphertext too short")
+	}
+	ke, err := deriveKey(key, append(usageBytes(usage), 0xAA))
+	if err != nil {
+		return nil, err
+	}
+	ki, err := deriveKey(key, append(usageBytes(usage), 0x55))
+	if err != nil {
+		return nil, err
+	}
+	n := len(ciphertext) - 12
+	data, err := ctsDecrypt(ke, ciphertext[:n])
+	if err != nil {
+		return nil, err
+	}
+	if !hmac.Equal(hmacSHA1(ki, data)[:12], ciphertext[n:]) {
+		return nil, ErrIntegrity
+	}
+	return data[aes.BlockSize:], nil
+}
+
+// DK(Key, Constant) = random-to-key(DR(Key, Constant))，AES的random-to-key为恒等变换
+func deriveKey(key, constant []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	k := nfold(constant, aes.BlockSize)
+	ret := make([]byte, 0, len(key)+aes.BlockSize)
+	for len(ret) < len(key) {
+		block.Encrypt(k, k)
+		ret = append(ret, k...)
+	}
+	return ret[:len(key)], nil
+}
+
+// n-fold，输出n字节
+// https://datatracker.ietf.org/doc/html/rfc3961#section-5.1
+func nfold(in []byte, n int) []byte {
+	k := len(in)
+	lcm := n * k / gcd(n, k)
+	buf := make([]byte, 0, lcm)
+	for i := 0; i < lcm/k; i++ {
+		buf = append(buf, rotateRight(in, 13*i)...)
+	}
+	out := make([]byte, n)
+	for off := 0; off < lcm; off += n {
+		onesComplementAdd(out, buf[off:off+n])
+	}
+	return out
+}
+
+func gcd(a, b int) int {
+	for b != 0 {
+		a, b = b, a%b
+	}
+	return a
+}
+
+// 将整个字节串视为大端位串循环右移
+func rotateRight(in []byte, bits int) []byte {
+	total := len(in) * 8
+	bits %= total
+	out := make([]byte, len(in))
+	for i := 0; i < total; i++ {
+		src := (i - bits + total) % total
+		if in[src/8]&(0x80>>uint(src%8)) != 0 {
+			out[i/8] |= 0x80 >> uint(i%8)
+		}
+	}
+	return out
+}
+
+// 反码加法，进位循环加回最低位
+func onesComplementAdd(acc, b []byte) {
+	carry := 0
+	for i := len(acc) - 1; i >= 0; i-- {
+		sum := int(acc[i]) + int(b[i]) + carry
+		acc[i] = byte(sum)
+		carry = sum >> 8
+	}
+	for carry != 0 {
+		for i := len(acc) - 1; i >= 0 && carry != 0; i-- {
+			sum := int(acc[i]) + carry
+			acc[i] = byte(sum)
+			carry = sum >> 8
+		}
+	}
+}
+
+// AES-CTS，IV为0，交换最后两个密文块
+// https://datatracker.ietf.org/doc/html/rfc3962#section-5
+func ctsEncrypt(key, plaintext []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	n := len(plaintext)
+	if n < aes.BlockSize {
+		return nil, errors.New("Kerberos plaintext too short")
+	}
+	padded := make([]byte, (n+aes.BlockSize-1)/aes.BlockSize*aes.BlockSize)
+	copy(padded, plaintext)
+	cipher.NewCBCEncrypter(block, make([]byte, aes.BlockSize)).CryptBlocks(padded, padded)
+	if n == aes.BlockSize {
+		return padded, nil
+	}
+	blocks := len(padded) / aes.BlockSize
+	r := n - (blocks-1)*aes.BlockSize
+	ret := make([]byte, 0, n)
+	ret = append(ret, padded[:(blocks-2)*aes.BlockSize]...)
+	ret = append(ret, padded[(blocks-1)*aes.BlockSize:]...)
+	ret = append(ret, padded[(blocks-2)*aes.BlockSize:(blocks-2)*aes.BlockSize+r]...)
+	return ret, nil
+}
+
+func ctsDecrypt(key, ciphertext []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	n := len(ciphertext)
+	if n < aes.BlockSize {
+		return nil, errors.New("Kerberos ciphertext too short")
+	}
+	if n == aes.BlockSize {
+		ret := make([]byte, n)
+		block.Decrypt(ret, ciphertext)
+		return ret, nil
+	}
+	blocks := (n + aes.BlockSize - 1) / aes.BlockSize
+	r := n - (blocks-1)*aes.BlockSize
+	// 还原标准CBC密文：倒数第二块为被截断块补齐后的结果
+	last := ciphertext[(blocks-2)*aes.BlockSize : (blocks-1)*aes.BlockSize]
+	partial := ciphertext[(blocks-1)*aes.BlockSize:]
+	d := make([]byte, aes.BlockSize)
+	block.Decrypt(d, last)
+	full := make([]byte, 0, blocks*aes.BlockSize)
+	full = append(full, ciphertext[:(blocks-2)*aes.BlockSize]...)
+	full = append(full, partial...)
+	full = append(full, d[r:]...)
+	full = append(full, last...)
+	cipher.NewCBCDecrypter(block, make([]byte, aes.BlockSize)).CryptBlocks(full, full)
+	return full[:n], nil
+}
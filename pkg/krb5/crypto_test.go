@@ -0,0 +1,161 @@
+package krb5
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func unhex(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(strings.Join(strings.Fields(s), ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// https://datatracker.ietf.org/doc/html/rfc3962#appendix-B
+func TestAESStringToKey(t *testing.T) {
+	tests := []struct {
+		iterations int
+		password   string
+		salt       string
+		aes128     string
+		aes256     string
+	}{
+		{
+			1, "password", "ATHENA.MIT.EDUraeburn",
+			"42 26 3c 6e 89 f4 fc 28 b8 df 68 ee 09 79 9f 15",
+			"fe 69 7b 52 bc 0d 3c e1 44 32 ba 03 6a 92 e6 5b bb 52 28 09 90 a2 fa 27 88 39 98 d7 2a f3 01 61",
+		},
+		{
+			2, "password", "ATHENA.MIT.EDUraeburn",
+			"c6 51 bf 29 e2 30 0a c2 7f a4 69 d6 93 bd da 13",
+			"a2 e1 6d 16 b3 60 69 c1 35 d5 e9 d2 e2 5f 89 61 02 68 56 18 b9 59 14 b4 67 c6 76 22 22 58 24 ff",
+		},
+		{
+			1200, "password", "ATHENA.MIT.EDUraeburn",
+			"4c 01 cd 46 d6 32 d0 1e 6d be 23 0a 01 ed 64 2a",
+			"55 a6 ac 74 0a d1 7b 48 46 94 10 51 e1 e8 b0 a7 54 8d 93 b0 ab 30 a8 bc 3f f1 62 80 38 2b 8c 2a",
+		},
+		{
+			5, "password", "\x12\x34\x56\x78\x78\x56\x34\x12",
+			"e9 b2 3d 52 27 37 47 dd 5c 35 cb 55 be 61 9d 8e",
+			"97 a4 e7 86 be 20 d8 1a 38 2d 5e bc 96 d5 90 9c ab cd ad c8 7c a4 8f 57 45 04 15 9f 16 c3 6e 31",
+		},
+		{
+			1200, strings.Repeat("X", 64), "pass phrase equals block size",
+			"59 d1 bb 78 9a 82 8b 1a a5 4e f9 c2 88 3f 69 ed",
+			"89 ad ee 36 08 db 8b c7 1f 1b fb fe 45 94 86 b0 56 18 b7 0c ba e2 20 92 53 4e 56 c5 53 ba 4b 34",
+		},
+		{
+			50, "\xf0\x9d\x84\x9e", "EXAMPLE.COMpianist",
+			"f1 49 c1 f2 e1 54 a7 34 52 d4 3e 7f e6 2a 56 e5",
+			"4b 6d 98 39 f8 44 06 df 1f 09 cc 16 6d b4 b8 3c 57 18 48 b7 84 a3 d6 bd c3 46 58 9a 3e 39 3f 9e",
+		},
+	}
+	for _, tt := range tests {
+		for _, c := range []struct {
+			etype int32
+			want  string
+		}{{ETYPE_AES128_CTS_HMAC_SHA1_96, tt.aes128}, {ETYPE_AES256_CTS_HMAC_SHA1_96, tt.aes256}} {
+			key, err := aesStringToKey(c.etype, tt.password, tt.salt, tt.iterations)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := unhex(t, c.want); !bytes.Equal(key.KeyValue, want) {
+				t.Errorf("etype %d iterations %d salt %q: got %x, want %x", c.etype, tt.iterations, tt.salt, key.KeyValue, want)
+			}
+		}
+	}
+}
+
+// https://datatracker.ietf.org/doc/html/rfc3962#appendix-B
+func TestAESCTS(t *testing.T) {
+	key := []byte("chicken teriyaki")
+	plain := "I would like the General Gau's Chicken, please, and wonton soup."
+	tests := []struct {
+		n    int
+		want string
+	}{
+		{17, "c6 35 35 68 f2 bf 8c b4 d8 a5 80 36 2d a7 ff 7f 97"},
+		{31, "fc 00 78 3e 0e fd b2 c1 d4 45 d4 c8 ef f7 ed 22 97 68 72 68 d6 ec cc c0 c0 7b 25 e2 5e cf e5"},
+		{32, "39 31 25 23 a7 86 62 d5 be 7f cb cc 98 eb f5 a8 97 68 72 68 d6 ec cc c0 c0 7b 25 e2 5e cf e5 84"},
+		{47, "97 68 72 68 d6 ec cc c0 c0 7b 25 e2 5e cf e5 84 b3 ff fd 94 0c 16 a1 8c 1b 55 49 d2 f8 38 02 9e 39 31 25 23 a7 86 62 d5 be 7f cb cc 98 eb f5"},
+		{48, "97 68 72 68 d6 ec cc c0 c0 7b 25 e2 5e cf e5 84 9d ad 8b bb 96 c4 cd c0 3b c1 03 e1 a1 94 bb d8 39 31 25 23 a7 86 62 d5 be 7f cb cc 98 eb f5 a8"},
+		{64, "97 68 72 68 d6 ec cc c0 c0 7b 25 e2 5e cf e5 84 39 31 25 23 a7 86 62 d5 be 7f cb cc 98 eb f5 a8 48 07 ef e8 36 ee 89 a5 26 73 0d bc 2f 7b c8 40 9d ad 8b bb 96 c4 cd c0 3b c1 03 e1 a1 94 bb d8"},
+	}
+	for _, tt := range tests {
+		want := unhex(t, tt.want)
+		got, err := ctsEncrypt(key, []byte(plain[:tt.n]))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("encrypt %d bytes: got %x, want %x", tt.n, got, want)
+		}
+		dec, err := ctsDecrypt(key, want)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(dec) != plain[:tt.n] {
+			t.Errorf("decrypt %d bytes: got %q", tt.n, dec)
+		}
+	}
+}
+
+// https://datatracker.ietf.org/doc/html/rfc3961#appendix-A.1
+func TestNFold(t *testing.T) {
+	tests := []struct {
+		in   string
+		bits int
+		want string
+	}{
+		{"012345", 64, "be072631276b1955"},
+		{"password", 56, "78a07b6caf85fa"},
+		{"Rough Consensus, and Running Code", 64, "bb6ed30870b7f0e0"},
+		{"password", 168, "59e4a8ca7c0385c3c37b3f6d2000247cb6e6bd5b3e"},
+		{"MASSACHVSETTS INSTITVTE OF TECHNOLOGY", 192, "db3b0d8f0b061e603282b308a50841229ad798fab9540c1b"},
+		{"Q", 168, "518a54a215a8452a518a54a215a8452a518a54a215"},
+		{"ba", 168, "fb25d531ae8974499f52fd92ea9857c4ba24cf297e"},
+		{"kerberos", 64, "6b65726265726f73"},
+		{"kerberos", 128, "6b65726265726f737b9b5b2b93132b93"},
+		{"kerberos", 168, "8372c236344e5f1550cd0747e15d62ca7a5a3bcea4"},
+		{"kerberos", 256, "6b65726265726f737b9b5b2b93132b935c9bdcdad95c9899c4cae4dee6d6cae4"},
+	}
+	for _, tt := range tests {
+		if got := nfold([]byte(tt.in), tt.bits/8); !bytes.Equal(got, unhex(t, tt.want)) {
+			t.Errorf("%d-fold(%q) = %x, want %s", tt.bits, tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestEncryptDecrypt(t *testing.T) {
+	for _, etype := range []int32{ETYPE_AES128_CTS_HMAC_SHA1_96, ETYPE_AES256_CTS_HMAC_SHA1_96, ETYPE_RC4_HMAC} {
+		key, err := RandomKey(etype)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, n := range []int{0, 1, 16, 33} {
+			plain := bytes.Repeat([]byte{0x5a}, n)
+			data, err := EncryptData(key, KeyUsageAPReqAuthenticator, plain)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := DecryptData(key, KeyUsageAPReqAuthenticator, data)
+			if err != nil {
+				t.Fatalf("etype %d length %d: %v", etype, n, err)
+			}
+			if !bytes.Equal(got, plain) {
+				t.Fatalf("etype %d length %d: got %x", etype, n, got)
+			}
+			// 密钥用途不同时完整性校验失败
+			if _, err = DecryptData(key, KeyUsageAPRepEncPart, data); !errors.Is(err, ErrIntegrity) {
+				t.Fatalf("etype %d: wrong usage error = %v", etype, err)
+			}
+		}
+	}
+}
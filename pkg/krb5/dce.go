@@ -0,0 +1,207 @@
+package krb5
+
+// 此文件实现DCE风格的Kerberos安全上下文，用于DCE/RPC认证绑定
+// 客户端发送未封装的AP-REQ，服务端返回AP-REP，客户端再返回AP-REP完成三次交换(MS-KILE 3.4.5)，之后按RFC-4121令牌保护消息
+// https://datatracker.ietf.org/doc/html/rfc4121#section-4.2
+
+import (
+	"crypto/hmac"
+	"encoding/binary"
+	"errors"
+	"time"
+)
+
+const (
+	tokIdMIC        = 0x0404
+	tokIdWrap       = 0x0504
+	tokenHeaderSize = 16
+	dceWrapRRC      = 28 // 加密头部与校验和轮转到令牌中，存根数据原地加密
+	DCEMICSize      = tokenHeaderSize + 12
+	DCEWrapSize     = tokenHeaderSize + dceWrapRRC + 16 // 存根按16字节对齐时的Wrap令牌长度
+)
+
+// 令牌标志
+const (
+	tokenSentByAcceptor = 0x01
+	tokenSealed         = 0x02
+	tokenAcceptorSubkey = 0x04
+)
+
+var errInvalidToken = errors.New("Invalid Kerberos message token")
+
+// DCE风格的安全上下文，发送与接收的序号均从认证器中的序号开始
+type DCEContext struct {
+	cred     *Credential
+	auth     authenticatorData
+	acceptor bool
+	key      EncryptionKey // 消息保护密钥，服务端返回子密钥时为子密钥
+	flags    byte          // 发送令牌的标志
+	sendSeq  uint64
+}
+
+// 开始认证，返回放在SPNEGO NegTokenInit中的AP-REQ
+func NewDCEContext(cred *Credential, flags uint32) (*DCEContext, []byte, error) {
+	apReq, auth, err := newGSSAPReq(cred, flags|GSS_C_MUTUAL_FLAG|GSS_C_DCE_STYLE)
+	if err != nil {
+		return nil, nil, err
+	}
+	d := &DCEContext{
+		cred:    cred,
+		auth:    auth,
+		key:     cred.SessionKey,
+		sendSeq: uint64(auth.seqNumber),
+	}
+	return d, apReq, nil
+}
+
+// 校验服务端的AP-REP，返回客户端的AP-REP
+// 服务端AP-REP中的时间须与认证器一致，客户端AP-REP携带服务端的序号且不含子密钥
+func (d *DCEContext) Accept(token []byte) ([]byte, error) {
+	part, err := ParseAPRep(token, d.cred.SessionKey)
+	if err != nil {
+		return nil, err
+	}
+	if part.CTime.Unix() != d.auth.ctime.Unix() || int(part.CUSec) != d.auth.cusec {
+		return nil, errors.New("Kerberos AP-REP does not match the authenticator")
+	}
+	if len(part.SubKey.KeyValue) > 0 {
+		d.key = part.SubKey
+		d.flags = tokenAcceptorSubkey
+	}
+	now := time.Now().UTC()
+	enc, err := EncryptData(d.cred.SessionKey, KeyUsageAPRepEncPart, marshalEncAPRepPart(now, now.Nanosecond()/1000, uint32(part.SeqNumber)))
+	if err != nil {
+		return nil, err
+	}
+	return marshalAPRep(enc), nil
+}
+
+// 消息保护密钥
+func (d *DCEContext) Key() EncryptionKey {
+	return d.key
+}
+
+// 只有AES加密类型使用RFC-4121令牌
+func (d *DCEContext) CheckProtection() error {
+	switch d.key.KeyType {
+	case ETYPE_AES128_CTS_HMAC_SHA1_96, ETYPE_AES256_CTS_HMAC_SHA1_96:
+		return nil
+	}
+	return errors.New("Kerberos message protection is only supported with AES keys")
+}
+
+func (d *DCEContext) usages() (seal, sign, peerSeal, peerSign uint32) {
+	if d.acceptor {
+		return KeyUsageAcceptorSeal, KeyUsageAcceptorSign, KeyUsageInitiatorSeal, KeyUsageInitiatorSign
+	}
+	return KeyUsageInitiatorSeal, KeyUsageInitiatorSign, KeyUsageAcceptorSeal, KeyUsageAcceptorSign
+}
+
+// 对方令牌的标志须与己方方向相反
+func (d *DCEContext) peerToken(token []byte, tokId uint16) bool {
+	if len(token) < tokenHeaderSize || binary.BigEndian.Uint16(token) != tokId {
+		return false
+	}
+	return (token[2]&tokenSentByAcceptor != 0) != d.acceptor
+}
+
+func (d *DCEContext) header(tokId uint16) []byte {
+	h := make([]byte, tokenHeaderSize)
+	binary.BigEndian.PutUint16(h, tokId)
+	h[2] = d.flags
+	if d.acceptor {
+		h[2] |= tokenSentByAcceptor
+	}
+	for i := 3; i < 8; i++ {
+		h[i] = 0xff
+	}
+	binary.BigEndian.PutUint64(h[8:], d.sendSeq)
+	d.sendSeq++
+	return h
+}
+
+// 计算MIC令牌，校验和覆盖数据与令牌头部
+func (d *DCEContext) GetMIC(data []byte) ([]byte, error) {
+	_, sign, _, _ := d.usages()
+	token := d.header(tokIdMIC)
+	cksum, err := MakeChecksum(d.key, sign, append(append([]byte{}, data...), token...))
+	if err != nil {
+		return nil, err
+	}
+	return append(token, cksum.Checksum...), nil
+}
+
+// 校验对方的MIC令牌
+func (d *DCEContext) VerifyMIC(data, token []byte) error {
+	if len(token) != DCEMICSize || !d.peerToken(token, tokIdMIC) {
+		return errInvalidToken
+	}
+	_, _, _, sign := d.usages()
+	cksum, err := MakeChecksum(d.key, sign, append(append([]byte{}, data...), token[:tokenHeaderSize]...))
+	if err != nil {
+		return err
+	}
+	if !hmac.Equal(cksum.Checksum, token[tokenHeaderSize:]) {
+		return ErrIntegrity
+	}
+	return nil
+}
+
+// 加密数据，返回与data等长的密文以及放在认证数据中的令牌
+// 密文按RRC+EC右移，移到前部的加密头部、校验和及混淆数据放在令牌头部之后
+func (d *DCEContext) Wrap(data []byte) ([]byte, []byte, error) {
+	seal, _, _, _ := d.usages()
+	ec := (16 - len(data)%16) % 16
+	token := d.header(tokIdWrap)
+	token[2] |= tokenSealed
+	binary.BigEndian.PutUint16(token[4:], uint16(ec))
+	plain := make([]byte, 0, len(data)+ec+tokenHeaderSize)
+	plain = append(plain, data...)
+	for i := 0; i < ec; i++ {
+		plain = append(plain, 0xff)
+	}
+	// 加密的头部副本中RRC为0
+	plain = append(plain, token...)
+	cipher, err := Encrypt(d.key, seal, plain)
+	if err != nil {
+		return nil, nil, err
+	}
+	binary.BigEndian.PutUint16(token[6:], dceWrapRRC)
+	n := len(cipher) - len(data)
+	rotated := rotateBytes(cipher, dceWrapRRC+ec)
+	return rotated[n:], append(token, rotated[:n]...), nil
+}
+
+// 解密对方的Wrap令牌，返回去除EC填充后的明文
+func (d *DCEContext) Unwrap(data, token []byte) ([]byte, error) {
+	if !d.peerToken(token, tokIdWrap) || token[2]&tokenSealed == 0 {
+		return nil, errInvalidToken
+	}
+	_, _, seal, _ := d.usages()
+	ec := int(binary.BigEndian.Uint16(token[4:]))
+	rrc := int(binary.BigEndian.Uint16(token[6:]))
+	rotated := append(append([]byte{}, token[tokenHeaderSize:]...), data...)
+	if len(rotated) == 0 {
+		return nil, errInvalidToken
+	}
+	plain, err := Decrypt(d.key, seal, rotateBytes(rotated, len(rotated)-(rrc+ec)%len(rotated)))
+	if err != nil {
+		return nil, err
+	}
+	if len(plain) < ec+tokenHeaderSize {
+		return nil, errInvalidToken
+	}
+	h := plain[len(plain)-tokenHeaderSize:]
+	if !hmac.Equal(h[:6], token[:6]) || !hmac.Equal(h[8:], token[8:tokenHeaderSize]) {
+		return nil, errInvalidToken
+	}
+	return plain[:len(plain)-ec-tokenHeaderSize], nil
+}
+
+// 循环右移n字节
+func rotateBytes(b []byte, n int) []byte {
+	n %= len(b)
+	ret := make([]byte, 0, len(b))
+	ret = append(ret, b[len(b)-n:]...)
+	return append(ret, b[:len(b)-n]...)
+}
@@ -0,0 +1,150 @@
+package krb5
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"testing"
+)
+
+func newTestDCEContext(t *testing.T) (*DCEContext, EncryptionKey) {
+	t.Helper()
+	sessionKey, err := RandomKey(ETYPE_AES256_CTS_HMAC_SHA1_96)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cred := &Credential{
+		Client:     NewPrincipalName(KRB_NT_PRINCIPAL, "alice"),
+		CRealm:     "EXAMPLE.COM",
+		Server:     NewPrincipalName(KRB_NT_SRV_INST, "host/fs01.example.com"),
+		SRealm:     "EXAMPLE.COM",
+		Ticket:     derApplication(1, derSequence()),
+		SessionKey: sessionKey,
+	}
+	d, apReq, err := NewDCEContext(cred, GSS_C_CONF_FLAG|GSS_C_INTEG_FLAG)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(apReq) == 0 || apReq[0] != 0x60|KRB_AP_REQ {
+		t.Fatalf("AP-REQ is not an unwrapped KRB_AP_REQ: %x", apReq[:2])
+	}
+	return d, sessionKey
+}
+
+// 服务端AP-REP，包含子密钥与服务端序号
+func testServerAPRep(t *testing.T, d *DCEContext, sessionKey, subkey EncryptionKey, cusec int, seq uint32) []byte {
+	t.Helper()
+	part := derApplication(encAPRepPart, derSequence(
+		derExplicit(0, derTime(d.auth.ctime)),
+		derExplicit(1, derInt(int64(cusec))),
+		derExplicit(2, subkey.marshal()),
+		derExplicit(3, derInt(int64(seq))),
+	))
+	enc, err := EncryptData(sessionKey, KeyUsageAPRepEncPart, part)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return marshalAPRep(enc)
+}
+
+func TestDCEContextAccept(t *testing.T) {
+	d, sessionKey := newTestDCEContext(t)
+	subkey, err := RandomKey(ETYPE_AES256_CTS_HMAC_SHA1_96)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = d.Accept(testServerAPRep(t, d, sessionKey, subkey, d.auth.cusec+1, 7)); err == nil {
+		t.Fatal("AP-REP with a different cusec accepted")
+	}
+	rep, err := d.Accept(testServerAPRep(t, d, sessionKey, subkey, d.auth.cusec, 0x1234))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(d.Key().KeyValue, subkey.KeyValue) {
+		t.Fatal("protection key is not the acceptor subkey")
+	}
+	// 客户端AP-REP使用票据会话密钥加密，带回服务端序号
+	part, err := ParseAPRep(rep, sessionKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if part.SeqNumber != 0x1234 || len(part.SubKey.KeyValue) != 0 {
+		t.Fatalf("unexpected client AP-REP %+v", part)
+	}
+}
+
+func TestDCEContextProtection(t *testing.T) {
+	d, sessionKey := newTestDCEContext(t)
+	subkey, err := RandomKey(ETYPE_AES128_CTS_HMAC_SHA1_96)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = d.Accept(testServerAPRep(t, d, sessionKey, subkey, d.auth.cusec, 0)); err != nil {
+		t.Fatal(err)
+	}
+	if err = d.CheckProtection(); err != nil {
+		t.Fatal(err)
+	}
+	seq := uint64(d.auth.seqNumber)
+	peer := &DCEContext{acceptor: true, key: subkey, flags: tokenAcceptorSubkey, sendSeq: seq}
+
+	data := bytes.Repeat([]byte{0x42}, 32)
+	mic, err := d.GetMIC(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mic) != DCEMICSize || !bytes.Equal(mic[:8], []byte{0x04, 0x04, tokenAcceptorSubkey, 0xff, 0xff, 0xff, 0xff, 0xff}) ||
+		binary.BigEndian.Uint64(mic[8:]) != seq {
+		t.Fatalf("unexpected MIC token %x", mic)
+	}
+	if err = peer.VerifyMIC(data, mic); err != nil {
+		t.Fatal(err)
+	}
+	mic, err = peer.GetMIC(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = d.VerifyMIC(data, mic); err != nil {
+		t.Fatal(err)
+	}
+	data[0] ^= 1
+	if err = d.VerifyMIC(data, mic); !errors.Is(err, ErrIntegrity) {
+		t.Fatalf("tampered MIC error = %v", err)
+	}
+	// 己方发出的令牌不能作为对方令牌通过校验
+	if mic, err = d.GetMIC(data); err != nil {
+		t.Fatal(err)
+	}
+	if err = d.VerifyMIC(data, mic); err == nil {
+		t.Fatal("own MIC token accepted")
+	}
+
+	for _, n := range []int{32, 5} {
+		plain := bytes.Repeat([]byte{byte(n)}, n)
+		sealed, token, err := d.Wrap(plain)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ec := (16 - n%16) % 16
+		if len(sealed) != n || len(token) != DCEWrapSize+ec || bytes.Equal(sealed, plain) {
+			t.Fatalf("length %d: sealed %d bytes, token %d bytes", n, len(sealed), len(token))
+		}
+		got, err := peer.Unwrap(sealed, token)
+		if err != nil {
+			t.Fatalf("length %d: %v", n, err)
+		}
+		if !bytes.Equal(got, plain) {
+			t.Fatalf("length %d: unwrapped %x", n, got)
+		}
+		if sealed, token, err = peer.Wrap(plain); err != nil {
+			t.Fatal(err)
+		}
+		if got, err = d.Unwrap(sealed, token); err != nil || !bytes.Equal(got, plain) {
+			t.Fatalf("length %d: unwrapped %x, %v", n, got, err)
+		}
+		sealed[0] ^= 1
+		if _, err = d.Unwrap(sealed, token); !errors.Is(err, ErrIntegrity) {
+			t.Fatalf("tampered wrap error = %v", err)
+		}
+	}
+}
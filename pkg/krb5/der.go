@@ -0,0 +1,243 @@
+package krb5
+
+// 此文件用于编码发送给KDC及服务端的Kerberos消息
+// encoding/asn1无法输出GeneralString，也无法在同一字段上同时使用APPLICATION与上下文标签，因此手动拼接DER
+
+import (
+	"encoding/asn1"
+	"time"
+)
+
+// 编码标签与长度
+func derTLV(class, tag int, compound bool, content []byte) []byte {
+	b := byte(class<<6) | byte(tag)
+	if compound {
+		b |= 0x20
+	}
+	ret := []byte{b}
+	n := len(content)
+	switch {
+	case n < 0x80:
+		ret = append(ret, byte(n))
+	case n < 0x100:
+		ret = append(ret, 0x81, byte(n))
+	case n < 0x10000:
+		ret = append(ret, 0x82, byte(n>>8), byte(n))
+	default:
+		ret = append(ret, 0x83, byte(n>>16), byte(n>>8), byte(n))
+	}
+	return append(ret, content...)
+}
+
+func derSequence(elems ...[]byte) []byte {
+	var content []byte
+	for _, e := range elems {
+		content = append(content, e...)
+	}
+	return derTLV(asn1.ClassUniversal, asn1.TagSequence, true, content)
+}
+
+// 上下文显式标签 [n]
+func derExplicit(tag int, inner []byte) []byte {
+	return derTLV(asn1.ClassContextSpecific, tag, true, inner)
+}
+
+// 应用标签 [APPLICATION n]
+func derApplication(tag int, inner []byte) []byte {
+	return derTLV(asn1.ClassApplication, tag, true, inner)
+}
+
+func derInt(v int64) []byte {
+	buf, _ := asn1.Marshal(v)
+	return buf
+}
+
+func derOctetString(b []byte) []byte {
+	return derTLV(asn1.ClassUniversal, asn1.TagOctetString, false, b)
+}
+
+func derGeneralString(s string) []byte {
+	return derTLV(asn1.ClassUniversal, asn1.TagGeneralString, false, []byte(s))
+}
+
+// KerberosTime 不带小数秒的UTC时间
+func derTime(t time.Time) []byte {
+	return derTLV(asn1.ClassUniversal, asn1.TagGeneralizedTime, false, []byte(t.UTC().Format("20060102150405Z")))
+}
+
+func derBoolean(v bool) []byte {
+	if v {
+		return []byte{0x01, 0x01, 0xff}
+	}
+	return []byte{0x01, 0x01, 0x00}
+}
+
+// KerberosFlags 固定32位
+func derFlags(bits ...int) []byte {
+	flags := make([]byte, 5)
+	for _, bit := range bits {
+		flags[1+bit/8] |= 0x80 >> uint(bit%8)
+	}
+	return derTLV(asn1.ClassUniversal, asn1.TagBitString, false, flags)
+}
+
+func (p PrincipalName) marshal() []byte {
+	var names []byte
+	for _, s := range p.NameString {
+		names = append(names, derGeneralString(s)...)
+	}
+	return derSequence(
+		derExplicit(0, derInt(int64(p.NameType))),
+		derExplicit(1, derTLV(asn1.ClassUniversal, asn1.TagSequence, true, names)),
+	)
+}
+
+func (k EncryptionKey) marshal() []byte {
+	return derSequence(
+		derExplicit(0, derInt(int64(k.KeyType))),
+		derExplicit(1, derOctetString(k.KeyValue)),
+	)
+}
+
+func (e EncryptedData) marshal() []byte {
+	elems := [][]byte{derExplicit(0, derInt(int64(e.EType)))}
+	if e.KVNO != 0 {
+		elems = append(elems, derExplicit(1, derInt(int64(e.KVNO))))
+	}
+	elems = append(elems, derExplicit(2, derOctetString(e.Cipher)))
+	return derSequence(elems...)
+}
+
+func (c Checksum) marshal() []byte {
+	return derSequence(
+		derExplicit(0, derInt(int64(c.CksumType))),
+		derExplicit(1, derOctetString(c.Checksum)),
+	)
+}
+
+func (p PAData) marshal() []byte {
+	return derSequence(
+		derExplicit(1, derInt(int64(p.PADataType))),
+		derExplicit(2, derOctetString(p.PADataValue)),
+	)
+}
+
+// 请求体 KDC-REQ-BODY
+type kdcReqBody struct {
+	options []int
+	cname   *PrincipalName
+	realm   string
+	sname   PrincipalName
+	till    time.Time
+	nonce   int32
+	etypes  []int32
+}
+
+func (b kdcReqBody) marshal() []byte {
+	elems := [][]byte{derExplicit(0, derFlags(b.options...))}
+	if b.cname != nil {
+		elems = append(elems, derExplicit(1, b.cname.marshal()))
+	}
+	elems = append(elems,
+		derExplicit(2, derGeneralString(b.realm)),
+		derExplicit(3, b.sname.marshal()),
+		derExplicit(5, derTime(b.till)),
+		derExplicit(7, derInt(int64(b.nonce))),
+	)
+	var etypes []byte
+	for _, e := range b.etypes {
+		etypes = append(etypes, derInt(int64(e))...)
+	}
+	elems = append(elems, derExplicit(8, derTLV(asn1.ClassUniversal, asn1.TagSequence, true, etypes)))
+	return derSequence(elems...)
+}
+
+// KDC-REQ，msgType为AS-REQ或TGS-REQ
+func marshalKDCReq(msgType int, padata []PAData, body []byte) []byte {
+	elems := [][]byte{
+		derExplicit(1, derInt(PVNO)),
+		derExplicit(2, derInt(int64(msgType))),
+	}
+	if len(padata) > 0 {
+		var pa []byte
+		for _, p := range padata {
+			pa = append(pa, p.marshal()...)
+		}
+		elems = append(elems, derExplicit(3, derTLV(asn1.ClassUniversal, asn1.TagSequence, true, pa)))
+	}
+	elems = append(elems, derExplicit(4, body))
+	return derApplication(msgType, derSequence(elems...))
+}
+
+// PA-ENC-TS-ENC
+func marshalPAEncTimestamp(t time.Time, usec int) []byte {
+	return derSequence(
+		derExplicit(0, derTime(t)),
+		derExplicit(1, derInt(int64(usec))),
+	)
+}
+
+// KERB-PA-PAC-REQUEST
+func marshalPACRequest(include bool) []byte {
+	return derSequence(derExplicit(0, derBoolean(include)))
+}
+
+// Authenticator
+type authenticatorData struct {
+	crealm    string
+	cname     PrincipalName
+	cksum     *Checksum
+	cusec     int
+	ctime     time.Time
+	subkey    *EncryptionKey
+	seqNumber uint32
+}
+
+func (a authenticatorData) marshal() []byte {
+	elems := [][]byte{
+		derExplicit(0, derInt(PVNO)),
+		derExplicit(1, derGeneralString(a.crealm)),
+		derExplicit(2, a.cname.marshal()),
+	}
+	if a.cksum != nil {
+		elems = append(elems, derExplicit(3, a.cksum.marshal()))
+	}
+	elems = append(elems,
+		derExplicit(4, derInt(int64(a.cusec))),
+		derExplicit(5, derTime(a.ctime)),
+	)
+	if a.subkey != nil {
+		elems = append(elems, derExplicit(6, a.subkey.marshal()))
+	}
+	elems = append(elems, derExplicit(7, derInt(int64(a.seqNumber))))
+	return derApplication(authenticator, derSequence(elems...))
+}
+
+// AP-REQ，ticket为APPLICATION 1编码的票据
+func marshalAPReq(options []int, ticket []byte, auth EncryptedData) []byte {
+	return derApplication(KRB_AP_REQ, derSequence(
+		derExplicit(0, derInt(PVNO)),
+		derExplicit(1, derInt(KRB_AP_REQ)),
+		derExplicit(2, derFlags(options...)),
+		derExplicit(3, ticket),
+		derExplicit(4, auth.marshal()),
+	))
+}
+
+// EncAPRepPart，DCE风格中客户端返回的第三个消息不含子密钥
+func marshalEncAPRepPart(ctime time.Time, cusec int, seqNumber uint32) []byte {
+	return derApplication(encAPRepPart, derSequence(
+		derExplicit(0, derTime(ctime)),
+		derExplicit(1, derInt(int64(cusec))),
+		derExplicit(3, derInt(int64(seqNumber))),
+	))
+}
+
+// AP-REP
+func marshalAPRep(enc EncryptedData) []byte {
+	return derApplication(KRB_AP_REP, derSequence(
+		derExplicit(0, derInt(PVNO)),
+		derExplicit(1, derInt(KRB_AP_REP)),
+		derExplicit(2, enc.marshal()),
+	))
+}
@@ -5,6 +5,7 @@ package gss
 import (
 	"encoding/asn1"
 	"github.com/4ra1n/go-impacket/pkg/encoder"
+	"github.com/4ra1n/go-impacket/pkg/krb5"
 	"github.com/4ra1n/go-impacket/pkg/krb5/ntlm"
 	"strconv"
 	"strings"
@@ -78,6 +79,31 @@ func NewNegTokenInit() (NegTokenInit, error) {
 	}, nil
 }
 
+// Kerberos协商令牌，mechToken为GSS-API封装的AP-REQ
+func NewNegTokenInitKerberos(mechToken []byte) (NegTokenInit, error) {
+	oid, err := ObjectIDStrToInt(SPNEGOOID)
+	if err != nil {
+		return NegTokenInit{}, err
+	}
+	mskrb5oid, err := ObjectIDStrToInt(krb5.MSKRB5OID)
+	if err != nil {
+		return NegTokenInit{}, err
+	}
+	krb5oid, err := ObjectIDStrToInt(krb5.KRB5OID)
+	if err != nil {
+		return NegTokenInit{}, err
+	}
+	return NegTokenInit{
+		OID: oid,
+		Data: NegTokenInitData{
+			MechTypes:    []asn1.ObjectIdentifier{mskrb5oid, krb5oid},
+			ReqFlags:     asn1.BitString{},
+			MechToken:    mechToken,
+			MechTokenMIC: []byte{},
+		},
+	}, nil
+}
+
 func NewNegTokenResp() (NegTokenResp, error) {
 	return NegTokenResp{}, nil
 }
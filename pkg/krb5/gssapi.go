@@ -0,0 +1,122 @@
+package krb5
+
+// 此文件用于GSS-API Kerberos机制令牌 遵循RFC-4121标准
+
+import (
+	"encoding/asn1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// Kerberos机制对象标识符
+const (
+	KRB5OID   = "1.2.840.113554.1.2.2"
+	MSKRB5OID = "1.2.840.48018.1.2.2"
+)
+
+// 令牌类型
+const (
+	TOK_ID_KRB_AP_REQ = 0x0100
+	TOK_ID_KRB_AP_REP = 0x0200
+	TOK_ID_KRB_ERROR  = 0x0300
+)
+
+// GSS上下文标志，位于认证器校验和中
+const (
+	GSS_C_DELEG_FLAG    = 0x01
+	GSS_C_MUTUAL_FLAG   = 0x02
+	GSS_C_REPLAY_FLAG   = 0x04
+	GSS_C_SEQUENCE_FLAG = 0x08
+	GSS_C_CONF_FLAG     = 0x10
+	GSS_C_INTEG_FLAG    = 0x20
+	GSS_C_DCE_STYLE     = 0x1000 // DCE/RPC使用的三次AP交换
+)
+
+var krb5OID = asn1.ObjectIdentifier{1, 2, 840, 113554, 1, 2, 2}
+
+// 封装为GSS-API InitialContextToken
+func WrapToken(tokId uint16, msg []byte) []byte {
+	oid, _ := asn1.Marshal(krb5OID)
+	inner := make([]byte, 0, len(oid)+2+len(msg))
+	inner = append(inner, oid...)
+	inner = append(inner, byte(tokId>>8), byte(tokId))
+	inner = append(inner, msg...)
+	return derTLV(asn1.ClassApplication, 0, true, inner)
+}
+
+// 解析GSS-API令牌，返回令牌类型以及Kerberos消息
+func UnwrapToken(token []byte) (uint16, []byte, error) {
+	var raw asn1.RawValue
+	if _, err := asn1.Unmarshal(token, &raw); err != nil {
+		return 0, nil, err
+	}
+	if raw.Class != asn1.ClassApplication || raw.Tag != 0 {
+		return 0, nil, errors.New("Invalid GSS-API token")
+	}
+	var oid asn1.ObjectIdentifier
+	rest, err := asn1.Unmarshal(raw.Bytes, &oid)
+	if err != nil {
+		return 0, nil, err
+	}
+	if !oid.Equal(krb5OID) {
+		return 0, nil, fmt.Errorf("Unexpected GSS-API mechanism %s", oid)
+	}
+	if len(rest) < 2 {
+		return 0, nil, errors.New("GSS-API token too short")
+	}
+	return binary.BigEndian.Uint16(rest), rest[2:], nil
+}
+
+// 构造GSS-API封装的AP-REQ，用于SPNEGO协商
+// 认证器校验和使用0x8003类型携带上下文标志，不绑定通道
+func NewGSSAPReq(cred *Credential, flags uint32) ([]byte, error) {
+	apReq, _, err := newGSSAPReq(cred, flags)
+	if err != nil {
+		return nil, err
+	}
+	return WrapToken(TOK_ID_KRB_AP_REQ, apReq), nil
+}
+
+// 构造未封装的AP-REQ，同时返回认证器用于校验AP-REP以及确定初始序号
+func newGSSAPReq(cred *Credential, flags uint32) ([]byte, authenticatorData, error) {
+	data := make([]byte, 24)
+	binary.LittleEndian.PutUint32(data, 16)
+	binary.LittleEndian.PutUint32(data[20:], flags)
+	var options []int
+	if flags&GSS_C_MUTUAL_FLAG != 0 {
+		options = append(options, APOptionMutualRequired)
+	}
+	return newAPReq(cred, KeyUsageAPReqAuthenticator, &Checksum{CksumType: CKSUMTYPE_GSSAPI, Checksum: data}, options)
+}
+
+// 解析服务端返回的AP-REP，令牌可以是GSS-API封装或原始消息
+func ParseAPRep(token []byte, sessionKey EncryptionKey) (*EncAPRepPart, error) {
+	msg := token
+	if len(token) > 0 && token[0] == 0x60 {
+		tokId, inner, err := UnwrapToken(token)
+		if err != nil {
+			return nil, err
+		}
+		if tokId != TOK_ID_KRB_AP_REP && tokId != TOK_ID_KRB_ERROR {
+			return nil, fmt.Errorf("Unexpected GSS-API token id 0x%04x", tokId)
+		}
+		msg = inner
+	}
+	if err := parseKRBError(msg); err != nil {
+		return nil, err
+	}
+	var rep APRep
+	if _, err := asn1.UnmarshalWithParams(msg, &rep, fmt.Sprintf("application,explicit,tag:%d", KRB_AP_REP)); err != nil {
+		return nil, err
+	}
+	plain, err := DecryptData(sessionKey, KeyUsageAPRepEncPart, rep.EncPart)
+	if err != nil {
+		return nil, err
+	}
+	var part EncAPRepPart
+	if _, err = asn1.UnmarshalWithParams(plain, &part, fmt.Sprintf("application,explicit,tag:%d", encAPRepPart)); err != nil {
+		return nil, err
+	}
+	return &part, nil
+}
@@ -0,0 +1,236 @@
+package krb5
+
+// 此文件用于读写keytab文件，支持第1版(本机字节序)与第2版(大端序)格式
+// https://web.mit.edu/kerberos/krb5-devel/doc/formats/keytab_file_format.html
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	KeytabVersion1 = 0x0501
+	KeytabVersion2 = 0x0502
+)
+
+type Keytab struct {
+	Version uint16
+	Entries []KeytabEntry
+}
+
+type KeytabEntry struct {
+	Principal PrincipalName
+	Realm     string
+	Timestamp time.Time
+	KVNO      uint32
+	Key       EncryptionKey
+}
+
+func NewKeytab() *Keytab {
+	return &Keytab{Version: KeytabVersion2}
+}
+
+func LoadKeytab(path string) (*Keytab, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParseKeytab(data)
+}
+
+func (k *Keytab) Save(path string) error {
+	data, err := k.Marshal()
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0600)
+}
+
+// 第1版使用本机字节序，这里按小端处理
+func keytabByteOrder(version uint16) (binary.ByteOrder, error) {
+	switch version {
+	case KeytabVersion1:
+		return binary.LittleEndian, nil
+	case KeytabVersion2:
+		return binary.BigEndian, nil
+	}
+	return nil, fmt.Errorf("Unsupported keytab version 0x%04x", version)
+}
+
+// 解析keytab，长度为负的记录为已删除的空洞
+func ParseKeytab(data []byte) (*Keytab, error) {
+	if len(data) < 2 {
+		return nil, errors.New("Truncated keytab file")
+	}
+	k := &Keytab{Version: binary.BigEndian.Uint16(data)}
+	order, err := keytabByteOrder(k.Version)
+	if err != nil {
+		return nil, err
+	}
+	data = data[2:]
+	for len(data) >= 4 {
+		size := int32(order.Uint32(data))
+		data = data[4:]
+		if size < 0 {
+			if int(-size) > len(data) {
+				return nil, errors.New("Truncated keytab file")
+			}
+			data = data[-size:]
+			continue
+		}
+		if size == 0 || int(size) > len(data) {
+			break
+		}
+		entry, err := parseKeytabEntry(data[:size], k.Version, order)
+		if err != nil {
+			return nil, err
+		}
+		k.Entries = append(k.Entries, entry)
+		data = data[size:]
+	}
+	return k, nil
+}
+
+func parseKeytabEntry(data []byte, version uint16, order binary.ByteOrder) (KeytabEntry, error) {
+	var entry KeytabEntry
+	var err error
+	r := bytes.NewReader(data)
+	read := func(v interface{}) {
+		if err == nil {
+			err = binary.Read(r, order, v)
+		}
+	}
+	str := func() string {
+		var n uint16
+		read(&n)
+		if err != nil || int(n) > r.Len() {
+			err = errors.New("Truncated keytab entry")
+			return ""
+		}
+		buf := make([]byte, n)
+		r.Read(buf)
+		return string(buf)
+	}
+	var count uint16
+	read(&count)
+	if version == KeytabVersion1 {
+		// 第1版组件数包含域名
+		count--
+	}
+	entry.Realm = str()
+	for i := uint16(0); i < count && err == nil; i++ {
+		entry.Principal.NameString = append(entry.Principal.NameString, str())
+	}
+	if version == KeytabVersion2 {
+		var nameType uint32
+		read(&nameType)
+		entry.Principal.NameType = int32(nameType)
+	} else {
+		entry.Principal.NameType = KRB_NT_PRINCIPAL
+	}
+	var timestamp uint32
+	var vno8 uint8
+	var keyType uint16
+	read(&timestamp)
+	read(&vno8)
+	read(&keyType)
+	entry.Timestamp = time.Unix(int64(timestamp), 0).UTC()
+	entry.KVNO = uint32(vno8)
+	entry.Key.KeyType = int32(keyType)
+	entry.Key.KeyValue = []byte(str())
+	if err != nil {
+		return KeytabEntry{}, err
+	}
+	// 记录末尾可选的32位版本号，非0时覆盖8位版本号
+	if r.Len() >= 4 {
+		var vno uint32
+		read(&vno)
+		if vno != 0 {
+			entry.KVNO = vno
+		}
+	}
+	return entry, err
+}
+
+func (k *Keytab) Marshal() ([]byte, error) {
+	version := k.Version
+	if version == 0 {
+		version = KeytabVersion2
+	}
+	order, err := keytabByteOrder(version)
+	if err != nil {
+		return nil, err
+	}
+	w := &bytes.Buffer{}
+	binary.Write(w, binary.BigEndian, version)
+	for _, entry := range k.Entries {
+		e := &bytes.Buffer{}
+		str := func(s string) {
+			binary.Write(e, order, uint16(len(s)))
+			e.WriteString(s)
+		}
+		count := uint16(len(entry.Principal.NameString))
+		if version == KeytabVersion1 {
+			count++
+		}
+		binary.Write(e, order, count)
+		str(entry.Realm)
+		for _, s := range entry.Principal.NameString {
+			str(s)
+		}
+		if version == KeytabVersion2 {
+			binary.Write(e, order, uint32(entry.Principal.NameType))
+		}
+		binary.Write(e, order, ccacheTime(entry.Timestamp))
+		binary.Write(e, order, uint8(entry.KVNO))
+		binary.Write(e, order, uint16(entry.Key.KeyType))
+		str(string(entry.Key.KeyValue))
+		binary.Write(e, order, entry.KVNO)
+		binary.Write(w, order, int32(e.Len()))
+		w.Write(e.Bytes())
+	}
+	return w.Bytes(), nil
+}
+
+// 添加密钥记录
+func (k *Keytab) AddEntry(principal PrincipalName, realm string, kvno uint32, key EncryptionKey) {
+	k.Entries = append(k.Entries, KeytabEntry{
+		Principal: principal,
+		Realm:     realm,
+		Timestamp: time.Now().UTC(),
+		KVNO:      kvno,
+		Key:       key,
+	})
+}
+
+// 查找主体的密钥，etype为0时按AES256、AES128、RC4的顺序选择，同类型取最大版本号
+func (k *Keytab) GetKey(principal, realm string, etype int32) (EncryptionKey, uint32, error) {
+	etypes := []int32{etype}
+	if etype == 0 {
+		etypes = []int32{ETYPE_AES256_CTS_HMAC_SHA1_96, ETYPE_AES128_CTS_HMAC_SHA1_96, ETYPE_RC4_HMAC}
+	}
+	for _, e := range etypes {
+		var found *KeytabEntry
+		for i := range k.Entries {
+			entry := &k.Entries[i]
+			if entry.Key.KeyType != e || !strings.EqualFold(entry.Principal.String(), principal) {
+				continue
+			}
+			if realm != "" && !strings.EqualFold(entry.Realm, realm) {
+				continue
+			}
+			if found == nil || entry.KVNO > found.KVNO {
+				found = entry
+			}
+		}
+		if found != nil {
+			return found.Key, found.KVNO, nil
+		}
+	}
+	return EncryptionKey{}, 0, errors.New("No key found in keytab for " + principal)
+}
@@ -0,0 +1,110 @@
+package krb5
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+// 按MIT keytab格式手工构造，包含多个主体、同一主体的多个加密类型，
+// 以及版本号超过255时8位版本号被截断、由记录末尾的32位版本号覆盖的记录
+// https://web.mit.edu/kerberos/krb5-devel/doc/formats/keytab_file_format.html
+const testKeytabHex = "" +
+	// version
+	"0502" +
+	// HTTP/web.example.com aes256 kvno 3
+	"000000570002000b4558414d504c452e434f4d000448545450000f7765622e6578616d706c652e636f6d000000016530a5c00300120020000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f00000003" +
+	// HTTP/web.example.com aes128 kvno 3
+	"000000470002000b4558414d504c452e434f4d000448545450000f7765622e6578616d706c652e636f6d000000016530a5c00300110010808182838485868788898a8b8c8d8e8f00000003" +
+	// host/fs01.example.com rc4 kvno 2
+	"000000480002000b4558414d504c452e434f4d0004686f73740010667330312e6578616d706c652e636f6d000000016530a5c00200170010a0a1a2a3a4a5a6a7a8a9aaabacadaeaf00000002" +
+	// alice aes256 kvno 300, 8-bit kvno truncated
+	"000000470001000b4558414d504c452e434f4d0005616c696365000000016530a5c02c00120020c0c1c2c3c4c5c6c7c8c9cacbcccdcecfd0d1d2d3d4d5d6d7d8d9dadbdcdddedf0000012c"
+
+// 第1版按小端字节序，组件数包含域名且没有名称类型
+const testKeytabV1Hex = "" +
+	// version
+	"0501" +
+	// host/fs01.example.com rc4 kvno 2
+	"4400000003000b004558414d504c452e434f4d0400686f73741000667330312e6578616d706c652e636f6dc0a530650217001000a0a1a2a3a4a5a6a7a8a9aaabacadaeaf02000000" +
+	// alice aes256 kvno 300, 8-bit kvno truncated
+	"4300000002000b004558414d504c452e434f4d0500616c696365c0a530652c12002000c0c1c2c3c4c5c6c7c8c9cacbcccdcecfd0d1d2d3d4d5d6d7d8d9dadbdcdddedf2c010000"
+
+func TestKeytabRoundTrip(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		hex     string
+		entries int
+	}{
+		{"v2", testKeytabHex, 4},
+		{"v1", testKeytabV1Hex, 2},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			data := testFixture(t, tt.hex)
+			k, err := ParseKeytab(data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(k.Entries) != tt.entries {
+				t.Fatalf("got %d entries, want %d", len(k.Entries), tt.entries)
+			}
+			last := k.Entries[len(k.Entries)-1]
+			if last.Principal.String() != "alice" || last.Principal.NameType != KRB_NT_PRINCIPAL ||
+				last.Realm != "EXAMPLE.COM" || last.KVNO != 300 || last.Timestamp.Unix() != 0x6530a5c0 {
+				t.Fatalf("unexpected entry %+v", last)
+			}
+			out, err := k.Marshal()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(out, data) {
+				t.Fatalf("marshal mismatch\n got %x\nwant %x", out, data)
+			}
+			again, err := ParseKeytab(out)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(again, k) {
+				t.Fatalf("reparse mismatch\n got %+v\nwant %+v", again, k)
+			}
+		})
+	}
+}
+
+// 删除记录后留下的空洞在解析时跳过，写回时不再保留
+func TestKeytabHole(t *testing.T) {
+	data := testFixture(t, testKeytabHex)
+	hole := append([]byte{0xff, 0xff, 0xff, 0xf8}, make([]byte, 8)...)
+	withHole := append(append(append([]byte{}, data[:2]...), hole...), data[2:]...)
+	k, err := ParseKeytab(withHole)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := k.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out, data) {
+		t.Fatalf("marshal mismatch\n got %x\nwant %x", out, data)
+	}
+}
+
+func TestKeytabGetKey(t *testing.T) {
+	k, err := ParseKeytab(testFixture(t, testKeytabHex))
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, kvno, err := k.GetKey("http/WEB.example.com", "example.com", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key.KeyType != ETYPE_AES256_CTS_HMAC_SHA1_96 || kvno != 3 {
+		t.Fatalf("got etype %d kvno %d", key.KeyType, kvno)
+	}
+	if key, _, err = k.GetKey("host/fs01.example.com", "", ETYPE_RC4_HMAC); err != nil || len(key.KeyValue) != 16 {
+		t.Fatalf("rc4 key %+v: %v", key, err)
+	}
+	if _, _, err = k.GetKey("host/fs01.example.com", "", ETYPE_AES256_CTS_HMAC_SHA1_96); err == nil {
+		t.Fatal("missing etype found")
+	}
+}
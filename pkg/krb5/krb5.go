@@ -0,0 +1,256 @@
+package krb5
+
+// Kerberos V5 认证 遵循RFC-4120、RFC-3961、RFC-3962、RFC-4757标准
+
+import (
+	"encoding/asn1"
+	"strings"
+	"time"
+)
+
+const PVNO = 5
+
+// 消息类型
+const (
+	KRB_AS_REQ    = 10
+	KRB_AS_REP    = 11
+	KRB_TGS_REQ   = 12
+	KRB_TGS_REP   = 13
+	KRB_AP_REQ    = 14
+	KRB_AP_REP    = 15
+	KRB_ERROR     = 30
+	authenticator = 2
+	encASRepPart  = 25
+	encTGSRepPart = 26
+	encAPRepPart  = 27
+)
+
+// 主体名称类型
+const (
+	KRB_NT_UNKNOWN   = 0
+	KRB_NT_PRINCIPAL = 1
+	KRB_NT_SRV_INST  = 2
+	KRB_NT_SRV_HST   = 3
+)
+
+// 预认证数据类型
+const (
+	PA_TGS_REQ       = 1
+	PA_ENC_TIMESTAMP = 2
+	PA_PW_SALT       = 3
+	PA_ETYPE_INFO    = 11
+	PA_ETYPE_INFO2   = 19
+	PA_PAC_REQUEST   = 128
+)
+
+// 加密类型
+const (
+	ETYPE_AES128_CTS_HMAC_SHA1_96 = 17
+	ETYPE_AES256_CTS_HMAC_SHA1_96 = 18
+	ETYPE_RC4_HMAC                = 23
+)
+
+// 校验和类型
+const (
+	CKSUMTYPE_HMAC_SHA1_96_AES128 = 15
+	CKSUMTYPE_HMAC_SHA1_96_AES256 = 16
+	CKSUMTYPE_HMAC_MD5            = -138
+	CKSUMTYPE_GSSAPI              = 0x8003
+)
+
+// 密钥用途
+// https://datatracker.ietf.org/doc/html/rfc4120#section-7.5.1
+const (
+	KeyUsageASReqTimestamp       = 1
+	KeyUsageKDCRepTicket         = 2
+	KeyUsageASRepEncPart         = 3
+	KeyUsageTGSReqAuthChecksum   = 6
+	KeyUsageTGSReqAuthenticator  = 7
+	KeyUsageTGSRepEncPartSession = 8
+	KeyUsageTGSRepEncPartSubkey  = 9
+	KeyUsageAPReqAuthenticator   = 11
+	KeyUsageAPRepEncPart         = 12
+	KeyUsageKrbCredEncPart       = 14
+	KeyUsageAcceptorSeal         = 22 // RFC-4121 消息保护令牌
+	KeyUsageAcceptorSign         = 23
+	KeyUsageInitiatorSeal        = 24
+	KeyUsageInitiatorSign        = 25
+)
+
+// KDC选项，按位编号从高位开始
+const (
+	KDCOptionForwardable  = 1
+	KDCOptionProxiable    = 3
+	KDCOptionRenewable    = 8
+	KDCOptionCanonicalize = 15
+	KDCOptionRenewableOK  = 27
+)
+
+// AP选项
+const (
+	APOptionUseSessionKey  = 1
+	APOptionMutualRequired = 2
+)
+
+// 常见错误码
+const (
+	KDC_ERR_C_PRINCIPAL_UNKNOWN = 6
+	KDC_ERR_S_PRINCIPAL_UNKNOWN = 7
+	KDC_ERR_ETYPE_NOSUPP        = 14
+	KDC_ERR_CLIENT_REVOKED      = 18
+	KDC_ERR_KEY_EXPIRED         = 23
+	KDC_ERR_PREAUTH_FAILED      = 24
+	KDC_ERR_PREAUTH_REQUIRED    = 25
+	KRB_AP_ERR_SKEW             = 37
+	KRB_ERR_RESPONSE_TOO_BIG    = 52
+	KRB_ERR_GENERIC             = 60
+	KDC_ERR_WRONG_REALM         = 68
+)
+
+var ErrorCodeMap = map[int32]string{
+	KDC_ERR_C_PRINCIPAL_UNKNOWN: "KDC_ERR_C_PRINCIPAL_UNKNOWN",
+	KDC_ERR_S_PRINCIPAL_UNKNOWN: "KDC_ERR_S_PRINCIPAL_UNKNOWN",
+	KDC_ERR_ETYPE_NOSUPP:        "KDC_ERR_ETYPE_NOSUPP",
+	KDC_ERR_CLIENT_REVOKED:      "KDC_ERR_CLIENT_REVOKED",
+	KDC_ERR_KEY_EXPIRED:         "KDC_ERR_KEY_EXPIRED",
+	KDC_ERR_PREAUTH_FAILED:      "KDC_ERR_PREAUTH_FAILED",
+	KDC_ERR_PREAUTH_REQUIRED:    "KDC_ERR_PREAUTH_REQUIRED",
+	KRB_AP_ERR_SKEW:             "KRB_AP_ERR_SKEW",
+	KRB_ERR_RESPONSE_TOO_BIG:    "KRB_ERR_RESPONSE_TOO_BIG",
+	KRB_ERR_GENERIC:             "KRB_ERR_GENERIC",
+	KDC_ERR_WRONG_REALM:         "KDC_ERR_WRONG_REALM",
+}
+
+// 以下为Kerberos消息的ASN.1结构，用于解析KDC及服务端返回的数据
+// 发送的消息由der.go中的方法手动编码，标准库无法输出GeneralString类型
+
+type PrincipalName struct {
+	NameType   int32    `asn1:"explicit,tag:0"`
+	NameString []string `asn1:"explicit,tag:1"`
+}
+
+type EncryptionKey struct {
+	KeyType  int32  `asn1:"explicit,tag:0"`
+	KeyValue []byte `asn1:"explicit,tag:1"`
+}
+
+type EncryptedData struct {
+	EType  int32  `asn1:"explicit,tag:0"`
+	KVNO   int32  `asn1:"optional,explicit,tag:1"`
+	Cipher []byte `asn1:"explicit,tag:2"`
+}
+
+type Checksum struct {
+	CksumType int32  `asn1:"explicit,tag:0"`
+	Checksum  []byte `asn1:"explicit,tag:1"`
+}
+
+type HostAddress struct {
+	AddrType int32  `asn1:"explicit,tag:0"`
+	Address  []byte `asn1:"explicit,tag:1"`
+}
+
+type AuthorizationData struct {
+	ADType int32  `asn1:"explicit,tag:0"`
+	ADData []byte `asn1:"explicit,tag:1"`
+}
+
+type PAData struct {
+	PADataType  int32  `asn1:"explicit,tag:1"`
+	PADataValue []byte `asn1:"explicit,tag:2"`
+}
+
+type ETypeInfo2Entry struct {
+	EType     int32  `asn1:"explicit,tag:0"`
+	Salt      string `asn1:"optional,explicit,tag:1"`
+	S2KParams []byte `asn1:"optional,explicit,tag:2"`
+}
+
+// 票据，外层为APPLICATION 1
+type Ticket struct {
+	TktVNO  int32         `asn1:"explicit,tag:0"`
+	Realm   string        `asn1:"explicit,tag:1"`
+	SName   PrincipalName `asn1:"explicit,tag:2"`
+	EncPart EncryptedData `asn1:"explicit,tag:3"`
+}
+
+// AS-REP/TGS-REP，Ticket保留原始编码以便原样转发
+type KDCRep struct {
+	PVNO    int32         `asn1:"explicit,tag:0"`
+	MsgType int32         `asn1:"explicit,tag:1"`
+	PAData  []PAData      `asn1:"optional,explicit,tag:2"`
+	CRealm  string        `asn1:"explicit,tag:3"`
+	CName   PrincipalName `asn1:"explicit,tag:4"`
+	Ticket  asn1.RawValue `asn1:"explicit,tag:5"`
+	EncPart EncryptedData `asn1:"explicit,tag:6"`
+}
+
+type EncKDCRepPart struct {
+	Key           EncryptionKey  `asn1:"explicit,tag:0"`
+	LastReq       asn1.RawValue  `asn1:"explicit,tag:1"`
+	Nonce         int32          `asn1:"explicit,tag:2"`
+	KeyExpiration time.Time      `asn1:"generalized,optional,explicit,tag:3"`
+	Flags         asn1.BitString `asn1:"explicit,tag:4"`
+	AuthTime      time.Time      `asn1:"generalized,explicit,tag:5"`
+	StartTime     time.Time      `asn1:"generalized,optional,explicit,tag:6"`
+	EndTime       time.Time      `asn1:"generalized,explicit,tag:7"`
+	RenewTill     time.Time      `asn1:"generalized,optional,explicit,tag:8"`
+	SRealm        string         `asn1:"explicit,tag:9"`
+	SName         PrincipalName  `asn1:"explicit,tag:10"`
+}
+
+type KRBError struct {
+	PVNO      int32         `asn1:"explicit,tag:0"`
+	MsgType   int32         `asn1:"explicit,tag:1"`
+	CTime     time.Time     `asn1:"generalized,optional,explicit,tag:2"`
+	CUSec     int32         `asn1:"optional,explicit,tag:3"`
+	STime     time.Time     `asn1:"generalized,explicit,tag:4"`
+	SUSec     int32         `asn1:"explicit,tag:5"`
+	ErrorCode int32         `asn1:"explicit,tag:6"`
+	CRealm    string        `asn1:"optional,explicit,tag:7"`
+	CName     PrincipalName `asn1:"optional,explicit,tag:8"`
+	Realm     string        `asn1:"explicit,tag:9"`
+	SName     PrincipalName `asn1:"explicit,tag:10"`
+	EText     string        `asn1:"optional,explicit,tag:11"`
+	EData     []byte        `asn1:"optional,explicit,tag:12"`
+}
+
+type APRep struct {
+	PVNO    int32         `asn1:"explicit,tag:0"`
+	MsgType int32         `asn1:"explicit,tag:1"`
+	EncPart EncryptedData `asn1:"explicit,tag:2"`
+}
+
+type EncAPRepPart struct {
+	CTime     time.Time     `asn1:"generalized,explicit,tag:0"`
+	CUSec     int32         `asn1:"explicit,tag:1"`
+	SubKey    EncryptionKey `asn1:"optional,explicit,tag:2"`
+	SeqNumber int64         `asn1:"optional,explicit,tag:3"`
+}
+
+// Kerberos错误
+type Error struct {
+	Code       int32
+	Text       string
+	methodData []PAData
+}
+
+func (e *Error) Error() string {
+	name, ok := ErrorCodeMap[e.Code]
+	if !ok {
+		name = "KRB_ERROR"
+	}
+	if e.Text != "" {
+		return "Kerberos error " + name + ": " + e.Text
+	}
+	return "Kerberos error " + name
+}
+
+// 根据主体字符串构造主体名称，如 cifs/host
+func NewPrincipalName(nameType int32, name string) PrincipalName {
+	return PrincipalName{NameType: nameType, NameString: strings.Split(name, "/")}
+}
+
+func (p PrincipalName) String() string {
+	return strings.Join(p.NameString, "/")
+}
@@ -7,7 +7,9 @@ import (
 	"crypto/hmac"
 	"crypto/md5"
 	"crypto/rand"
+	"crypto/rc4"
 	"encoding/binary"
+	"fmt"
 	"hash"
 	"time"
 
@@ -70,24 +72,39 @@ func NewChallenge() Challenge {
 	}
 }
 
-func NewAuthenticatePass(domain, user, workstation, password string, c Challenge) NTLMv2Authentication {
-	// 明文认证
-	//nthash := NTOWFv2(password, user, domain)
-	//lmhash := LMOWFv2(password, user, domain)
+// 认证消息默认的协商标志
+const authenticateFlags = FlgNeg56 |
+	FlgNeg128 |
+	FlgNegTargetInfo |
+	FlgNegExtendedSecurity |
+	FlgNegNTLMKey |
+	FlgRequestTarget |
+	FlgNegUNICODE
+
+// 明文认证，返回认证消息以及会话密钥SessionBaseKey，生成随机数失败时返回错误
+func NewAuthenticatePass(domain, user, workstation, password string, c Challenge) (NTLMv2Authentication, []byte, error) {
+	return NewAuthenticatePassFlags(domain, user, workstation, password, c, 0)
+}
+
+// hash认证，返回认证消息以及会话密钥SessionBaseKey
+func NewAuthenticateHash(domain, user, workstation, hash string, c Challenge) (NTLMv2Authentication, []byte, error) {
+	return NewAuthenticateHashFlags(domain, user, workstation, hash, c, 0)
+}
+
+// 明文认证，flags为额外请求的签名、加密、密钥交换等标志，仅保留服务端同样支持的部分
+// 返回认证消息以及ExportedSessionKey
+func NewAuthenticatePassFlags(domain, user, workstation, password string, c Challenge, flags uint32) (NTLMv2Authentication, []byte, error) {
 	h := hmac.New(md5.New, NTOWFv2(password, user, domain))
-	//return newAuthenticate(h, domain, user, workstation, nthash, lmhash, c)
-	return newAuthenticate(h, domain, user, workstation, c)
+	return newAuthenticate(h, domain, user, workstation, c, flags)
 }
 
-func NewAuthenticateHash(domain, user, workstation, hash string, c Challenge) NTLMv2Authentication {
-	// hash认证
-	//buf := make([]byte, len(hash)/2)
-	//hex.Decode(buf, []byte(hash))
+// hash认证，flags同NewAuthenticatePassFlags
+func NewAuthenticateHashFlags(domain, user, workstation, hash string, c Challenge, flags uint32) (NTLMv2Authentication, []byte, error) {
 	h := hmac.New(md5.New, NTOWFv2Hash(hash, user, domain))
-	return newAuthenticate(h, domain, user, workstation, c)
+	return newAuthenticate(h, domain, user, workstation, c, flags)
 }
 
-func newAuthenticate(h hash.Hash, domain, user, workstation string, c Challenge) NTLMv2Authentication {
+func newAuthenticate(h hash.Hash, domain, user, workstation string, c Challenge, flags uint32) (NTLMv2Authentication, []byte, error) {
 	// Assumes domain, user, and workstation are not unicode
 	var timestamp []byte
 	for k, av := range *c.TargetInfo {
@@ -104,7 +121,9 @@ func newAuthenticate(h hash.Hash, domain, user, workstation string, c Challenge)
 	}
 
 	clientChallenge := make([]byte, 8)
-	rand.Reader.Read(clientChallenge)
+	if _, err := rand.Read(clientChallenge); err != nil {
+		return NTLMv2Authentication{}, nil, fmt.Errorf("Failed to generate NTLM client challenge: %w", err)
+	}
 	serverChallenge := make([]byte, 8)
 	w := bytes.NewBuffer(make([]byte, 0))
 	binary.Write(w, binary.LittleEndian, c.ServerChallenge)
@@ -117,23 +136,32 @@ func newAuthenticate(h hash.Hash, domain, user, workstation string, c Challenge)
 	}
 	ntChallengeResponse, lmChallengeResponse, sessionBaseKey := ComputeNTLMv2Response(h, clientChallenge, serverChallenge, timestamp, w.Bytes())
 
+	// 未协商NTLMSSP_NEGOTIATE_KEY_EXCH时ExportedSessionKey即SessionBaseKey，不在报文中传输
+	// 否则随机生成ExportedSessionKey，使用KeyExchangeKey(NTLMv2下即SessionBaseKey)加密传输
+	flags = authenticateFlags | flags&c.NegotiateFlags
+	exportedSessionKey := sessionBaseKey
+	encryptedRandomSessionKey := []byte{}
+	if flags&FlgNegKeyExchange != 0 {
+		// 随机数读取失败时不能使用全零密钥签名、加密
+		exportedSessionKey = make([]byte, 16)
+		if _, err := rand.Read(exportedSessionKey); err != nil {
+			return NTLMv2Authentication{}, nil, fmt.Errorf("Failed to generate NTLM session key: %w", err)
+		}
+		encryptedRandomSessionKey = make([]byte, 16)
+		cipher, _ := rc4.NewCipher(sessionBaseKey)
+		cipher.XORKeyStream(encryptedRandomSessionKey, exportedSessionKey)
+	}
 	return NTLMv2Authentication{
 		Header: Header{
 			Signature:   []byte(NTLMSecSignature),
 			MessageType: NTLMAuthenticate,
 		},
-		DomainName:  encoder.ToUnicode(domain),
-		UserName:    encoder.ToUnicode(user),
-		Workstation: encoder.ToUnicode(workstation),
-		NegotiateFlags: FlgNeg56 |
-			FlgNeg128 |
-			FlgNegTargetInfo |
-			FlgNegExtendedSecurity |
-			FlgNegNTLMKey |
-			FlgRequestTarget |
-			FlgNegUNICODE,
+		DomainName:                encoder.ToUnicode(domain),
+		UserName:                  encoder.ToUnicode(user),
+		Workstation:               encoder.ToUnicode(workstation),
+		NegotiateFlags:            flags,
 		NtChallengeResponse:       ntChallengeResponse,
 		LmChallengeResponse:       lmChallengeResponse,
-		EncryptedRandomSessionKey: sessionBaseKey,
-	}
+		EncryptedRandomSessionKey: encryptedRandomSessionKey,
+	}, exportedSessionKey, nil
 }
@@ -0,0 +1,124 @@
+package ntlm
+
+// 此文件提供扩展会话安全下的消息签名与加密，用于dcerpc等需要逐包保护的协议
+// https://docs.microsoft.com/zh-cn/openspecs/windows_protocols/ms-nlmp/
+
+import (
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rc4"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+)
+
+// 签名长度，Version、Checksum、SeqNum
+const SignatureSize = 16
+
+const (
+	clientSigningMagic = "session key to client-to-server signing key magic constant\x00"
+	serverSigningMagic = "session key to server-to-client signing key magic constant\x00"
+	clientSealingMagic = "session key to client-to-server sealing key magic constant\x00"
+	serverSealingMagic = "session key to server-to-client sealing key magic constant\x00"
+)
+
+var ErrInvalidSignature = errors.New("NTLM message signature verification failed")
+
+// 客户端会话，发送与接收方向各自使用独立的密钥、RC4状态以及序号
+type Session struct {
+	flags            uint32
+	clientSigningKey []byte
+	serverSigningKey []byte
+	clientHandle     *rc4.Cipher
+	serverHandle     *rc4.Cipher
+	clientSeq        uint32
+	serverSeq        uint32
+}
+
+// 根据认证协商的flags与ExportedSessionKey建立客户端会话，要求协商扩展会话安全
+func NewClientSession(flags uint32, exportedSessionKey []byte) (*Session, error) {
+	if flags&FlgNegExtendedSecurity == 0 {
+		return nil, errors.New("NTLM session security requires extended session security")
+	}
+	if len(exportedSessionKey) != 16 {
+		return nil, errors.New("Invalid NTLM session key length")
+	}
+	// 加密密钥长度取决于协商的密钥强度
+	sealKey := exportedSessionKey
+	switch {
+	case flags&FlgNeg128 != 0:
+	case flags&FlgNeg56 != 0:
+		sealKey = sealKey[:7]
+	default:
+		sealKey = sealKey[:5]
+	}
+	s := &Session{
+		flags:            flags,
+		clientSigningKey: deriveKey(exportedSessionKey, clientSigningMagic),
+		serverSigningKey: deriveKey(exportedSessionKey, serverSigningMagic),
+	}
+	var err error
+	if s.clientHandle, err = rc4.NewCipher(deriveKey(sealKey, clientSealingMagic)); err != nil {
+		return nil, err
+	}
+	if s.serverHandle, err = rc4.NewCipher(deriveKey(sealKey, serverSealingMagic)); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func deriveKey(key []byte, magic string) []byte {
+	h := md5.New()
+	h.Write(key)
+	h.Write([]byte(magic))
+	return h.Sum(nil)
+}
+
+// 计算发送消息的签名，序号随之递增
+// 同时加密时需先调用Seal，再对明文消息签名
+func (s *Session) Sign(msg []byte) []byte {
+	sig := s.mac(s.clientSigningKey, s.clientHandle, s.clientSeq, msg)
+	s.clientSeq++
+	return sig
+}
+
+// 加密发送的数据
+func (s *Session) Seal(data []byte) []byte {
+	out := make([]byte, len(data))
+	s.clientHandle.XORKeyStream(out, data)
+	return out
+}
+
+// 解密接收的数据，需在Verify之前调用
+func (s *Session) Unseal(data []byte) []byte {
+	out := make([]byte, len(data))
+	s.serverHandle.XORKeyStream(out, data)
+	return out
+}
+
+// 校验接收消息的签名，msg为明文消息，序号随之递增
+func (s *Session) Verify(msg, sig []byte) error {
+	expected := s.mac(s.serverSigningKey, s.serverHandle, s.serverSeq, msg)
+	s.serverSeq++
+	if subtle.ConstantTimeCompare(expected, sig) != 1 {
+		return ErrInvalidSignature
+	}
+	return nil
+}
+
+// 扩展会话安全的签名，协商密钥交换时校验和使用RC4加密
+func (s *Session) mac(key []byte, handle *rc4.Cipher, seq uint32, msg []byte) []byte {
+	seqNum := make([]byte, 4)
+	binary.LittleEndian.PutUint32(seqNum, seq)
+	h := hmac.New(md5.New, key)
+	h.Write(seqNum)
+	h.Write(msg)
+	checksum := h.Sum(nil)[:8]
+	if s.flags&FlgNegKeyExchange != 0 {
+		handle.XORKeyStream(checksum, checksum)
+	}
+	sig := make([]byte, 0, SignatureSize)
+	sig = append(sig, 1, 0, 0, 0)
+	sig = append(sig, checksum...)
+	return append(sig, seqNum...)
+}
@@ -0,0 +1,92 @@
+package ntlm
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/4ra1n/go-impacket/pkg/encoder"
+)
+
+// 客户端方向取自MS-NLMP 4.2.4节(NTLMv2、扩展会话安全、密钥交换)，RandomSessionKey为0x55重复16字节
+// 服务端方向的结果按3.4.4节用MD5、RC4独立计算
+
+const testSessionFlags = FlgNegExtendedSecurity | FlgNeg128 | FlgNegKeyExchange | FlgNegSign | FlgNegSeal
+
+func unhex(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(strings.Join(strings.Fields(s), ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func newTestSession(t *testing.T) *Session {
+	t.Helper()
+	s, err := NewClientSession(testSessionFlags, bytes.Repeat([]byte{0x55}, 16))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestSessionKeys(t *testing.T) {
+	s := newTestSession(t)
+	if !bytes.Equal(s.clientSigningKey, unhex(t, "4788dc861b4782f35d43fd98fe1a2d39")) {
+		t.Fatalf("client signing key = %x", s.clientSigningKey)
+	}
+	sealKey := deriveKey(bytes.Repeat([]byte{0x55}, 16), clientSealingMagic)
+	if !bytes.Equal(sealKey, unhex(t, "59f600973cc4960a25480a7c196e4c58")) {
+		t.Fatalf("client sealing key = %x", sealKey)
+	}
+}
+
+// 4.2.4.4节GSS_WrapEx：先加密再对明文签名，签名中的校验和继续使用同一RC4状态
+func TestSessionSealSign(t *testing.T) {
+	s := newTestSession(t)
+	plain := encoder.ToUnicode("Plaintext")
+	sealed := s.Seal(plain)
+	if want := unhex(t, "54e50165bf1936dc996020c1811b0f06fb5f"); !bytes.Equal(sealed, want) {
+		t.Fatalf("Seal = %x, want %x", sealed, want)
+	}
+	if sig, want := s.Sign(plain), unhex(t, "01000000 7fb38ec5c55d4976 00000000"); !bytes.Equal(sig, want) {
+		t.Fatalf("Sign = %x, want %x", sig, want)
+	}
+}
+
+func TestSessionUnsealVerify(t *testing.T) {
+	tests := []struct {
+		plain, sealed, sig string
+	}{
+		{"Plaintext", "160871b730ba74e946c453d7465b54278dd0", "01000000 b298b847ce7c5807 00000000"},
+		{"Response", "3fb8a7181a36c5eebaa77346bcb5f469", "01000000 0789fef3b25c1c77 01000000"},
+	}
+	s := newTestSession(t)
+	for _, tt := range tests {
+		plain := s.Unseal(unhex(t, tt.sealed))
+		if want := encoder.ToUnicode(tt.plain); !bytes.Equal(plain, want) {
+			t.Fatalf("Unseal = %x, want %x", plain, want)
+		}
+		if err := s.Verify(plain, unhex(t, tt.sig)); err != nil {
+			t.Fatalf("Verify(%q): %v", tt.plain, err)
+		}
+	}
+	// 序号与RC4状态已前进，重放的签名校验失败
+	s = newTestSession(t)
+	plain := s.Unseal(unhex(t, tests[0].sealed))
+	if err := s.Verify(plain, unhex(t, tests[0].sig)); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Verify(plain, unhex(t, tests[0].sig)); !errors.Is(err, ErrInvalidSignature) {
+		t.Fatalf("replayed signature error = %v", err)
+	}
+}
+
+func TestNewClientSessionRequiresExtendedSecurity(t *testing.T) {
+	if _, err := NewClientSession(FlgNeg128|FlgNegSign, bytes.Repeat([]byte{0x55}, 16)); err == nil {
+		t.Fatal("session without extended session security accepted")
+	}
+}
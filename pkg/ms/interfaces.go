@@ -0,0 +1,60 @@
+package ms
+
+import "strings"
+
+// 此文件提供常见rpc接口的协议与提供者，用于rpcdump等工具显示终端映射
+
+// 已知rpc接口
+type KnownInterface struct {
+	Protocol string // 协议文档及接口名称
+	Provider string // 注册该接口的进程或模块
+}
+
+// 键为小写的接口uuid
+var KnownInterfaces = map[string]KnownInterface{
+	EPMv4_UUID:                             {"[MS-RPCE]: Endpoint Mapper", "rpcss.dll"},
+	IID_IObjectExporter:                    {"[MS-DCOM]: IObjectExporter", "rpcss.dll"},
+	"4d9f4ab8-7d1c-11cf-861e-0020af6e7c57": {"[MS-DCOM]: IActivation", "rpcss.dll"},
+	"000001a0-0000-0000-c000-000000000046": {"[MS-DCOM]: IRemoteSCMActivator", "rpcss.dll"},
+	SRVSVC_UUID:                            {"[MS-SRVS]: Server Service Remote Protocol", "srvsvc.dll"},
+	NTSVCS_UUID:                            {"[MS-SCMR]: Service Control Manager Remote Protocol", "services.exe"},
+	"6bffd098-a112-3610-9833-46c3f87e345a": {"[MS-WKST]: Workstation Service Remote Protocol", "wkssvc.dll"},
+	"12345778-1234-abcd-ef00-0123456789ab": {"[MS-LSAT]: Local Security Authority (Translation Methods) Remote Protocol", "lsasrv.dll"},
+	"12345778-1234-abcd-ef00-0123456789ac": {"[MS-SAMR]: Security Account Manager (SAM) Remote Protocol", "samsrv.dll"},
+	"12345678-1234-abcd-ef00-01234567cffb": {"[MS-NRPC]: Netlogon Remote Protocol", "netlogon.dll"},
+	"3919286a-b10c-11d0-9ba8-00c04fd92ef5": {"[MS-DSSP]: Directory Services Setup Remote Protocol", "lsasrv.dll"},
+	"3dde7c30-165d-11d1-ab8f-00805f14db40": {"[MS-BKRP]: BackupKey Remote Protocol", "lsasrv.dll"},
+	"c681d488-d850-11d0-8c52-00c04fd90f7e": {"[MS-EFSR]: Encrypting File System Remote (EFSRPC) Protocol", "efslsaext.dll"},
+	"df1941c5-fe89-4e79-bf10-463657acf44d": {"[MS-EFSR]: Encrypting File System Remote (EFSRPC) Protocol", "efssvc.dll"},
+	"e3514235-4b06-11d1-ab04-00c04fc2dcd2": {"[MS-DRSR]: Directory Replication Service (DRS) Remote Protocol", "ntdsai.dll"},
+	"b9785960-524f-11df-8b6d-83dcded72085": {"[MS-GKDI]: Group Key Distribution Protocol", "kdssvc.dll"},
+	"338cd001-2244-31f1-aaaa-900038001003": {"[MS-RRP]: Windows Remote Registry Protocol", "regsvc.dll"},
+	"86d35949-83c9-4044-b424-db363231fd0c": {"[MS-TSCH]: Task Scheduler Service Remoting Protocol", "schedsvc.dll"},
+	"1ff70682-0a51-30e8-076d-740be8cee98b": {"[MS-TSCH]: Task Scheduler Service Remoting Protocol", "schedsvc.dll"},
+	"378e52b0-c0a9-11cf-822d-00aa0051e40f": {"[MS-TSCH]: Task Scheduler Service Remoting Protocol", "schedsvc.dll"},
+	"12345678-1234-abcd-ef00-0123456789ab": {"[MS-RPRN]: Print System Remote Protocol", "spoolsv.exe"},
+	"76f03f96-cdfd-44fc-a22c-64950a001209": {"[MS-PAR]: Print System Asynchronous Remote Protocol", "spoolsv.exe"},
+	"0b6edbfa-4a24-4fc6-8a23-942b1eca65d1": {"[MS-PAN]: Print System Asynchronous Notification Protocol", "spoolsv.exe"},
+	"ae33069b-a2a8-46ee-a235-ddfd339be281": {"[MS-PAN]: Print System Asynchronous Notification Protocol", "spoolsv.exe"},
+	"d95afe70-a6d5-4259-822e-2c84da1ddb0d": {"[MS-RSP]: Remote Shutdown Protocol", "wininit.exe"},
+	"894de0c0-0d55-11d3-a322-00c04fa321a1": {"[MS-RSP]: Remote Shutdown Protocol", "wininit.exe"},
+	"82273fdc-e32a-18c3-3f78-827929dc23ea": {"[MS-EVEN]: EventLog Remoting Protocol", "wevtsvc.dll"},
+	"f6beaff7-1e19-4fbb-9f8f-b89e2018337c": {"[MS-EVEN6]: EventLog Remoting Protocol", "wevtsvc.dll"},
+	"4fc742e0-4a10-11cf-8273-00aa004ae673": {"[MS-DFSNM]: Distributed File System (DFS): Namespace Management Protocol", "dfssvc.exe"},
+	"897e2e5f-93f3-4376-9c9c-fd2277495c27": {"[MS-FRS2]: Distributed File System Replication Protocol", "dfsrs.exe"},
+	"8d9f4e40-a03d-11ce-8f69-08003e30051b": {"[MS-PNPR]: Plug and Play Remote (PNPR) Protocol", "umpnpmgr.dll"},
+	"6b5bdd1e-528c-422c-af8c-a4079be4fe48": {"[MS-FASP]: Firewall and Advanced Security Protocol", "FwRemoteSvr.dll"},
+	"8fb6d884-2388-11d0-8c35-00c04fda2795": {"[MS-W32T]: W32Time Remote Protocol", "w32time.dll"},
+	"50abc2a4-574d-40b3-9d66-ee4fd5fba076": {"[MS-DNSP]: Domain Name Service (DNS) Server Management Protocol", "dns.exe"},
+	"91ae6020-9e3c-11cf-8d7c-00aa00c091be": {"[MS-ICPR]: ICertPassage Remote Protocol", "certsrv.exe"},
+	"6bffd098-a112-3610-9833-46c3f874532d": {"[MS-DHCPM]: Microsoft Dynamic Host Configuration Protocol (DHCP) Server Management Protocol", "dhcpssvc.dll"},
+	"5b821720-f63b-11d0-aad2-00c04fc324db": {"[MS-DHCPM]: Microsoft Dynamic Host Configuration Protocol (DHCP) Server Management Protocol", "dhcpssvc.dll"},
+	"300f3532-38cc-11d0-a3f0-0020af6b0add": {"[MS-DLTW]: Distributed Link Tracking: Workstation Protocol", "trkwks.dll"},
+	"f5cc5a18-4264-101a-8c59-08002b2f8426": {"[MS-NSPI]: Name Service Provider Interface (NSPI) Protocol", "ntdsai.dll"},
+}
+
+// 查找已知接口，uuid不区分大小写
+func LookupInterface(uuid string) (KnownInterface, bool) {
+	i, ok := KnownInterfaces[strings.ToLower(uuid)]
+	return i, ok
+}
@@ -1,10 +1,16 @@
 package ms
 
+import (
+	"fmt"
+	"io/fs"
+)
+
 // 此文件提供SMB、NT相关的错误代码以及错误信息
 // https://docs.microsoft.com/en-us/openspecs/windows_protocols/ms-erref/1bc92ddf-b79e-413c-bbaa-99a5281a6c90
 
 const (
 	STATUS_SUCCESS                  = 0x00000000
+	STATUS_PENDING                  = 0x00000103
 	STATUS_MORE_PROCESSING_REQUIRED = 0xC0000016
 	STATUS_ACCESS_DENIED            = 0xC0000022
 	STATUS_LOGON_FAILURE            = 0xC000006D
@@ -15,10 +21,25 @@ const (
 	STATUS_INVALID_PARAMETER        = 0xC000000D
 	STATUS_OBJECT_NAME_NOT_FOUND    = 0xC0000034
 	STATUS_PIPE_BROKEN              = 0xC000014B
+	STATUS_CANCELLED                = 0xC0000120
+	STATUS_BUFFER_OVERFLOW          = 0x80000005
+	STATUS_NO_MORE_FILES            = 0x80000006
+	STATUS_NO_SUCH_FILE             = 0xC000000F
+	STATUS_OBJECT_PATH_NOT_FOUND    = 0xC000003A
+	STATUS_NOT_A_DIRECTORY          = 0xC0000103
+	STATUS_END_OF_FILE              = 0xC0000011
+	STATUS_FILE_IS_A_DIRECTORY      = 0xC00000BA
+	STATUS_OBJECT_NAME_INVALID      = 0xC0000033
+	STATUS_OBJECT_NAME_COLLISION    = 0xC0000035
+	STATUS_SHARING_VIOLATION        = 0xC0000043
+	STATUS_DELETE_PENDING           = 0xC0000056
+	STATUS_DIRECTORY_NOT_EMPTY      = 0xC0000101
+	STATUS_CANNOT_DELETE            = 0xC0000121
 )
 
 var StatusMap = map[uint32]string{
 	STATUS_SUCCESS:                  "Requested operation succeeded.",
+	STATUS_PENDING:                  "The operation that was requested is pending completion.",
 	STATUS_MORE_PROCESSING_REQUIRED: "More Processing Required",
 	STATUS_ACCESS_DENIED:            "A process has requested access to an object but has not been granted those access rights.",
 	STATUS_LOGON_FAILURE:            "Authentication failed.",
@@ -29,4 +50,44 @@ var StatusMap = map[uint32]string{
 	STATUS_INVALID_PARAMETER:        "An invalid parameter was passed to a service or function.",
 	STATUS_OBJECT_NAME_NOT_FOUND:    "The object name is not found.",
 	STATUS_PIPE_BROKEN:              "The pipe operation has failed because the other end of the pipe has been closed.",
+	STATUS_CANCELLED:                "The I/O request was canceled.",
+	STATUS_BUFFER_OVERFLOW:          "The data was too large to fit into the specified buffer.",
+	STATUS_NO_MORE_FILES:            "No more files were found which match the file specification.",
+	STATUS_NO_SUCH_FILE:             "The file does not exist.",
+	STATUS_OBJECT_PATH_NOT_FOUND:    "The path does not exist.",
+	STATUS_NOT_A_DIRECTORY:          "A requested opened file is not a directory.",
+	STATUS_END_OF_FILE:              "The end-of-file marker has been reached.",
+	STATUS_FILE_IS_A_DIRECTORY:      "The file that was specified as a target is a directory.",
+	STATUS_OBJECT_NAME_INVALID:      "The object name is invalid.",
+	STATUS_OBJECT_NAME_COLLISION:    "The object name already exists.",
+	STATUS_SHARING_VIOLATION:        "A file cannot be opened because the share access flags are incompatible.",
+	STATUS_DELETE_PENDING:           "A non-close operation has been requested of a file object that has a delete pending.",
+	STATUS_DIRECTORY_NOT_EMPTY:      "The directory is not empty.",
+	STATUS_CANNOT_DELETE:            "An attempt has been made to remove a file or directory that cannot be deleted.",
+}
+
+// 携带NT状态码的错误，错误信息与StatusMap一致
+// 可通过errors.Is与io/fs中的通用错误比较
+type StatusError uint32
+
+func (e StatusError) Error() string {
+	if msg, ok := StatusMap[uint32(e)]; ok {
+		return msg
+	}
+	return fmt.Sprintf("NT status 0x%08X", uint32(e))
+}
+
+func (e StatusError) Is(target error) bool {
+	switch target {
+	case fs.ErrNotExist:
+		return e == STATUS_OBJECT_NAME_NOT_FOUND || e == STATUS_OBJECT_PATH_NOT_FOUND ||
+			e == STATUS_NO_SUCH_FILE || e == STATUS_BAD_NETWORK_NAME
+	case fs.ErrExist:
+		return e == STATUS_OBJECT_NAME_COLLISION
+	case fs.ErrPermission:
+		return e == STATUS_ACCESS_DENIED
+	case fs.ErrClosed:
+		return e == STATUS_FILE_CLOSED
+	}
+	return false
 }
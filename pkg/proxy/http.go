@@ -0,0 +1,75 @@
+package proxy
+
+// HTTP CONNECT隧道
+// https://www.rfc-editor.org/rfc/rfc9110#name-connect
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+)
+
+type httpConnect struct {
+	network string
+	address string
+	auth    *Auth
+	forward Dialer
+}
+
+// 创建HTTP CONNECT拨号器，auth不为空时使用Basic认证
+func HTTPConnect(network, address string, auth *Auth, forward Dialer) (Dialer, error) {
+	if forward == nil {
+		forward = Direct
+	}
+	return &httpConnect{network: network, address: address, auth: auth, forward: forward}, nil
+}
+
+func (h *httpConnect) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, errors.New("HTTP proxy: unsupported network " + network)
+	}
+	conn, err := h.forward.DialContext(ctx, h.network, h.address)
+	if err != nil {
+		return nil, err
+	}
+	var r *bufio.Reader
+	if err = handshake(ctx, conn, func() (err error) {
+		r, err = h.connect(conn, address)
+		return err
+	}); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("HTTP proxy %s: %w", h.address, err)
+	}
+	if r.Buffered() > 0 {
+		return &bufferedConn{Conn: conn, r: r}, nil
+	}
+	return conn, nil
+}
+
+func (h *httpConnect) connect(conn net.Conn, address string) (*bufio.Reader, error) {
+	req := "CONNECT " + address + " HTTP/1.1\r\nHost: " + address + "\r\n"
+	if h.auth != nil {
+		token := base64.StdEncoding.EncodeToString([]byte(h.auth.User + ":" + h.auth.Password))
+		req += "Proxy-Authorization: Basic " + token + "\r\n"
+	}
+	req += "\r\n"
+	if _, err := conn.Write([]byte(req)); err != nil {
+		return nil, err
+	}
+	r := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(r, &http.Request{Method: http.MethodConnect})
+	if err != nil {
+		return nil, err
+	}
+	// 隧道建立后的数据不属于响应体，不能读取Body
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, errors.New(resp.Status)
+	}
+	return r, nil
+}
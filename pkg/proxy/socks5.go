@@ -0,0 +1,188 @@
+package proxy
+
+// SOCKS5协议，支持无认证以及用户名密码认证，只实现CONNECT命令
+// https://www.rfc-editor.org/rfc/rfc1928
+// https://www.rfc-editor.org/rfc/rfc1929
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+)
+
+const (
+	socks5Version = 0x05
+
+	socks5AuthNone         = 0x00
+	socks5AuthPassword     = 0x02
+	socks5AuthNoAcceptable = 0xff
+
+	socks5CmdConnect = 0x01
+
+	socks5AddrIPv4   = 0x01
+	socks5AddrDomain = 0x03
+	socks5AddrIPv6   = 0x04
+)
+
+// 服务端响应码
+var socks5Replies = map[byte]string{
+	0x01: "general SOCKS server failure",
+	0x02: "connection not allowed by ruleset",
+	0x03: "network unreachable",
+	0x04: "host unreachable",
+	0x05: "connection refused",
+	0x06: "TTL expired",
+	0x07: "command not supported",
+	0x08: "address type not supported",
+}
+
+type socks5 struct {
+	network string
+	address string
+	auth    *Auth
+	forward Dialer
+}
+
+// 创建SOCKS5拨号器，目标为域名时交由代理服务器解析
+func SOCKS5(network, address string, auth *Auth, forward Dialer) (Dialer, error) {
+	if forward == nil {
+		forward = Direct
+	}
+	if auth != nil && (len(auth.User) > 255 || len(auth.Password) > 255) {
+		return nil, errors.New("SOCKS5 username or password too long")
+	}
+	return &socks5{network: network, address: address, auth: auth, forward: forward}, nil
+}
+
+func (s *socks5) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, errors.New("SOCKS5 proxy: unsupported network " + network)
+	}
+	conn, err := s.forward.DialContext(ctx, s.network, s.address)
+	if err != nil {
+		return nil, err
+	}
+	if err = handshake(ctx, conn, func() error { return s.connect(conn, address) }); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("SOCKS5 proxy %s: %w", s.address, err)
+	}
+	return conn, nil
+}
+
+func (s *socks5) connect(conn net.Conn, address string) error {
+	host, portStr, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return errors.New("invalid port " + portStr)
+	}
+	// 协商认证方式
+	methods := []byte{socks5AuthNone}
+	if s.auth != nil {
+		methods = append(methods, socks5AuthPassword)
+	}
+	buf := append([]byte{socks5Version, byte(len(methods))}, methods...)
+	if _, err = conn.Write(buf); err != nil {
+		return err
+	}
+	reply := make([]byte, 2)
+	if _, err = io.ReadFull(conn, reply); err != nil {
+		return err
+	}
+	if reply[0] != socks5Version {
+		return errors.New("unexpected protocol version " + strconv.Itoa(int(reply[0])))
+	}
+	switch reply[1] {
+	case socks5AuthNone:
+	case socks5AuthPassword:
+		if s.auth == nil {
+			return errors.New("server requires authentication")
+		}
+		if err = s.authenticate(conn); err != nil {
+			return err
+		}
+	case socks5AuthNoAcceptable:
+		return errors.New("no acceptable authentication methods")
+	default:
+		return errors.New("unsupported authentication method " + strconv.Itoa(int(reply[1])))
+	}
+	// 发送CONNECT请求
+	buf = []byte{socks5Version, socks5CmdConnect, 0x00}
+	if ip := net.ParseIP(host); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			buf = append(buf, socks5AddrIPv4)
+			buf = append(buf, ip4...)
+		} else {
+			buf = append(buf, socks5AddrIPv6)
+			buf = append(buf, ip.To16()...)
+		}
+	} else {
+		if len(host) > 255 {
+			return errors.New("host name too long")
+		}
+		buf = append(buf, socks5AddrDomain, byte(len(host)))
+		buf = append(buf, host...)
+	}
+	buf = append(buf, byte(port>>8), byte(port))
+	if _, err = conn.Write(buf); err != nil {
+		return err
+	}
+	// 响应: VER REP RSV ATYP BND.ADDR BND.PORT
+	header := make([]byte, 4)
+	if _, err = io.ReadFull(conn, header); err != nil {
+		return err
+	}
+	if header[0] != socks5Version {
+		return errors.New("unexpected protocol version " + strconv.Itoa(int(header[0])))
+	}
+	if header[1] != 0x00 {
+		if msg, ok := socks5Replies[header[1]]; ok {
+			return errors.New(msg)
+		}
+		return errors.New("unknown reply code " + strconv.Itoa(int(header[1])))
+	}
+	var n int
+	switch header[3] {
+	case socks5AddrIPv4:
+		n = net.IPv4len
+	case socks5AddrIPv6:
+		n = net.IPv6len
+	case socks5AddrDomain:
+		l := make([]byte, 1)
+		if _, err = io.ReadFull(conn, l); err != nil {
+			return err
+		}
+		n = int(l[0])
+	default:
+		return errors.New("unknown address type " + strconv.Itoa(int(header[3])))
+	}
+	// 丢弃绑定地址及端口
+	_, err = io.ReadFull(conn, make([]byte, n+2))
+	return err
+}
+
+// 用户名密码认证
+func (s *socks5) authenticate(conn net.Conn) error {
+	buf := []byte{0x01, byte(len(s.auth.User))}
+	buf = append(buf, s.auth.User...)
+	buf = append(buf, byte(len(s.auth.Password)))
+	buf = append(buf, s.auth.Password...)
+	if _, err := conn.Write(buf); err != nil {
+		return err
+	}
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return err
+	}
+	if reply[1] != 0x00 {
+		return errors.New("username/password authentication failed")
+	}
+	return nil
+}
@@ -0,0 +1,89 @@
+package smb
+
+// 此文件用于SMB2信用值计算以及异步头部字段的读写
+// https://docs.microsoft.com/en-us/openspecs/windows_protocols/ms-smb2/18183100-026a-46e1-87a4-46013d534b9c
+
+import "encoding/binary"
+
+const (
+	// 每个信用值对应64KB的负载
+	CreditPayloadSize        = 65536
+	smb2CreditChargeOffset   = 6
+	smb2CreditRequestOffset  = 14
+	smb2AsyncIdOffset        = 32
+	SMB2CancelRequestSize    = SMB2HeaderSize + 4
+	SMB2UnsolicitedMessageId = 0xffffffffffffffff
+)
+
+// 按负载大小计算所需信用值
+func CreditCharge(payload uint32) uint16 {
+	if payload == 0 {
+		return 1
+	}
+	return uint16((payload-1)/CreditPayloadSize + 1)
+}
+
+// 根据请求中的读写长度计算信用值，单个请求中偏移量均相对SMB2头
+func RequestCreditCharge(pkt []byte) uint16 {
+	u32 := func(off int) uint32 {
+		if len(pkt) < SMB2HeaderSize+off+4 {
+			return 0
+		}
+		return binary.LittleEndian.Uint32(pkt[SMB2HeaderSize+off:])
+	}
+	var payload uint32
+	switch HeaderCommand(pkt) {
+	case SMB2_READ, SMB2_WRITE, SMB2_QUERY_INFO, SMB2_SET_INFO, SMB2_CHANGE_NOTIFY:
+		payload = u32(4)
+	case SMB2_QUERY_DIRECTORY:
+		payload = u32(28)
+	case SMB2_IOCTL:
+		// 取发送与接收长度中的较大值
+		payload = u32(28) + u32(40)
+		if resp := u32(32) + u32(44); resp > payload {
+			payload = resp
+		}
+	}
+	return CreditCharge(payload)
+}
+
+func HeaderCreditCharge(pkt []byte) uint16 {
+	return binary.LittleEndian.Uint16(pkt[smb2CreditChargeOffset:])
+}
+
+func SetHeaderCreditCharge(pkt []byte, charge uint16) {
+	binary.LittleEndian.PutUint16(pkt[smb2CreditChargeOffset:], charge)
+}
+
+// 响应中为服务端授予的信用值
+func HeaderCreditResponse(pkt []byte) uint16 {
+	return binary.LittleEndian.Uint16(pkt[smb2CreditRequestOffset:])
+}
+
+func SetHeaderCreditRequest(pkt []byte, credits uint16) {
+	binary.LittleEndian.PutUint16(pkt[smb2CreditRequestOffset:], credits)
+}
+
+// 异步响应中的AsyncId，占用同步头的Reserved与TreeId
+func HeaderAsyncId(pkt []byte) uint64 {
+	return binary.LittleEndian.Uint64(pkt[smb2AsyncIdOffset:])
+}
+
+// 构造取消请求，asyncId不为0时按异步方式取消
+// https://docs.microsoft.com/en-us/openspecs/windows_protocols/ms-smb2/91913fc6-4ec9-4a83-961b-370070067e63
+func NewCancelRequest(messageId, asyncId, sessionId uint64, treeId uint32) []byte {
+	pkt := make([]byte, SMB2CancelRequestSize)
+	copy(pkt, ProtocolSMB2)
+	binary.LittleEndian.PutUint16(pkt[4:], SMB2HeaderSize)
+	binary.LittleEndian.PutUint16(pkt[smb2CommandOffset:], SMB2_CANCEL)
+	binary.LittleEndian.PutUint64(pkt[smb2MessageIdOffset:], messageId)
+	if asyncId != 0 {
+		binary.LittleEndian.PutUint32(pkt[smb2FlagsOffset:], SMB2_FLAGS_ASYNC_COMMAND)
+		binary.LittleEndian.PutUint64(pkt[smb2AsyncIdOffset:], asyncId)
+	} else {
+		binary.LittleEndian.PutUint32(pkt[smb2TreeIdOffset:], treeId)
+	}
+	binary.LittleEndian.PutUint64(pkt[smb2SessionIdOffset:], sessionId)
+	binary.LittleEndian.PutUint16(pkt[SMB2HeaderSize:], 4)
+	return pkt
+}
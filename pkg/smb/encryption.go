@@ -0,0 +1,260 @@
+package smb
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+)
+
+// 此文件提供SMB3传输加密，即TRANSFORM_HEADER封装/解封装
+// https://docs.microsoft.com/en-us/openspecs/windows_protocols/ms-smb2/d6ce2327-a4c9-4793-be66-7b5bad2175fa
+
+const (
+	ProtocolSMB2Transform         = "\xFDSMB"
+	SMB2TransformHeaderSize       = 52
+	SMB2_TRANSFORM_FLAG_ENCRYPTED = 0x0001
+)
+
+// 树连接响应ShareFlags属性
+const (
+	SMB2_SHAREFLAG_DFS          = 0x00000001
+	SMB2_SHAREFLAG_DFS_ROOT     = 0x00000002
+	SMB2_SHAREFLAG_ENCRYPT_DATA = 0x00008000
+)
+
+// TRANSFORM_HEADER中各字段的偏移量
+const (
+	transformSignatureOffset = 4
+	transformNonceOffset     = 20
+	transformSizeOffset      = 36
+	transformFlagsOffset     = 42
+	transformSessionIdOffset = 44
+	smb2TreeIdOffset         = 36
+)
+
+var ErrDecryptFailed = errors.New("SMB2 message decryption failed")
+
+// 判断是否为加密数据包
+func IsTransform(pkt []byte) bool {
+	return len(pkt) >= SMB2TransformHeaderSize && string(pkt[:4]) == ProtocolSMB2Transform
+}
+
+// 读取SMB2头中的TreeId，仅适用于同步消息
+func HeaderTreeId(pkt []byte) uint32 {
+	return binary.LittleEndian.Uint32(pkt[smb2TreeIdOffset:])
+}
+
+// 读取TRANSFORM_HEADER中的SessionId
+func TransformSessionId(pkt []byte) uint64 {
+	return binary.LittleEndian.Uint64(pkt[transformSessionIdOffset:])
+}
+
+// 根据协议版本派生加密/解密密钥
+// 加密密钥用于客户端到服务端的消息，解密密钥用于服务端到客户端的消息
+// https://docs.microsoft.com/en-us/openspecs/windows_protocols/ms-smb2/7fd079ca-17e6-4f02-8449-46b606ea289c
+func DeriveEncryptionKeys(dialect, cipherId uint16, sessionKey, preauthHash []byte) (encryptionKey, decryptionKey []byte) {
+	// AES256使用完整会话密钥，其余只取前16字节
+	bits := 128
+	if cipherId == SMB2_ENCRYPTION_AES256_CCM || cipherId == SMB2_ENCRYPTION_AES256_GCM {
+		bits = 256
+	} else if len(sessionKey) > 16 {
+		sessionKey = sessionKey[:16]
+	}
+	if dialect >= SMB3_1_1_Dialect {
+		encryptionKey = KDF(sessionKey, []byte("SMBC2SCipherKey\x00"), preauthHash, bits)
+		decryptionKey = KDF(sessionKey, []byte("SMBS2CCipherKey\x00"), preauthHash, bits)
+		return
+	}
+	encryptionKey = KDF(sessionKey, []byte("SMB2AESCCM\x00"), []byte("ServerIn \x00"), bits)
+	decryptionKey = KDF(sessionKey, []byte("SMB2AESCCM\x00"), []byte("ServerOut\x00"), bits)
+	return
+}
+
+// 根据加密算法构造AEAD，CCM使用11字节nonce，GCM使用12字节nonce
+func newAEAD(cipherId uint16, key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	switch cipherId {
+	case SMB2_ENCRYPTION_AES128_CCM, SMB2_ENCRYPTION_AES256_CCM:
+		return newCCM(block, 11, 16), nil
+	case SMB2_ENCRYPTION_AES128_GCM, SMB2_ENCRYPTION_AES256_GCM:
+		return cipher.NewGCM(block)
+	default:
+		return nil, errors.New("Unsupported encryption algorithm")
+	}
+}
+
+// 将SMB2消息加密并封装为TRANSFORM_HEADER
+func Encrypt(cipherId uint16, key []byte, sessionId uint64, pkt []byte) ([]byte, error) {
+	aead, err := newAEAD(cipherId, key)
+	if err != nil {
+		return nil, err
+	}
+	ret := make([]byte, SMB2TransformHeaderSize, SMB2TransformHeaderSize+len(pkt))
+	copy(ret, ProtocolSMB2Transform)
+	nonce := ret[transformNonceOffset : transformNonceOffset+aead.NonceSize()]
+	if _, err = rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	binary.LittleEndian.PutUint32(ret[transformSizeOffset:], uint32(len(pkt)))
+	binary.LittleEndian.PutUint16(ret[transformFlagsOffset:], SMB2_TRANSFORM_FLAG_ENCRYPTED)
+	binary.LittleEndian.PutUint64(ret[transformSessionIdOffset:], sessionId)
+	// 附加数据为nonce开始到头部结束的32字节
+	sealed := aead.Seal(nil, nonce, pkt, ret[transformNonceOffset:SMB2TransformHeaderSize])
+	tagOffset := len(sealed) - aead.Overhead()
+	copy(ret[transformSignatureOffset:transformNonceOffset], sealed[tagOffset:])
+	return append(ret, sealed[:tagOffset]...), nil
+}
+
+// 解密TRANSFORM_HEADER封装的消息，返回原始SMB2消息
+func Decrypt(cipherId uint16, key []byte, pkt []byte) ([]byte, error) {
+	if !IsTransform(pkt) {
+		return nil, errors.New("Not a SMB2 transform packet")
+	}
+	aead, err := newAEAD(cipherId, key)
+	if err != nil {
+		return nil, err
+	}
+	size := binary.LittleEndian.Uint32(pkt[transformSizeOffset:])
+	if int(size) != len(pkt)-SMB2TransformHeaderSize {
+		return nil, errors.New("Invalid transform header message size")
+	}
+	nonce := pkt[transformNonceOffset : transformNonceOffset+aead.NonceSize()]
+	data := make([]byte, 0, len(pkt)-SMB2TransformHeaderSize+aead.Overhead())
+	data = append(data, pkt[SMB2TransformHeaderSize:]...)
+	data = append(data, pkt[transformSignatureOffset:transformNonceOffset]...)
+	ret, err := aead.Open(nil, nonce, data, pkt[transformNonceOffset:SMB2TransformHeaderSize])
+	if err != nil {
+		return nil, ErrDecryptFailed
+	}
+	return ret, nil
+}
+
+// AES-CCM，遵循RFC-3610标准，标准库未提供
+type ccm struct {
+	block     cipher.Block
+	nonceSize int
+	tagSize   int
+}
+
+func newCCM(block cipher.Block, nonceSize, tagSize int) cipher.AEAD {
+	return &ccm{block: block, nonceSize: nonceSize, tagSize: tagSize}
+}
+
+func (c *ccm) NonceSize() int {
+	return c.nonceSize
+}
+
+func (c *ccm) Overhead() int {
+	return c.tagSize
+}
+
+// 计数器块：flags为L-1，随后为nonce和L字节计数器
+func (c *ccm) counter(nonce []byte, i uint32) []byte {
+	ctr := make([]byte, aes.BlockSize)
+	ctr[0] = byte(14 - c.nonceSize)
+	copy(ctr[1:], nonce)
+	for j := aes.BlockSize - 1; j > c.nonceSize && i > 0; j-- {
+		ctr[j] = byte(i)
+		i >>= 8
+	}
+	return ctr
+}
+
+// CBC-MAC，对B0、附加数据以及明文计算认证值
+func (c *ccm) mac(nonce, plaintext, additionalData []byte) []byte {
+	l := 15 - c.nonceSize
+	b0 := make([]byte, aes.BlockSize)
+	b0[0] = byte((c.tagSize-2)/2<<3 | (l - 1))
+	if len(additionalData) > 0 {
+		b0[0] |= 0x40
+	}
+	copy(b0[1:], nonce)
+	n := uint64(len(plaintext))
+	for j := aes.BlockSize - 1; j > c.nonceSize; j-- {
+		b0[j] = byte(n)
+		n >>= 8
+	}
+
+	x := make([]byte, aes.BlockSize)
+	c.block.Encrypt(x, b0)
+	update := func(data []byte) {
+		for len(data) > 0 {
+			k := aes.BlockSize
+			if len(data) < k {
+				k = len(data)
+			}
+			for j := 0; j < k; j++ {
+				x[j] ^= data[j]
+			}
+			c.block.Encrypt(x, x)
+			data = data[k:]
+		}
+	}
+	if len(additionalData) > 0 {
+		// SMB附加数据长度固定为32字节，仅需两字节长度编码
+		aad := make([]byte, 2, 2+len(additionalData))
+		binary.BigEndian.PutUint16(aad, uint16(len(additionalData)))
+		update(append(aad, additionalData...))
+	}
+	update(plaintext)
+	return x[:c.tagSize]
+}
+
+// CTR模式加解密，计数器从1开始
+func (c *ccm) ctr(nonce, dst, src []byte) {
+	ks := make([]byte, aes.BlockSize)
+	for i := 0; len(src) > 0; i++ {
+		c.block.Encrypt(ks, c.counter(nonce, uint32(i+1)))
+		k := aes.BlockSize
+		if len(src) < k {
+			k = len(src)
+		}
+		for j := 0; j < k; j++ {
+			dst[j] = src[j] ^ ks[j]
+		}
+		dst, src = dst[k:], src[k:]
+	}
+}
+
+// 计算认证标签，T异或S0
+func (c *ccm) tag(nonce, plaintext, additionalData []byte) []byte {
+	t := c.mac(nonce, plaintext, additionalData)
+	s0 := make([]byte, aes.BlockSize)
+	c.block.Encrypt(s0, c.counter(nonce, 0))
+	for j := range t {
+		t[j] ^= s0[j]
+	}
+	return t
+}
+
+func (c *ccm) Seal(dst, nonce, plaintext, additionalData []byte) []byte {
+	if len(nonce) != c.nonceSize {
+		panic("ccm: incorrect nonce length")
+	}
+	out := make([]byte, len(plaintext)+c.tagSize)
+	c.ctr(nonce, out, plaintext)
+	copy(out[len(plaintext):], c.tag(nonce, plaintext, additionalData))
+	return append(dst, out...)
+}
+
+func (c *ccm) Open(dst, nonce, ciphertext, additionalData []byte) ([]byte, error) {
+	if len(nonce) != c.nonceSize {
+		return nil, errors.New("ccm: incorrect nonce length")
+	}
+	if len(ciphertext) < c.tagSize {
+		return nil, errors.New("ccm: ciphertext too short")
+	}
+	n := len(ciphertext) - c.tagSize
+	plaintext := make([]byte, n)
+	c.ctr(nonce, plaintext, ciphertext[:n])
+	if subtle.ConstantTimeCompare(c.tag(nonce, plaintext, additionalData), ciphertext[n:]) != 1 {
+		return nil, errors.New("ccm: message authentication failed")
+	}
+	return append(dst, plaintext...), nil
+}
@@ -0,0 +1,132 @@
+package smb
+
+import (
+	"bytes"
+	"crypto/aes"
+	"encoding/binary"
+	"errors"
+	"testing"
+)
+
+// AES-CCM取自RFC-3610第8节与NIST SP800-38C附录C，AES-GCM取自GCM规范的测试用例
+// 加密密钥派生结果使用OpenSSL的KBKDF独立计算
+
+func TestAESCCM(t *testing.T) {
+	tests := []struct {
+		name, key, nonce, aad, plain, sealed string
+	}{
+		{"RFC3610 packet 1", "c0c1c2c3c4c5c6c7c8c9cacbcccdcecf", "00000003020100a0a1a2a3a4a5", "0001020304050607",
+			"08090a0b0c0d0e0f101112131415161718191a1b1c1d1e",
+			"588c979a61c663d2f066d0c2c0f989806d5f6b61dac384 17e8d12cfdf926e0"},
+		{"RFC3610 packet 2", "c0c1c2c3c4c5c6c7c8c9cacbcccdcecf", "00000004030201a0a1a2a3a4a5", "0001020304050607",
+			"08090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f",
+			"72c91a36e135f8cf291ca894085c87e3cc15c439c9e43a3b a091d56e10400916"},
+		{"RFC3610 packet 3", "c0c1c2c3c4c5c6c7c8c9cacbcccdcecf", "00000005040302a0a1a2a3a4a5", "0001020304050607",
+			"08090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f20",
+			"51b1e5f44a197d1da46b0f8e2d282ae871e838bb64da859657 4adaa76fbd9fb0c5"},
+		{"SP800-38C example 1", "404142434445464748494a4b4c4d4e4f", "10111213141516", "0001020304050607",
+			"20212223", "7162015b 4dac255d"},
+		{"SP800-38C example 2", "404142434445464748494a4b4c4d4e4f", "1011121314151617", "000102030405060708090a0b0c0d0e0f",
+			"202122232425262728292a2b2c2d2e2f", "d2a1f0e051ea5f62081a7792073d593d 1fc64fbfaccd"},
+		{"SP800-38C example 3", "404142434445464748494a4b4c4d4e4f", "101112131415161718191a1b", "000102030405060708090a0b0c0d0e0f10111213",
+			"202122232425262728292a2b2c2d2e2f3031323334353637", "e3b201a9f5b71a7a9b1ceaeccd97e70b6176aad9a4428aa5 484392fbc1b09951"},
+	}
+	for _, tt := range tests {
+		block, err := aes.NewCipher(unhex(t, tt.key))
+		if err != nil {
+			t.Fatal(err)
+		}
+		nonce, aad, plain, sealed := unhex(t, tt.nonce), unhex(t, tt.aad), unhex(t, tt.plain), unhex(t, tt.sealed)
+		aead := newCCM(block, len(nonce), len(sealed)-len(plain))
+		if got := aead.Seal(nil, nonce, plain, aad); !bytes.Equal(got, sealed) {
+			t.Fatalf("%s: Seal = %x, want %x", tt.name, got, sealed)
+		}
+		got, err := aead.Open(nil, nonce, sealed, aad)
+		if err != nil || !bytes.Equal(got, plain) {
+			t.Fatalf("%s: Open = %x, %v", tt.name, got, err)
+		}
+		sealed[0] ^= 1
+		if _, err = aead.Open(nil, nonce, sealed, aad); err == nil {
+			t.Fatalf("%s: tampered ciphertext accepted", tt.name)
+		}
+	}
+}
+
+func TestAESGCM(t *testing.T) {
+	tests := []struct {
+		name, key, nonce, aad, plain, sealed string
+	}{
+		{"test case 2", "00000000000000000000000000000000", "000000000000000000000000", "",
+			"00000000000000000000000000000000",
+			"0388dace60b6a392f328c2b971b2fe78 ab6e47d42cec13bdf53a67b21257bddf"},
+		{"test case 4", "feffe9928665731c6d6a8f9467308308", "cafebabefacedbaddecaf888", "feedfacedeadbeeffeedfacedeadbeefabaddad2",
+			"d9313225f88406e5a55909c5aff5269a86a7a9531534f7da2e4c303d8a318a721c3c0c95956809532fcf0e2449a6b525b16aedf5aa0de657ba637b39",
+			"42831ec2217774244b7221b784d0d49ce3aa212f2c02a4e035c17e2329aca12e21d514b25466931c7d8f6a5aac84aa051ba30b396a0aac973d58e091 5bc94fbc3221a5db94fae95ae7121a47"},
+	}
+	for _, tt := range tests {
+		aead, err := newAEAD(SMB2_ENCRYPTION_AES128_GCM, unhex(t, tt.key))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := aead.Seal(nil, unhex(t, tt.nonce), unhex(t, tt.plain), unhex(t, tt.aad)); !bytes.Equal(got, unhex(t, tt.sealed)) {
+			t.Fatalf("%s: Seal = %x, want %s", tt.name, got, tt.sealed)
+		}
+	}
+}
+
+func TestDeriveEncryptionKeys(t *testing.T) {
+	sessionKey := unhex(t, "7cd451825d0450d235424e44ba6e78cc 0102030405060708090a0b0c0d0e0f10")
+	preauthHash := make([]byte, 64)
+	for i := range preauthHash {
+		preauthHash[i] = byte(i)
+	}
+	tests := []struct {
+		dialect, cipherId uint16
+		enc, dec          string
+	}{
+		{SMB3_0_Dialect, SMB2_ENCRYPTION_AES128_CCM, "fad27796665b313ebb578f388632b4f7", "b0f0427f7ceb416d1d9dcc0cd4f99447"},
+		{SMB3_1_1_Dialect, SMB2_ENCRYPTION_AES128_GCM, "ec71a7af46945738828ea0c165348db2", "0406ab75a19f43ac23751449321abcfc"},
+		{SMB3_1_1_Dialect, SMB2_ENCRYPTION_AES256_GCM,
+			"6ac66f1797b60c65134aa34293ea0afbdef4d3b94dbd29ac0d3db24a159e1215",
+			"b7baa15cec80a0903aa7aa4339bf16449a478883baafbd46f3fa2ac032dd6d19"},
+	}
+	for _, tt := range tests {
+		enc, dec := DeriveEncryptionKeys(tt.dialect, tt.cipherId, sessionKey, preauthHash)
+		if !bytes.Equal(enc, unhex(t, tt.enc)) || !bytes.Equal(dec, unhex(t, tt.dec)) {
+			t.Fatalf("DeriveEncryptionKeys(0x%04x, %d) = %x, %x", tt.dialect, tt.cipherId, enc, dec)
+		}
+	}
+}
+
+// 各加密算法的TRANSFORM_HEADER封装与解封装，篡改头部或密文后解密失败
+func TestTransformRoundTrip(t *testing.T) {
+	pkt := unhex(t, testSignedPacket)
+	for _, cipherId := range []uint16{SMB2_ENCRYPTION_AES128_CCM, SMB2_ENCRYPTION_AES128_GCM, SMB2_ENCRYPTION_AES256_CCM, SMB2_ENCRYPTION_AES256_GCM} {
+		key := make([]byte, 16)
+		if cipherId == SMB2_ENCRYPTION_AES256_CCM || cipherId == SMB2_ENCRYPTION_AES256_GCM {
+			key = make([]byte, 32)
+		}
+		for i := range key {
+			key[i] = byte(i)
+		}
+		enc, err := Encrypt(cipherId, key, 0x0000100000000011, pkt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !IsTransform(enc) || TransformSessionId(enc) != 0x0000100000000011 ||
+			binary.LittleEndian.Uint32(enc[transformSizeOffset:]) != uint32(len(pkt)) {
+			t.Fatalf("cipher %d: invalid transform header %x", cipherId, enc[:SMB2TransformHeaderSize])
+		}
+		dec, err := Decrypt(cipherId, key, enc)
+		if err != nil || !bytes.Equal(dec, pkt) {
+			t.Fatalf("cipher %d: Decrypt = %x, %v", cipherId, dec, err)
+		}
+		for _, off := range []int{transformSessionIdOffset, SMB2TransformHeaderSize} {
+			tampered := append([]byte(nil), enc...)
+			tampered[off] ^= 1
+			if _, err = Decrypt(cipherId, key, tampered); !errors.Is(err, ErrDecryptFailed) {
+				t.Fatalf("cipher %d: tampered byte %d error = %v", cipherId, off, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package smb
+
+// 此文件提供NetBIOS会话消息分帧以及SMB2复合消息的拆分与拼接
+// https://docs.microsoft.com/en-us/openspecs/windows_protocols/ms-smb2/1dfacde4-b5c7-4494-8a14-a09d3ab4cc83
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+const (
+	NetBIOSSessionMessage   = 0x00
+	NetBIOSSessionKeepAlive = 0x85
+	// 直接TCP传输的长度字段为24位
+	MaxMessageSize        = 0x00ffffff
+	smb2NextCommandOffset = 20
+)
+
+// 读取一条完整的会话消息，跳过保活消息
+func ReadMessage(r io.Reader) ([]byte, error) {
+	header := make([]byte, 4)
+	for {
+		if _, err := io.ReadFull(r, header); err != nil {
+			return nil, err
+		}
+		length := binary.BigEndian.Uint32(header) & MaxMessageSize
+		switch header[0] {
+		case NetBIOSSessionMessage:
+			buf := make([]byte, length)
+			if _, err := io.ReadFull(r, buf); err != nil {
+				return nil, err
+			}
+			return buf, nil
+		case NetBIOSSessionKeepAlive:
+			if _, err := io.CopyN(io.Discard, r, int64(length)); err != nil {
+				return nil, err
+			}
+		default:
+			return nil, fmt.Errorf("Unexpected NetBIOS session packet type 0x%02x", header[0])
+		}
+	}
+}
+
+// 写入一条会话消息，前置4字节长度
+func WriteMessage(w io.Writer, body []byte) error {
+	if len(body) > MaxMessageSize {
+		return errors.New("SMB message too large")
+	}
+	buf := make([]byte, 4, 4+len(body))
+	binary.BigEndian.PutUint32(buf, uint32(len(body)))
+	_, err := w.Write(append(buf, body...))
+	return err
+}
+
+func HeaderNextCommand(pkt []byte) uint32 {
+	return binary.LittleEndian.Uint32(pkt[smb2NextCommandOffset:])
+}
+
+// 复合请求中各请求的MessageId需连续，序列化后统一改写
+func SetHeaderMessageId(pkt []byte, messageId uint64) {
+	binary.LittleEndian.PutUint64(pkt[smb2MessageIdOffset:], messageId)
+}
+
+// 按NextCommand拆分复合消息，每个元素包含其后的填充字节，便于逐个校验签名
+func SplitCompound(pkt []byte) ([][]byte, error) {
+	if !IsSMB2(pkt) {
+		return [][]byte{pkt}, nil
+	}
+	var ret [][]byte
+	for {
+		if len(pkt) < SMB2HeaderSize {
+			return nil, errors.New("Truncated compound SMB2 message")
+		}
+		next := HeaderNextCommand(pkt)
+		if next == 0 {
+			return append(ret, pkt), nil
+		}
+		if next%8 != 0 || next < SMB2HeaderSize || int(next) > len(pkt) {
+			return nil, errors.New("Invalid NextCommand in compound SMB2 message")
+		}
+		ret = append(ret, pkt[:next])
+		pkt = pkt[next:]
+	}
+}
+
+// 拼接复合请求，除最后一个外每个请求填充到8字节对齐并写入NextCommand
+// 返回拼接结果以及各请求在其中的切片，签名需在拼接之后进行
+func JoinCompound(pkts [][]byte) ([]byte, [][]byte) {
+	var buf []byte
+	offsets := make([]int, 0, len(pkts)+1)
+	for i, pkt := range pkts {
+		offsets = append(offsets, len(buf))
+		buf = append(buf, pkt...)
+		if i == len(pkts)-1 {
+			break
+		}
+		buf = append(buf, make([]byte, Pad8(len(pkt)))...)
+		binary.LittleEndian.PutUint32(buf[offsets[i]+smb2NextCommandOffset:], uint32(len(buf)-offsets[i]))
+	}
+	offsets = append(offsets, len(buf))
+	parts := make([][]byte, len(pkts))
+	for i := range pkts {
+		parts[i] = buf[offsets[i]:offsets[i+1]]
+	}
+	return buf, parts
+}
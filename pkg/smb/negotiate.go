@@ -0,0 +1,169 @@
+package smb
+
+import (
+	"crypto/sha512"
+	"encoding/binary"
+	"errors"
+
+	"github.com/4ra1n/go-impacket/pkg/encoder"
+)
+
+// 此文件定义SMB3.1.1协商上下文以及预认证完整性
+// https://docs.microsoft.com/en-us/openspecs/windows_protocols/ms-smb2/15332256-522e-4a53-8cd7-0bd17678a2f7
+
+// Capabilities属性
+const (
+	SMB2_GLOBAL_CAP_DFS                = 0x00000001
+	SMB2_GLOBAL_CAP_LEASING            = 0x00000002
+	SMB2_GLOBAL_CAP_LARGE_MTU          = 0x00000004
+	SMB2_GLOBAL_CAP_MULTI_CHANNEL      = 0x00000008
+	SMB2_GLOBAL_CAP_PERSISTENT_HANDLES = 0x00000010
+	SMB2_GLOBAL_CAP_DIRECTORY_LEASING  = 0x00000020
+	SMB2_GLOBAL_CAP_ENCRYPTION         = 0x00000040
+)
+
+// ContextType属性
+const (
+	SMB2_PREAUTH_INTEGRITY_CAPABILITIES = 0x0001
+	SMB2_ENCRYPTION_CAPABILITIES        = 0x0002
+	SMB2_COMPRESSION_CAPABILITIES       = 0x0003
+	SMB2_NETNAME_NEGOTIATE_CONTEXT_ID   = 0x0005
+	SMB2_TRANSPORT_CAPABILITIES         = 0x0006
+	SMB2_RDMA_TRANSFORM_CAPABILITIES    = 0x0007
+	SMB2_SIGNING_CAPABILITIES           = 0x0008
+)
+
+// 预认证完整性哈希算法
+const (
+	SMB2_PREAUTH_INTEGRITY_SHA512 = 0x0001
+)
+
+// 加密算法
+const (
+	SMB2_ENCRYPTION_AES128_CCM = 0x0001
+	SMB2_ENCRYPTION_AES128_GCM = 0x0002
+	SMB2_ENCRYPTION_AES256_CCM = 0x0003
+	SMB2_ENCRYPTION_AES256_GCM = 0x0004
+)
+
+// 签名算法
+const (
+	SMB2_SIGNING_HMAC_SHA256 = 0x0000
+	SMB2_SIGNING_AES_CMAC    = 0x0001
+	SMB2_SIGNING_AES_GMAC    = 0x0002
+)
+
+// 协商上下文通用结构，每个上下文需按8字节对齐
+type NegotiateContextStruct struct {
+	ContextType uint16
+	DataLength  uint16 `smb:"len:Data"`
+	Reserved    uint32
+	Data        []byte
+}
+
+// https://docs.microsoft.com/en-us/openspecs/windows_protocols/ms-smb2/5a07bd66-4734-4af8-abcf-5a44ff7ee0e5
+type PreauthIntegrityCapabilitiesStruct struct {
+	HashAlgorithmCount uint16
+	SaltLength         uint16 `smb:"len:Salt"`
+	HashAlgorithms     []uint16
+	Salt               []byte
+}
+
+// https://docs.microsoft.com/en-us/openspecs/windows_protocols/ms-smb2/16693be7-2b27-4d3b-804b-f605bde5bcdd
+type EncryptionCapabilitiesStruct struct {
+	CipherCount uint16
+	Ciphers     []uint16
+}
+
+// https://docs.microsoft.com/en-us/openspecs/windows_protocols/ms-smb2/cb9b5d66-b6be-4d18-aa66-8784a871cc10
+type SigningCapabilitiesStruct struct {
+	SigningAlgorithmCount uint16
+	SigningAlgorithms     []uint16
+}
+
+// 构造协商上下文
+func NewNegotiateContext(contextType uint16, data interface{}) (NegotiateContextStruct, error) {
+	buf, err := encoder.Marshal(data)
+	if err != nil {
+		return NegotiateContextStruct{}, err
+	}
+	return NegotiateContextStruct{
+		ContextType: contextType,
+		Data:        buf,
+	}, nil
+}
+
+// 序列化协商上下文列表，上下文之间填充至8字节对齐
+func MarshalNegotiateContexts(contexts []NegotiateContextStruct) ([]byte, error) {
+	var ret []byte
+	for i, ctx := range contexts {
+		buf, err := encoder.Marshal(ctx)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, buf...)
+		if i != len(contexts)-1 {
+			ret = append(ret, make([]byte, Pad8(len(ret)))...)
+		}
+	}
+	return ret, nil
+}
+
+// 从协商响应中解析协商上下文，offset为相对SMB2头的偏移量
+func ParseNegotiateContexts(pkt []byte, offset uint32, count uint16) ([]NegotiateContextStruct, error) {
+	var ret []NegotiateContextStruct
+	pos := int(offset)
+	for i := 0; i < int(count); i++ {
+		if pos+8 > len(pkt) {
+			return nil, errors.New("Negotiate context out of range")
+		}
+		ctx := NegotiateContextStruct{
+			ContextType: binary.LittleEndian.Uint16(pkt[pos:]),
+			DataLength:  binary.LittleEndian.Uint16(pkt[pos+2:]),
+			Reserved:    binary.LittleEndian.Uint32(pkt[pos+4:]),
+		}
+		end := pos + 8 + int(ctx.DataLength)
+		if end > len(pkt) {
+			return nil, errors.New("Negotiate context data out of range")
+		}
+		ctx.Data = pkt[pos+8 : end]
+		ret = append(ret, ctx)
+		pos = end + Pad8(end-int(offset))
+	}
+	return ret, nil
+}
+
+// 读取上下文中首个算法标识，服务端响应中只会返回一个被选中的算法
+// 预认证上下文数据以HashAlgorithmCount、SaltLength开头，其余上下文以数量开头
+func (n NegotiateContextStruct) SelectedAlgorithm() (uint16, error) {
+	skip := 2
+	if n.ContextType == SMB2_PREAUTH_INTEGRITY_CAPABILITIES {
+		skip = 4
+	}
+	if len(n.Data) < skip+2 || binary.LittleEndian.Uint16(n.Data) == 0 {
+		return 0, errors.New("Negotiate context does not contain an algorithm")
+	}
+	return binary.LittleEndian.Uint16(n.Data[skip:]), nil
+}
+
+// 计算对齐到8字节需要填充的长度
+func Pad8(n int) int {
+	return (8 - n%8) % 8
+}
+
+// 预认证完整性哈希 H = SHA512(H || message)
+// https://docs.microsoft.com/en-us/openspecs/windows_protocols/ms-smb2/5ba46a6c-9a6e-4c1a-ab7b-0e5b2e8ce80b
+func PreauthHash(prev, pkt []byte) []byte {
+	h := sha512.New()
+	h.Write(prev)
+	h.Write(pkt)
+	return h.Sum(nil)
+}
+
+// 未协商签名算法时按协议版本选择默认算法
+func DefaultSigningAlgorithm(dialect uint16) uint16 {
+	if dialect >= SMB3_0_Dialect {
+		return SMB2_SIGNING_AES_CMAC
+	}
+	return SMB2_SIGNING_HMAC_SHA256
+}
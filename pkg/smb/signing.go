@@ -0,0 +1,242 @@
+package smb
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+)
+
+// 此文件提供SMB2/SMB3消息签名
+// https://docs.microsoft.com/en-us/openspecs/windows_protocols/ms-smb2/a3e9c0fd-5b9d-4ef3-93f3-49db2b3b3c6a
+
+// SMB2 Flags属性
+const (
+	SMB2_FLAGS_SERVER_TO_REDIR    = 0x00000001
+	SMB2_FLAGS_ASYNC_COMMAND      = 0x00000002
+	SMB2_FLAGS_RELATED_OPERATIONS = 0x00000004
+	SMB2_FLAGS_SIGNED             = 0x00000008
+	SMB2_FLAGS_PRIORITY_MASK      = 0x00000070
+	SMB2_FLAGS_DFS_OPERATIONS     = 0x10000000
+	SMB2_FLAGS_REPLAY_OPERATION   = 0x20000000
+)
+
+// SessionSetup响应SessionFlags属性
+const (
+	SMB2_SESSION_FLAG_IS_GUEST     = 0x0001
+	SMB2_SESSION_FLAG_IS_NULL      = 0x0002
+	SMB2_SESSION_FLAG_ENCRYPT_DATA = 0x0004
+)
+
+// SMB2头中各字段的偏移量，签名时直接操作序列化后的数据
+const (
+	SMB2HeaderSize      = 64
+	smb2StatusOffset    = 8
+	smb2CommandOffset   = 12
+	smb2FlagsOffset     = 16
+	smb2MessageIdOffset = 24
+	smb2SessionIdOffset = 40
+	smb2SignatureOffset = 48
+)
+
+var ErrInvalidSignature = errors.New("SMB2 message signature verification failed")
+
+// 判断是否为SMB2数据包
+func IsSMB2(pkt []byte) bool {
+	return len(pkt) >= SMB2HeaderSize && string(pkt[:4]) == ProtocolSMB2
+}
+
+// SP800-108 计数器模式密钥派生，PRF为HMAC-SHA256
+// https://docs.microsoft.com/en-us/openspecs/windows_protocols/ms-smb2/7fd079ca-17e6-4f02-8449-46b606ea289c
+func KDF(key, label, context []byte, bits int) []byte {
+	h := hmac.New(sha256.New, key)
+	buf := make([]byte, 4)
+	binary.BigEndian.PutUint32(buf, 1)
+	h.Write(buf)
+	h.Write(label)
+	h.Write([]byte{0})
+	h.Write(context)
+	binary.BigEndian.PutUint32(buf, uint32(bits))
+	h.Write(buf)
+	return h.Sum(nil)[:bits/8]
+}
+
+// 根据协议版本派生签名密钥，SMB2.x直接使用会话密钥
+// 会话密钥超过16字节时(如Kerberos AES256)只取前16字节
+func DeriveSigningKey(dialect uint16, sessionKey, preauthHash []byte) []byte {
+	if len(sessionKey) > 16 {
+		sessionKey = sessionKey[:16]
+	}
+	switch {
+	case dialect >= SMB3_1_1_Dialect:
+		return KDF(sessionKey, []byte("SMBSigningKey\x00"), preauthHash, 128)
+	case dialect >= SMB3_0_Dialect:
+		return KDF(sessionKey, []byte("SMB2AESCMAC\x00"), []byte("SmbSign\x00"), 128)
+	default:
+		key := make([]byte, 16)
+		copy(key, sessionKey)
+		return key
+	}
+}
+
+// AES-CMAC，遵循RFC-4493标准
+func AESCMAC(key, msg []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	k1 := make([]byte, aes.BlockSize)
+	block.Encrypt(k1, k1)
+	k1 = cmacDouble(k1)
+	k2 := cmacDouble(k1)
+
+	n := (len(msg) + aes.BlockSize - 1) / aes.BlockSize
+	complete := n > 0 && len(msg)%aes.BlockSize == 0
+	if n == 0 {
+		n = 1
+	}
+	last := make([]byte, aes.BlockSize)
+	if complete {
+		copy(last, msg[(n-1)*aes.BlockSize:])
+		for i := range last {
+			last[i] ^= k1[i]
+		}
+	} else {
+		rest := msg[(n-1)*aes.BlockSize:]
+		copy(last, rest)
+		last[len(rest)] = 0x80
+		for i := range last {
+			last[i] ^= k2[i]
+		}
+	}
+
+	x := make([]byte, aes.BlockSize)
+	for i := 0; i < n-1; i++ {
+		for j := 0; j < aes.BlockSize; j++ {
+			x[j] ^= msg[i*aes.BlockSize+j]
+		}
+		block.Encrypt(x, x)
+	}
+	for j := range x {
+		x[j] ^= last[j]
+	}
+	block.Encrypt(x, x)
+	return x, nil
+}
+
+// CMAC子密钥生成，左移一位并按需异或Rb
+func cmacDouble(in []byte) []byte {
+	out := make([]byte, len(in))
+	var carry byte
+	for i := len(in) - 1; i >= 0; i-- {
+		out[i] = in[i]<<1 | carry
+		carry = in[i] >> 7
+	}
+	if carry != 0 {
+		out[len(out)-1] ^= 0x87
+	}
+	return out
+}
+
+// AES-GMAC，nonce由MessageId、消息方向以及是否为CANCEL命令组成
+// https://docs.microsoft.com/en-us/openspecs/windows_protocols/ms-smb2/a3e9c0fd-5b9d-4ef3-93f3-49db2b3b3c6a
+func AESGMAC(key, pkt []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	copy(nonce, pkt[smb2MessageIdOffset:smb2MessageIdOffset+8])
+	if HeaderFlags(pkt)&SMB2_FLAGS_SERVER_TO_REDIR != 0 {
+		nonce[8] |= 0x01
+	}
+	if HeaderCommand(pkt) == SMB2_CANCEL {
+		nonce[8] |= 0x02
+	}
+	return aead.Seal(nil, nonce, nil, pkt), nil
+}
+
+// 计算签名，pkt中的签名字段需已清零
+func computeSignature(algorithm uint16, key, pkt []byte) ([]byte, error) {
+	switch algorithm {
+	case SMB2_SIGNING_AES_CMAC:
+		return AESCMAC(key, pkt)
+	case SMB2_SIGNING_AES_GMAC:
+		return AESGMAC(key, pkt)
+	case SMB2_SIGNING_HMAC_SHA256:
+		h := hmac.New(sha256.New, key)
+		h.Write(pkt)
+		return h.Sum(nil)[:16], nil
+	default:
+		return nil, errors.New("Unsupported signing algorithm")
+	}
+}
+
+// 对单个SMB2消息签名，直接修改pkt
+func Sign(algorithm uint16, key, pkt []byte) error {
+	if !IsSMB2(pkt) {
+		return errors.New("Not a SMB2 packet")
+	}
+	flags := binary.LittleEndian.Uint32(pkt[smb2FlagsOffset:])
+	binary.LittleEndian.PutUint32(pkt[smb2FlagsOffset:], flags|SMB2_FLAGS_SIGNED)
+	sig := pkt[smb2SignatureOffset : smb2SignatureOffset+16]
+	for i := range sig {
+		sig[i] = 0
+	}
+	signature, err := computeSignature(algorithm, key, pkt)
+	if err != nil {
+		return err
+	}
+	copy(sig, signature)
+	return nil
+}
+
+// 校验单个SMB2消息签名，不修改pkt
+func Verify(algorithm uint16, key, pkt []byte) error {
+	if !IsSMB2(pkt) {
+		return errors.New("Not a SMB2 packet")
+	}
+	tmp := make([]byte, len(pkt))
+	copy(tmp, pkt)
+	expected := make([]byte, 16)
+	copy(expected, tmp[smb2SignatureOffset:])
+	for i := smb2SignatureOffset; i < smb2SignatureOffset+16; i++ {
+		tmp[i] = 0
+	}
+	signature, err := computeSignature(algorithm, key, tmp)
+	if err != nil {
+		return err
+	}
+	if subtle.ConstantTimeCompare(signature, expected) != 1 {
+		return ErrInvalidSignature
+	}
+	return nil
+}
+
+// 读取SMB2头部字段
+func HeaderCommand(pkt []byte) uint16 {
+	return binary.LittleEndian.Uint16(pkt[smb2CommandOffset:])
+}
+
+func HeaderFlags(pkt []byte) uint32 {
+	return binary.LittleEndian.Uint32(pkt[smb2FlagsOffset:])
+}
+
+func HeaderStatus(pkt []byte) uint32 {
+	return binary.LittleEndian.Uint32(pkt[smb2StatusOffset:])
+}
+
+func HeaderMessageId(pkt []byte) uint64 {
+	return binary.LittleEndian.Uint64(pkt[smb2MessageIdOffset:])
+}
+
+func HeaderSessionId(pkt []byte) uint64 {
+	return binary.LittleEndian.Uint64(pkt[smb2SessionIdOffset:])
+}
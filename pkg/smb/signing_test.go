@@ -0,0 +1,154 @@
+package smb
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"testing"
+)
+
+// AES-CMAC、HMAC-SHA256取自RFC-4493、RFC-4231，SMB3.0签名密钥取自微软公布的示例
+// 其余密钥派生与签名结果使用OpenSSL的KBKDF、CMAC、GMAC、HMAC独立计算
+
+func unhex(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(strings.Join(strings.Fields(s), ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+const rfc4493Message = `6bc1bee22e409f96e93d7e117393172a ae2d8a571e03ac9c9eb76fac45af8e51
+	30c81c46a35ce411e5fbc1191a0a52ef f69f2445df4f9b17ad2b417be66c3710`
+
+func TestAESCMAC(t *testing.T) {
+	key := unhex(t, "2b7e151628aed2a6abf7158809cf4f3c")
+	msg := unhex(t, rfc4493Message)
+	tests := []struct {
+		n   int
+		mac string
+	}{
+		{0, "bb1d6929e95937287fa37d129b756746"},
+		{16, "070a16b46b4d4144f79bdd9dd04a287c"},
+		{40, "dfa66747de9ae63030ca32611497c827"},
+		{64, "51f0bebf7e3b9d92fc49741779363cfe"},
+	}
+	for _, tt := range tests {
+		mac, err := AESCMAC(key, msg[:tt.n])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(mac, unhex(t, tt.mac)) {
+			t.Fatalf("AES-CMAC of %d bytes = %x, want %s", tt.n, mac, tt.mac)
+		}
+	}
+}
+
+// RFC-4493 2.3节的子密钥
+func TestCMACSubkeys(t *testing.T) {
+	k1 := cmacDouble(unhex(t, "7df76b0c1ab899b33e42f047b91b546f"))
+	if !bytes.Equal(k1, unhex(t, "fbeed618357133667c85e08f7236a8de")) {
+		t.Fatalf("K1 = %x", k1)
+	}
+	if k2 := cmacDouble(k1); !bytes.Equal(k2, unhex(t, "f7ddac306ae266ccf90bc11ee46d513b")) {
+		t.Fatalf("K2 = %x", k2)
+	}
+}
+
+func TestKDF(t *testing.T) {
+	sessionKey := unhex(t, "7cd451825d0450d235424e44ba6e78cc")
+	preauthHash := make([]byte, 64)
+	for i := range preauthHash {
+		preauthHash[i] = byte(i)
+	}
+	tests := []struct {
+		label, context string
+		want           string
+	}{
+		{"SMB2AESCMAC\x00", "SmbSign\x00", "0b7e9c5cac36c0f6ea9ab275298cedce"},
+		{"SMB2AESCCM\x00", "ServerIn \x00", "fad27796665b313ebb578f388632b4f7"},
+		{"SMBSigningKey\x00", string(preauthHash), "481642b8b0d9374628a7bc43f6def7b8"},
+		{"SMBC2SCipherKey\x00", string(preauthHash), "ec71a7af46945738828ea0c165348db2"},
+	}
+	for _, tt := range tests {
+		if got := KDF(sessionKey, []byte(tt.label), []byte(tt.context), 128); !bytes.Equal(got, unhex(t, tt.want)) {
+			t.Fatalf("KDF(%q) = %x, want %s", tt.label, got, tt.want)
+		}
+	}
+}
+
+func TestDeriveSigningKey(t *testing.T) {
+	// 超过16字节的会话密钥只取前16字节
+	sessionKey := unhex(t, "7cd451825d0450d235424e44ba6e78cc 0102030405060708 0102030405060708")
+	preauthHash := make([]byte, 64)
+	for i := range preauthHash {
+		preauthHash[i] = byte(i)
+	}
+	tests := []struct {
+		dialect uint16
+		want    string
+	}{
+		{SMB2_1_Dialect, "7cd451825d0450d235424e44ba6e78cc"},
+		{SMB3_0_Dialect, "0b7e9c5cac36c0f6ea9ab275298cedce"},
+		{SMB3_1_1_Dialect, "481642b8b0d9374628a7bc43f6def7b8"},
+	}
+	for _, tt := range tests {
+		if got := DeriveSigningKey(tt.dialect, sessionKey, preauthHash); !bytes.Equal(got, unhex(t, tt.want)) {
+			t.Fatalf("DeriveSigningKey(0x%04x) = %x, want %s", tt.dialect, got, tt.want)
+		}
+	}
+}
+
+// HMAC-SHA256签名截取前16字节
+func TestHMACSHA256Signature(t *testing.T) {
+	tests := []struct {
+		key, data, want string
+	}{
+		{"0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b", hex.EncodeToString([]byte("Hi There")), "b0344c61d8db38535ca8afceaf0bf12b"},
+		{hex.EncodeToString([]byte("Jefe")), hex.EncodeToString([]byte("what do ya want for nothing?")), "5bdcc146bf60754e6a042426089575c7"},
+	}
+	for _, tt := range tests {
+		got, err := computeSignature(SMB2_SIGNING_HMAC_SHA256, unhex(t, tt.key), unhex(t, tt.data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, unhex(t, tt.want)) {
+			t.Fatalf("HMAC-SHA256 = %x, want %s", got, tt.want)
+		}
+	}
+}
+
+// READ响应，MessageId为5，Flags已包含SERVER_TO_REDIR与SIGNED
+const testSignedPacket = `fe534d42400000000000000008000000 09000000000000000500000000000000
+	00000000000000001100000000100000 00000000000000000000000000000000
+	0001020304050607`
+
+func TestSignVerify(t *testing.T) {
+	tests := []struct {
+		algorithm uint16
+		key, want string
+	}{
+		{SMB2_SIGNING_HMAC_SHA256, "7cd451825d0450d235424e44ba6e78cc", "64f1547306f6a5417e1d16ac13adcc0e"},
+		{SMB2_SIGNING_AES_CMAC, "0b7e9c5cac36c0f6ea9ab275298cedce", "20fd3fcb98126ea8d92953c2f274b5f5"},
+		{SMB2_SIGNING_AES_GMAC, "0b7e9c5cac36c0f6ea9ab275298cedce", "6875dec8f574c9894ea7cba6a583dcb3"},
+	}
+	for _, tt := range tests {
+		pkt := unhex(t, testSignedPacket)
+		key := unhex(t, tt.key)
+		if err := Sign(tt.algorithm, key, pkt); err != nil {
+			t.Fatal(err)
+		}
+		if sig := pkt[smb2SignatureOffset : smb2SignatureOffset+16]; !bytes.Equal(sig, unhex(t, tt.want)) {
+			t.Fatalf("algorithm %d: signature %x, want %s", tt.algorithm, sig, tt.want)
+		}
+		if err := Verify(tt.algorithm, key, pkt); err != nil {
+			t.Fatalf("algorithm %d: %v", tt.algorithm, err)
+		}
+		pkt[len(pkt)-1] ^= 1
+		if err := Verify(tt.algorithm, key, pkt); !errors.Is(err, ErrInvalidSignature) {
+			t.Fatalf("algorithm %d: tampered packet error = %v", tt.algorithm, err)
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package smb2
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"github.com/4ra1n/go-impacket/pkg/encoder"
+	"github.com/4ra1n/go-impacket/pkg/ms"
+	"github.com/4ra1n/go-impacket/pkg/smb"
+)
+
+// 此文件用于smb2关闭文件句柄请求
+
+// Close请求Flags属性
+const (
+	SMB2_CLOSE_FLAG_POSTQUERY_ATTRIB = 0x0001
+)
+
+// https://docs.microsoft.com/en-us/openspecs/windows_protocols/ms-smb2/f84053b0-bcb2-4f85-9717-536dae2b02bd
+// 关闭请求结构
+type CloseRequestStruct struct {
+	smb.SMB2PacketStruct
+	StructureSize uint16 //2字节，必须设置24
+	Flags         uint16
+	Reserved      uint32
+	FileId        []byte `smb:"fixed:16"` //16字节，文件句柄
+}
+
+// https://docs.microsoft.com/en-us/openspecs/windows_protocols/ms-smb2/c0c15c57-3f3e-452b-b51c-9cc650a13f7b
+// 关闭响应结构
+type CloseResponseStruct struct {
+	smb.SMB2PacketStruct
+	StructureSize  uint16 //2字节，必须设置60
+	Flags          uint16
+	Reserved       uint32
+	CreationTime   uint64
+	LastAccessTime uint64
+	LastWriteTime  uint64
+	ChangeTime     uint64
+	AllocationSize uint64
+	EndofFile      uint64
+	FileAttributes uint32
+}
+
+func (c *Client) NewCloseRequest(treeId uint32, fileId []byte) CloseRequestStruct {
+	smb2Header := NewSMB2Packet()
+	smb2Header.Command = smb.SMB2_CLOSE
+	smb2Header.CreditCharge = 1
+	smb2Header.MessageId = c.GetMessageId()
+	smb2Header.SessionId = c.GetSessionId()
+	smb2Header.TreeId = treeId
+	smb2Header.CreditRequestResponse = 127
+	return CloseRequestStruct{
+		SMB2PacketStruct: smb2Header,
+		StructureSize:    24,
+		Flags:            0,
+		FileId:           fileId,
+	}
+}
+
+func NewCloseResponse() CloseResponseStruct {
+	smb2Header := NewSMB2Packet()
+	return CloseResponseStruct{
+		SMB2PacketStruct: smb2Header,
+	}
+}
+
+// 关闭文件句柄
+func (c *Client) CloseRequest(treeId uint32, fileId []byte) error {
+	return c.CloseRequestContext(context.Background(), treeId, fileId)
+}
+
+func (c *Client) CloseRequestContext(ctx context.Context, treeId uint32, fileId []byte) error {
+	c.Debug("Sending Close request", nil)
+	req := c.NewCloseRequest(treeId, fileId)
+	buf, err := c.SMBSendContext(ctx, req)
+	if err != nil {
+		c.Debug("", err)
+		return err
+	}
+	if status := smb.HeaderStatus(buf); status != ms.STATUS_SUCCESS {
+		return fmt.Errorf("Failed to close file: %w", ms.StatusError(status))
+	}
+	res := NewCloseResponse()
+	c.Debug("Unmarshalling Close response", nil)
+	if err = encoder.Unmarshal(buf, &res); err != nil {
+		c.Debug("Raw:\n"+hex.Dump(buf), err)
+		return err
+	}
+	c.Debug("Completed Close", nil)
+	return nil
+}
@@ -1,8 +1,9 @@
 package smb2
 
 import (
+	"context"
 	"encoding/hex"
-	"errors"
+	"fmt"
 	"github.com/4ra1n/go-impacket/pkg/encoder"
 	"github.com/4ra1n/go-impacket/pkg/ms"
 	"github.com/4ra1n/go-impacket/pkg/smb"
@@ -98,6 +99,7 @@ const (
 // DesiredAccess属性
 const (
 	FILE_READ_DATA         = 0x00000001
+	FILE_LIST_DIRECTORY    = 0x00000001
 	FILE_WRITE_DATA        = 0x00000002
 	FILE_APPEND_DATA       = 0x00000004
 	FILE_READ_EA           = 0x00000008
@@ -139,6 +141,7 @@ type CreateRequestStruct struct {
 	CreateContextsOffset uint32
 	CreateContextsLength uint32
 	Filename             []byte `smb:"unicode"`
+	Padding              []byte //文件名为空时缓冲区至少需要1字节
 }
 
 // https://docs.microsoft.com/en-us/openspecs/windows_protocols/ms-smb2/d166aa9e-0b53-410e-b35e-3933d8131927
@@ -178,6 +181,9 @@ func (c *Client) NewCreateRequest(treeId uint32, filename string, r CreateReques
 	r.CreateContextsOffset = 0
 	r.CreateContextsLength = 0
 	r.Filename = encoder.ToUnicode(filename)
+	if len(r.Filename) == 0 {
+		r.Padding = []byte{0}
+	}
 	return r
 }
 
@@ -197,27 +203,44 @@ func NewCreateResponse() CreateResponseStruct {
 }
 
 func (c *Client) CreateRequest(treeId uint32, filename string, r CreateRequestStruct) (fileId []byte, err error) {
+	return c.CreateRequestContext(context.Background(), treeId, filename, r)
+}
+
+func (c *Client) CreateRequestContext(ctx context.Context, treeId uint32, filename string, r CreateRequestStruct) (fileId []byte, err error) {
+	res, err := c.createContext(ctx, treeId, filename, r)
+	if err != nil {
+		return nil, err
+	}
+	return res.FileId, nil
+}
+
+// 发送创建请求并返回完整响应，便于获取文件大小、属性等信息
+func (c *Client) createContext(ctx context.Context, treeId uint32, filename string, r CreateRequestStruct) (CreateResponseStruct, error) {
 	c.Debug("Sending Create file request ["+filename+"]", nil)
 	req := c.NewCreateRequest(treeId, filename, r)
-	buf, err := c.SMBSend(req)
+	res := NewCreateResponse()
+	buf, err := c.SMBSendContext(ctx, req)
 	if err != nil {
 		c.Debug("", err)
-		return nil, err
+		return res, err
 	}
-	res := NewCreateResponse()
 	c.Debug("Unmarshalling Create file response ["+filename+"]", nil)
 	if err := encoder.Unmarshal(buf, &res); err != nil {
 		c.Debug("Raw:\n"+hex.Dump(buf), err)
 	}
 	if res.SMB2PacketStruct.Status != ms.STATUS_SUCCESS {
-		return nil, errors.New("Failed to create file to [" + filename + "]: " + ms.StatusMap[res.SMB2PacketStruct.Status])
+		return res, fmt.Errorf("Failed to create file to [%s]: %w", filename, ms.StatusError(res.SMB2PacketStruct.Status))
 	}
 	c.Debug("Completed CreateFile ["+filename+"]", nil)
-	return res.FileId, nil
+	return res, nil
 }
 
 // 打开管道
 func (c *Client) CreatePipeRequest(treeId uint32, pipename string) (fileId []byte, err error) {
+	return c.CreatePipeRequestContext(context.Background(), treeId, pipename)
+}
+
+func (c *Client) CreatePipeRequestContext(ctx context.Context, treeId uint32, pipename string) (fileId []byte, err error) {
 	r := CreateRequestStruct{
 		OpLock:             SMB2_OPLOCK_LEVEL_NONE,
 		ImpersonationLevel: Impersonation,
@@ -227,7 +250,7 @@ func (c *Client) CreatePipeRequest(treeId uint32, pipename string) (fileId []byt
 		CreateDisposition:  FILE_OPEN,
 		CreateOptions:      FILE_NON_DIRECTORY_FILE,
 	}
-	fileId, err = c.CreateRequest(treeId, pipename, r)
+	fileId, err = c.CreateRequestContext(ctx, treeId, pipename, r)
 	if err != nil {
 		c.Debug("", err)
 		return nil, err
@@ -0,0 +1,273 @@
+package smb2
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/4ra1n/go-impacket/pkg/common"
+	"github.com/4ra1n/go-impacket/pkg/encoder"
+	"github.com/4ra1n/go-impacket/pkg/ms"
+	"github.com/4ra1n/go-impacket/pkg/smb"
+)
+
+// 此文件用于smb2查询目录请求
+
+// https://docs.microsoft.com/en-us/openspecs/windows_protocols/ms-fscc/4718fc40-e539-4014-8e33-b675af74e3e1
+// FileInformationClass属性
+const (
+	FileDirectoryInformation       = 0x01
+	FileFullDirectoryInformation   = 0x02
+	FileBothDirectoryInformation   = 0x03
+	FileNamesInformation           = 0x0C
+	FileIdBothDirectoryInformation = 0x25
+	FileIdFullDirectoryInformation = 0x26
+)
+
+// QueryDirectory请求Flags属性
+const (
+	SMB2_RESTART_SCANS       = 0x01
+	SMB2_RETURN_SINGLE_ENTRY = 0x02
+	SMB2_INDEX_SPECIFIED     = 0x04
+	SMB2_REOPEN              = 0x10
+)
+
+// 单次查询的输出缓冲区大小上限
+const queryDirectoryBufferSize = 65536
+
+// https://docs.microsoft.com/en-us/openspecs/windows_protocols/ms-smb2/10906442-294c-46d3-8515-c277efe1f752
+// 查询目录请求结构
+type QueryDirectoryRequestStruct struct {
+	smb.SMB2PacketStruct
+	StructureSize        uint16 //2字节，必须设置33
+	FileInformationClass uint8
+	Flags                uint8
+	FileIndex            uint32
+	FileId               []byte `smb:"fixed:16"` //16字节，目录句柄
+	FileNameOffset       uint16 `smb:"offset:FileName"`
+	FileNameLength       uint16 `smb:"len:FileName"`
+	OutputBufferLength   uint32
+	FileName             []byte //搜索模式，支持通配符
+}
+
+// https://docs.microsoft.com/en-us/openspecs/windows_protocols/ms-smb2/4f75351b-048c-4a0c-9ea3-addd55a71956
+// 查询目录响应结构，Buffer需按OutputBufferOffset读取
+type QueryDirectoryResponseStruct struct {
+	smb.SMB2PacketStruct
+	StructureSize      uint16
+	OutputBufferOffset uint16
+	OutputBufferLength uint32
+}
+
+// 目录项，对应FileIdBothDirectoryInformation
+// https://docs.microsoft.com/en-us/openspecs/windows_protocols/ms-fscc/1e144bff-c056-45aa-bd29-c13d214ee2ba
+type FileInfo struct {
+	FileName       string
+	ShortName      string
+	FileIndex      uint32
+	FileId         uint64
+	EndOfFile      uint64 //文件大小
+	AllocationSize uint64
+	FileAttributes uint32
+	EaSize         uint32
+	CreationTime   time.Time
+	LastAccessTime time.Time
+	LastWriteTime  time.Time
+	ChangeTime     time.Time
+}
+
+// 是否为目录
+func (f FileInfo) IsDir() bool {
+	return f.FileAttributes&FILE_ATTRIBUTE_DIRECTORY != 0
+}
+
+func (c *Client) NewQueryDirectoryRequest(treeId uint32, fileId []byte, pattern string, flags uint8) QueryDirectoryRequestStruct {
+	smb2Header := NewSMB2Packet()
+	smb2Header.Command = smb.SMB2_QUERY_DIRECTORY
+	smb2Header.CreditCharge = 1
+	smb2Header.MessageId = c.GetMessageId()
+	smb2Header.SessionId = c.GetSessionId()
+	smb2Header.TreeId = treeId
+	smb2Header.CreditRequestResponse = 127
+	bufferSize := uint32(queryDirectoryBufferSize)
+	if size := c.GetMaxTransactSize(); size > 0 && size < bufferSize {
+		bufferSize = size
+	}
+	return QueryDirectoryRequestStruct{
+		SMB2PacketStruct:     smb2Header,
+		StructureSize:        33,
+		FileInformationClass: FileIdBothDirectoryInformation,
+		Flags:                flags,
+		FileIndex:            0,
+		FileId:               fileId,
+		OutputBufferLength:   bufferSize,
+		FileName:             encoder.ToUnicode(pattern),
+	}
+}
+
+func NewQueryDirectoryResponse() QueryDirectoryResponseStruct {
+	smb2Header := NewSMB2Packet()
+	return QueryDirectoryResponseStruct{
+		SMB2PacketStruct: smb2Header,
+	}
+}
+
+// 列出共享下目录的内容，path为共享内的相对路径，pattern为空时列出全部
+// 结果不包含"."与".."
+func (c *Client) ListDirectory(share, path, pattern string) ([]FileInfo, error) {
+	return c.ListDirectoryContext(context.Background(), share, path, pattern)
+}
+
+func (c *Client) ListDirectoryContext(ctx context.Context, share, path, pattern string) ([]FileInfo, error) {
+	treeId, err := c.shareTreeId(ctx, share)
+	if err != nil {
+		return nil, err
+	}
+	path = sharePath(path)
+	fileId, err := c.openDirectory(ctx, treeId, path)
+	if err != nil {
+		return nil, err
+	}
+	// ctx取消后仍关闭句柄，避免句柄在服务端泄漏
+	cleanup, cancel := common.CleanupContext(ctx)
+	defer cancel()
+	defer c.CloseRequestContext(cleanup, treeId, fileId)
+	if pattern == "" {
+		pattern = "*"
+	}
+	var files []FileInfo
+	flags := uint8(SMB2_RESTART_SCANS)
+	for {
+		entries, err := c.QueryDirectoryRequestContext(ctx, treeId, fileId, pattern, flags)
+		if err != nil {
+			return nil, err
+		}
+		if len(entries) == 0 {
+			break
+		}
+		for _, entry := range entries {
+			if entry.FileName == "." || entry.FileName == ".." {
+				continue
+			}
+			files = append(files, entry)
+		}
+		flags = 0
+	}
+	c.Debug("Completed ListDirectory ["+share+"\\"+path+"]", nil)
+	return files, nil
+}
+
+// 查询一次目录，没有更多目录项时返回nil
+func (c *Client) QueryDirectoryRequest(treeId uint32, fileId []byte, pattern string, flags uint8) ([]FileInfo, error) {
+	return c.QueryDirectoryRequestContext(context.Background(), treeId, fileId, pattern, flags)
+}
+
+func (c *Client) QueryDirectoryRequestContext(ctx context.Context, treeId uint32, fileId []byte, pattern string, flags uint8) ([]FileInfo, error) {
+	c.Debug("Sending QueryDirectory request ["+pattern+"]", nil)
+	req := c.NewQueryDirectoryRequest(treeId, fileId, pattern, flags)
+	buf, err := c.SMBSendContext(ctx, req)
+	if err != nil {
+		c.Debug("", err)
+		return nil, err
+	}
+	switch status := smb.HeaderStatus(buf); status {
+	case ms.STATUS_SUCCESS:
+	case ms.STATUS_NO_MORE_FILES, ms.STATUS_NO_SUCH_FILE:
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("Failed to query directory: %w", ms.StatusError(status))
+	}
+	res := NewQueryDirectoryResponse()
+	c.Debug("Unmarshalling QueryDirectory response", nil)
+	if err = encoder.Unmarshal(buf, &res); err != nil {
+		c.Debug("Raw:\n"+hex.Dump(buf), err)
+		return nil, err
+	}
+	start := int(res.OutputBufferOffset)
+	end := start + int(res.OutputBufferLength)
+	if start < smb.SMB2HeaderSize || end > len(buf) {
+		return nil, errors.New("Invalid QueryDirectory response buffer")
+	}
+	return parseFileIdBothDirectoryInformation(buf[start:end])
+}
+
+// 解析FileIdBothDirectoryInformation列表
+func parseFileIdBothDirectoryInformation(buf []byte) ([]FileInfo, error) {
+	entries := make([]FileInfo, 0)
+	for len(buf) > 0 {
+		if len(buf) < 104 {
+			return nil, errors.New("Truncated directory information entry")
+		}
+		next := binary.LittleEndian.Uint32(buf[0:])
+		nameLen := int(binary.LittleEndian.Uint32(buf[60:]))
+		shortLen := int(buf[68])
+		if 104+nameLen > len(buf) || shortLen > 24 {
+			return nil, errors.New("Truncated directory information entry")
+		}
+		entries = append(entries, FileInfo{
+			FileIndex:      binary.LittleEndian.Uint32(buf[4:]),
+			CreationTime:   fileTime(binary.LittleEndian.Uint64(buf[8:])),
+			LastAccessTime: fileTime(binary.LittleEndian.Uint64(buf[16:])),
+			LastWriteTime:  fileTime(binary.LittleEndian.Uint64(buf[24:])),
+			ChangeTime:     fileTime(binary.LittleEndian.Uint64(buf[32:])),
+			EndOfFile:      binary.LittleEndian.Uint64(buf[40:]),
+			AllocationSize: binary.LittleEndian.Uint64(buf[48:]),
+			FileAttributes: binary.LittleEndian.Uint32(buf[56:]),
+			EaSize:         binary.LittleEndian.Uint32(buf[64:]),
+			ShortName:      encoder.FromUnicode(buf[70 : 70+shortLen]),
+			FileId:         binary.LittleEndian.Uint64(buf[96:]),
+			FileName:       encoder.FromUnicode(buf[104 : 104+nameLen]),
+		})
+		if next == 0 {
+			break
+		}
+		if int(next) > len(buf) {
+			return nil, errors.New("Invalid directory information entry offset")
+		}
+		buf = buf[next:]
+	}
+	return entries, nil
+}
+
+// 打开目录句柄
+func (c *Client) openDirectory(ctx context.Context, treeId uint32, path string) ([]byte, error) {
+	r := CreateRequestStruct{
+		OpLock:             SMB2_OPLOCK_LEVEL_NONE,
+		ImpersonationLevel: Impersonation,
+		AccessMask:         FILE_LIST_DIRECTORY | FILE_READ_ATTRIBUTES | SYNCHRONIZE,
+		FileAttributes:     0,
+		ShareAccess:        FILE_SHARE_READ | FILE_SHARE_WRITE | FILE_SHARE_DELETE,
+		CreateDisposition:  FILE_OPEN,
+		CreateOptions:      FILE_DIRECTORY_FILE,
+	}
+	return c.CreateRequestContext(ctx, treeId, path, r)
+}
+
+// 获取共享的树id，尚未连接时进行树连接
+func (c *Client) shareTreeId(ctx context.Context, share string) (uint32, error) {
+	if treeId, ok := c.GetTreeId(share); ok {
+		return treeId, nil
+	}
+	return c.TreeConnectContext(ctx, share)
+}
+
+// 转换为共享内的相对路径，使用反斜杠分隔且不以分隔符开头或结尾
+func sharePath(path string) string {
+	path = strings.ReplaceAll(path, "/", "\\")
+	return strings.Trim(path, "\\")
+}
+
+// FILETIME转换为time.Time，0表示未设置
+func fileTime(ft uint64) time.Time {
+	if ft == 0 {
+		return time.Time{}
+	}
+	// 1601-01-01到1970-01-01之间的100纳秒间隔数
+	const epochDiff = 116444736000000000
+	d := int64(ft) - epochDiff
+	return time.Unix(d/10000000, d%10000000*100)
+}
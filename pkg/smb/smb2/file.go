@@ -0,0 +1,347 @@
+package smb2
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/4ra1n/go-impacket/pkg/smb"
+)
+
+// 此文件用于以io接口的方式读写共享中的文件
+
+// 单次读写请求的大小上限，smb2.0.2不支持多信用值请求
+// 其他版本限制为1MB，避免单个请求占用过多信用值
+const (
+	smb202MaxIOSize = 65536
+	maxIOSize       = 1048576
+)
+
+// 远程文件句柄
+type File struct {
+	c      *Client
+	name   string
+	treeId uint32
+	fileId []byte
+	size   int64
+	mu     sync.Mutex // 保护fileId、size以及offset
+	offset int64
+}
+
+// 以只读方式打开共享中的文件，返回的句柄实现io.ReadSeeker和io.ReaderAt
+func (c *Client) OpenFile(share, path string) (*File, error) {
+	return c.OpenFileContext(context.Background(), share, path)
+}
+
+func (c *Client) OpenFileContext(ctx context.Context, share, path string) (*File, error) {
+	r := CreateRequestStruct{
+		OpLock:             SMB2_OPLOCK_LEVEL_NONE,
+		ImpersonationLevel: Impersonation,
+		AccessMask:         FILE_READ_DATA | FILE_READ_ATTRIBUTES | SYNCHRONIZE,
+		FileAttributes:     FILE_ATTRIBUTE_NORMAL,
+		ShareAccess:        FILE_SHARE_READ | FILE_SHARE_WRITE,
+		CreateDisposition:  FILE_OPEN,
+		CreateOptions:      FILE_NON_DIRECTORY_FILE,
+	}
+	return c.openFile(ctx, share, path, r)
+}
+
+// 创建共享中的文件，已存在时清空，返回的句柄可读写，实现io.Writer和io.WriterAt
+func (c *Client) CreateFile(share, path string) (*File, error) {
+	return c.CreateFileContext(context.Background(), share, path)
+}
+
+func (c *Client) CreateFileContext(ctx context.Context, share, path string) (*File, error) {
+	r := CreateRequestStruct{
+		OpLock:             SMB2_OPLOCK_LEVEL_NONE,
+		ImpersonationLevel: Impersonation,
+		AccessMask:         FILE_READ_DATA | FILE_WRITE_DATA | FILE_APPEND_DATA | FILE_READ_ATTRIBUTES | FILE_WRITE_ATTRIBUTES | SYNCHRONIZE,
+		FileAttributes:     FILE_ATTRIBUTE_NORMAL,
+		ShareAccess:        FILE_SHARE_READ,
+		CreateDisposition:  FILE_OVERWRITE_IF,
+		CreateOptions:      FILE_NON_DIRECTORY_FILE,
+	}
+	return c.openFile(ctx, share, path, r)
+}
+
+func (c *Client) openFile(ctx context.Context, share, path string, r CreateRequestStruct) (*File, error) {
+	treeId, err := c.shareTreeId(ctx, share)
+	if err != nil {
+		return nil, err
+	}
+	path = sharePath(path)
+	res, err := c.createContext(ctx, treeId, path, r)
+	if err != nil {
+		return nil, err
+	}
+	return &File{
+		c:      c,
+		name:   path,
+		treeId: treeId,
+		fileId: res.FileId,
+		size:   int64(binary.LittleEndian.Uint64(res.EndofFile)),
+	}, nil
+}
+
+// 共享内的相对路径
+func (f *File) Name() string {
+	return f.name
+}
+
+// 文件大小，包含通过该句柄写入的数据
+func (f *File) Size() int64 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.size
+}
+
+// 查询文件属性
+func (f *File) Stat() (FileInfo, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.fileId == nil {
+		return FileInfo{}, errors.New("File already closed")
+	}
+	buf, err := f.c.QueryInfoRequest(f.treeId, f.fileId, SMB2_0_INFO_FILE, FileAllInformation, queryInfoOutputLength)
+	if err != nil {
+		return FileInfo{}, err
+	}
+	info, err := parseFileAllInformation(buf)
+	if err != nil {
+		return FileInfo{}, err
+	}
+	info.FileName = f.name[strings.LastIndex(f.name, "\\")+1:]
+	f.size = int64(info.EndOfFile)
+	return info, nil
+}
+
+// 查询文件大小、链接数以及是否等待删除
+func (f *File) StandardInfo() (FileStandardInfo, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.fileId == nil {
+		return FileStandardInfo{}, errors.New("File already closed")
+	}
+	buf, err := f.c.QueryInfoRequest(f.treeId, f.fileId, SMB2_0_INFO_FILE, FileStandardInformation, fileStandardInformationSize)
+	if err != nil {
+		return FileStandardInfo{}, err
+	}
+	info, err := parseFileStandardInformation(buf)
+	if err != nil {
+		return FileStandardInfo{}, err
+	}
+	f.size = int64(info.EndOfFile)
+	return info, nil
+}
+
+func (f *File) Read(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	n, err := f.readAt(context.Background(), f.fileId, p, f.offset)
+	f.offset += int64(n)
+	if n > 0 && err == io.EOF {
+		err = nil
+	}
+	return n, err
+}
+
+func (f *File) ReadAt(p []byte, off int64) (int, error) {
+	return f.ReadAtContext(context.Background(), p, off)
+}
+
+// 按协商的MaxReadSize分块读取，读满p或到达文件末尾时返回
+// 只在mu下取出fileId，多个ReadAt可以并发执行
+func (f *File) ReadAtContext(ctx context.Context, p []byte, off int64) (int, error) {
+	f.mu.Lock()
+	fileId := f.fileId
+	f.mu.Unlock()
+	return f.readAt(ctx, fileId, p, off)
+}
+
+func (f *File) readAt(ctx context.Context, fileId []byte, p []byte, off int64) (int, error) {
+	if fileId == nil {
+		return 0, errors.New("File already closed")
+	}
+	if off < 0 {
+		return 0, errors.New("Negative offset")
+	}
+	chunk := f.c.readChunkSize()
+	n := 0
+	for n < len(p) {
+		length := len(p) - n
+		if length > chunk {
+			length = chunk
+		}
+		data, err := f.c.ReadAtRequestContext(ctx, f.treeId, fileId, uint64(off)+uint64(n), uint32(length))
+		if err != nil {
+			return n, err
+		}
+		n += copy(p[n:], data)
+	}
+	return n, nil
+}
+
+func (f *File) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	n, err := f.writeAt(context.Background(), p, f.offset)
+	f.offset += int64(n)
+	return n, err
+}
+
+func (f *File) WriteAt(p []byte, off int64) (int, error) {
+	return f.WriteAtContext(context.Background(), p, off)
+}
+
+// 按协商的MaxWriteSize分块写入
+func (f *File) WriteAtContext(ctx context.Context, p []byte, off int64) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.writeAt(ctx, p, off)
+}
+
+// 调用方需持有mu
+func (f *File) writeAt(ctx context.Context, p []byte, off int64) (int, error) {
+	if f.fileId == nil {
+		return 0, errors.New("File already closed")
+	}
+	if off < 0 {
+		return 0, errors.New("Negative offset")
+	}
+	chunk := f.c.writeChunkSize()
+	n := 0
+	for n < len(p) {
+		end := n + chunk
+		if end > len(p) {
+			end = len(p)
+		}
+		if err := f.c.writeAll(ctx, f.treeId, f.fileId, uint64(off)+uint64(n), p[n:end]); err != nil {
+			return n, err
+		}
+		n = end
+		if off+int64(n) > f.size {
+			f.size = off + int64(n)
+		}
+	}
+	return n, nil
+}
+
+// 从r读取全部数据写入文件当前位置
+func (f *File) ReadFrom(r io.Reader) (int64, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.fileId == nil {
+		return 0, errors.New("File already closed")
+	}
+	n, err := f.c.writeFrom(context.Background(), f.treeId, f.fileId, uint64(f.offset), r)
+	f.offset += n
+	if f.offset > f.size {
+		f.size = f.offset
+	}
+	return n, err
+}
+
+func (f *File) Seek(offset int64, whence int) (int64, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		offset += f.size
+	default:
+		return 0, errors.New("Invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("Negative position")
+	}
+	f.offset = offset
+	return offset, nil
+}
+
+func (f *File) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.fileId == nil {
+		return nil
+	}
+	err := f.c.CloseRequest(f.treeId, f.fileId)
+	f.fileId = nil
+	return err
+}
+
+// 下载共享中的文件写入w，返回写入的字节数
+func (c *Client) Download(share, remote string, w io.Writer) (int64, error) {
+	return c.DownloadContext(context.Background(), share, remote, w)
+}
+
+func (c *Client) DownloadContext(ctx context.Context, share, remote string, w io.Writer) (int64, error) {
+	f, err := c.OpenFileContext(ctx, share, remote)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	buf := make([]byte, c.readChunkSize())
+	var written int64
+	for {
+		n, err := f.ReadAtContext(ctx, buf, written)
+		if n > 0 {
+			if _, werr := w.Write(buf[:n]); werr != nil {
+				return written, werr
+			}
+			written += int64(n)
+		}
+		if err == io.EOF {
+			c.Debug("Completed Download ["+share+"\\"+f.name+"]", nil)
+			return written, nil
+		}
+		if err != nil {
+			return written, err
+		}
+	}
+}
+
+// 上传数据到共享中的文件，已存在时覆盖，返回写入的字节数
+func (c *Client) Upload(share, remote string, r io.Reader) (int64, error) {
+	return c.UploadContext(context.Background(), share, remote, r)
+}
+
+func (c *Client) UploadContext(ctx context.Context, share, remote string, r io.Reader) (int64, error) {
+	f, err := c.CreateFileContext(ctx, share, remote)
+	if err != nil {
+		return 0, err
+	}
+	n, err := c.writeFrom(ctx, f.treeId, f.fileId, 0, r)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return n, err
+	}
+	c.Debug("Completed Upload ["+share+"\\"+f.name+"]", nil)
+	return n, nil
+}
+
+// 单次读取大小，取协商得到的MaxReadSize
+func (c *Client) readChunkSize() int {
+	return c.maxIOSize(c.GetMaxReadSize())
+}
+
+// 单次写入大小，取协商得到的MaxWriteSize
+func (c *Client) writeChunkSize() int {
+	return c.maxIOSize(c.GetMaxWriteSize())
+}
+
+func (c *Client) maxIOSize(size uint32) int {
+	if size == 0 || (c.GetDialect() == smb.SMB2_0_2_Dialect && size > smb202MaxIOSize) {
+		return smb202MaxIOSize
+	}
+	if size > maxIOSize {
+		return maxIOSize
+	}
+	return int(size)
+}
@@ -0,0 +1,277 @@
+package smb2
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/fs"
+	pathpkg "path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// 此文件用于将共享适配为只读的io/fs文件系统
+// 可直接用于fs.WalkDir、http.FS、template.ParseFS等标准库接口
+
+// 共享文件系统，实现fs.FS、fs.ReadDirFS和fs.StatFS
+// 路径使用正斜杠分隔，"."表示共享根目录
+type FS struct {
+	c      *Client
+	share  string
+	treeId uint32
+}
+
+// 连接共享并返回对应的文件系统
+func (c *Client) FS(share string) (*FS, error) {
+	return c.FSContext(context.Background(), share)
+}
+
+func (c *Client) FSContext(ctx context.Context, share string) (*FS, error) {
+	treeId, err := c.shareTreeId(ctx, share)
+	if err != nil {
+		return nil, err
+	}
+	return &FS{
+		c:      c,
+		share:  share,
+		treeId: treeId,
+	}, nil
+}
+
+// 打开文件或目录，目录实现fs.ReadDirFile，文件同时实现io.Seeker和io.ReaderAt
+func (s *FS) Open(name string) (fs.File, error) {
+	path, err := fsPath("open", name)
+	if err != nil {
+		return nil, err
+	}
+	r := CreateRequestStruct{
+		OpLock:             SMB2_OPLOCK_LEVEL_NONE,
+		ImpersonationLevel: Impersonation,
+		AccessMask:         FILE_READ_DATA | FILE_READ_ATTRIBUTES | SYNCHRONIZE,
+		FileAttributes:     0,
+		ShareAccess:        FILE_SHARE_READ | FILE_SHARE_WRITE | FILE_SHARE_DELETE,
+		CreateDisposition:  FILE_OPEN,
+		CreateOptions:      0,
+	}
+	res, err := s.c.createContext(context.Background(), s.treeId, path, r)
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+	info := createFileInfo(res, pathpkg.Base(name))
+	if info.IsDir() {
+		return &fsDir{
+			fs:     s,
+			name:   name,
+			fileId: res.FileId,
+			info:   info,
+			flags:  SMB2_RESTART_SCANS,
+		}, nil
+	}
+	return &fsFile{
+		file: &File{
+			c:      s.c,
+			name:   path,
+			treeId: s.treeId,
+			fileId: res.FileId,
+			size:   int64(info.EndOfFile),
+		},
+		path: name,
+	}, nil
+}
+
+// 列出目录内容，按文件名排序
+func (s *FS) ReadDir(name string) ([]fs.DirEntry, error) {
+	path, err := fsPath("readdir", name)
+	if err != nil {
+		return nil, err
+	}
+	fileId, err := s.c.openDirectory(context.Background(), s.treeId, path)
+	if err != nil {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: err}
+	}
+	d := &fsDir{
+		fs:     s,
+		name:   name,
+		fileId: fileId,
+		flags:  SMB2_RESTART_SCANS,
+	}
+	entries, err := d.ReadDir(-1)
+	if cerr := d.Close(); err == nil {
+		err = cerr
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Name() < entries[j].Name()
+	})
+	return entries, err
+}
+
+// 查询文件或目录的属性
+func (s *FS) Stat(name string) (fs.FileInfo, error) {
+	path, err := fsPath("stat", name)
+	if err != nil {
+		return nil, err
+	}
+	info, err := s.c.stat(context.Background(), s.treeId, path)
+	if err != nil {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: err}
+	}
+	info.FileName = pathpkg.Base(name)
+	return info, nil
+}
+
+// 共享文件系统中的文件，只转发读取相关的方法，不暴露File的写入方法
+type fsFile struct {
+	file *File
+	path string
+}
+
+func (f *fsFile) Stat() (fs.FileInfo, error) {
+	info, err := f.file.Stat()
+	if err != nil {
+		return nil, &fs.PathError{Op: "stat", Path: f.path, Err: err}
+	}
+	return info, nil
+}
+
+func (f *fsFile) Read(p []byte) (int, error) {
+	return f.file.Read(p)
+}
+
+func (f *fsFile) ReadAt(p []byte, off int64) (int, error) {
+	return f.file.ReadAt(p, off)
+}
+
+func (f *fsFile) Seek(offset int64, whence int) (int64, error) {
+	return f.file.Seek(offset, whence)
+}
+
+func (f *fsFile) Close() error {
+	return f.file.Close()
+}
+
+// 共享文件系统中的目录，目录项在ReadDir时按需查询
+type fsDir struct {
+	fs      *FS
+	name    string
+	fileId  []byte
+	info    FileInfo
+	flags   uint8
+	eof     bool
+	entries []fs.DirEntry
+}
+
+func (d *fsDir) Stat() (fs.FileInfo, error) {
+	return d.info, nil
+}
+
+func (d *fsDir) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.name, Err: errors.New("Is a directory")}
+}
+
+// n大于0时最多返回n项，没有更多目录项时返回io.EOF；n小于等于0时返回剩余全部目录项
+func (d *fsDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	if d.fileId == nil {
+		return nil, &fs.PathError{Op: "readdir", Path: d.name, Err: fs.ErrClosed}
+	}
+	for !d.eof && (n <= 0 || len(d.entries) < n) {
+		files, err := d.fs.c.QueryDirectoryRequest(d.fs.treeId, d.fileId, "*", d.flags)
+		if err != nil {
+			return nil, &fs.PathError{Op: "readdir", Path: d.name, Err: err}
+		}
+		d.flags = 0
+		if len(files) == 0 {
+			d.eof = true
+			break
+		}
+		for _, file := range files {
+			if file.FileName == "." || file.FileName == ".." {
+				continue
+			}
+			d.entries = append(d.entries, fs.FileInfoToDirEntry(file))
+		}
+	}
+	if n <= 0 {
+		entries := d.entries
+		d.entries = nil
+		if entries == nil {
+			entries = []fs.DirEntry{}
+		}
+		return entries, nil
+	}
+	if len(d.entries) == 0 {
+		return nil, io.EOF
+	}
+	if n > len(d.entries) {
+		n = len(d.entries)
+	}
+	entries := d.entries[:n:n]
+	d.entries = d.entries[n:]
+	return entries, nil
+}
+
+func (d *fsDir) Close() error {
+	if d.fileId == nil {
+		return nil
+	}
+	err := d.fs.c.CloseRequest(d.fs.treeId, d.fileId)
+	d.fileId = nil
+	return err
+}
+
+// 以下方法使FileInfo实现fs.FileInfo
+
+func (f FileInfo) Name() string {
+	return f.FileName
+}
+
+func (f FileInfo) Size() int64 {
+	return int64(f.EndOfFile)
+}
+
+// 只读属性映射为0444，目录附加fs.ModeDir与执行权限
+func (f FileInfo) Mode() fs.FileMode {
+	mode := fs.FileMode(0644)
+	if f.FileAttributes&FILE_ATTRIBUTE_READONLY != 0 {
+		mode = 0444
+	}
+	if f.IsDir() {
+		mode |= fs.ModeDir | 0111
+	}
+	return mode
+}
+
+func (f FileInfo) ModTime() time.Time {
+	return f.LastWriteTime
+}
+
+// 返回FileInfo本身
+func (f FileInfo) Sys() interface{} {
+	return f
+}
+
+// 校验fs路径并转换为共享内的相对路径
+func fsPath(op, name string) (string, error) {
+	if !fs.ValidPath(name) || strings.ContainsAny(name, "\\:") {
+		return "", &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	if name == "." {
+		return "", nil
+	}
+	return strings.ReplaceAll(name, "/", "\\"), nil
+}
+
+// 从创建响应中获取属性
+func createFileInfo(res CreateResponseStruct, name string) FileInfo {
+	return FileInfo{
+		FileName:       name,
+		CreationTime:   fileTime(binary.LittleEndian.Uint64(res.CreationTime)),
+		LastAccessTime: fileTime(binary.LittleEndian.Uint64(res.LastAccessTime)),
+		LastWriteTime:  fileTime(binary.LittleEndian.Uint64(res.LastWriteTime)),
+		ChangeTime:     fileTime(binary.LittleEndian.Uint64(res.LastChangeTime)),
+		AllocationSize: binary.LittleEndian.Uint64(res.AllocationSize),
+		EndOfFile:      binary.LittleEndian.Uint64(res.EndofFile),
+		FileAttributes: res.FileAttributes,
+	}
+}
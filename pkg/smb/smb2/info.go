@@ -0,0 +1,255 @@
+package smb2
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/4ra1n/go-impacket/pkg/encoder"
+	"github.com/4ra1n/go-impacket/pkg/ms"
+	"github.com/4ra1n/go-impacket/pkg/smb"
+)
+
+// 此文件用于smb2查询、设置信息请求
+
+// InfoType属性
+const (
+	SMB2_0_INFO_FILE       = 0x01
+	SMB2_0_INFO_FILESYSTEM = 0x02
+	SMB2_0_INFO_SECURITY   = 0x03
+	SMB2_0_INFO_QUOTA      = 0x04
+)
+
+// https://docs.microsoft.com/en-us/openspecs/windows_protocols/ms-fscc/4718fc40-e539-4014-8e33-b675af74e3e1
+// 文件信息FileInfoClass属性
+const (
+	FileBasicInformation         = 0x04
+	FileStandardInformation      = 0x05
+	FileInternalInformation      = 0x06
+	FileRenameInformation        = 0x0A
+	FileDispositionInformation   = 0x0D
+	FileAllInformation           = 0x12
+	FileEndOfFileInformation     = 0x14
+	FileNetworkOpenInformation   = 0x22
+	FileAttributeTagInformation  = 0x23
+	FileDispositionInformationEx = 0x40
+)
+
+const (
+	fileAllInformationSize        = 100 //FileAllInformation中文件名之前的固定部分
+	fileStandardInformationSize   = 24
+	fileRenameInformationBaseSize = 20
+	queryInfoOutputLength         = 4096
+)
+
+// https://docs.microsoft.com/en-us/openspecs/windows_protocols/ms-smb2/d623b2f7-a5cd-4639-8cc9-71fa7d9f9ba9
+// 查询信息请求结构
+type QueryInfoRequestStruct struct {
+	smb.SMB2PacketStruct
+	StructureSize         uint16 //2字节，必须设置41
+	InfoType              uint8
+	FileInfoClass         uint8
+	OutputBufferLength    uint32
+	InputBufferOffset     uint16
+	Reserved              uint16
+	InputBufferLength     uint32
+	AdditionalInformation uint32
+	Flags                 uint32
+	FileId                []byte `smb:"fixed:16"` //16字节，文件句柄
+	Buffer                []byte //没有输入数据时至少需要1字节
+}
+
+// https://docs.microsoft.com/en-us/openspecs/windows_protocols/ms-smb2/3b1b3598-a898-44ca-bfac-2dcae065247f
+// 查询信息响应结构，Buffer需按OutputBufferOffset读取
+type QueryInfoResponseStruct struct {
+	smb.SMB2PacketStruct
+	StructureSize      uint16
+	OutputBufferOffset uint16
+	OutputBufferLength uint32
+}
+
+// https://docs.microsoft.com/en-us/openspecs/windows_protocols/ms-smb2/ee9614c4-be54-4a3c-98f1-769a7032a0e4
+// 设置信息请求结构
+type SetInfoRequestStruct struct {
+	smb.SMB2PacketStruct
+	StructureSize         uint16 //2字节，必须设置33
+	InfoType              uint8
+	FileInfoClass         uint8
+	BufferLength          uint32 `smb:"len:Buffer"`
+	BufferOffset          uint16 `smb:"offset:Buffer"`
+	Reserved              uint16
+	AdditionalInformation uint32
+	FileId                []byte `smb:"fixed:16"` //16字节，文件句柄
+	Buffer                []byte
+}
+
+// https://docs.microsoft.com/en-us/openspecs/windows_protocols/ms-smb2/c4318eb4-bdab-49b7-9352-abd7b0e2b2fb
+// 设置信息响应结构
+type SetInfoResponseStruct struct {
+	smb.SMB2PacketStruct
+	StructureSize uint16
+}
+
+func (c *Client) NewQueryInfoRequest(treeId uint32, fileId []byte, infoType, fileInfoClass uint8, outputLength uint32) QueryInfoRequestStruct {
+	smb2Header := NewSMB2Packet()
+	smb2Header.Command = smb.SMB2_QUERY_INFO
+	smb2Header.CreditCharge = 1
+	smb2Header.MessageId = c.GetMessageId()
+	smb2Header.SessionId = c.GetSessionId()
+	smb2Header.TreeId = treeId
+	smb2Header.CreditRequestResponse = 127
+	return QueryInfoRequestStruct{
+		SMB2PacketStruct:   smb2Header,
+		StructureSize:      41,
+		InfoType:           infoType,
+		FileInfoClass:      fileInfoClass,
+		OutputBufferLength: outputLength,
+		FileId:             fileId,
+		Buffer:             []byte{0},
+	}
+}
+
+func NewQueryInfoResponse() QueryInfoResponseStruct {
+	smb2Header := NewSMB2Packet()
+	return QueryInfoResponseStruct{
+		SMB2PacketStruct: smb2Header,
+	}
+}
+
+func (c *Client) NewSetInfoRequest(treeId uint32, fileId []byte, infoType, fileInfoClass uint8, buf []byte) SetInfoRequestStruct {
+	smb2Header := NewSMB2Packet()
+	smb2Header.Command = smb.SMB2_SET_INFO
+	smb2Header.CreditCharge = 1
+	smb2Header.MessageId = c.GetMessageId()
+	smb2Header.SessionId = c.GetSessionId()
+	smb2Header.TreeId = treeId
+	smb2Header.CreditRequestResponse = 127
+	return SetInfoRequestStruct{
+		SMB2PacketStruct: smb2Header,
+		StructureSize:    33,
+		InfoType:         infoType,
+		FileInfoClass:    fileInfoClass,
+		FileId:           fileId,
+		Buffer:           buf,
+	}
+}
+
+func NewSetInfoResponse() SetInfoResponseStruct {
+	smb2Header := NewSMB2Packet()
+	return SetInfoResponseStruct{
+		SMB2PacketStruct: smb2Header,
+	}
+}
+
+// 查询信息，返回输出缓冲区，数据被截断(STATUS_BUFFER_OVERFLOW)时返回已有部分
+func (c *Client) QueryInfoRequest(treeId uint32, fileId []byte, infoType, fileInfoClass uint8, outputLength uint32) ([]byte, error) {
+	return c.QueryInfoRequestContext(context.Background(), treeId, fileId, infoType, fileInfoClass, outputLength)
+}
+
+func (c *Client) QueryInfoRequestContext(ctx context.Context, treeId uint32, fileId []byte, infoType, fileInfoClass uint8, outputLength uint32) ([]byte, error) {
+	c.Debug("Sending QueryInfo request", nil)
+	req := c.NewQueryInfoRequest(treeId, fileId, infoType, fileInfoClass, outputLength)
+	buf, err := c.SMBSendContext(ctx, req)
+	if err != nil {
+		c.Debug("", err)
+		return nil, err
+	}
+	switch status := smb.HeaderStatus(buf); status {
+	case ms.STATUS_SUCCESS, ms.STATUS_BUFFER_OVERFLOW:
+	default:
+		return nil, fmt.Errorf("Failed to query info: %w", ms.StatusError(status))
+	}
+	res := NewQueryInfoResponse()
+	c.Debug("Unmarshalling QueryInfo response", nil)
+	if err = encoder.Unmarshal(buf, &res); err != nil {
+		c.Debug("Raw:\n"+hex.Dump(buf), err)
+		return nil, err
+	}
+	start := int(res.OutputBufferOffset)
+	end := start + int(res.OutputBufferLength)
+	if end == start {
+		return []byte{}, nil
+	}
+	if start < smb.SMB2HeaderSize || end > len(buf) {
+		return nil, errors.New("Invalid QueryInfo response buffer")
+	}
+	c.Debug("Completed QueryInfo", nil)
+	return buf[start:end], nil
+}
+
+// 设置信息
+func (c *Client) SetInfoRequest(treeId uint32, fileId []byte, infoType, fileInfoClass uint8, buf []byte) error {
+	return c.SetInfoRequestContext(context.Background(), treeId, fileId, infoType, fileInfoClass, buf)
+}
+
+func (c *Client) SetInfoRequestContext(ctx context.Context, treeId uint32, fileId []byte, infoType, fileInfoClass uint8, buf []byte) error {
+	c.Debug("Sending SetInfo request", nil)
+	req := c.NewSetInfoRequest(treeId, fileId, infoType, fileInfoClass, buf)
+	resp, err := c.SMBSendContext(ctx, req)
+	if err != nil {
+		c.Debug("", err)
+		return err
+	}
+	if status := smb.HeaderStatus(resp); status != ms.STATUS_SUCCESS {
+		return fmt.Errorf("Failed to set info: %w", ms.StatusError(status))
+	}
+	c.Debug("Completed SetInfo", nil)
+	return nil
+}
+
+// 解析FileAllInformation，文件名不在结果中填充
+// https://docs.microsoft.com/en-us/openspecs/windows_protocols/ms-fscc/95f3056a-ebc1-4f5d-b938-3f68a44677a6
+func parseFileAllInformation(buf []byte) (FileInfo, error) {
+	if len(buf) < fileAllInformationSize {
+		return FileInfo{}, errors.New("Truncated FileAllInformation")
+	}
+	return FileInfo{
+		CreationTime:   fileTime(binary.LittleEndian.Uint64(buf[0:])),
+		LastAccessTime: fileTime(binary.LittleEndian.Uint64(buf[8:])),
+		LastWriteTime:  fileTime(binary.LittleEndian.Uint64(buf[16:])),
+		ChangeTime:     fileTime(binary.LittleEndian.Uint64(buf[24:])),
+		FileAttributes: binary.LittleEndian.Uint32(buf[32:]),
+		AllocationSize: binary.LittleEndian.Uint64(buf[40:]),
+		EndOfFile:      binary.LittleEndian.Uint64(buf[48:]),
+		FileId:         binary.LittleEndian.Uint64(buf[64:]),
+		EaSize:         binary.LittleEndian.Uint32(buf[72:]),
+	}, nil
+}
+
+// FileStandardInformation
+// https://docs.microsoft.com/en-us/openspecs/windows_protocols/ms-fscc/5afa7f66-619c-48f3-955f-68c4ece704ae
+type FileStandardInfo struct {
+	AllocationSize uint64
+	EndOfFile      uint64
+	NumberOfLinks  uint32
+	DeletePending  bool
+	Directory      bool
+}
+
+func parseFileStandardInformation(buf []byte) (FileStandardInfo, error) {
+	if len(buf) < fileStandardInformationSize {
+		return FileStandardInfo{}, errors.New("Truncated FileStandardInformation")
+	}
+	return FileStandardInfo{
+		AllocationSize: binary.LittleEndian.Uint64(buf[0:]),
+		EndOfFile:      binary.LittleEndian.Uint64(buf[8:]),
+		NumberOfLinks:  binary.LittleEndian.Uint32(buf[16:]),
+		DeletePending:  buf[20] != 0,
+		Directory:      buf[21] != 0,
+	}, nil
+}
+
+// 构造FileRenameInformation(SMB2格式)，name为共享内的目标路径
+// https://docs.microsoft.com/en-us/openspecs/windows_protocols/ms-fscc/52aa0b70-8094-4971-862d-79793f41e6a8
+func newFileRenameInformation(name string, replaceIfExists bool) []byte {
+	fileName := encoder.ToUnicode(name)
+	buf := make([]byte, fileRenameInformationBaseSize+len(fileName))
+	if replaceIfExists {
+		buf[0] = 1
+	}
+	// 8字节保留字段之后为8字节RootDirectory，必须为0
+	binary.LittleEndian.PutUint32(buf[16:], uint32(len(fileName)))
+	copy(buf[fileRenameInformationBaseSize:], fileName)
+	return buf
+}
@@ -0,0 +1,91 @@
+package smb2
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"strings"
+
+	"github.com/4ra1n/go-impacket/pkg/encoder"
+	"github.com/4ra1n/go-impacket/pkg/krb5"
+	"github.com/4ra1n/go-impacket/pkg/krb5/gss"
+	"github.com/4ra1n/go-impacket/pkg/ms"
+	"github.com/4ra1n/go-impacket/pkg/smb"
+)
+
+// 此文件用于Kerberos认证的会话建立
+
+// 获取目标cifs服务票据
+func (c *Client) serviceTicket(ctx context.Context) (*krb5.Credential, error) {
+	opt := c.GetOptions()
+	return opt.ServiceTicketContext(ctx, "cifs/"+strings.ToLower(opt.Host))
+}
+
+// Kerberos会话建立，AP-REQ放在NegTokenInit中一次完成认证
+func (c *Client) kerberosSessionSetup(ctx context.Context) error {
+	c.Debug("Requesting Kerberos service ticket", nil)
+	cred, err := c.serviceTicket(ctx)
+	if err != nil {
+		c.Debug("", err)
+		return err
+	}
+	token, err := krb5.NewGSSAPReq(cred, krb5.GSS_C_MUTUAL_FLAG|krb5.GSS_C_REPLAY_FLAG|krb5.GSS_C_SEQUENCE_FLAG|krb5.GSS_C_CONF_FLAG|krb5.GSS_C_INTEG_FLAG)
+	if err != nil {
+		c.Debug("", err)
+		return err
+	}
+	init, err := gss.NewNegTokenInitKerberos(token)
+	if err != nil {
+		c.Debug("", err)
+		return err
+	}
+	smb2Header := NewSMB2Packet()
+	smb2Header.Command = smb.SMB2_SESSION_SETUP
+	smb2Header.CreditCharge = 1
+	smb2Header.MessageId = c.GetMessageId()
+	smb2Header.CreditRequestResponse = 127
+	req := smb.SMB2SessionSetupRequestStruct{
+		SMB2PacketStruct:     smb2Header,
+		StructureSize:        25,
+		Flags:                0x00,
+		SecurityMode:         byte(smb.SecurityModeSigningEnabled),
+		Capabilities:         0,
+		Channel:              0,
+		SecurityBufferOffset: 88,
+		SecurityBufferLength: 0,
+		PreviousSessionID:    0,
+		SecurityBlob:         &init,
+	}
+	c.Debug("Sending Kerberos SessionSetup request", nil)
+	buf, err := c.SMBSendContext(ctx, req)
+	if err != nil {
+		c.Debug("", err)
+		return err
+	}
+	if status := smb.HeaderStatus(buf); status != ms.STATUS_SUCCESS {
+		return errors.New("Kerberos session setup failed: " + ms.StatusMap[status])
+	}
+	res, err := NewSessionSetupResponse()
+	if err != nil {
+		c.Debug("", err)
+		return err
+	}
+	if err = encoder.Unmarshal(buf, &res); err != nil {
+		c.Debug("Raw:\n"+hex.Dump(buf), err)
+		return err
+	}
+	c.WithSessionId(res.SMB2PacketStruct.SessionId)
+	// 服务端返回AP-REP且包含子密钥时，使用子密钥作为会话密钥
+	sessionKey := cred.SessionKey.KeyValue
+	if res.SecurityBlob != nil && len(res.SecurityBlob.ResponseToken) > 0 {
+		part, err := krb5.ParseAPRep(res.SecurityBlob.ResponseToken, cred.SessionKey)
+		if err != nil {
+			c.Debug("", err)
+			return err
+		}
+		if len(part.SubKey.KeyValue) > 0 {
+			sessionKey = part.SubKey.KeyValue
+		}
+	}
+	return c.finishSessionSetup(res.Flags, sessionKey, buf)
+}
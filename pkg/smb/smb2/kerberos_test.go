@@ -0,0 +1,495 @@
+package smb2
+
+import (
+	"context"
+	"encoding/asn1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/4ra1n/go-impacket/pkg/common"
+	"github.com/4ra1n/go-impacket/pkg/encoder"
+	"github.com/4ra1n/go-impacket/pkg/krb5"
+	"github.com/4ra1n/go-impacket/pkg/krb5/gss"
+	"github.com/4ra1n/go-impacket/pkg/smb"
+)
+
+// 本地KDC与SMB服务端，覆盖AS-REQ、TGS-REQ、AP-REQ以及用会话密钥签名的会话建立响应
+
+const (
+	testRealm    = "EXAMPLE.COM"
+	testUser     = "alice"
+	testPassword = "Passw0rd!"
+	testHost     = "fs01.example.com"
+	testSession  = 0x0000100000000011
+)
+
+// 请求与票据内部结构，客户端发送的消息由krb5包手动编码，这里按RFC-4120解析
+
+type testKDCReq struct {
+	PVNO    int32         `asn1:"explicit,tag:1"`
+	MsgType int32         `asn1:"explicit,tag:2"`
+	PAData  []krb5.PAData `asn1:"optional,explicit,tag:3"`
+	ReqBody asn1.RawValue `asn1:"explicit,tag:4"`
+}
+
+type testKDCReqBody struct {
+	Options asn1.BitString     `asn1:"explicit,tag:0"`
+	CName   krb5.PrincipalName `asn1:"optional,explicit,tag:1"`
+	Realm   string             `asn1:"explicit,tag:2"`
+	SName   krb5.PrincipalName `asn1:"explicit,tag:3"`
+	Till    time.Time          `asn1:"generalized,explicit,tag:5"`
+	Nonce   int32              `asn1:"explicit,tag:7"`
+	ETypes  []int32            `asn1:"explicit,tag:8"`
+}
+
+type testPAEncTimestamp struct {
+	Time time.Time `asn1:"generalized,explicit,tag:0"`
+	USec int32     `asn1:"optional,explicit,tag:1"`
+}
+
+type testAPReq struct {
+	PVNO          int32              `asn1:"explicit,tag:0"`
+	MsgType       int32              `asn1:"explicit,tag:1"`
+	Options       asn1.BitString     `asn1:"explicit,tag:2"`
+	Ticket        asn1.RawValue      `asn1:"explicit,tag:3"`
+	Authenticator krb5.EncryptedData `asn1:"explicit,tag:4"`
+}
+
+type testAuthenticator struct {
+	AVNO      int32              `asn1:"explicit,tag:0"`
+	CRealm    string             `asn1:"explicit,tag:1"`
+	CName     krb5.PrincipalName `asn1:"explicit,tag:2"`
+	Cksum     krb5.Checksum      `asn1:"optional,explicit,tag:3"`
+	CUSec     int32              `asn1:"explicit,tag:4"`
+	CTime     time.Time          `asn1:"generalized,explicit,tag:5"`
+	SubKey    krb5.EncryptionKey `asn1:"optional,explicit,tag:6"`
+	SeqNumber int64              `asn1:"optional,explicit,tag:7"`
+}
+
+type testEncTicketPart struct {
+	Flags    asn1.BitString     `asn1:"explicit,tag:0"`
+	Key      krb5.EncryptionKey `asn1:"explicit,tag:1"`
+	CRealm   string             `asn1:"explicit,tag:2"`
+	CName    krb5.PrincipalName `asn1:"explicit,tag:3"`
+	AuthTime time.Time          `asn1:"generalized,explicit,tag:5"`
+	EndTime  time.Time          `asn1:"generalized,explicit,tag:7"`
+}
+
+// 以APPLICATION标签编码
+func marshalApplication(tag int, v interface{}) ([]byte, error) {
+	inner, err := asn1.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return asn1.Marshal(asn1.RawValue{Class: asn1.ClassApplication, Tag: tag, IsCompound: true, Bytes: inner})
+}
+
+func testUnmarshalApplication(buf []byte, tag int, v interface{}) error {
+	_, err := asn1.UnmarshalWithParams(buf, v, fmt.Sprintf("application,explicit,tag:%d", tag))
+	return err
+}
+
+type testKDC struct {
+	ln         net.Listener
+	userKey    krb5.EncryptionKey
+	krbtgtKey  krb5.EncryptionKey
+	serviceKey krb5.EncryptionKey
+	mu         sync.Mutex
+	requests   []int32 // 收到的消息类型，预认证失败时记为KRB_ERROR
+	err        error
+}
+
+func newTestKDC(t *testing.T, serviceKey krb5.EncryptionKey) *testKDC {
+	userKey, err := krb5.StringToKey(krb5.ETYPE_AES256_CTS_HMAC_SHA1_96, testPassword, testRealm+testUser)
+	if err != nil {
+		t.Fatal(err)
+	}
+	krbtgtKey, err := krb5.RandomKey(krb5.ETYPE_AES256_CTS_HMAC_SHA1_96)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	k := &testKDC{ln: ln, userKey: userKey, krbtgtKey: krbtgtKey, serviceKey: serviceKey}
+	go k.serve()
+	t.Cleanup(func() { ln.Close() })
+	return k
+}
+
+func (k *testKDC) serve() {
+	for {
+		conn, err := k.ln.Accept()
+		if err != nil {
+			return
+		}
+		go k.handle(conn)
+	}
+}
+
+func (k *testKDC) handle(conn net.Conn) {
+	defer conn.Close()
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return
+	}
+	req := make([]byte, binary.BigEndian.Uint32(header))
+	if _, err := io.ReadFull(conn, req); err != nil {
+		return
+	}
+	resp, msgType, err := k.reply(req)
+	k.mu.Lock()
+	k.requests = append(k.requests, msgType)
+	if err != nil && k.err == nil {
+		k.err = err
+	}
+	k.mu.Unlock()
+	if err != nil {
+		return
+	}
+	binary.BigEndian.PutUint32(header, uint32(len(resp)))
+	conn.Write(append(header, resp...))
+}
+
+func (k *testKDC) reply(buf []byte) ([]byte, int32, error) {
+	if len(buf) == 0 {
+		return nil, 0, errors.New("empty KDC request")
+	}
+	msgType := int32(buf[0] &^ 0x60)
+	var req testKDCReq
+	if err := testUnmarshalApplication(buf, int(msgType), &req); err != nil {
+		return nil, msgType, err
+	}
+	var body testKDCReqBody
+	if _, err := asn1.Unmarshal(req.ReqBody.Bytes, &body); err != nil {
+		return nil, msgType, err
+	}
+	switch msgType {
+	case krb5.KRB_AS_REQ:
+		return k.asReply(req, body)
+	case krb5.KRB_TGS_REQ:
+		resp, err := k.tgsReply(req, body)
+		return resp, msgType, err
+	}
+	return nil, msgType, fmt.Errorf("unexpected KDC message %d", msgType)
+}
+
+// 未携带加密时间戳时要求预认证，并在ETYPE-INFO2中返回盐值
+func (k *testKDC) asReply(req testKDCReq, body testKDCReqBody) ([]byte, int32, error) {
+	var ts *krb5.PAData
+	for i := range req.PAData {
+		if req.PAData[i].PADataType == krb5.PA_ENC_TIMESTAMP {
+			ts = &req.PAData[i]
+		}
+	}
+	if ts == nil {
+		info, err := asn1.Marshal([]krb5.ETypeInfo2Entry{{EType: krb5.ETYPE_AES256_CTS_HMAC_SHA1_96, Salt: testRealm + testUser}})
+		if err != nil {
+			return nil, krb5.KRB_AS_REQ, err
+		}
+		edata, err := asn1.Marshal([]krb5.PAData{{PADataType: krb5.PA_ETYPE_INFO2, PADataValue: info}})
+		if err != nil {
+			return nil, krb5.KRB_AS_REQ, err
+		}
+		resp, err := marshalApplication(krb5.KRB_ERROR, krb5.KRBError{
+			PVNO:      krb5.PVNO,
+			MsgType:   krb5.KRB_ERROR,
+			STime:     time.Now().UTC().Truncate(time.Second),
+			ErrorCode: krb5.KDC_ERR_PREAUTH_REQUIRED,
+			Realm:     testRealm,
+			SName:     body.SName,
+			EData:     edata,
+		})
+		return resp, krb5.KRB_ERROR, err
+	}
+	var enc krb5.EncryptedData
+	if _, err := asn1.Unmarshal(ts.PADataValue, &enc); err != nil {
+		return nil, krb5.KRB_AS_REQ, err
+	}
+	plain, err := krb5.DecryptData(k.userKey, krb5.KeyUsageASReqTimestamp, enc)
+	if err != nil {
+		return nil, krb5.KRB_AS_REQ, err
+	}
+	var pa testPAEncTimestamp
+	if _, err = asn1.Unmarshal(plain, &pa); err != nil {
+		return nil, krb5.KRB_AS_REQ, err
+	}
+	if d := time.Since(pa.Time); d > 5*time.Minute || d < -5*time.Minute {
+		return nil, krb5.KRB_AS_REQ, errors.New("timestamp out of range")
+	}
+	if body.CName.String() != testUser || body.SName.String() != "krbtgt/"+testRealm {
+		return nil, krb5.KRB_AS_REQ, fmt.Errorf("unexpected AS-REQ principals %s %s", body.CName, body.SName)
+	}
+	resp, err := k.kdcRep(krb5.KRB_AS_REP, body.CName, body, k.krbtgtKey, k.userKey, krb5.KeyUsageASRepEncPart)
+	return resp, krb5.KRB_AS_REQ, err
+}
+
+// 校验TGT与认证器中的请求体校验和后签发服务票据
+func (k *testKDC) tgsReply(req testKDCReq, body testKDCReqBody) ([]byte, error) {
+	if len(req.PAData) != 1 || req.PAData[0].PADataType != krb5.PA_TGS_REQ {
+		return nil, errors.New("missing PA-TGS-REQ")
+	}
+	sessionKey, auth, err := acceptAPReq(req.PAData[0].PADataValue, k.krbtgtKey, krb5.KeyUsageTGSReqAuthenticator)
+	if err != nil {
+		return nil, err
+	}
+	cksum, err := krb5.MakeChecksum(sessionKey, krb5.KeyUsageTGSReqAuthChecksum, req.ReqBody.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	if auth.Cksum.CksumType != cksum.CksumType || string(auth.Cksum.Checksum) != string(cksum.Checksum) {
+		return nil, errors.New("TGS-REQ body checksum mismatch")
+	}
+	if body.SName.String() != "cifs/"+testHost {
+		return nil, fmt.Errorf("unexpected service %s", body.SName)
+	}
+	return k.kdcRep(krb5.KRB_TGS_REP, auth.CName, body, k.serviceKey, sessionKey, krb5.KeyUsageTGSRepEncPartSession)
+}
+
+// 生成新的会话密钥，票据由serverKey加密，响应加密部分由replyKey加密
+func (k *testKDC) kdcRep(msgType int32, cname krb5.PrincipalName, body testKDCReqBody, serverKey, replyKey krb5.EncryptionKey, usage uint32) ([]byte, error) {
+	sessionKey, err := krb5.RandomKey(krb5.ETYPE_AES256_CTS_HMAC_SHA1_96)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now().UTC().Truncate(time.Second)
+	flags := asn1.BitString{Bytes: []byte{0x40, 0, 0, 0}, BitLength: 32}
+	ticket, err := newTestTicket(body.SName, cname, sessionKey, serverKey, now)
+	if err != nil {
+		return nil, err
+	}
+	tag := 25
+	if msgType == krb5.KRB_TGS_REP {
+		tag = 26
+	}
+	part, err := marshalApplication(tag, krb5.EncKDCRepPart{
+		Key:       sessionKey,
+		LastReq:   asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 1, IsCompound: true, Bytes: []byte{0x30, 0x00}},
+		Nonce:     body.Nonce,
+		Flags:     flags,
+		AuthTime:  now,
+		StartTime: now,
+		EndTime:   now.Add(10 * time.Hour),
+		SRealm:    testRealm,
+		SName:     body.SName,
+	})
+	if err != nil {
+		return nil, err
+	}
+	encPart, err := krb5.EncryptData(replyKey, usage, part)
+	if err != nil {
+		return nil, err
+	}
+	return marshalApplication(int(msgType), krb5.KDCRep{
+		PVNO:    krb5.PVNO,
+		MsgType: msgType,
+		CRealm:  testRealm,
+		CName:   cname,
+		Ticket:  asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 5, IsCompound: true, Bytes: ticket},
+		EncPart: encPart,
+	})
+}
+
+func newTestTicket(sname, cname krb5.PrincipalName, sessionKey, serverKey krb5.EncryptionKey, now time.Time) ([]byte, error) {
+	part, err := marshalApplication(3, testEncTicketPart{
+		Flags:    asn1.BitString{Bytes: []byte{0x40, 0, 0, 0}, BitLength: 32},
+		Key:      sessionKey,
+		CRealm:   testRealm,
+		CName:    cname,
+		AuthTime: now,
+		EndTime:  now.Add(10 * time.Hour),
+	})
+	if err != nil {
+		return nil, err
+	}
+	enc, err := krb5.EncryptData(serverKey, krb5.KeyUsageKDCRepTicket, part)
+	if err != nil {
+		return nil, err
+	}
+	return marshalApplication(1, krb5.Ticket{TktVNO: krb5.PVNO, Realm: testRealm, SName: sname, EncPart: enc})
+}
+
+// 服务端处理AP-REQ：用服务密钥解密票据，再用票据中的会话密钥解密认证器
+func acceptAPReq(buf []byte, serverKey krb5.EncryptionKey, usage uint32) (krb5.EncryptionKey, testAuthenticator, error) {
+	var ap testAPReq
+	var auth testAuthenticator
+	if err := testUnmarshalApplication(buf, krb5.KRB_AP_REQ, &ap); err != nil {
+		return krb5.EncryptionKey{}, auth, err
+	}
+	var ticket krb5.Ticket
+	if err := testUnmarshalApplication(ap.Ticket.Bytes, 1, &ticket); err != nil {
+		return krb5.EncryptionKey{}, auth, err
+	}
+	plain, err := krb5.DecryptData(serverKey, krb5.KeyUsageKDCRepTicket, ticket.EncPart)
+	if err != nil {
+		return krb5.EncryptionKey{}, auth, err
+	}
+	var part testEncTicketPart
+	if err = testUnmarshalApplication(plain, 3, &part); err != nil {
+		return krb5.EncryptionKey{}, auth, err
+	}
+	if plain, err = krb5.DecryptData(part.Key, usage, ap.Authenticator); err != nil {
+		return krb5.EncryptionKey{}, auth, err
+	}
+	if err = testUnmarshalApplication(plain, 2, &auth); err != nil {
+		return krb5.EncryptionKey{}, auth, err
+	}
+	if auth.CName.String() != part.CName.String() || auth.CRealm != part.CRealm {
+		return krb5.EncryptionKey{}, auth, errors.New("authenticator does not match ticket")
+	}
+	return part.Key, auth, nil
+}
+
+// 处理一个Kerberos会话建立请求，返回AP-REP中的子密钥并用其派生的密钥对响应签名
+func serveKerberosSessionSetup(conn net.Conn, serviceKey krb5.EncryptionKey, dialect uint16) (krb5.EncryptionKey, error) {
+	data, err := smb.ReadMessage(conn)
+	if err != nil {
+		return krb5.EncryptionKey{}, err
+	}
+	if !smb.IsSMB2(data) || smb.HeaderCommand(data) != smb.SMB2_SESSION_SETUP {
+		return krb5.EncryptionKey{}, errors.New("expected SMB2 SESSION_SETUP")
+	}
+	// SecurityBufferOffset与SecurityBufferLength位于请求体偏移12处
+	offset := int(binary.LittleEndian.Uint16(data[64+12:]))
+	length := int(binary.LittleEndian.Uint16(data[64+14:]))
+	if offset+length > len(data) {
+		return krb5.EncryptionKey{}, errors.New("invalid security buffer")
+	}
+	var init gss.NegTokenInit
+	if err = init.UnmarshalBinary(data[offset:offset+length], nil); err != nil {
+		return krb5.EncryptionKey{}, err
+	}
+	tokId, apReq, err := krb5.UnwrapToken(init.Data.MechToken)
+	if err != nil {
+		return krb5.EncryptionKey{}, err
+	}
+	if tokId != krb5.TOK_ID_KRB_AP_REQ {
+		return krb5.EncryptionKey{}, fmt.Errorf("unexpected token id 0x%04x", tokId)
+	}
+	sessionKey, auth, err := acceptAPReq(apReq, serviceKey, krb5.KeyUsageAPReqAuthenticator)
+	if err != nil {
+		return krb5.EncryptionKey{}, err
+	}
+	if auth.Cksum.CksumType != krb5.CKSUMTYPE_GSSAPI || len(auth.Cksum.Checksum) < 24 ||
+		binary.LittleEndian.Uint32(auth.Cksum.Checksum[20:])&krb5.GSS_C_MUTUAL_FLAG == 0 {
+		return krb5.EncryptionKey{}, errors.New("missing GSS-API checksum with mutual flag")
+	}
+	subKey, err := krb5.RandomKey(krb5.ETYPE_AES256_CTS_HMAC_SHA1_96)
+	if err != nil {
+		return krb5.EncryptionKey{}, err
+	}
+	inner, err := asn1.Marshal(krb5.EncAPRepPart{CTime: auth.CTime, CUSec: auth.CUSec, SubKey: subKey, SeqNumber: 1})
+	if err != nil {
+		return krb5.EncryptionKey{}, err
+	}
+	part, err := asn1.Marshal(asn1.RawValue{Class: asn1.ClassApplication, Tag: 27, IsCompound: true, Bytes: inner})
+	if err != nil {
+		return krb5.EncryptionKey{}, err
+	}
+	enc, err := krb5.EncryptData(sessionKey, krb5.KeyUsageAPRepEncPart, part)
+	if err != nil {
+		return krb5.EncryptionKey{}, err
+	}
+	if inner, err = asn1.Marshal(krb5.APRep{PVNO: krb5.PVNO, MsgType: krb5.KRB_AP_REP, EncPart: enc}); err != nil {
+		return krb5.EncryptionKey{}, err
+	}
+	apRep, err := asn1.Marshal(asn1.RawValue{Class: asn1.ClassApplication, Tag: krb5.KRB_AP_REP, IsCompound: true, Bytes: inner})
+	if err != nil {
+		return krb5.EncryptionKey{}, err
+	}
+	header := NewSMB2Packet()
+	header.Command = smb.SMB2_SESSION_SETUP
+	header.Flags = smb.SMB2_FLAGS_SERVER_TO_REDIR
+	header.MessageId = smb.HeaderMessageId(data)
+	header.SessionId = testSession
+	header.CreditRequestResponse = 1
+	res := smb.SMB2SessionSetupResponseStruct{
+		SMB2PacketStruct: header,
+		StructureSize:    9,
+		SecurityBlob:     &gss.NegTokenResp{ResponseToken: krb5.WrapToken(krb5.TOK_ID_KRB_AP_REP, apRep)},
+	}
+	pkt, err := encoder.Marshal(res)
+	if err != nil {
+		return krb5.EncryptionKey{}, err
+	}
+	key := smb.DeriveSigningKey(dialect, subKey.KeyValue, nil)
+	if err = smb.Sign(smb.DefaultSigningAlgorithm(dialect), key, pkt); err != nil {
+		return krb5.EncryptionKey{}, err
+	}
+	return subKey, smb.WriteMessage(conn, pkt)
+}
+
+func TestKerberosSessionSetup(t *testing.T) {
+	serviceKey, err := krb5.RandomKey(krb5.ETYPE_AES256_CTS_HMAC_SHA1_96)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kdc := newTestKDC(t, serviceKey)
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	defer serverConn.Close()
+
+	dialect := uint16(smb.SMB3_0_2_Dialect)
+	c := &Client{}
+	c.WithOptions(&common.ClientOptions{
+		Host:        testHost,
+		Domain:      testRealm,
+		User:        testUser,
+		Password:    testPassword,
+		Kerberos:    true,
+		KDCHost:     kdc.ln.Addr().String(),
+		ReadTimeout: 10 * time.Second,
+	})
+	c.WithConn(clientConn)
+	c.WithDialect(dialect)
+	c.WithSigningAlgorithm(smb.DefaultSigningAlgorithm(dialect))
+	c.IsSigningRequired = true
+
+	type result struct {
+		subKey krb5.EncryptionKey
+		err    error
+	}
+	done := make(chan result, 1)
+	go func() {
+		subKey, err := serveKerberosSessionSetup(serverConn, serviceKey, dialect)
+		done <- result{subKey, err}
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	err = c.kerberosSessionSetup(ctx)
+	server := <-done
+	if server.err != nil {
+		t.Fatalf("server: %v", server.err)
+	}
+	kdc.mu.Lock()
+	requests, kdcErr := kdc.requests, kdc.err
+	kdc.mu.Unlock()
+	if kdcErr != nil {
+		t.Fatalf("kdc: %v", kdcErr)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 首个AS-REQ未带预认证，按ETYPE-INFO2的盐值计算密钥后重试
+	want := []int32{krb5.KRB_ERROR, krb5.KRB_AS_REQ, krb5.KRB_TGS_REQ}
+	if fmt.Sprint(requests) != fmt.Sprint(want) {
+		t.Fatalf("KDC requests %v, want %v", requests, want)
+	}
+	if !c.IsAuthenticated || c.GetSessionId() != testSession {
+		t.Fatalf("session not established: authenticated %v session 0x%x", c.IsAuthenticated, c.GetSessionId())
+	}
+	// 会话密钥取AP-REP中的子密钥，签名密钥与服务端一致
+	if string(c.GetSessionKey()) != string(server.subKey.KeyValue) {
+		t.Fatal("session key is not the AP-REP subkey")
+	}
+	if string(c.GetSigningKey()) != string(smb.DeriveSigningKey(dialect, server.subKey.KeyValue, nil)) {
+		t.Fatal("signing key mismatch")
+	}
+}
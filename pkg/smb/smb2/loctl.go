@@ -1,8 +1,11 @@
 package smb2
 
 import (
+	"context"
 	"encoding/hex"
+	"fmt"
 	"github.com/4ra1n/go-impacket/pkg/encoder"
+	"github.com/4ra1n/go-impacket/pkg/ms"
 	"github.com/4ra1n/go-impacket/pkg/smb"
 )
 
@@ -107,10 +110,17 @@ func (c *Client) NewFSCTLPIPEWAITRequest(pipename string) FSCTLPIPEWAITRequestSt
 	}
 }
 
+// 等待命名管道的默认超时，毫秒
+const pipeWaitTimeout = 500000
+
 // 连接并绑定命名管道，并拿到管道句柄
 func (c *Client) ConnectAndWriteStdInPipes(pipename string) (treeid uint32, pipehandle []byte, err error) {
-	timeout := uint64(500000)
-	treeId, err := c.TreeConnect("IPC$")
+	return c.ConnectAndWriteStdInPipesContext(context.Background(), pipename)
+}
+
+func (c *Client) ConnectAndWriteStdInPipesContext(ctx context.Context, pipename string) (treeid uint32, pipehandle []byte, err error) {
+	timeout := uint64(pipeWaitTimeout)
+	treeId, err := c.TreeConnectContext(ctx, "IPC$")
 	if err != nil {
 		c.Debug("", err)
 		return 0, nil, err
@@ -125,7 +135,7 @@ func (c *Client) ConnectAndWriteStdInPipes(pipename string) (treeid uint32, pipe
 	FSCTLPIPEWAITRequestIn.Timeout = timeout
 	IOCTLRequest.Buffer = FSCTLPIPEWAITRequestIn
 	c.Debug("Sending Ioctl stdin pipe request ["+pipename+"]", nil)
-	buf, err := c.SMBSend(IOCTLRequest)
+	buf, err := c.SMBSendContext(ctx, IOCTLRequest)
 	if err != nil {
 		c.Debug("", err)
 		return 0, nil, err
@@ -137,84 +147,79 @@ func (c *Client) ConnectAndWriteStdInPipes(pipename string) (treeid uint32, pipe
 		return 0, nil, err
 	}
 	// 创建管道请求
-	pipeHander, err := c.CreatePipeRequest(treeId, pipename)
+	pipeHander, err := c.CreatePipeRequestContext(ctx, treeId, pipename)
 	if err != nil {
 		return 0, nil, err
 	}
 	// 将数据写入管道
-	err = c.WritePipeRequest(treeId, []byte("cmd"), pipeHander)
+	err = c.WritePipeRequestContext(ctx, treeId, []byte("cmd"), pipeHander)
 	if err != nil {
 		return 0, nil, err
 	}
 	return treeId, pipeHander, nil
 }
 
-// 拿到stdin、out、err句柄
+// 拿到stdin、out、err句柄，管道名分别为pipename加_in、_out、_err后缀
 func (c *Client) ConnectAndBindNamedPipes(pipename string) (stdinpipe, stdoutpipe, stderrpipe []byte, err error) {
-	var stdIn, stdOut, stdErr []byte
-	timeout := uint64(500000)
-	treeId, err := c.TreeConnect("IPC$")
+	return c.ConnectAndBindNamedPipesContext(context.Background(), pipename)
+}
+
+func (c *Client) ConnectAndBindNamedPipesContext(ctx context.Context, pipename string) (stdinpipe, stdoutpipe, stderrpipe []byte, err error) {
+	treeId, err := c.TreeConnectContext(ctx, "IPC$")
 	if err != nil {
 		c.Debug("", err)
-		//return nil, err
+		return nil, nil, nil, err
+	}
+	if stdinpipe, err = c.OpenNamedPipeContext(ctx, treeId, pipename+"_in"); err != nil {
+		return nil, nil, nil, err
+	}
+	if stdoutpipe, err = c.OpenNamedPipeContext(ctx, treeId, pipename+"_out"); err != nil {
+		c.CloseRequestContext(ctx, treeId, stdinpipe)
+		return nil, nil, nil, err
+	}
+	if stderrpipe, err = c.OpenNamedPipeContext(ctx, treeId, pipename+"_err"); err != nil {
+		c.CloseRequestContext(ctx, treeId, stdinpipe)
+		c.CloseRequestContext(ctx, treeId, stdoutpipe)
+		return nil, nil, nil, err
 	}
+	return stdinpipe, stdoutpipe, stderrpipe, nil
+}
+
+// 等待命名管道可用，timeout为毫秒，管道不存在时立即返回错误
+func (c *Client) WaitNamedPipe(treeId uint32, pipename string, timeout uint64) error {
+	return c.WaitNamedPipeContext(context.Background(), treeId, pipename, timeout)
+}
+
+func (c *Client) WaitNamedPipeContext(ctx context.Context, treeId uint32, pipename string, timeout uint64) error {
 	IOCTLRequest := c.NewIOCTLRequest(treeId)
 	// 使用FSCTL_PIPE_WAIT，FileId必须为0xFFFFFFFFFFFFFFFF
 	IOCTLRequest.Function = FSCTL_PIPE_WAIT
 	IOCTLRequest.Flags = SMB2_0_IOCTL_IS_FSCTL
 	IOCTLRequest.GUIDHandle = []byte{0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF}
-	// 连接输入管道
-	pipeIn := pipename + "_in"
-	FSCTLPIPEWAITRequestIn := c.NewFSCTLPIPEWAITRequest(pipeIn)
-	FSCTLPIPEWAITRequestIn.Timeout = timeout
-	IOCTLRequest.Buffer = FSCTLPIPEWAITRequestIn
-	c.Debug("Sending Ioctl stdin pipe request ["+pipeIn+"]", nil)
-	buf, err := c.SMBSend(IOCTLRequest)
+	FSCTLPIPEWAITRequest := c.NewFSCTLPIPEWAITRequest(pipename)
+	FSCTLPIPEWAITRequest.Timeout = timeout
+	IOCTLRequest.Buffer = FSCTLPIPEWAITRequest
+	c.Debug("Sending Ioctl pipe wait request ["+pipename+"]", nil)
+	buf, err := c.SMBSendContext(ctx, IOCTLRequest)
 	if err != nil {
 		c.Debug("", err)
-		//return nil, err
+		return err
 	}
-	res := NewIOCTLResponse()
-	c.Debug("Unmarshalling Ioctl stdin pipe response ["+pipeIn+"]", nil)
-	if err := encoder.Unmarshal(buf, &res); err != nil {
-		c.Debug("Raw:\n"+hex.Dump(buf), err)
+	if status := smb.HeaderStatus(buf); status != ms.STATUS_SUCCESS {
+		return fmt.Errorf("Failed to wait pipe [%s]: %w", pipename, ms.StatusError(status))
 	}
-	stdIn = res.GUIDHandle
-	c.Debug("Completed Ioctl stdin pipe ["+pipeIn+"]", nil)
-	// 连接输出管道
-	pipeOut := pipename + "_out"
-	FSCTLPIPEWAITRequestOut := c.NewFSCTLPIPEWAITRequest(pipeOut)
-	FSCTLPIPEWAITRequestOut.Timeout = timeout
-	IOCTLRequest.Buffer = FSCTLPIPEWAITRequestOut
-	c.Debug("Sending Ioctl stdout pipe request ["+pipeOut+"]", nil)
-	buf, err = c.SMBSend(IOCTLRequest)
-	if err != nil {
-		c.Debug("", err)
-		//return nil, err
-	}
-	res = NewIOCTLResponse()
-	c.Debug("Unmarshalling Ioctl stdout pipe response ["+pipeOut+"]", nil)
-	if err = encoder.Unmarshal(buf, &res); err != nil {
-		c.Debug("Raw:\n"+hex.Dump(buf), err)
-	}
-	c.Debug("Completed Ioctl stdout pipe ["+pipeOut+"]", nil)
-	// 创建
-	// 连接错误管道
-	pipeErr := pipename + "_err"
-	FSCTLPIPEWAITRequestErr := c.NewFSCTLPIPEWAITRequest(pipeErr)
-	FSCTLPIPEWAITRequestErr.Timeout = timeout
-	IOCTLRequest.Buffer = FSCTLPIPEWAITRequestErr
-	c.Debug("Sending Ioctl stderr pipe request ["+pipeErr+"]", nil)
-	buf, err = c.SMBSend(IOCTLRequest)
-	if err != nil {
-		c.Debug("", err)
-		//return nil, err
-	}
-	res = NewIOCTLResponse()
-	c.Debug("Unmarshalling Ioctl stderr pipe response ["+pipeErr+"]", nil)
-	if err = encoder.Unmarshal(buf, &res); err != nil {
-		c.Debug("Raw:\n"+hex.Dump(buf), err)
+	c.Debug("Completed Ioctl pipe wait ["+pipename+"]", nil)
+	return nil
+}
+
+// 等待并打开命名管道，返回管道句柄
+func (c *Client) OpenNamedPipe(treeId uint32, pipename string) (fileId []byte, err error) {
+	return c.OpenNamedPipeContext(context.Background(), treeId, pipename)
+}
+
+func (c *Client) OpenNamedPipeContext(ctx context.Context, treeId uint32, pipename string) (fileId []byte, err error) {
+	if err = c.WaitNamedPipeContext(ctx, treeId, pipename, pipeWaitTimeout); err != nil {
+		return nil, err
 	}
-	c.Debug("Completed Ioctl stderr pipe ["+pipeErr+"]", nil)
-	return stdIn, stdOut, stdErr, nil
+	return c.CreatePipeRequestContext(ctx, treeId, pipename)
 }
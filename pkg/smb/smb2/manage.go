@@ -0,0 +1,167 @@
+package smb2
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/4ra1n/go-impacket/pkg/common"
+)
+
+// 此文件用于共享中文件、目录的删除、重命名、创建以及属性查询
+
+// 获取文件或目录的属性，path为空时为共享根目录
+func (c *Client) Stat(share, path string) (FileInfo, error) {
+	return c.StatContext(context.Background(), share, path)
+}
+
+func (c *Client) StatContext(ctx context.Context, share, path string) (FileInfo, error) {
+	treeId, err := c.shareTreeId(ctx, share)
+	if err != nil {
+		return FileInfo{}, err
+	}
+	return c.stat(ctx, treeId, path)
+}
+
+// 通过FileAllInformation查询属性，文件名取路径的最后一段
+func (c *Client) stat(ctx context.Context, treeId uint32, path string) (FileInfo, error) {
+	r := CreateRequestStruct{
+		OpLock:             SMB2_OPLOCK_LEVEL_NONE,
+		ImpersonationLevel: Impersonation,
+		AccessMask:         FILE_READ_ATTRIBUTES | SYNCHRONIZE,
+		FileAttributes:     0,
+		ShareAccess:        FILE_SHARE_READ | FILE_SHARE_WRITE | FILE_SHARE_DELETE,
+		CreateDisposition:  FILE_OPEN,
+		CreateOptions:      0,
+	}
+	var info FileInfo
+	err := c.withTreeHandle(ctx, treeId, path, r, func(fileId []byte) error {
+		buf, err := c.QueryInfoRequestContext(ctx, treeId, fileId, SMB2_0_INFO_FILE, FileAllInformation, queryInfoOutputLength)
+		if err != nil {
+			return err
+		}
+		info, err = parseFileAllInformation(buf)
+		return err
+	})
+	if err != nil {
+		return FileInfo{}, err
+	}
+	path = sharePath(path)
+	info.FileName = path[strings.LastIndex(path, "\\")+1:]
+	return info, nil
+}
+
+// 删除文件
+func (c *Client) Remove(share, path string) error {
+	return c.RemoveContext(context.Background(), share, path)
+}
+
+func (c *Client) RemoveContext(ctx context.Context, share, path string) error {
+	return c.deleteContext(ctx, share, path, FILE_NON_DIRECTORY_FILE)
+}
+
+// 删除空目录
+func (c *Client) Rmdir(share, path string) error {
+	return c.RmdirContext(context.Background(), share, path)
+}
+
+func (c *Client) RmdirContext(ctx context.Context, share, path string) error {
+	if sharePath(path) == "" {
+		return errors.New("Cannot remove share root")
+	}
+	return c.deleteContext(ctx, share, path, FILE_DIRECTORY_FILE)
+}
+
+// 通过FileDispositionInformation标记删除，句柄关闭后生效
+func (c *Client) deleteContext(ctx context.Context, share, path string, createOptions uint32) error {
+	r := CreateRequestStruct{
+		OpLock:             SMB2_OPLOCK_LEVEL_NONE,
+		ImpersonationLevel: Impersonation,
+		AccessMask:         DELETE | FILE_READ_ATTRIBUTES | SYNCHRONIZE,
+		FileAttributes:     0,
+		ShareAccess:        FILE_SHARE_READ | FILE_SHARE_WRITE | FILE_SHARE_DELETE,
+		CreateDisposition:  FILE_OPEN,
+		CreateOptions:      createOptions,
+	}
+	err := c.withHandle(ctx, share, path, r, func(treeId uint32, fileId []byte) error {
+		return c.SetInfoRequestContext(ctx, treeId, fileId, SMB2_0_INFO_FILE, FileDispositionInformation, []byte{1})
+	})
+	if err != nil {
+		return fmt.Errorf("Failed to delete [%s]: %w", sharePath(path), err)
+	}
+	c.Debug("Completed Delete ["+share+"\\"+sharePath(path)+"]", nil)
+	return nil
+}
+
+// 重命名或移动文件、目录，newpath为同一共享内的目标路径，目标已存在时失败
+func (c *Client) Rename(share, oldpath, newpath string) error {
+	return c.RenameContext(context.Background(), share, oldpath, newpath)
+}
+
+func (c *Client) RenameContext(ctx context.Context, share, oldpath, newpath string) error {
+	r := CreateRequestStruct{
+		OpLock:             SMB2_OPLOCK_LEVEL_NONE,
+		ImpersonationLevel: Impersonation,
+		AccessMask:         DELETE | FILE_READ_ATTRIBUTES | SYNCHRONIZE,
+		FileAttributes:     0,
+		ShareAccess:        FILE_SHARE_READ | FILE_SHARE_WRITE | FILE_SHARE_DELETE,
+		CreateDisposition:  FILE_OPEN,
+		CreateOptions:      0,
+	}
+	newpath = sharePath(newpath)
+	err := c.withHandle(ctx, share, oldpath, r, func(treeId uint32, fileId []byte) error {
+		return c.SetInfoRequestContext(ctx, treeId, fileId, SMB2_0_INFO_FILE, FileRenameInformation, newFileRenameInformation(newpath, false))
+	})
+	if err != nil {
+		return fmt.Errorf("Failed to rename [%s] to [%s]: %w", sharePath(oldpath), newpath, err)
+	}
+	c.Debug("Completed Rename ["+share+"\\"+newpath+"]", nil)
+	return nil
+}
+
+// 创建目录，上级目录必须存在
+func (c *Client) Mkdir(share, path string) error {
+	return c.MkdirContext(context.Background(), share, path)
+}
+
+func (c *Client) MkdirContext(ctx context.Context, share, path string) error {
+	r := CreateRequestStruct{
+		OpLock:             SMB2_OPLOCK_LEVEL_NONE,
+		ImpersonationLevel: Impersonation,
+		AccessMask:         FILE_READ_ATTRIBUTES | SYNCHRONIZE,
+		FileAttributes:     FILE_ATTRIBUTE_DIRECTORY,
+		ShareAccess:        FILE_SHARE_READ | FILE_SHARE_WRITE | FILE_SHARE_DELETE,
+		CreateDisposition:  FILE_CREATE,
+		CreateOptions:      FILE_DIRECTORY_FILE,
+	}
+	return c.withHandle(ctx, share, path, r, func(treeId uint32, fileId []byte) error {
+		return nil
+	})
+}
+
+// 打开句柄执行fn后关闭，fn的错误优先返回
+func (c *Client) withHandle(ctx context.Context, share, path string, r CreateRequestStruct, fn func(treeId uint32, fileId []byte) error) error {
+	treeId, err := c.shareTreeId(ctx, share)
+	if err != nil {
+		return err
+	}
+	return c.withTreeHandle(ctx, treeId, path, r, func(fileId []byte) error {
+		return fn(treeId, fileId)
+	})
+}
+
+func (c *Client) withTreeHandle(ctx context.Context, treeId uint32, path string, r CreateRequestStruct, fn func(fileId []byte) error) error {
+	fileId, err := c.CreateRequestContext(ctx, treeId, sharePath(path), r)
+	if err != nil {
+		return err
+	}
+	err = fn(fileId)
+	// ctx取消后仍关闭句柄，设置了关闭时删除的文件在关闭后才会删除
+	cleanup, cancel := common.CleanupContext(ctx)
+	defer cancel()
+	if cerr := c.CloseRequestContext(cleanup, treeId, fileId); err == nil {
+		err = cerr
+	}
+	return err
+}
@@ -1,11 +1,15 @@
 package smb2
 
 import (
+	"context"
+	"encoding/binary"
 	"encoding/hex"
 	"errors"
+	"fmt"
 	"github.com/4ra1n/go-impacket/pkg/encoder"
 	"github.com/4ra1n/go-impacket/pkg/ms"
 	"github.com/4ra1n/go-impacket/pkg/smb"
+	"io"
 )
 
 // 此文件用于smb2读数据请求
@@ -81,10 +85,14 @@ func NewReadResponse() ReadResponseStruct2 {
 }
 
 func (c *Client) ReadRequest(treeId uint32, fileId []byte) (info []byte, err error) {
+	return c.ReadRequestContext(context.Background(), treeId, fileId)
+}
+
+func (c *Client) ReadRequestContext(ctx context.Context, treeId uint32, fileId []byte) (info []byte, err error) {
 	c.Debug("Sending Read request", nil)
 	req := c.NewReadRequest(treeId, fileId)
 	req.ReadLength = 1024
-	buf, err := c.SMBSend(req)
+	buf, err := c.SMBSendContext(ctx, req)
 	if err != nil {
 		c.Debug("", err)
 		return nil, err
@@ -101,3 +109,80 @@ func (c *Client) ReadRequest(treeId uint32, fileId []byte) (info []byte, err err
 	c.Debug("Completed Read response", nil)
 	return res.Info, nil
 }
+
+// 从指定偏移读取至多length字节，到达文件末尾时返回io.EOF
+func (c *Client) ReadAtRequest(treeId uint32, fileId []byte, offset uint64, length uint32) ([]byte, error) {
+	return c.ReadAtRequestContext(context.Background(), treeId, fileId, offset, length)
+}
+
+func (c *Client) ReadAtRequestContext(ctx context.Context, treeId uint32, fileId []byte, offset uint64, length uint32) ([]byte, error) {
+	req := c.NewReadRequest(treeId, fileId)
+	req.ReadLength = length
+	binary.LittleEndian.PutUint64(req.FileOffset, offset)
+	buf, err := c.SMBSendContext(ctx, req)
+	if err != nil {
+		c.Debug("", err)
+		return nil, err
+	}
+	switch status := smb.HeaderStatus(buf); status {
+	case ms.STATUS_SUCCESS:
+	case ms.STATUS_END_OF_FILE:
+		return nil, io.EOF
+	default:
+		return nil, fmt.Errorf("Failed to Read response to :%w", ms.StatusError(status))
+	}
+	// 响应中DataOffset位于头部后第2字节，DataLength位于第4字节
+	if len(buf) < smb.SMB2HeaderSize+16 {
+		return nil, errors.New("Invalid Read response")
+	}
+	start := int(buf[smb.SMB2HeaderSize+2])
+	end := start + int(binary.LittleEndian.Uint32(buf[smb.SMB2HeaderSize+4:]))
+	if end == start {
+		return nil, io.EOF
+	}
+	if start < smb.SMB2HeaderSize+16 || end > len(buf) {
+		return nil, errors.New("Invalid Read response buffer")
+	}
+	return buf[start:end], nil
+}
+
+// 读取管道数据，消息模式管道中消息超过单次读取大小时返回已读取的部分
+// 管道中没有数据时阻塞，不受ReadTimeout限制，只能通过ctx取消
+func (c *Client) ReadPipeRequest(treeId uint32, fileId []byte) ([]byte, error) {
+	return c.ReadPipeRequestContext(context.Background(), treeId, fileId)
+}
+
+func (c *Client) ReadPipeRequestContext(ctx context.Context, treeId uint32, fileId []byte) ([]byte, error) {
+	req := c.NewReadRequest(treeId, fileId)
+	req.ReadLength = uint32(c.readChunkSize())
+	pending, err := c.SMBSendAsyncContext(ctx, req)
+	if err != nil {
+		c.Debug("", err)
+		return nil, err
+	}
+	resps, err := pending.WaitNoTimeoutContext(ctx)
+	if err != nil {
+		c.Debug("", err)
+		return nil, err
+	}
+	buf := resps[0]
+	switch status := smb.HeaderStatus(buf); status {
+	case ms.STATUS_SUCCESS, ms.STATUS_BUFFER_OVERFLOW:
+	case ms.STATUS_END_OF_FILE, ms.STATUS_PIPE_BROKEN:
+		return nil, io.EOF
+	default:
+		return nil, fmt.Errorf("Failed to read pipe :%w", ms.StatusError(status))
+	}
+	if len(buf) < smb.SMB2HeaderSize+16 {
+		return nil, errors.New("Invalid Read response")
+	}
+	start := int(buf[smb.SMB2HeaderSize+2])
+	end := start + int(binary.LittleEndian.Uint32(buf[smb.SMB2HeaderSize+4:]))
+	if end == start {
+		return nil, nil
+	}
+	if start < smb.SMB2HeaderSize+16 || end > len(buf) {
+		return nil, errors.New("Invalid Read response buffer")
+	}
+	return buf[start:end], nil
+}
@@ -1,6 +1,8 @@
 package smb2
 
 import (
+	"context"
+	"crypto/rand"
 	"encoding/hex"
 	"errors"
 	"fmt"
@@ -10,7 +12,6 @@ import (
 	ntlm2 "github.com/4ra1n/go-impacket/pkg/krb5/ntlm"
 	"github.com/4ra1n/go-impacket/pkg/ms"
 	"github.com/4ra1n/go-impacket/pkg/smb"
-	"net"
 )
 
 // 此文件提供smb连接方法
@@ -37,48 +38,141 @@ func NewSMB2Packet() smb.SMB2PacketStruct {
 	}
 }
 
+// 默认协商的协议版本
+var DefaultDialects = []uint16{
+	smb.SMB2_0_2_Dialect,
+	smb.SMB2_1_Dialect,
+	smb.SMB3_0_Dialect,
+	smb.SMB3_0_2_Dialect,
+	smb.SMB3_1_1_Dialect,
+}
+
+// 获取需要协商的协议版本列表
+func (c *Client) dialects() []uint16 {
+	if c.GetOptions() != nil && len(c.GetOptions().Dialects) > 0 {
+		return c.GetOptions().Dialects
+	}
+	return DefaultDialects
+}
+
+func hasDialect(dialects []uint16, dialect uint16) bool {
+	for _, d := range dialects {
+		if d == dialect {
+			return true
+		}
+	}
+	return false
+}
+
+// smb3.1.1协商上下文：预认证完整性、加密以及签名算法
+func newNegotiateContexts() ([]smb.NegotiateContextStruct, error) {
+	salt := make([]byte, 32)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	preauth, err := smb.NewNegotiateContext(smb.SMB2_PREAUTH_INTEGRITY_CAPABILITIES, smb.PreauthIntegrityCapabilitiesStruct{
+		HashAlgorithmCount: 1,
+		HashAlgorithms:     []uint16{smb.SMB2_PREAUTH_INTEGRITY_SHA512},
+		Salt:               salt,
+	})
+	if err != nil {
+		return nil, err
+	}
+	ciphers := []uint16{
+		smb.SMB2_ENCRYPTION_AES128_GCM,
+		smb.SMB2_ENCRYPTION_AES128_CCM,
+		smb.SMB2_ENCRYPTION_AES256_GCM,
+		smb.SMB2_ENCRYPTION_AES256_CCM,
+	}
+	encryption, err := smb.NewNegotiateContext(smb.SMB2_ENCRYPTION_CAPABILITIES, smb.EncryptionCapabilitiesStruct{
+		CipherCount: uint16(len(ciphers)),
+		Ciphers:     ciphers,
+	})
+	if err != nil {
+		return nil, err
+	}
+	algorithms := []uint16{
+		smb.SMB2_SIGNING_AES_GMAC,
+		smb.SMB2_SIGNING_AES_CMAC,
+		smb.SMB2_SIGNING_HMAC_SHA256,
+	}
+	signing, err := smb.NewNegotiateContext(smb.SMB2_SIGNING_CAPABILITIES, smb.SigningCapabilitiesStruct{
+		SigningAlgorithmCount: uint16(len(algorithms)),
+		SigningAlgorithms:     algorithms,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return []smb.NegotiateContextStruct{preauth, encryption, signing}, nil
+}
+
 // 协商版本请求初始化
-func (c *Client) NewNegotiateRequest() smb.SMB2NegotiateRequestStruct {
+func (c *Client) NewNegotiateRequest() (smb.SMB2NegotiateRequestStruct, error) {
 	// 初始化
 	smb2Header := NewSMB2Packet()
 	smb2Header.Command = smb.SMB2_NEGOTIATE
 	smb2Header.MessageId = c.GetMessageId()
 	smb2Header.CreditCharge = 1
-	return smb.SMB2NegotiateRequestStruct{
-		SMB2PacketStruct: smb2Header,
-		StructureSize:    36,
-		DialectCount:     1,
-		SecurityMode:     smb.SecurityModeSigningEnabled, // 必须开启签名
-		Reserved:         0,
-		Capabilities:     0,
-		ClientGuid:       make([]byte, 16),
-		ClientStartTime:  0,
-		Dialects: []uint16{
-			uint16(smb.SMB2_1_Dialect),
-		},
+	dialects := c.dialects()
+	clientGuid := make([]byte, 16)
+	if _, err := rand.Read(clientGuid); err != nil {
+		return smb.SMB2NegotiateRequestStruct{}, err
 	}
+	req := smb.SMB2NegotiateRequestStruct{
+		SMB2PacketStruct:     smb2Header,
+		StructureSize:        36,
+		DialectCount:         uint16(len(dialects)),
+		SecurityMode:         smb.SecurityModeSigningEnabled, // 必须开启签名
+		Reserved:             0,
+		Capabilities:         0,
+		ClientGuid:           clientGuid,
+		Dialects:             dialects,
+		Padding:              []byte{},
+		NegotiateContextList: []byte{},
+	}
+	// smb3.0/3.0.2通过Capabilities声明支持加密，smb3.1.1通过协商上下文
+	if hasDialect(dialects, smb.SMB3_0_Dialect) || hasDialect(dialects, smb.SMB3_0_2_Dialect) {
+		req.Capabilities |= smb.SMB2_GLOBAL_CAP_ENCRYPTION
+	}
+	if hasDialect(dialects, smb.SMB3_1_1_Dialect) {
+		contexts, err := newNegotiateContexts()
+		if err != nil {
+			return smb.SMB2NegotiateRequestStruct{}, err
+		}
+		list, err := smb.MarshalNegotiateContexts(contexts)
+		if err != nil {
+			return smb.SMB2NegotiateRequestStruct{}, err
+		}
+		// 偏移量从SMB2头开始计算，协商上下文需8字节对齐
+		offset := smb.SMB2HeaderSize + int(req.StructureSize) + 2*len(dialects)
+		req.Padding = make([]byte, smb.Pad8(offset))
+		req.NegotiateContextOffset = uint32(offset + len(req.Padding))
+		req.NegotiateContextCount = uint16(len(contexts))
+		req.NegotiateContextList = list
+	}
+	return req, nil
 }
 
 // 协商版本响应初始化
 func NewNegotiateResponse() smb.SMB2NegotiateResponseStruct {
 	smb2Header := NewSMB2Packet()
 	return smb.SMB2NegotiateResponseStruct{
-		SMB2PacketStruct:     smb2Header,
-		StructureSize:        0,
-		SecurityMode:         0,
-		DialectRevision:      0,
-		Reserved:             0,
-		ServerGuid:           make([]byte, 16),
-		Capabilities:         0,
-		MaxTransactSize:      0,
-		MaxReadSize:          0,
-		MaxWriteSize:         0,
-		SystemTime:           0,
-		ServerStartTime:      0,
-		SecurityBufferOffset: 0,
-		SecurityBufferLength: 0,
-		Reserved2:            0,
-		SecurityBlob:         &gss.NegTokenInit{},
+		SMB2PacketStruct:       smb2Header,
+		StructureSize:          0,
+		SecurityMode:           0,
+		DialectRevision:        0,
+		NegotiateContextCount:  0,
+		ServerGuid:             make([]byte, 16),
+		Capabilities:           0,
+		MaxTransactSize:        0,
+		MaxReadSize:            0,
+		MaxWriteSize:           0,
+		SystemTime:             0,
+		ServerStartTime:        0,
+		SecurityBufferOffset:   0,
+		SecurityBufferLength:   0,
+		NegotiateContextOffset: 0,
+		SecurityBlob:           &gss.NegTokenInit{},
 	}
 }
 
@@ -175,10 +269,22 @@ func (c *Client) NewSessionSetup2Request() (smb.SMB2SessionSetup2RequestStruct,
 }
 
 func (c *Client) NegotiateProtocol() (err error) {
+	return c.NegotiateProtocolContext(context.Background())
+}
+
+func (c *Client) NegotiateProtocolContext(ctx context.Context) (err error) {
 	// 第一步 发送协商请求
 	c.Debug("Sending Negotiate request", nil)
-	negReq := c.NewNegotiateRequest()
-	buf, err := c.SMBSend(negReq)
+	negReq, err := c.NewNegotiateRequest()
+	if err != nil {
+		c.Debug("", err)
+		return err
+	}
+	// smb3.1.1需要从协商请求开始计算预认证完整性哈希
+	if negReq.NegotiateContextCount > 0 {
+		c.WithPreauthHash(make([]byte, 64))
+	}
+	buf, err := c.SMBSendContext(ctx, negReq)
 	if err != nil {
 		c.Debug("", err)
 		return err
@@ -201,24 +307,34 @@ func (c *Client) NegotiateProtocol() (err error) {
 	//oid := negRes.SecurityBlob.OID
 	//fmt.Println(oid)
 	// 检查是否存在ntlmssp
-	hasNTLMSSP := false
-	ntlmsspOID, err := gss.ObjectIDStrToInt(ntlm2.NTLMSSPMECHTYPEOID)
-	if err != nil {
-		return err
-	}
-	for _, mechType := range negRes.SecurityBlob.Data.MechTypes {
-		if mechType.Equal(ntlmsspOID) {
-			hasNTLMSSP = true
-			break
+	if !c.GetOptions().Kerberos {
+		hasNTLMSSP := false
+		ntlmsspOID, err := gss.ObjectIDStrToInt(ntlm2.NTLMSSPMECHTYPEOID)
+		if err != nil {
+			return err
+		}
+		for _, mechType := range negRes.SecurityBlob.Data.MechTypes {
+			if mechType.Equal(ntlmsspOID) {
+				hasNTLMSSP = true
+				break
+			}
+		}
+		if !hasNTLMSSP {
+			return errors.New("Server does not support NTLMSSP")
 		}
-	}
-	if !hasNTLMSSP {
-		return errors.New("Server does not support NTLMSSP")
 	}
 	// 设置会话安全模式
 	c.WithSecurityMode(negRes.SecurityMode)
 	// 设置会话协议
 	c.WithDialect(negRes.DialectRevision)
+	c.Debug(fmt.Sprintf("Negotiated dialect 0x%04x", negRes.DialectRevision), nil)
+	c.WithMaxTransactSize(negRes.MaxTransactSize)
+	c.WithMaxReadSize(negRes.MaxReadSize)
+	c.WithMaxWriteSize(negRes.MaxWriteSize)
+	if err = c.handleNegotiateContexts(buf, negRes); err != nil {
+		c.Debug("", err)
+		return err
+	}
 	// 签名开启/关闭
 	mode := c.GetSecurityMode()
 	if mode&smb.SecurityModeSigningEnabled > 0 {
@@ -230,6 +346,9 @@ func (c *Client) NegotiateProtocol() (err error) {
 	} else {
 		c.IsSigningRequired = false
 	}
+	if c.GetOptions().Kerberos {
+		return c.kerberosSessionSetup(ctx)
+	}
 	// 第二步 发送质询
 	c.Debug("Sending SessionSetup1 request", nil)
 	ssreq, err := c.NewSessionSetupRequest()
@@ -248,7 +367,7 @@ func (c *Client) NegotiateProtocol() (err error) {
 		return err
 	}
 
-	buf, err = c.SMBSend(ssreq)
+	buf, err = c.SMBSendContext(ctx, ssreq)
 	if err != nil {
 		c.Debug("Raw:\n"+hex.Dump(buf), err)
 		return err
@@ -282,14 +401,19 @@ func (c *Client) NegotiateProtocol() (err error) {
 	}
 
 	var auth ntlm2.NTLMv2Authentication
+	var sessionKey []byte
 	if c.GetOptions().Hash != "" {
 		// Hash present, use it for auth
 		c.Debug("Performing hash-based authentication", nil)
-		auth = ntlm2.NewAuthenticateHash(c.GetOptions().Domain, c.GetOptions().User, c.GetOptions().Workstation, c.GetOptions().Hash, challenge)
+		auth, sessionKey, err = ntlm2.NewAuthenticateHash(c.GetOptions().Domain, c.GetOptions().User, c.GetOptions().Workstation, c.GetOptions().Hash, challenge)
 	} else {
 		// No hash, use password
 		c.Debug("Performing password-based authentication", nil)
-		auth = ntlm2.NewAuthenticatePass(c.GetOptions().Domain, c.GetOptions().User, c.GetOptions().Workstation, c.GetOptions().Password, challenge)
+		auth, sessionKey, err = ntlm2.NewAuthenticatePass(c.GetOptions().Domain, c.GetOptions().User, c.GetOptions().Workstation, c.GetOptions().Password, challenge)
+	}
+	if err != nil {
+		c.Debug("", err)
+		return err
 	}
 
 	responseToken, err := encoder.Marshal(auth)
@@ -307,13 +431,13 @@ func (c *Client) NegotiateProtocol() (err error) {
 		return err
 	}
 
-	buf, err = c.SMBSend(ss2req)
+	buf, err = c.SMBSendContext(ctx, ss2req)
 	if err != nil {
 		c.Debug("", err)
 		return err
 	}
 	c.Debug("Unmarshalling SessionSetup2 response", nil)
-	var authResp smb.SMB2PacketStruct
+	var authResp smb.SMB2SessionSetup2ResponseStruct
 	if err = encoder.Unmarshal(buf, &authResp); err != nil {
 		c.Debug("Raw:\n"+hex.Dump(buf), err)
 		return err
@@ -323,27 +447,119 @@ func (c *Client) NegotiateProtocol() (err error) {
 		status, _ := ms.StatusMap[authResp.Status]
 		return errors.New(status)
 	}
+	return c.finishSessionSetup(authResp.SessionFlags, sessionKey, buf)
+}
+
+// 会话建立完成后根据会话标识处理签名及加密
+func (c *Client) finishSessionSetup(sessionFlags uint16, sessionKey, finalResponse []byte) (err error) {
+	// 匿名或来宾会话没有可用的会话密钥，不能签名
+	if sessionFlags&(smb.SMB2_SESSION_FLAG_IS_GUEST|smb.SMB2_SESSION_FLAG_IS_NULL) != 0 {
+		c.Debug("Guest or anonymous session, signing disabled", nil)
+		c.IsSigningRequired = false
+	} else if err = c.setupSessionKeys(sessionKey, finalResponse); err != nil {
+		c.Debug("Raw:\n"+hex.Dump(finalResponse), err)
+		return err
+	}
+	// 服务端要求会话加密，后续所有请求都需要加密
+	if sessionFlags&smb.SMB2_SESSION_FLAG_ENCRYPT_DATA != 0 {
+		if c.GetEncryptionKey() == nil {
+			return errors.New("Server requires encryption but no cipher was negotiated")
+		}
+		c.Debug("Session encryption enabled", nil)
+		c.IsEncryptionRequired = true
+	}
 	c.IsAuthenticated = true
 
 	c.Debug("Completed NegotiateProtocol and SessionSetup", nil)
 	return nil
 }
 
+// 处理协商响应中的smb3.1.1协商上下文
+func (c *Client) handleNegotiateContexts(buf []byte, negRes smb.SMB2NegotiateResponseStruct) error {
+	c.WithSigningAlgorithm(smb.DefaultSigningAlgorithm(negRes.DialectRevision))
+	c.WithCipherId(0)
+	if negRes.DialectRevision != smb.SMB3_1_1_Dialect {
+		// smb3.0/3.0.2固定使用AES-128-CCM
+		if negRes.DialectRevision >= smb.SMB3_0_Dialect && negRes.Capabilities&smb.SMB2_GLOBAL_CAP_ENCRYPTION != 0 {
+			c.WithCipherId(smb.SMB2_ENCRYPTION_AES128_CCM)
+		}
+		// 低版本协议不需要预认证完整性
+		c.WithPreauthHash(nil)
+		return nil
+	}
+	contexts, err := smb.ParseNegotiateContexts(buf, negRes.NegotiateContextOffset, negRes.NegotiateContextCount)
+	if err != nil {
+		return err
+	}
+	hasPreauth := false
+	for _, ctx := range contexts {
+		switch ctx.ContextType {
+		case smb.SMB2_PREAUTH_INTEGRITY_CAPABILITIES:
+			alg, err := ctx.SelectedAlgorithm()
+			if err != nil {
+				return err
+			}
+			if alg != smb.SMB2_PREAUTH_INTEGRITY_SHA512 {
+				return fmt.Errorf("Unsupported preauth integrity hash algorithm 0x%04x", alg)
+			}
+			hasPreauth = true
+		case smb.SMB2_ENCRYPTION_CAPABILITIES:
+			cipherId, err := ctx.SelectedAlgorithm()
+			if err != nil {
+				return err
+			}
+			c.WithCipherId(cipherId)
+		case smb.SMB2_SIGNING_CAPABILITIES:
+			alg, err := ctx.SelectedAlgorithm()
+			if err != nil {
+				return err
+			}
+			c.WithSigningAlgorithm(alg)
+		}
+	}
+	if !hasPreauth {
+		return errors.New("Server did not return preauth integrity capabilities")
+	}
+	return nil
+}
+
+// 保存会话密钥并派生签名及加密密钥，校验最后一个会话建立响应的签名
+func (c *Client) setupSessionKeys(sessionKey, finalResponse []byte) error {
+	c.WithSessionKey(sessionKey)
+	c.WithSigningKey(smb.DeriveSigningKey(c.GetDialect(), sessionKey, c.GetPreauthHash()))
+	if c.GetCipherId() != 0 {
+		c.WithEncryptionKeys(smb.DeriveEncryptionKeys(c.GetDialect(), c.GetCipherId(), sessionKey, c.GetPreauthHash()))
+	}
+	if smb.HeaderFlags(finalResponse)&smb.SMB2_FLAGS_SIGNED != 0 {
+		return smb.Verify(c.GetSigningAlgorithm(), c.GetSigningKey(), finalResponse)
+	}
+	// smb3.1.1服务端必须对最后一个会话建立响应签名
+	if c.GetDialect() == smb.SMB3_1_1_Dialect {
+		return errors.New("Final session setup response is not signed")
+	}
+	return nil
+}
+
 // SMB2连接封装
 func NewSession(opt common.ClientOptions, debug bool) (client *Client, err error) {
-	address := fmt.Sprintf("%s:%d", opt.Host, opt.Port)
-	conn, err := net.Dial("tcp", address)
+	return NewSessionContext(context.Background(), opt, debug)
+}
+
+// ctx作用于建立连接以及协商认证过程
+func NewSessionContext(ctx context.Context, opt common.ClientOptions, debug bool) (client *Client, err error) {
+	conn, err := common.Dial(ctx, &opt)
 	if err != nil {
-		return
+		return nil, err
 	}
 	client = &Client{}
 	client.WithOptions(&opt)
 	client.WithConn(conn)
 	client.WithDebug(debug)
 
-	err = client.NegotiateProtocol()
+	err = client.NegotiateProtocolContext(ctx)
 	if err != nil {
-		return
+		conn.Close()
+		return nil, err
 	}
 
 	return client, nil
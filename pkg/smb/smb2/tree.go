@@ -1,6 +1,7 @@
 package smb2
 
 import (
+	"context"
 	"encoding/hex"
 	"errors"
 	"fmt"
@@ -100,13 +101,17 @@ func NewTreeDisconnectResponse() TreeDisconnectResponseStruct {
 
 // 树连接
 func (c *Client) TreeConnect(name string) (treeId uint32, err error) {
+	return c.TreeConnectContext(context.Background(), name)
+}
+
+func (c *Client) TreeConnectContext(ctx context.Context, name string) (treeId uint32, err error) {
 	c.Debug("Sending TreeConnect request ["+name+"]", nil)
 	req, err := c.NewTreeConnectRequest(name)
 	if err != nil {
 		c.Debug("", err)
 		return 0, err
 	}
-	buf, err := c.SMBSend(req)
+	buf, err := c.SMBSendContext(ctx, req)
 	if err != nil {
 		c.Debug("", err)
 		return 0, err
@@ -118,30 +123,28 @@ func (c *Client) TreeConnect(name string) (treeId uint32, err error) {
 		//return err
 	}
 	if res.SMB2PacketStruct.Status != ms.STATUS_SUCCESS {
-		return 0, errors.New("Failed to connect to [" + name + "]: " + ms.StatusMap[res.SMB2PacketStruct.Status])
+		return 0, fmt.Errorf("Failed to connect to [%s]: %w", name, ms.StatusError(res.SMB2PacketStruct.Status))
 	}
 	treeID := res.SMB2PacketStruct.TreeId
-	trees := make(map[string]uint32)
-	trees[name] = treeID
-	c.WithTrees(trees)
+	// 共享要求加密时，该树连接上的请求都需要加密
+	if res.ShareFlags&smb.SMB2_SHAREFLAG_ENCRYPT_DATA != 0 {
+		if c.GetEncryptionKey() == nil {
+			return 0, errors.New("Share [" + name + "] requires encryption but no cipher was negotiated")
+		}
+		c.WithTreeEncryption(treeID, true)
+	}
+	c.AddTree(name, treeID)
 	c.Debug("Completed TreeConnect ["+name+"]", nil)
 	return treeID, nil
 }
 
 // 断开树连接
 func (c *Client) TreeDisconnect(name string) error {
-	var (
-		treeid    uint32
-		pathFound bool
-	)
-	trees := c.GetTrees()
-	for k, v := range trees {
-		if k == name {
-			treeid = v
-			pathFound = true
-			break
-		}
-	}
+	return c.TreeDisconnectContext(context.Background(), name)
+}
+
+func (c *Client) TreeDisconnectContext(ctx context.Context, name string) error {
+	treeid, pathFound := c.GetTreeId(name)
 	if !pathFound {
 		err := errors.New("Unable to find tree path for disconnect")
 		c.Debug("", err)
@@ -153,7 +156,7 @@ func (c *Client) TreeDisconnect(name string) error {
 		c.Debug("", err)
 		return err
 	}
-	buf, err := c.SMBSend(req)
+	buf, err := c.SMBSendContext(ctx, req)
 	if err != nil {
 		c.Debug("", err)
 		return err
@@ -164,11 +167,11 @@ func (c *Client) TreeDisconnect(name string) error {
 		c.Debug("Raw:\n"+hex.Dump(buf), err)
 		return err
 	}
-	if res.SMB2PacketStruct.Status != ms.STATUS_MORE_PROCESSING_REQUIRED {
-		return errors.New("Failed to connect to tree: " + ms.StatusMap[res.SMB2PacketStruct.Status])
+	if res.SMB2PacketStruct.Status != ms.STATUS_SUCCESS {
+		return errors.New("Failed to disconnect from tree: " + ms.StatusMap[res.SMB2PacketStruct.Status])
 	}
-	delete(trees, name)
-	c.WithTrees(trees)
+	c.WithTreeEncryption(treeid, false)
+	c.RemoveTree(name)
 	c.Debug("TreeDisconnect completed ["+name+"]", nil)
 	return nil
 }
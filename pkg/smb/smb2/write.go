@@ -1,11 +1,13 @@
 package smb2
 
 import (
+	"context"
 	"encoding/hex"
 	"errors"
 	"github.com/4ra1n/go-impacket/pkg/encoder"
 	"github.com/4ra1n/go-impacket/pkg/ms"
 	"github.com/4ra1n/go-impacket/pkg/smb"
+	"io"
 	"os"
 )
 
@@ -75,6 +77,10 @@ func NewWriteResponse() WriteResponseStruct {
 
 // 需要传入树id
 func (c *Client) WriteRequest(treeId uint32, filepath, filename string, fileId []byte) (err error) {
+	return c.WriteRequestContext(context.Background(), treeId, filepath, filename, fileId)
+}
+
+func (c *Client) WriteRequestContext(ctx context.Context, treeId uint32, filepath, filename string, fileId []byte) (err error) {
 	c.Debug("Sending Write file request ["+filename+"]", nil)
 	// 将文件读入缓冲区
 	file, err := os.Open(filepath + filename)
@@ -82,50 +88,84 @@ func (c *Client) WriteRequest(treeId uint32, filepath, filename string, fileId [
 		return err
 	}
 	defer file.Close()
-	// 一次传入1kb数据
-	fileBuf := make([]byte, 10240)
-	fileOffset := 0
-	i := 0
-Loop:
+	if _, err = c.writeFrom(ctx, treeId, fileId, 0, file); err != nil {
+		c.Debug("", err)
+		return errors.New("Failed to write file to [" + filename + "]: " + err.Error())
+	}
+	c.Debug("Completed WriteFile ["+filename+"]", nil)
+	return nil
+}
+
+// 从指定偏移写入数据，返回服务端实际写入的字节数
+func (c *Client) WriteAtRequest(treeId uint32, fileId []byte, offset uint64, data []byte) (uint32, error) {
+	return c.WriteAtRequestContext(context.Background(), treeId, fileId, offset, data)
+}
+
+func (c *Client) WriteAtRequestContext(ctx context.Context, treeId uint32, fileId []byte, offset uint64, data []byte) (uint32, error) {
+	req := c.NewWriteRequest(treeId, fileId, data)
+	req.FileOffset = offset
+	buf, err := c.SMBSendContext(ctx, req)
+	if err != nil {
+		c.Debug("", err)
+		return 0, err
+	}
+	if status := smb.HeaderStatus(buf); status != ms.STATUS_SUCCESS {
+		return 0, ms.StatusError(status)
+	}
+	res := NewWriteResponse()
+	if err = encoder.Unmarshal(buf, &res); err != nil {
+		c.Debug("Raw:\n"+hex.Dump(buf), err)
+		return 0, err
+	}
+	return res.WriteCount, nil
+}
+
+// 从r读取数据按MaxWriteSize分块写入，返回写入的字节数
+func (c *Client) writeFrom(ctx context.Context, treeId uint32, fileId []byte, offset uint64, r io.Reader) (int64, error) {
+	chunk := make([]byte, c.writeChunkSize())
+	var written int64
 	for {
-		switch nr, _ := file.Read(fileBuf[:]); true {
-		case nr < 0:
-			return errors.New("Failed read file to [" + filepath + filename + "]")
-		case nr == 0: // EOF
-			break Loop
-		case nr > 0:
-			req := c.NewWriteRequest(treeId, fileId, fileBuf)
-			if i == 0 {
-				req.FileOffset = 0
-			} else {
-				req.FileOffset = uint64(fileOffset)
-			}
-			fileOffset += nr
-			i++
-			buf, err := c.SMBSend(req)
-			if err != nil {
-				c.Debug("", err)
-				return err
-			}
-			res := NewWriteResponse()
-			c.Debug("Unmarshalling Write file response ["+filename+"]", nil)
-			if err = encoder.Unmarshal(buf, &res); err != nil {
-				c.Debug("Raw:\n"+hex.Dump(buf), err)
-			}
-			if res.SMB2PacketStruct.Status != ms.STATUS_SUCCESS {
-				return errors.New("Failed to write file to [" + filename + "]: " + ms.StatusMap[res.SMB2PacketStruct.Status])
+		nr, err := io.ReadFull(r, chunk)
+		if nr > 0 {
+			if err := c.writeAll(ctx, treeId, fileId, offset+uint64(written), chunk[:nr]); err != nil {
+				return written, err
 			}
+			written += int64(nr)
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return written, nil
+		}
+		if err != nil {
+			return written, err
 		}
 	}
-	c.Debug("Completed WriteFile ["+filename+"]", nil)
+}
+
+// 写入全部数据，服务端未写满时从剩余位置继续
+func (c *Client) writeAll(ctx context.Context, treeId uint32, fileId []byte, offset uint64, data []byte) error {
+	for len(data) > 0 {
+		n, err := c.WriteAtRequestContext(ctx, treeId, fileId, offset, data)
+		if err != nil {
+			return err
+		}
+		if n == 0 || int(n) > len(data) {
+			return io.ErrShortWrite
+		}
+		offset += uint64(n)
+		data = data[n:]
+	}
 	return nil
 }
 
 // 写入管道数据
 func (c *Client) WritePipeRequest(treeId uint32, buffer, fileId []byte) error {
+	return c.WritePipeRequestContext(context.Background(), treeId, buffer, fileId)
+}
+
+func (c *Client) WritePipeRequestContext(ctx context.Context, treeId uint32, buffer, fileId []byte) error {
 	c.Debug("Sending Write pipe request", nil)
 	req := c.NewWriteRequest(treeId, fileId, buffer)
-	buf, err := c.SMBSend(req)
+	buf, err := c.SMBSendContext(ctx, req)
 	if err != nil {
 		c.Debug("", err)
 		return err
@@ -103,18 +103,21 @@ type SMBV1NegotiateRequestStruct struct {
 // SMB2 Negotiate 请求头结构
 type SMB2NegotiateRequestStruct struct {
 	SMB2PacketStruct
-	StructureSize   uint16   //2字节，客户端必须设置36
-	DialectCount    uint16   `smb:"count:Dialects"` //2字节，必须大于0
-	SecurityMode    uint16   //2字节，设置是否启用SMB签名
-	Reserved        uint16   //2字节，必须设置0
-	Capabilities    uint32   //4字节，如果客户端使用SMB3.x，必须使用SMB2_GLOBAL_CAP_*构造，否则设置为0
-	ClientGuid      []byte   `smb:"fixed:16"` //16字节，客户端自身生成
-	ClientStartTime uint64   //8字节，保留字段，归零
-	Dialects        []uint16 //16位整数数组
+	StructureSize          uint16   //2字节，客户端必须设置36
+	DialectCount           uint16   `smb:"count:Dialects"` //2字节，必须大于0
+	SecurityMode           uint16   //2字节，设置是否启用SMB签名
+	Reserved               uint16   //2字节，必须设置0
+	Capabilities           uint32   //4字节，如果客户端使用SMB3.x，必须使用SMB2_GLOBAL_CAP_*构造，否则设置为0
+	ClientGuid             []byte   `smb:"fixed:16"` //16字节，客户端自身生成
+	NegotiateContextOffset uint32   //4字节，smb3.1.1协商上下文偏移量，其他版本与下面两个字段合为ClientStartTime，归零
+	NegotiateContextCount  uint16   //2字节，协商上下文数量
+	Reserved2              uint16   //2字节，保留字段，归零
+	Dialects               []uint16 //16位整数数组
+	Padding                []byte   //协商上下文需8字节对齐
+	NegotiateContextList   []byte   //smb3.1.1协商上下文列表
 }
 
 type SMBV1NegotiateResponseStruct struct {
-	TotalLength uint32
 	SMBV1PacketStruct
 	WCT           uint8
 	SelectedIndex uint16
@@ -136,21 +139,21 @@ type SMBV1NegotiateResponseStruct struct {
 // SMB2 Negotiate 响应头结构
 type SMB2NegotiateResponseStruct struct {
 	SMB2PacketStruct
-	StructureSize        uint16            //2字节，客户端必须设置36
-	SecurityMode         uint16            //2字节，设置是否启用SMB签名
-	DialectRevision      uint16            //2字节，SMB协议号
-	Reserved             uint16            //2字节，保留字段，归零
-	ServerGuid           []byte            `smb:"fixed:16"` //16字节，服务器标识符
-	Capabilities         uint32            //4字节，服务器协议作用
-	MaxTransactSize      uint32            //4字节，客户端set_info请求缓冲区大小
-	MaxReadSize          uint32            //4字节，服务器接受smb read请求最大长度
-	MaxWriteSize         uint32            //4字节，服务器接受smb write请求最大长度
-	SystemTime           uint64            //8字节，处理协商请求服务器系统时间
-	ServerStartTime      uint64            //8字节，服务器启动时间
-	SecurityBufferOffset uint16            `smb:"offset:SecurityBlob"` //2字节，smb2表头开始到安全缓存区的偏移量
-	SecurityBufferLength uint16            `smb:"len:SecurityBlob"`    //2字节，安全缓冲区长度
-	Reserved2            uint32            //4字节，协商上下文偏移量
-	SecurityBlob         *gss.NegTokenInit //服务器返回二进制安全对象，遵循RFC2743标准
+	StructureSize          uint16            //2字节，客户端必须设置36
+	SecurityMode           uint16            //2字节，设置是否启用SMB签名
+	DialectRevision        uint16            //2字节，SMB协议号
+	NegotiateContextCount  uint16            //2字节，smb3.1.1协商上下文数量，其他版本为保留字段
+	ServerGuid             []byte            `smb:"fixed:16"` //16字节，服务器标识符
+	Capabilities           uint32            //4字节，服务器协议作用
+	MaxTransactSize        uint32            //4字节，客户端set_info请求缓冲区大小
+	MaxReadSize            uint32            //4字节，服务器接受smb read请求最大长度
+	MaxWriteSize           uint32            //4字节，服务器接受smb write请求最大长度
+	SystemTime             uint64            //8字节，处理协商请求服务器系统时间
+	ServerStartTime        uint64            //8字节，服务器启动时间
+	SecurityBufferOffset   uint16            `smb:"offset:SecurityBlob"` //2字节，smb2表头开始到安全缓存区的偏移量
+	SecurityBufferLength   uint16            `smb:"len:SecurityBlob"`    //2字节，安全缓冲区长度
+	NegotiateContextOffset uint32            //4字节，smb3.1.1协商上下文偏移量，其他版本为保留字段
+	SecurityBlob           *gss.NegTokenInit //服务器返回二进制安全对象，遵循RFC2743标准
 }
 
 type SMBV1SessionSetupRequestStruct struct {
@@ -190,7 +193,6 @@ type SMB2SessionSetupRequestStruct struct {
 // https://docs.microsoft.com/en-us/openspecs/windows_protocols/ms-smb2/0324190f-a31b-4666-9fa9-5c624273a694
 // 质询响应结构体
 type SMBV1SessionSetupResponseStruct struct {
-	TotalLen uint32
 	SMBV1PacketStruct
 	WCT                uint8
 	AndXCommand        uint8
@@ -228,3 +230,10 @@ type SMB2SessionSetup2RequestStruct struct {
 	PreviousSessionID    uint64 //8字节，会话标识符。服务端用来标识客户端会话
 	SecurityBlob         *gss.NegTokenResp
 }
+
+// 认证响应结构，只解析会话标识，不解析安全缓冲区
+type SMB2SessionSetup2ResponseStruct struct {
+	SMB2PacketStruct
+	StructureSize uint16
+	SessionFlags  uint16 //2字节，标识来宾、匿名会话
+}
@@ -1,10 +1,10 @@
 package smbv1
 
 import (
+	"context"
 	"encoding/hex"
 	"errors"
 	"fmt"
-	"net"
 
 	"github.com/4ra1n/go-impacket/pkg/common"
 	"github.com/4ra1n/go-impacket/pkg/encoder"
@@ -132,9 +132,13 @@ func NewSessionSetupResponse() (smb.SMBV1SessionSetupResponseStruct, error) {
 }
 
 func (c *Client) NegotiateProtocol() (err error) {
+	return c.NegotiateProtocolContext(context.Background())
+}
+
+func (c *Client) NegotiateProtocolContext(ctx context.Context) (err error) {
 	c.Debug("sending negotiate request", nil)
 	negReq := c.NewNegotiateRequest()
-	buf, err := c.SMBSend(negReq)
+	buf, err := c.SMBSendContext(ctx, negReq)
 	if err != nil {
 		c.Debug("", err)
 		return err
@@ -167,7 +171,7 @@ func (c *Client) NegotiateProtocol() (err error) {
 		return err
 	}
 	c.Debug("client -> server \n"+hex.Dump(buf), err)
-	buf, err = c.SMBSend(ssreq)
+	buf, err = c.SMBSendContext(ctx, ssreq)
 	if err != nil {
 		return err
 	}
@@ -207,11 +211,15 @@ func (c *Client) NegotiateProtocol() (err error) {
 	if c.GetOptions().Hash != "" {
 		// Hash present, use it for auth
 		c.Debug("Performing hash-based authentication", nil)
-		auth = ntlm.NewAuthenticateHash(c.GetOptions().Domain, c.GetOptions().User, c.GetOptions().Workstation, c.GetOptions().Hash, challenge)
+		auth, _, err = ntlm.NewAuthenticateHash(c.GetOptions().Domain, c.GetOptions().User, c.GetOptions().Workstation, c.GetOptions().Hash, challenge)
 	} else {
 		// No hash, use password
 		c.Debug("Performing password-based authentication", nil)
-		auth = ntlm.NewAuthenticatePass(c.GetOptions().Domain, c.GetOptions().User, c.GetOptions().Workstation, c.GetOptions().Password, challenge)
+		auth, _, err = ntlm.NewAuthenticatePass(c.GetOptions().Domain, c.GetOptions().User, c.GetOptions().Workstation, c.GetOptions().Password, challenge)
+	}
+	if err != nil {
+		c.Debug("", err)
+		return err
 	}
 	fmt.Println(ss2req)
 	fmt.Println(auth)
@@ -231,7 +239,7 @@ func (c *Client) NegotiateProtocol() (err error) {
 	//	return err
 	//}
 	//
-	//buf, err = c.SMBSend(ss2req)
+	//buf, err = c.SMBSendContext(ctx, ss2req)
 	//if err != nil {
 	//	c.Debug("", err)
 	//	return err
@@ -255,8 +263,11 @@ func (c *Client) NegotiateProtocol() (err error) {
 
 // SMB2连接封装
 func NewSession(opt common.ClientOptions, debug bool) (client *Client, err error) {
-	address := fmt.Sprintf("%s:%d", opt.Host, opt.Port)
-	conn, err := net.Dial("tcp", address)
+	return NewSessionContext(context.Background(), opt, debug)
+}
+
+func NewSessionContext(ctx context.Context, opt common.ClientOptions, debug bool) (client *Client, err error) {
+	conn, err := common.Dial(ctx, &opt)
 	if err != nil {
 		return
 	}
@@ -264,9 +275,10 @@ func NewSession(opt common.ClientOptions, debug bool) (client *Client, err error
 	client.WithOptions(&opt)
 	client.WithConn(conn)
 	client.WithDebug(debug)
-	err = client.NegotiateProtocol()
+	err = client.NegotiateProtocolContext(ctx)
 	if err != nil {
-		return
+		conn.Close()
+		return nil, err
 	}
 	return client, nil
 }
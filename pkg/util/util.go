@@ -105,6 +105,14 @@ func PDUUuidFromBytes(uuid string) []byte {
 	return r
 }
 
+// PDU中的uuid字节数组转成字符串，与PDUUuidFromBytes互逆
+func PDUUuidToString(b []byte) string {
+	if len(b) < 16 {
+		return ""
+	}
+	return fmt.Sprintf("%02x%02x%02x%02x-%02x%02x-%02x%02x-%x-%x", b[3], b[2], b[1], b[0], b[5], b[4], b[7], b[6], b[8:10], b[10:16])
+}
+
 func Random(n int) []byte {
 	const alpha = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
 	var bytes = make([]byte, n)